@@ -0,0 +1,126 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+func runDecode(args []string) error {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	pcap := fs.String("pcap", "", "pcap file of the UDP datagrams to decode")
+	asJSON := fs.Bool("json", false, "print the messages as JSON")
+	annotate := fs.Bool("annotate", false, "print the messages field by field")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: go-stun decode [-pcap file] [hex ...]")
+		fmt.Fprintln(os.Stderr, "The hex messages, or hex dumps, are read from the standard input, separated by blank lines, if none is given.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *pcap != "" {
+		f, err := os.Open(*pcap)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r, err := stun.NewPcapReader(bufio.NewReader(f))
+		if err != nil {
+			return err
+		}
+		for {
+			p, err := r.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			m, err := stun.ParseMessage(p.Payload)
+			if err != nil {
+				continue
+			}
+			switch {
+			case *asJSON:
+				err = printJSON(struct {
+					Time     time.Time
+					Src, Dst netip.AddrPort
+					Message  *stun.Message
+				}{p.Time, p.Src, p.Dst, m})
+			case *annotate:
+				fmt.Println(p.Time.Format("15:04:05.000000"), p.Src, "->", p.Dst)
+				err = m.Annotate(os.Stdout)
+			default:
+				fmt.Println(p.Time.Format("15:04:05.000000"), p.Src, "->", p.Dst, m)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	blobs := fs.Args()
+	if len(blobs) == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		var blob []string
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				blob = append(blob, line)
+				continue
+			}
+			if len(blob) > 0 {
+				blobs, blob = append(blobs, strings.Join(blob, "\n")), nil
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		if len(blob) > 0 {
+			blobs = append(blobs, strings.Join(blob, "\n"))
+		}
+	}
+	for i, blob := range blobs {
+		m, err := stun.Decode(blob)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			if err := printJSON(m); err != nil {
+				return err
+			}
+			continue
+		}
+		if *annotate {
+			if i > 0 {
+				fmt.Println()
+			}
+			if err := m.Annotate(os.Stdout); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Println(m)
+	}
+	return nil
+}
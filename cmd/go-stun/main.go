@@ -0,0 +1,597 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+// Command go-stun discovers the NATs, measures the STUN servers, runs a
+// STUN server and decodes STUN messages.
+//
+// Usage:
+//
+//	go-stun <command> [flags]
+//
+// The commands are:
+//
+//	discover   NAT type and external address (RFC 3489)
+//	behavior   mapping and filtering behaviors of the NAT (RFC 5780)
+//	keepalive  keep a binding alive and report its mapped address
+//	ping       round-trip time and jitter to a STUN server
+//	bench      latency percentiles and loss of a STUN server under load
+//	interop    RFCs and attributes supported by STUN servers
+//	serve      run a STUN server
+//	decode     decode STUN messages of hex or a pcap file
+//	replay     replay the discovery of a capture offline
+//
+// Run go-stun <command> -h for the flags of a command. The results are
+// printed as JSON, an object per line, with the -json flag.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+	"github.com/ccding/go-stun/stunprom"
+)
+
+// command is a subcommand, run with the arguments after its name.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"discover", "NAT type and external address (RFC 3489)", runDiscover},
+	{"behavior", "mapping and filtering behaviors of the NAT (RFC 5780)", runBehavior},
+	{"keepalive", "keep a binding alive and report its mapped address", runKeepalive},
+	{"ping", "round-trip time and jitter to a STUN server", runPing},
+	{"bench", "latency percentiles and loss of a STUN server under load", runBench},
+	{"interop", "RFCs and attributes supported by STUN servers", runInterop},
+	{"serve", "run a STUN server", runServe},
+	{"decode", "decode STUN messages of hex or a pcap file", runDecode},
+	{"replay", "replay the discovery of a capture offline", runReplay},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: go-stun <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+// clientFlags defines the flags of the client on fs, and returns the
+// function creating the client of them once parsed, with the function to
+// call once done with it.
+func clientFlags(fs *flag.FlagSet) func() (*stun.Client, func() error, error) {
+	serverAddr := fs.String("s", stun.DefaultServerAddr, "STUN server address")
+	iface := fs.String("i", "", "network interface to bind to")
+	v := fs.Bool("v", false, "verbose mode")
+	vv := fs.Bool("vv", false, "double verbose mode (includes -v)")
+	capture := fs.String("capture", "", "pcap file to write the STUN messages to")
+	return func() (*stun.Client, func() error, error) {
+		p, done, err := openCapture(*capture)
+		if err != nil {
+			return nil, nil, err
+		}
+		client := stun.NewClient()
+		client.SetServerAddr(*serverAddr)
+		client.SetInterface(*iface)
+		client.SetVerbose(*v || *vv)
+		client.SetVVerbose(*vv)
+		client.SetCapture(p)
+		return client, done, nil
+	}
+}
+
+// openCapture creates the pcap file at path, none if empty, and returns
+// its writer with the function flushing and closing it.
+func openCapture(path string) (*stun.PcapWriter, func() error, error) {
+	if path == "" {
+		return nil, func() error { return nil }, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := bufio.NewWriter(f)
+	p, err := stun.NewPcapWriter(w)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return p, func() error {
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
+
+// interruptContext returns a context done on SIGINT.
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// printJSON prints v as JSON on a line.
+func printJSON(v interface{}) error {
+	return json.NewEncoder(os.Stdout).Encode(v)
+}
+
+func printHost(prefix string, host *stun.Host) {
+	fmt.Println(prefix, "IP Family:", host.Family())
+	fmt.Println(prefix, "IP:", host.IP())
+	fmt.Println(prefix, "Port:", host.Port())
+}
+
+func runDiscover(args []string) (err error) {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	newClient := clientFlags(fs)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Parse(args)
+	client, done, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := done(); err == nil {
+			err = cerr
+		}
+	}()
+	nat, host, err := client.Discover()
+	if err != nil {
+		return err
+	}
+	return printDiscovery(nat, host, *asJSON)
+}
+
+// runReplay replays the discovery of a pcap file of discover -capture, to
+// reproduce the NAT type of it without the network of the capture.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	v := fs.Bool("v", false, "verbose mode")
+	vv := fs.Bool("vv", false, "double verbose mode (includes -v)")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: go-stun replay [flags] file.pcap")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	conn, err := stun.NewReplayConn(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	client := stun.NewClientWithConnection(conn)
+	client.SetServerAddr(conn.ServerAddr())
+	client.SetVerbose(*v || *vv)
+	client.SetVVerbose(*vv)
+	nat, host, err := client.Discover()
+	if err != nil {
+		return err
+	}
+	return printDiscovery(nat, host, *asJSON)
+}
+
+// printDiscovery prints the result of a discovery.
+func printDiscovery(nat stun.NATType, host *stun.Host, asJSON bool) error {
+	if asJSON {
+		return printJSON(struct {
+			NATType  stun.NATType
+			External *stun.Host
+		}{nat, host})
+	}
+	fmt.Println("NAT Type:", nat)
+	if host != nil {
+		printHost("External", host)
+	}
+	return nil
+}
+
+func runBehavior(args []string) (err error) {
+	fs := flag.NewFlagSet("behavior", flag.ExitOnError)
+	newClient := clientFlags(fs)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Parse(args)
+	client, done, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := done(); err == nil {
+			err = cerr
+		}
+	}()
+	b, err := client.DiscoverBehavior()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(b)
+	}
+	fmt.Println("Mapping Behavior:", b.Mapping)
+	fmt.Println("Filtering Behavior:", b.Filtering)
+	printHost("External", b.Mapped)
+	return nil
+}
+
+func runKeepalive(args []string) (err error) {
+	fs := flag.NewFlagSet("keepalive", flag.ExitOnError)
+	serverAddr := fs.String("s", stun.DefaultServerAddr, "STUN server address")
+	interval := fs.Duration("interval", 15*time.Second, "time between the keep-alives")
+	count := fs.Int("n", 0, "number of the keep-alives, 0 for no limit")
+	v := fs.Bool("v", false, "verbose mode")
+	asJSON := fs.Bool("json", false, "print the results as JSON")
+	capture := fs.String("capture", "", "pcap file to write the STUN messages to")
+	fs.Parse(args)
+	p, done, err := openCapture(*capture)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := done(); err == nil {
+			err = cerr
+		}
+	}()
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := stun.NewClientWithConnection(conn)
+	client.SetServerAddr(*serverAddr)
+	client.SetVerbose(*v)
+	client.SetCapture(p)
+	ctx, stop := interruptContext()
+	defer stop()
+	var mapped *stun.Host
+	for i := 0; *count == 0 || i < *count; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(*interval):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		host, err := client.Keepalive()
+		if err != nil {
+			return err
+		}
+		changed := mapped != nil && host.String() != mapped.String()
+		switch {
+		case *asJSON:
+			err = printJSON(struct {
+				Time    time.Time
+				Mapped  *stun.Host
+				Changed bool
+			}{time.Now(), host, changed})
+			if err != nil {
+				return err
+			}
+		case mapped == nil:
+			fmt.Println(time.Now().Format(time.RFC3339), "Mapped:", host)
+		case changed:
+			fmt.Println(time.Now().Format(time.RFC3339), "Mapped:", host, "(changed from", mapped.String()+")")
+		default:
+			fmt.Println(time.Now().Format(time.RFC3339), "Mapped:", host, "(kept)")
+		}
+		mapped = host
+	}
+	return nil
+}
+
+func runPing(args []string) (err error) {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	newClient := clientFlags(fs)
+	count := fs.Int("n", 5, "number of the transactions")
+	interval := fs.Duration("interval", 200*time.Millisecond, "time between the transactions")
+	timeout := fs.Duration("timeout", time.Second, "time a transaction is waited for")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Parse(args)
+	ctx, stop := interruptContext()
+	defer stop()
+	client, done, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := done(); err == nil {
+			err = cerr
+		}
+	}()
+	res, err := client.PingWithOptions(ctx, "", &stun.PingOptions{Samples: *count, Interval: *interval, Timeout: *timeout})
+	if *asJSON {
+		if res != nil {
+			if err := printJSON(res); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+	if res != nil {
+		for i, rtt := range res.RTTs {
+			fmt.Printf("Response %d from %s: rtt=%v\n", i+1, res.Server, rtt)
+		}
+		fmt.Printf("%d transactions, %d responded, %.1f%% loss\n", res.Sent, len(res.RTTs), 100*res.Loss())
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rtt min/avg/max = %v/%v/%v, jitter %v\n", res.Min, res.RTT, res.Max, res.Jitter)
+	return nil
+}
+
+func runBench(args []string) (err error) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	newClient := clientFlags(fs)
+	requests := fs.Int("n", 1000, "number of the transactions, unlimited with -d")
+	duration := fs.Duration("d", 0, "duration of the run, none if 0")
+	concurrency := fs.Int("c", 10, "number of the transactions in flight")
+	rate := fs.Float64("rate", 0, "transactions started per second, unlimited if 0")
+	size := fs.Int("size", 0, "size of the requests in bytes, padded with PADDING")
+	timeout := fs.Duration("timeout", time.Second, "time a transaction is waited for")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Parse(args)
+	if *duration > 0 && !flagSet(fs, "n") {
+		*requests = 0
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	client, done, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := done(); err == nil {
+			err = cerr
+		}
+	}()
+	res, err := client.Bench(ctx, "", &stun.BenchOptions{
+		Requests:    *requests,
+		Duration:    *duration,
+		Concurrency: *concurrency,
+		Rate:        *rate,
+		Size:        *size,
+		Timeout:     *timeout,
+	})
+	// The result so far is printed on an interrupt.
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	if res != nil {
+		if *asJSON {
+			if err := printJSON(res); err != nil {
+				return err
+			}
+			return err
+		}
+		fmt.Printf("%d transactions in %v, %.1f/s, %d responded, %d errors, %.1f%% loss\n",
+			res.Sent, res.Elapsed.Round(time.Millisecond), res.Rate(), res.Responded, res.Errors, 100*res.Loss())
+		if res.Responded > 0 {
+			fmt.Printf("rtt min/avg/max = %v/%v/%v\n", res.Min, res.Mean, res.Max)
+			fmt.Printf("rtt p50/p90/p99 = %v/%v/%v\n", res.P50, res.P90, res.P99)
+		}
+	}
+	return err
+}
+
+func runInterop(args []string) (err error) {
+	fs := flag.NewFlagSet("interop", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: go-stun interop [flags] [server ...]")
+		fmt.Fprintln(fs.Output(), "The servers are read from -f, or are the public ones, if none.")
+		fs.PrintDefaults()
+	}
+	newClient := clientFlags(fs)
+	list := fs.String("f", "", "file of the servers to test, one per line")
+	attempts := fs.Int("attempts", 3, "number of the requests of a test before it fails")
+	timeout := fs.Duration("timeout", 500*time.Millisecond, "time a request is waited for")
+	concurrency := fs.Int("c", 4, "number of the servers tested at once")
+	tcp := fs.Bool("tcp", false, "test the servers over TCP as well")
+	asJSON := fs.Bool("json", false, "print the reports as JSON")
+	fs.Parse(args)
+	servers := fs.Args()
+	if *list != "" {
+		lines, err := readLines(*list)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, lines...)
+	}
+	if len(servers) == 0 {
+		servers = stun.PublicServers
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	client, done, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := done(); err == nil {
+			err = cerr
+		}
+	}()
+	reports, err := client.Interop(ctx, servers, &stun.InteropOptions{
+		Attempts:    *attempts,
+		Timeout:     *timeout,
+		Concurrency: *concurrency,
+		TCP:         *tcp,
+	})
+	for _, r := range reports {
+		if *asJSON {
+			if err := printJSON(r); err != nil {
+				return err
+			}
+			continue
+		}
+		printInterop(r, *tcp)
+	}
+	return err
+}
+
+// printInterop prints the report of a server.
+func printInterop(r *stun.InteropReport, tcp bool) {
+	fmt.Println("Server:", r.Server)
+	if r.Err != nil {
+		fmt.Println("  Error:", r.Err)
+		return
+	}
+	yes := func(ok bool) string {
+		if ok {
+			return "yes"
+		}
+		return "no"
+	}
+	fmt.Println("  RTT:", r.RTT.Round(time.Microsecond))
+	if r.Software != "" {
+		fmt.Printf("  Software: %q\n", r.Software)
+	}
+	fmt.Println("  RFCs:", strings.Join(r.RFCs(), ", "))
+	fmt.Println("  Attributes:", strings.Join(r.Attributes, ", "))
+	if r.OtherAddress != nil {
+		fmt.Printf("  Other address: %v (responds: %s)\n", r.OtherAddress, yes(r.Alternate))
+	}
+	fmt.Printf("  CHANGE-REQUEST: IP %s, port %s\n", yes(r.ChangeIP), yes(r.ChangePort))
+	fmt.Println("  FINGERPRINT:", yes(r.Fingerprint))
+	fmt.Println("  Unknown attributes rejected:", yes(r.UnknownAttributes))
+	if tcp {
+		fmt.Println("  TCP:", yes(r.TCP))
+	}
+}
+
+// readLines returns the lines of the file at path, but the blank ones and
+// the comments of #.
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// flagSet reports whether the flag of the name is set on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func runServe(args []string) (err error) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("l", ":3478", "UDP address to listen on")
+	alt := fs.String("alt", "", "alternate UDP address of another IP, serving RFC 5780 if set")
+	tcp := fs.String("tcp", "", "TCP address to listen on, none if empty")
+	v := fs.Bool("v", false, "verbose mode")
+	capture := fs.String("capture", "", "pcap file to write the STUN messages to")
+	metrics := fs.String("metrics", "", "HTTP address to serve the Prometheus metrics on at /metrics and the expvar counters at /debug/vars, none if empty")
+	fs.Parse(args)
+	p, done, err := openCapture(*capture)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := done(); err == nil {
+			err = cerr
+		}
+	}()
+	s := stun.NewServer()
+	s.SetVerbose(*v)
+	s.SetCapture(p)
+	errs := make(chan error, 3)
+	if *metrics != "" {
+		c := stunprom.NewCollector("")
+		c.AddServer("go-stun", s)
+		stun.PublishExpvar()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", c)
+		mux.Handle("/debug/vars", expvar.Handler())
+		go func() { errs <- http.ListenAndServe(*metrics, mux) }()
+	}
+	go func() {
+		if *alt != "" {
+			errs <- s.ListenAndServeAlternate(*addr, *alt)
+		} else {
+			errs <- s.ListenAndServe(*addr)
+		}
+	}()
+	if *tcp != "" {
+		go func() { errs <- s.ListenAndServeTCP(*tcp) }()
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	select {
+	case err := <-errs:
+		s.Close()
+		return err
+	case <-ctx.Done():
+		if err := s.Close(); err != nil && !errors.Is(err, stun.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+}
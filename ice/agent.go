@@ -0,0 +1,1129 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// The STUN transactions of an agent are sent numRetransmit times at most,
+// waiting initialTimeout first, or the RTO of the checks, and twice longer
+// each time, up to maxTimeout, as the STUN client.
+const (
+	numRetransmit  = 9
+	initialTimeout = 100 * time.Millisecond
+	maxTimeout     = 1600 * time.Millisecond
+	maxPacketSize  = 1500
+)
+
+// maxComponents is the number of the components of a stream at most, of
+// the IDs from 1 to 256 (RFC 8445 section 5.1.2.1).
+const maxComponents = 256
+
+// dataQueueSize is the number of the packets of data queued for Read by the
+// connection of an agent, beyond which the data is dropped.
+const dataQueueSize = 64
+
+// Errors of the agents.
+var (
+	ErrAgentClosed  = errors.New("ICE agent closed.")
+	ErrChecksFailed = errors.New("ICE connectivity checks failed.")
+	// ErrConsentExpired is returned by the writes of a connection once the
+	// consent of the peer expired.
+	ErrConsentExpired = errors.New("ICE consent expired.")
+)
+
+// Config is the configuration of an Agent.
+type Config struct {
+	// Addrs are the local addresses the host candidates are gathered on,
+	// by default all the addresses of the interfaces up but the loopback
+	// and the link-local ones.
+	Addrs []netip.Addr
+	// STUNServers are the addresses of the STUN servers, as "host:port",
+	// the server reflexive candidates are gathered from.
+	STUNServers []string
+	// TURNServers are the TURN servers the relay candidates are allocated
+	// on.
+	TURNServers []TURNServer
+	// Controlling makes the agent the controlling one, which nominates the
+	// pair to be selected, e.g. as the offerer. The role is switched on a
+	// conflict with the peer, from the tie-breakers.
+	Controlling bool
+	// Lite makes the agent an ICE-lite one (RFC 8445 section 2.5), e.g. of
+	// a server of a public address: it gathers the host candidates only,
+	// and answers the checks of the peer, a full agent controlling, without
+	// checking back. It needs neither the candidates nor the credentials
+	// of the peer.
+	Lite bool
+	// Trickle makes the agent expect the candidates of the peer trickled
+	// (RFC 8838), added while the checks run: these fail only once the
+	// EndOfRemoteCandidates.
+	Trickle bool
+	// Ta is the interval between the STUN transactions started by the
+	// agent, of the gathering and of the checks, 50ms by default and 5ms
+	// at least (RFC 8445 section 14.2).
+	Ta time.Duration
+	// ConsentInterval is the interval between the consent checks over the
+	// selected pair, 5s by default, and ConsentTimeout the time without a
+	// response after which the consent expires, 30s by default (RFC 7675).
+	// An ICE-lite agent does not check the consent.
+	ConsentInterval time.Duration
+	ConsentTimeout  time.Duration
+	// MDNS is the use of the mDNS names of the host candidates, to resolve
+	// those of the peer by default.
+	MDNS MDNSMode
+	// Nomination is how the agent nominates the pair to be selected, once
+	// controlling, RegularNomination by default.
+	Nomination NominationPolicy
+	// Nominate, if not nil, chooses the pair to be nominated by the
+	// regular nomination, e.g. preferring wired interfaces to cellular
+	// ones, out of the valid pairs by priority. It is called as the pairs
+	// succeed, without the lock of the agent, and returns the index of the
+	// pair to be nominated, or -1 to wait for more. Once no pair is left to
+	// check, the first one is nominated if none is chosen.
+	Nominate func(valid []CandidatePair) int
+	// Policy filters the candidates gathered, GatherAll by default.
+	Policy GatherPolicy
+	// PreferIPv6 prefers the host candidates of IPv6 to those of IPv4,
+	// which are preferred in the order of Addrs otherwise.
+	PreferIPv6 bool
+	// Interfaces are the names of the interfaces the addresses of which
+	// are gathered on, by default all, unless Addrs.
+	Interfaces []string
+	// Costs are the costs of the interfaces by name, of 0 if not included:
+	// the host candidates are preferred by the costs of their interfaces
+	// first, over PreferIPv6 and the order of Addrs.
+	Costs map[string]InterfaceCost
+	// Protocols are the transport protocols of the host candidates, "udp"
+	// and "tcp", of the active, passive and simultaneous-open candidates
+	// (RFC 6544), e.g. where no UDP path exists. The server reflexive and
+	// the relay candidates are of UDP. It is "udp" only by default.
+	Protocols []string
+	// Components is the number of the components of the stream, e.g. 2 of
+	// RTP and RTCP, of the IDs from 1, which are checked and selected each.
+	// It is 1 by default.
+	Components int
+	// Tracer, if not nil, traces the STUN transactions of the agent, of
+	// the gathering and of the checks, a span each, and those of its TURN
+	// clients.
+	Tracer stun.Tracer
+}
+
+// GatherPolicy filters the candidates gathered by an agent, as the
+// iceTransportPolicy of WebRTC.
+type GatherPolicy int
+
+// Gather policies.
+const (
+	// GatherAll gathers all the candidates.
+	GatherAll GatherPolicy = iota
+	// GatherNoHost keeps the host candidates from the peer: they are
+	// checked from as the bases of the server reflexive ones, but not
+	// signaled.
+	GatherNoHost
+	// GatherRelay gathers the relay candidates only, which hides the
+	// addresses of the agent from the peer: the host candidates are not
+	// checked from.
+	GatherRelay
+)
+
+// TURNServer is a TURN server with the long-term credentials to allocate
+// relay candidates on it.
+type TURNServer struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+// Agent is an ICE agent (RFC 8445), which gathers the candidates of a peer
+// with Gather, and checks them against the remote ones given by
+// AddRemoteCandidate to establish the connection returned by Connect.
+type Agent struct {
+	cfg        Config
+	logger     *stun.Logger
+	tieBreaker uint64
+	data       []chan packet // received from the remote candidates, by component
+	done       chan struct{} // closed by Close
+
+	mu          sync.Mutex
+	controlling bool // switched on a role conflict
+	ufrag       string
+	pwd         string
+	prevUfrag   string // accepted after SetLocalCredentials, until the peer rotates too
+	prevPwd     string
+	gen         int           // of the checks, incremented by Restart
+	connected   chan struct{} // closed once a pair of each component is selected
+	failed      chan struct{} // closed once all the pairs of a component failed
+	bases       []*base
+	turns       []*stun.TURNClient
+	local       []localCandidate
+	remote      []Candidate
+	remoteUfrag string
+	remotePwd   string
+	pairs       []*pair
+	triggered   []*pair                  // checked first, in order
+	slot        time.Time                // of the next transaction, paced by Ta
+	nominating  map[int]*pair            // by component
+	selected    map[int]*pair            // by component, until replaced after Restart
+	pending     map[string]chan response // by transaction ID
+	trickle     chan Candidate           // receiving the candidates, while gathering
+	gathered    bool                     // once started
+	gatherDone  bool
+	remoteDone  bool // EndOfRemoteCandidates, if trickled
+	checking    bool
+	consentSubs []chan ConsentEvent
+	stateSubs   []chan StateEvent
+	gathering   GatheringState
+	state       ConnectionState
+	mdns        *mdns       // once used
+	resolving   int         // remote candidates of names
+	offered     map[int]int // valid pairs offered to Nominate, by component
+	closed      bool
+}
+
+// localCandidate is a local candidate with its base.
+type localCandidate struct {
+	Candidate
+	base   *base
+	hidden bool // from the peer, by the gather policy or as peer reflexive
+}
+
+// response is a STUN response with its source address.
+type response struct {
+	m    *stun.Message
+	from netip.AddrPort
+}
+
+// packet is a packet of data received from a remote candidate.
+type packet struct {
+	buf  []byte
+	from netip.AddrPort
+}
+
+// base is a local socket the candidates are based on (RFC 8445 section
+// 5.1.1.1), which the agent reads until closed.
+type base struct {
+	conn      net.PacketConn
+	addr      netip.AddrPort
+	local     uint16 // local preference of the candidates
+	tcpType   string // of a TCP candidate, or empty of UDP
+	component int
+	relay     *stun.TURNAllocation // of a relay candidate, the conn
+}
+
+// protocol returns the transport protocol of the base, "udp" or "tcp".
+func (b *base) protocol() string {
+	if b.tcpType != "" {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// NewAgent returns an agent of the configuration, with random local
+// credentials.
+func NewAgent(cfg Config) (*Agent, error) {
+	for _, s := range cfg.TURNServers {
+		if s.Addr == "" {
+			return nil, errors.New("TURN server without address.")
+		}
+	}
+	switch {
+	case cfg.Ta == 0:
+		cfg.Ta = defaultTa
+	case cfg.Ta < minTa:
+		return nil, errors.New("ICE Ta below 5ms.")
+	}
+	if cfg.ConsentInterval == 0 {
+		cfg.ConsentInterval = defaultConsentInterval
+	}
+	if cfg.ConsentTimeout == 0 {
+		cfg.ConsentTimeout = defaultConsentTimeout
+	}
+	if cfg.ConsentInterval < 0 || cfg.ConsentTimeout < cfg.ConsentInterval {
+		return nil, errors.New("Invalid ICE consent interval or timeout.")
+	}
+	if cfg.Lite && cfg.Policy != GatherAll {
+		return nil, errors.New("ICE-lite agent of a gather policy.")
+	}
+	if cfg.Protocols == nil {
+		cfg.Protocols = []string{"udp"}
+	}
+	for _, p := range cfg.Protocols {
+		if p != "udp" && p != "tcp" {
+			return nil, errors.New("Unsupported ICE candidate protocol.")
+		}
+	}
+	switch {
+	case cfg.Components == 0:
+		cfg.Components = 1
+	case cfg.Components < 0 || cfg.Components > maxComponents:
+		return nil, errors.New("Invalid number of ICE components.")
+	}
+	data := make([]chan packet, cfg.Components)
+	for i := range data {
+		data[i] = make(chan packet, dataQueueSize)
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	ufrag, pwd, err := credentials()
+	if err != nil {
+		return nil, err
+	}
+	return &Agent{
+		cfg:         cfg,
+		logger:      stun.NewLogger(),
+		controlling: cfg.Controlling && !cfg.Lite,
+		tieBreaker:  binary.BigEndian.Uint64(b),
+		ufrag:       ufrag,
+		pwd:         pwd,
+		data:        data,
+		done:        make(chan struct{}),
+		connected:   make(chan struct{}),
+		failed:      make(chan struct{}),
+		nominating:  make(map[int]*pair),
+		selected:    make(map[int]*pair),
+		offered:     make(map[int]int),
+		pending:     make(map[string]chan response),
+	}, nil
+}
+
+// credentials returns a random username fragment and password, of 4 and 22
+// characters at least out of the ice-chars of base64 (RFC 8839 section
+// 5.4).
+func credentials() (ufrag, pwd string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b[:6]), base64.RawStdEncoding.EncodeToString(b[6:]), nil
+}
+
+// LocalCredentials returns the username fragment and the password of the
+// agent, to be signaled to the peer with its candidates.
+func (a *Agent) LocalCredentials() (ufrag, pwd string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.ufrag, a.pwd
+}
+
+// Restart restarts ICE (RFC 8445 section 9) with new local credentials,
+// which it returns to be signaled to the peer with the local candidates.
+// The remote credentials and candidates are cleared, to be set again from
+// the peer before Connect runs the checks again. The selected pairs, if
+// any, are kept over the connections until other ones are selected.
+func (a *Agent) Restart() (ufrag, pwd string, err error) {
+	ufrag, pwd, err = credentials()
+	if err != nil {
+		return "", "", err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return "", "", ErrAgentClosed
+	}
+	a.ufrag, a.pwd = ufrag, pwd
+	a.prevUfrag, a.prevPwd = "", ""
+	a.gen++
+	a.remoteUfrag, a.remotePwd = "", ""
+	a.remote, a.pairs, a.triggered = nil, nil, nil
+	a.nominating = make(map[int]*pair)
+	a.offered = make(map[int]int)
+	a.remoteDone = false
+	a.checking = false
+	a.connected = make(chan struct{})
+	a.failed = make(chan struct{})
+	a.logger.Debugln("ICE restarted with ufrag", ufrag)
+	return ufrag, pwd, nil
+}
+
+// RotateCredentials replaces the local credentials of the agent with new
+// ones, as SetLocalCredentials, and returns them.
+func (a *Agent) RotateCredentials() (ufrag, pwd string, err error) {
+	if ufrag, pwd, err = credentials(); err != nil {
+		return "", "", err
+	}
+	return ufrag, pwd, a.SetLocalCredentials(ufrag, pwd)
+}
+
+// SetLocalCredentials replaces the local username fragment and password of
+// the agent, without restarting ICE, e.g. to refresh them periodically over
+// a long session. The checks of the peer are authenticated with the new
+// credentials, or the previous ones until the peer uses the new ones, once
+// signaled.
+func (a *Agent) SetLocalCredentials(ufrag, pwd string) error {
+	if !iceChars(ufrag, 4) || !iceChars(pwd, 22) {
+		return errors.New("Invalid ICE credentials.")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return ErrAgentClosed
+	}
+	if ufrag == a.ufrag {
+		return errors.New("ICE username fragment unchanged.")
+	}
+	a.prevUfrag, a.prevPwd = a.ufrag, a.pwd
+	a.ufrag, a.pwd = ufrag, pwd
+	a.logger.Debugln("ICE credentials rotated to ufrag", ufrag)
+	return nil
+}
+
+// iceChars reports whether s is of min to 256 ice-chars (RFC 8839 section
+// 5.4).
+func iceChars(s string, min int) bool {
+	if len(s) < min || len(s) > 256 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '+' || c == '/') {
+			return false
+		}
+	}
+	return true
+}
+
+// SetRemoteCredentials sets the username fragment and the password of the
+// peer, which authenticate the connectivity checks, also of a live agent
+// once the peer rotated its credentials, for the checks sent afterwards.
+func (a *Agent) SetRemoteCredentials(ufrag, pwd string) {
+	a.mu.Lock()
+	a.remoteUfrag, a.remotePwd = ufrag, pwd
+	a.mu.Unlock()
+}
+
+// AddRemoteCandidate adds a candidate of the peer, which is paired with the
+// local candidates of its family to be checked. The candidate of an mDNS
+// name is added once resolved, unless the MDNS mode is MDNSDisabled.
+func (a *Agent) AddRemoteCandidate(c Candidate) error {
+	if c.Name != "" && !c.Addr.IsValid() {
+		return a.resolveCandidate(c)
+	}
+	if !c.Addr.IsValid() {
+		return errors.New("Invalid ICE candidate address.")
+	}
+	switch c.Protocol = strings.ToLower(c.Protocol); c.Protocol {
+	case "", "udp":
+		c.Protocol, c.TCPType = "udp", ""
+	case "tcp":
+		if c.TCPType != TCPActive && c.TCPType != TCPPassive && c.TCPType != TCPSimultaneousOpen {
+			return errors.New("Invalid ICE TCP candidate type.")
+		}
+	default:
+		return errors.New("Unsupported ICE candidate protocol.")
+	}
+	switch {
+	case c.Component == 0:
+		c.Component = 1
+	case c.Component < 0 || c.Component > a.cfg.Components:
+		return errors.New("Invalid ICE candidate component.")
+	}
+	c.Addr = unmap(c.Addr)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return ErrAgentClosed
+	}
+	for i, rc := range a.remote {
+		if rc.Addr != c.Addr || rc.Component != c.Component || rc.Protocol != c.Protocol {
+			continue
+		}
+		if rc.Type == PeerReflexive && c.Type != PeerReflexive {
+			// The peer reflexive candidate learned from a check is the
+			// candidate signaled after it (RFC 8445 section 7.3.1.3).
+			a.remote[i] = c
+			for _, p := range a.pairs {
+				if p.remote.Addr == c.Addr && p.remote.Component == c.Component && p.remote.Protocol == c.Protocol {
+					p.remote = c
+				}
+			}
+			a.sortPairs()
+		}
+		return nil
+	}
+	a.remote = append(a.remote, c)
+	for _, lc := range a.local {
+		a.pair(lc, c)
+	}
+	return nil
+}
+
+// Connect runs the connectivity checks of the candidates, while or once
+// gathered, until a pair of each component is selected, and returns the
+// connection over the one of the component 1, the others being returned by
+// ComponentConn. It returns ErrChecksFailed once all the pairs of a
+// component failed, after the end of the candidates. An ICE-lite agent
+// waits for the pairs nominated by the peer instead. After Restart, it
+// waits for the pairs replacing the selected ones, which are kept if the
+// checks fail.
+func (a *Agent) Connect(ctx context.Context) (*Conn, error) {
+	a.mu.Lock()
+	switch {
+	case a.closed:
+		a.mu.Unlock()
+		return nil, ErrAgentClosed
+	case !a.gathered:
+		a.mu.Unlock()
+		return nil, errors.New("ICE candidates not gathered.")
+	case !a.cfg.Lite && (a.remoteUfrag == "" || a.remotePwd == ""):
+		a.mu.Unlock()
+		return nil, errors.New("Remote ICE credentials not set.")
+	}
+	if !a.checking && !a.cfg.Lite {
+		a.checking = true
+		go a.run(a.gen)
+	}
+	if a.state != ConnectionConnected {
+		a.setConnection(ConnectionChecking)
+	}
+	connected, failed := a.connected, a.failed
+	a.mu.Unlock()
+	select {
+	case <-connected:
+		return &Conn{a: a, component: 1, wake: make(chan struct{})}, nil
+	case <-failed:
+		return nil, ErrChecksFailed
+	case <-a.done:
+		return nil, ErrAgentClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ComponentConn returns the connection over the selected pair of the
+// component, once connected.
+func (a *Agent) ComponentConn(component int) (*Conn, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case a.closed:
+		return nil, ErrAgentClosed
+	case a.selected[component] == nil:
+		return nil, errors.New("No ICE pair selected of the component.")
+	}
+	return &Conn{a: a, component: component, wake: make(chan struct{})}, nil
+}
+
+// Selected returns the local and the remote candidates of the selected
+// pair of the component 1, if any.
+func (a *Agent) Selected() (local, remote Candidate, ok bool) {
+	return a.SelectedComponent(1)
+}
+
+// SelectedComponent returns the local and the remote candidates of the
+// selected pair of the component, if any.
+func (a *Agent) SelectedComponent(component int) (local, remote Candidate, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p := a.selected[component]
+	if p == nil {
+		return Candidate{}, Candidate{}, false
+	}
+	return p.local.Candidate, p.remote, true
+}
+
+// SetVerbose sets the agent to be in the verbose mode.
+func (a *Agent) SetVerbose(v bool) {
+	a.logger.SetDebug(v)
+}
+
+// Gather gathers the candidates of the agent, once: the host candidates on
+// the local addresses, the server reflexive ones from the STUN servers and
+// the relay ones on the TURN servers. The candidates of the servers failing
+// are left out. It returns the candidates gathered, by priority.
+func (a *Agent) Gather() ([]Candidate, error) {
+	ch, err := a.Trickle()
+	if err != nil {
+		return nil, err
+	}
+	for range ch {
+	}
+	return a.LocalCandidates(), nil
+}
+
+// Trickle gathers the candidates of the agent as Gather, but in the
+// background once the host candidates are gathered, and returns a channel
+// receiving the candidates as gathered to be trickled to the peer (RFC
+// 8838). The channel is closed once the gathering is complete, i.e. at the
+// end of candidates.
+func (a *Agent) Trickle() (<-chan Candidate, error) {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil, ErrAgentClosed
+	}
+	if a.gathered {
+		a.mu.Unlock()
+		return nil, errors.New("ICE candidates gathered already.")
+	}
+	a.gathered = true
+	a.setGathering(GatheringInProgress)
+	a.mu.Unlock()
+	addrs := append([]netip.Addr(nil), a.cfg.Addrs...)
+	if a.cfg.Addrs == nil {
+		var err error
+		if addrs, err = localAddrs(a.cfg.Interfaces); err != nil {
+			a.abortGathering()
+			return nil, err
+		}
+	}
+	if a.cfg.PreferIPv6 {
+		sort.SliceStable(addrs, func(i, j int) bool {
+			return addrs[i].Is6() && !addrs[j].Is6()
+		})
+	}
+	if a.cfg.Costs != nil {
+		if err := sortByCost(addrs, a.cfg.Costs); err != nil {
+			a.abortGathering()
+			return nil, err
+		}
+	}
+	stunServers := a.cfg.STUNServers
+	if a.cfg.Policy == GatherRelay {
+		stunServers = nil
+	}
+	servers := len(stunServers) + len(a.cfg.TURNServers)
+	if a.cfg.Lite {
+		servers = 0
+	}
+	// The channel holds all the candidates, so that the gathering never
+	// waits for the application.
+	ch := make(chan Candidate, len(addrs)*a.cfg.Components*(4+servers))
+	a.mu.Lock()
+	a.trickle = ch
+	a.mu.Unlock()
+	var types []string // of the host candidates, empty of UDP
+	if contains(a.cfg.Protocols, "udp") {
+		types = append(types, "")
+	}
+	if contains(a.cfg.Protocols, "tcp") {
+		types = append(types, TCPActive, TCPPassive, TCPSimultaneousOpen)
+	}
+	var bases []*base // of UDP, of the server candidates
+	hosts := 0
+	for i, ip := range addrs {
+		var name string
+		if a.cfg.MDNS == MDNSGather && a.cfg.Policy == GatherAll {
+			var err error
+			if name, err = a.announce(ip); err != nil {
+				a.endGathering()
+				return nil, err
+			}
+		}
+		for component := 1; component <= a.cfg.Components; component++ {
+			for _, tcpType := range types {
+				local, protocol := 0xffff-uint16(i), "udp"
+				if tcpType != "" {
+					local, protocol = tcpPreference(tcpType, 0x1fff-uint16(i)), "tcp"
+				}
+				b, err := a.listen(ip, local, tcpType, component)
+				if err != nil {
+					a.logger.Debugln("Gather host candidate on", ip, protocol, tcpType, ":", err)
+					continue
+				}
+				if tcpType == "" {
+					bases = append(bases, b)
+				}
+				hosts++
+				a.add(Candidate{
+					Foundation: foundation(Host, ip, "", protocol),
+					Type:       Host,
+					Addr:       b.addr,
+					Name:       name,
+				}, b)
+			}
+		}
+	}
+	if hosts == 0 {
+		a.endGathering()
+		return nil, errors.New("No local address to gather ICE candidates on.")
+	}
+	if servers == 0 || len(bases) == 0 {
+		a.endGathering()
+		return ch, nil
+	}
+	go func() {
+		var wg sync.WaitGroup
+		for _, b := range bases {
+			for _, server := range stunServers {
+				wg.Add(1)
+				go func(b *base, server string) {
+					defer wg.Done()
+					if err := a.gatherReflexive(b, server); err != nil {
+						a.logger.Debugln("Gather server reflexive candidate from", server, ":", err)
+					}
+				}(b, server)
+			}
+			for _, server := range a.cfg.TURNServers {
+				wg.Add(1)
+				go func(b *base, server TURNServer) {
+					defer wg.Done()
+					if err := a.gatherRelay(b, server); err != nil {
+						a.logger.Debugln("Gather relay candidate on", server.Addr, ":", err)
+					}
+				}(b, server)
+			}
+		}
+		wg.Wait()
+		a.endGathering()
+	}()
+	return ch, nil
+}
+
+// endGathering completes the gathering, and closes the channel of Trickle.
+func (a *Agent) endGathering() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.gatherDone = true
+	a.setGathering(GatheringComplete)
+	close(a.trickle)
+	a.trickle = nil
+}
+
+// abortGathering undoes the start of a gathering failed before any
+// candidate, so that it can be retried.
+func (a *Agent) abortGathering() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.gathered = false
+	a.setGathering(GatheringNew)
+}
+
+// EndOfRemoteCandidates signals the end of the candidates of the peer, once
+// trickled all, so that the checks fail once all the pairs failed (RFC 8838
+// section 8.2).
+func (a *Agent) EndOfRemoteCandidates() {
+	a.mu.Lock()
+	a.remoteDone = true
+	a.mu.Unlock()
+}
+
+// LocalCandidates returns the candidates gathered, by priority.
+func (a *Agent) LocalCandidates() []Candidate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var candidates []Candidate
+	for _, lc := range a.local {
+		if !lc.hidden {
+			candidates = append(candidates, a.signaled(lc))
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Priority > candidates[j].Priority
+	})
+	return candidates
+}
+
+// Close closes the sockets of the agent and releases its allocations.
+func (a *Agent) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.done)
+	if a.mdns != nil {
+		a.mdns.close()
+	}
+	for _, ch := range a.consentSubs {
+		close(ch)
+	}
+	a.consentSubs = nil
+	a.setConnection(ConnectionClosed)
+	for _, ch := range a.stateSubs {
+		close(ch)
+	}
+	a.stateSubs = nil
+	bases, turns := a.bases, a.turns
+	a.mu.Unlock()
+	for _, c := range turns {
+		c.Close()
+	}
+	for _, b := range bases {
+		b.conn.Close()
+	}
+	return nil
+}
+
+// add adds the candidate c based on b, unless redundant with a candidate of
+// the same address and base (RFC 8445 section 5.1.3), pairs it with the
+// remote candidates, and trickles it.
+func (a *Agent) add(c Candidate, b *base) {
+	c.Component = b.component
+	c.Protocol, c.TCPType = b.protocol(), b.tcpType
+	c.Priority = priority(c.Type, b.local, c.Component)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, lc := range a.local {
+		if !lc.hidden && lc.Addr == c.Addr && lc.Protocol == c.Protocol && (lc.Related == c.Related || lc.Type == Host && c.Related == b.addr) {
+			return
+		}
+	}
+	lc := localCandidate{c, b, c.Type == Host && a.cfg.Policy != GatherAll}
+	a.local = append(a.local, lc)
+	for _, rc := range a.remote {
+		a.pair(lc, rc)
+	}
+	if a.trickle != nil && !lc.hidden {
+		a.trickle <- a.signaled(lc)
+	}
+}
+
+// signaled returns the local candidate lc as signaled to the peer, without
+// the related address of a hidden host candidate by the gather policy (RFC
+// 8839 section 5.1).
+func (a *Agent) signaled(lc localCandidate) Candidate {
+	c := lc.Candidate
+	if a.cfg.Policy != GatherAll {
+		c.Related = netip.AddrPort{}
+	}
+	return c
+}
+
+// listen opens a socket of the component on the local address ip, of UDP
+// or of a TCP candidate of the type tcpType, and reads it.
+func (a *Agent) listen(ip netip.Addr, local uint16, tcpType string, component int) (*base, error) {
+	var conn net.PacketConn
+	var err error
+	if tcpType == "" {
+		conn, err = net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)))
+	} else {
+		conn, err = listenTCP(ip, tcpType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b := &base{conn: conn, addr: addrPort(conn.LocalAddr()), local: local, tcpType: tcpType, component: component}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		conn.Close()
+		return nil, ErrAgentClosed
+	}
+	a.bases = append(a.bases, b)
+	a.mu.Unlock()
+	go a.read(b)
+	return b, nil
+}
+
+// gatherReflexive gathers the server reflexive candidate of the base b from
+// the STUN server.
+func (a *Agent) gatherReflexive(b *base, server string) error {
+	addr, err := resolve(b, server)
+	if err != nil {
+		return err
+	}
+	req, err := stun.NewMessage(stun.TypeBindingRequest)
+	if err != nil {
+		return err
+	}
+	a.pace()
+	resp, _, err := a.transact(b, req, nil, addr.AddrPort(), initialTimeout, nil)
+	if err != nil {
+		return err
+	}
+	mapped := resp.XorAddress(stun.AttributeXorMappedAddress)
+	if resp.Type() != stun.TypeBindingResponse || mapped == nil {
+		return errors.New("Binding response without XOR-MAPPED-ADDRESS.")
+	}
+	a.add(Candidate{
+		Foundation: foundation(ServerReflexive, b.addr.Addr(), addr.IP.String(), "udp"),
+		Type:       ServerReflexive,
+		Addr:       unmap(mapped.AddrPort()),
+		Related:    b.addr,
+	}, b)
+	return nil
+}
+
+// gatherRelay allocates the relay candidate of the base b on the TURN
+// server, with a TURN client of another socket on the address of b. The
+// allocation is the base of the relay candidate, over which its checks and
+// data are relayed.
+func (a *Agent) gatherRelay(b *base, server TURNServer) error {
+	addr, err := resolve(b, server.Addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(b.addr.Addr(), 0)))
+	if err != nil {
+		return err
+	}
+	c := stun.NewTURNClient(conn, addr)
+	c.SetCredentials(server.Username, server.Password)
+	if a.cfg.Tracer != nil {
+		c.SetTracer(a.cfg.Tracer)
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return c.Close()
+	}
+	a.turns = append(a.turns, c)
+	a.mu.Unlock()
+	alloc, err := c.Allocate()
+	if err != nil {
+		return err
+	}
+	var related netip.AddrPort
+	if mapped := alloc.MappedAddr(); mapped != nil {
+		related = unmap(mapped.AddrPort())
+	}
+	rb := &base{conn: alloc, addr: unmap(alloc.RelayedAddr().AddrPort()), local: b.local, component: b.component, relay: alloc}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return alloc.Close()
+	}
+	a.bases = append(a.bases, rb)
+	a.mu.Unlock()
+	go a.read(rb)
+	a.add(Candidate{
+		Foundation: foundation(Relay, b.addr.Addr(), addr.IP.String(), "udp"),
+		Type:       Relay,
+		Addr:       rb.addr,
+		Related:    related,
+	}, rb)
+	return nil
+}
+
+// permit installs the permission of the remote candidate rc on the TURN
+// server of the relay base b, so that its checks and data are relayed.
+func (a *Agent) permit(b *base, rc Candidate) {
+	if err := b.relay.CreatePermission(rc.Addr.Addr()); err != nil {
+		a.logger.Debugln("ICE permission of", rc.Addr, "on", b.addr, ":", err)
+	}
+}
+
+// pace waits for the next slot of the transactions of the agent, which
+// start every Ta at most.
+func (a *Agent) pace() {
+	a.mu.Lock()
+	now := time.Now()
+	if a.slot.Before(now) {
+		a.slot = now
+	}
+	d := a.slot.Sub(now)
+	a.slot = a.slot.Add(a.cfg.Ta)
+	a.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// transact sends the request req from the base b to addr, signed with the
+// key unless nil, again while unanswered from the timeout rto, and returns
+// the response with its source address. The requests and the response are
+// counted in the stats of a pair, unless nil, and traced as a check then.
+func (a *Agent) transact(b *base, req *stun.Message, key []byte, addr netip.AddrPort, rto time.Duration, stats *pairStats) (resp *stun.Message, from netip.AddrPort, err error) {
+	span := a.startSpan(b, addr, stats != nil)
+	attempts := 0
+	var rtt time.Duration
+	defer func() {
+		span.SetAttribute("stun.attempts", attempts)
+		switch {
+		case resp != nil:
+			span.SetAttribute("stun.outcome", "responded")
+			span.SetAttribute("stun.rtt", rtt)
+			if resp.Type() == stun.TypeBindingErrorResponse {
+				span.SetAttribute("stun.error_code", resp.ErrorCode())
+			}
+		case attempts == numRetransmit:
+			span.SetAttribute("stun.outcome", "lost")
+		default:
+			span.SetAttribute("stun.outcome", "failed")
+		}
+		span.End(err)
+	}()
+	id := string(req.TransactionID())
+	ch := make(chan response, 1)
+	a.mu.Lock()
+	a.pending[id] = ch
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		delete(a.pending, id)
+		a.mu.Unlock()
+	}()
+	raw := req.Encode(key)
+	to := net.UDPAddrFromAddrPort(addr)
+	timeout := rto
+	for i := 0; i < numRetransmit; i++ {
+		if _, err := b.conn.WriteTo(raw, to); err != nil {
+			return nil, netip.AddrPort{}, err
+		}
+		sent := time.Now()
+		attempts++
+		if stats != nil {
+			stats.requestsSent.Add(1)
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case r := <-ch:
+			timer.Stop()
+			rtt = time.Since(sent)
+			if stats != nil {
+				stats.roundTrip(rtt)
+			}
+			return r.m, r.from, nil
+		case <-a.done:
+			timer.Stop()
+			return nil, netip.AddrPort{}, ErrAgentClosed
+		case <-timer.C:
+		}
+		if timeout < maxTimeout {
+			timeout *= 2
+		}
+	}
+	return nil, netip.AddrPort{}, errors.New("No response to the STUN request.")
+}
+
+// startSpan starts the span of a transaction from the base b to addr, of a
+// check if check, or of the gathering from a STUN server otherwise.
+func (a *Agent) startSpan(b *base, addr netip.AddrPort, check bool) stun.Span {
+	if a.cfg.Tracer == nil {
+		return noopSpan{}
+	}
+	name := "STUN Binding"
+	if check {
+		name = "ICE check"
+	}
+	_, span := a.cfg.Tracer.Start(context.Background(), name)
+	span.SetAttribute("ice.component", b.component)
+	span.SetAttribute("ice.local", b.addr.String())
+	if check {
+		span.SetAttribute("ice.remote", unmap(addr).String())
+	} else {
+		span.SetAttribute("stun.server", unmap(addr).String())
+	}
+	return span
+}
+
+// noopSpan is the span of no tracer.
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) End(err error)                              {}
+
+// read dispatches the messages received on the base b until closed, and
+// queues the other packets as data.
+func (a *Agent) read(b *base) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		from := addrPort(addr)
+		raw := append([]byte(nil), buf[:n]...)
+		m, err := stun.ParseMessage(raw)
+		if err != nil {
+			a.deliver(b, raw, from)
+			continue
+		}
+		switch m.Type() {
+		case stun.TypeBindingRequest:
+			a.handleCheck(b, m, from)
+		case stun.TypeBindingResponse, stun.TypeBindingErrorResponse:
+			a.mu.Lock()
+			ch := a.pending[string(m.TransactionID())]
+			delete(a.pending, string(m.TransactionID()))
+			a.mu.Unlock()
+			if ch != nil {
+				ch <- response{m, from}
+			}
+		}
+	}
+}
+
+// deliver queues the data from a remote candidate received on the base b
+// for Read of its component, and drops it if the queue is full.
+func (a *Agent) deliver(b *base, buf []byte, from netip.AddrPort) {
+	select {
+	case a.data[b.component-1] <- packet{buf, from}:
+	default:
+		a.logger.Debugln("Drop data from", from, "as the queue is full")
+	}
+}
+
+// resolve resolves the address of a server of the family of the base b.
+func resolve(b *base, server string) (*net.UDPAddr, error) {
+	network := "udp4"
+	if b.addr.Addr().Is6() {
+		network = "udp6"
+	}
+	return net.ResolveUDPAddr(network, server)
+}
+
+// unmap returns addr with an IPv4-mapped IPv6 address unmapped.
+func unmap(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+// localAddrs returns the addresses of the interfaces up of the names, or
+// all if nil, but the loopback and the link-local ones.
+func localAddrs(names []string) ([]netip.Addr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []netip.Addr
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || names != nil && !contains(names, iface.Name) {
+			continue
+		}
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, ifaddr := range ifaddrs {
+			prefix, err := netip.ParsePrefix(ifaddr.String())
+			if err != nil {
+				continue
+			}
+			ip := prefix.Addr().Unmap()
+			if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			addrs = append(addrs, ip)
+		}
+	}
+	return addrs, nil
+}
+
+// contains reports whether the strings contain s.
+func contains(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
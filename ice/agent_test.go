@@ -0,0 +1,654 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+var loopback = netip.MustParseAddr("127.0.0.1")
+
+// newTestServer starts a STUN server on the loopback address, or a TURN
+// server with the credentials of alice if turn, and returns its address.
+func newTestServer(t *testing.T, turn bool) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := stun.NewServer()
+	if turn {
+		s.SetAuth("example.org", stun.StaticCredentials{"alice": "secret"})
+		if _, err := stun.NewTURNServer(s, stun.TURNConfig{RelayIP: loopback, AllowPeers: []netip.Prefix{netip.PrefixFrom(loopback, 8)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go s.Serve(conn)
+	t.Cleanup(func() { s.Close() })
+	return conn.LocalAddr().String()
+}
+
+// newTestNAT forwards the packets sent to its address to server from
+// another address, as a NAT, and the responses back, and returns its
+// address and the mapped one.
+func newTestNAT(t *testing.T, server string) (string, string) {
+	inside, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		inside.Close()
+		outside.Close()
+	})
+	to, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := make(chan net.Addr, 1)
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, from, err := inside.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case clients <- from:
+			default:
+			}
+			outside.WriteTo(buf[:n], to)
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		client := <-clients
+		for {
+			n, _, err := outside.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			inside.WriteTo(buf[:n], client)
+		}
+	}()
+	return inside.LocalAddr().String(), outside.LocalAddr().String()
+}
+
+func TestAgentGather(t *testing.T) {
+	server := newTestServer(t, false)
+	nat, mapped := newTestNAT(t, server)
+	a, err := NewAgent(Config{
+		Addrs:       []netip.Addr{loopback},
+		STUNServers: []string{nat, server},
+		TURNServers: []TURNServer{{Addr: newTestServer(t, true), Username: "alice", Password: "secret"}},
+	})
+	if err != nil {
+		t.Fatalf("NewAgent error: %v", err)
+	}
+	defer a.Close()
+	candidates, err := a.Gather()
+	if err != nil {
+		t.Fatalf("Gather error: %v", err)
+	}
+	// The reflexive address of the server without NAT is the host one.
+	if len(candidates) != 3 {
+		t.Fatalf("Gather error: %v", candidates)
+	}
+	host, srflx, relay := candidates[0], candidates[1], candidates[2]
+	if host.Type != Host || host.Addr.Addr() != loopback || host.Related.IsValid() {
+		t.Errorf("Gather error: host candidate %v", host)
+	}
+	if srflx.Type != ServerReflexive || srflx.Addr.String() != mapped || srflx.Related != host.Addr {
+		t.Errorf("Gather error: server reflexive candidate %v", srflx)
+	}
+	if relay.Type != Relay || relay.Addr.Addr() != loopback || relay.Related.Addr() != loopback {
+		t.Errorf("Gather error: relay candidate %v", relay)
+	}
+	if host.Foundation == srflx.Foundation || srflx.Foundation == relay.Foundation || host.Component != 1 || host.Protocol != "udp" {
+		t.Errorf("Gather error: foundations %s, %s, %s", host.Foundation, srflx.Foundation, relay.Foundation)
+	}
+	if _, err := a.Gather(); err == nil {
+		t.Errorf("Gather error: expected error gathering again")
+	}
+	a.Close()
+	if _, err := a.Gather(); err != ErrAgentClosed {
+		t.Errorf("Gather error: expected ErrAgentClosed, get %v", err)
+	}
+}
+
+func TestAgentGatherPolicy(t *testing.T) {
+	server := newTestServer(t, false)
+	turn := newTestServer(t, true)
+	for _, tc := range []struct {
+		policy GatherPolicy
+		types  []CandidateType
+	}{
+		// The reflexive candidate of the host address is kept of the host
+		// candidate hidden.
+		{GatherNoHost, []CandidateType{ServerReflexive, ServerReflexive, Relay}},
+		{GatherRelay, []CandidateType{Relay}},
+	} {
+		nat, _ := newTestNAT(t, server)
+		a, err := NewAgent(Config{
+			Addrs:       []netip.Addr{loopback},
+			STUNServers: []string{nat, server},
+			TURNServers: []TURNServer{{Addr: turn, Username: "alice", Password: "secret"}},
+			Policy:      tc.policy,
+		})
+		if err != nil {
+			t.Fatalf("NewAgent error: %v", err)
+		}
+		defer a.Close()
+		candidates, err := a.Gather()
+		if err != nil {
+			t.Fatalf("Gather error: %v", err)
+		}
+		if len(candidates) != len(tc.types) {
+			t.Fatalf("Gather error: policy %d, %v", tc.policy, candidates)
+		}
+		for i, c := range candidates {
+			if c.Type != tc.types[i] || c.Related.IsValid() {
+				t.Errorf("Gather error: policy %d, %v", tc.policy, candidates)
+			}
+		}
+	}
+	if _, err := NewAgent(Config{Lite: true, Policy: GatherRelay}); err == nil {
+		t.Errorf("NewAgent error: ICE-lite agent of a gather policy")
+	}
+}
+
+func TestAgentPreferIPv6(t *testing.T) {
+	ip6 := netip.MustParseAddr("::1")
+	a, err := NewAgent(Config{Addrs: []netip.Addr{loopback, ip6}, PreferIPv6: true})
+	if err != nil {
+		t.Fatalf("NewAgent error: %v", err)
+	}
+	defer a.Close()
+	candidates, err := a.Gather()
+	if err != nil {
+		t.Fatalf("Gather error: %v", err)
+	}
+	if len(candidates) != 2 {
+		t.Skipf("IPv6 unavailable: %v", candidates)
+	}
+	if candidates[0].Addr.Addr() != ip6 {
+		t.Errorf("Gather error: IPv6 not preferred, %v", candidates)
+	}
+}
+
+func TestAgentCosts(t *testing.T) {
+	second := netip.MustParseAddr("127.0.0.2")
+	names := interfaceNames
+	interfaceNames = func() (map[netip.Addr]string, error) {
+		return map[netip.Addr]string{loopback: "wlan0", second: "eth0"}, nil
+	}
+	defer func() { interfaceNames = names }()
+	a, b := newTestPeers(t, Config{Costs: map[string]InterfaceCost{"wlan0": CostWiFi, "eth0": CostEthernet}})
+	if c := a.LocalCandidates(); c[0].Addr.Addr() != second {
+		t.Errorf("Gather error: ethernet not preferred, %v", c)
+	}
+	connect(t, a, b)
+	if local, remote, _ := a.Selected(); local.Addr.Addr() != second || remote.Addr.Addr() != second {
+		t.Errorf("Selected error: %v to %v, expected the ethernet candidates", local, remote)
+	}
+}
+
+func TestAgentGatherRetry(t *testing.T) {
+	names := interfaceNames
+	interfaceNames = func() (map[netip.Addr]string, error) {
+		return nil, errors.New("No interfaces.")
+	}
+	defer func() { interfaceNames = names }()
+	a, err := NewAgent(Config{Addrs: []netip.Addr{loopback}, Costs: map[string]InterfaceCost{"eth0": CostEthernet}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if _, err := a.Gather(); err == nil {
+		t.Fatalf("Gather error: expected error of the interfaces")
+	}
+	if g, _ := a.State(); g != GatheringNew {
+		t.Errorf("Gather error: state %v after failing", g)
+	}
+	// The gathering is retried once the interfaces are known.
+	interfaceNames = names
+	if c, err := a.Gather(); err != nil || len(c) == 0 {
+		t.Errorf("Gather error: %v, %v on retrying", c, err)
+	}
+}
+
+func TestLocalAddrs(t *testing.T) {
+	all, err := localAddrs(nil)
+	if err != nil {
+		t.Fatalf("localAddrs error: %v", err)
+	}
+	if addrs, err := localAddrs([]string{}); err != nil || len(addrs) != 0 {
+		t.Errorf("localAddrs error: %v of no interface, %v", addrs, err)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil || len(ifaces) == 0 {
+		t.Skip("No interface")
+	}
+	n := 0
+	for _, iface := range ifaces {
+		addrs, err := localAddrs([]string{iface.Name})
+		if err != nil {
+			t.Fatalf("localAddrs error: %v", err)
+		}
+		n += len(addrs)
+	}
+	if n != len(all) {
+		t.Errorf("localAddrs error: %d addresses of the interfaces, %d of all", n, len(all))
+	}
+}
+
+// newTestAgents returns a controlling and a controlled agent of cfg on the
+// loopback address, which know the candidates of each other.
+func newTestAgents(t *testing.T, cfg Config) (*Agent, *Agent) {
+	var agents [2]*Agent
+	for i := range agents {
+		cfg.Addrs = []netip.Addr{loopback}
+		cfg.Controlling = i == 0
+		a, err := NewAgent(cfg)
+		if err != nil {
+			t.Fatalf("NewAgent error: %v", err)
+		}
+		t.Cleanup(func() { a.Close() })
+		if _, err := a.Gather(); err != nil {
+			t.Fatalf("Gather error: %v", err)
+		}
+		agents[i] = a
+	}
+	for i, a := range agents {
+		peer := agents[1-i]
+		a.SetRemoteCredentials(peer.LocalCredentials())
+		for _, c := range peer.LocalCandidates() {
+			if err := a.AddRemoteCandidate(c); err != nil {
+				t.Fatalf("AddRemoteCandidate error: %v", err)
+			}
+		}
+	}
+	return agents[0], agents[1]
+}
+
+// connect connects the agents, and returns their connections.
+func connect(t *testing.T, a, b *Agent) (*Conn, *Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error, 1)
+	var bc *Conn
+	go func() {
+		var err error
+		bc, err = b.Connect(ctx)
+		errs <- err
+	}()
+	ac, err := a.Connect(ctx)
+	if err != nil {
+		t.Fatalf("Connect error: controlling, %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Connect error: controlled, %v", err)
+	}
+	return ac, bc
+}
+
+func TestAgentConnect(t *testing.T) {
+	a, b := newTestAgents(t, Config{})
+	ac, bc := connect(t, a, b)
+	if ac.LocalAddr().String() != bc.RemoteAddr().String() || ac.RemoteAddr().String() != bc.LocalAddr().String() {
+		t.Errorf("Connect error: %v to %v, %v to %v", ac.LocalAddr(), ac.RemoteAddr(), bc.LocalAddr(), bc.RemoteAddr())
+	}
+	buf := make([]byte, 64)
+	for _, c := range [][2]*Conn{{ac, bc}, {bc, ac}} {
+		if _, err := c[0].Write([]byte("ping")); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		c[1].SetReadDeadline(time.Now().Add(time.Second))
+		n, err := c[1].Read(buf)
+		if err != nil || string(buf[:n]) != "ping" {
+			t.Fatalf("Read error: read %q, %v", buf[:n], err)
+		}
+	}
+	ac.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := ac.Read(buf); err != os.ErrDeadlineExceeded {
+		t.Errorf("Read error: expected ErrDeadlineExceeded, get %v", err)
+	}
+}
+
+func TestAgentRelay(t *testing.T) {
+	turn := newTestServer(t, true)
+	a, b := newTestAgents(t, Config{
+		TURNServers: []TURNServer{{Addr: turn, Username: "alice", Password: "secret"}},
+		Policy:      GatherRelay,
+	})
+	ac, bc := connect(t, a, b)
+	for _, agent := range []*Agent{a, b} {
+		if local, remote, _ := agent.Selected(); local.Type != Relay || remote.Type != Relay {
+			t.Fatalf("Selected error: %v to %v, expected relay candidates", local, remote)
+		}
+	}
+	buf := make([]byte, 64)
+	for _, c := range [][2]*Conn{{ac, bc}, {bc, ac}} {
+		if _, err := c[0].Write([]byte("ping")); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		c[1].SetReadDeadline(time.Now().Add(time.Second))
+		n, err := c[1].Read(buf)
+		if err != nil || string(buf[:n]) != "ping" {
+			t.Fatalf("Read error: read %q, %v", buf[:n], err)
+		}
+	}
+}
+
+func TestAgentComponents(t *testing.T) {
+	a, b := newTestAgents(t, Config{Components: 2})
+	connect(t, a, b)
+	for _, agent := range []*Agent{a, b} {
+		for component := 1; component <= 2; component++ {
+			local, remote, ok := agent.SelectedComponent(component)
+			if !ok || local.Component != component || remote.Component != component {
+				t.Fatalf("SelectedComponent error: component %d, %v to %v", component, local, remote)
+			}
+		}
+	}
+	ac, err := a.ComponentConn(2)
+	if err != nil {
+		t.Fatalf("ComponentConn error: %v", err)
+	}
+	bc, err := b.ComponentConn(2)
+	if err != nil {
+		t.Fatalf("ComponentConn error: %v", err)
+	}
+	if ac.LocalAddr().String() != bc.RemoteAddr().String() {
+		t.Errorf("ComponentConn error: %v to %v, %v to %v", ac.LocalAddr(), ac.RemoteAddr(), bc.LocalAddr(), bc.RemoteAddr())
+	}
+	if _, err := ac.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	buf := make([]byte, 64)
+	bc.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := bc.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Read error: read %q, %v", buf[:n], err)
+	}
+	// The data of the component 2 is not read on the component 1.
+	b1, _ := b.ComponentConn(1)
+	b1.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := b1.Read(buf); err != os.ErrDeadlineExceeded {
+		t.Errorf("Read error: expected ErrDeadlineExceeded, get %v", err)
+	}
+	if _, err := a.ComponentConn(3); err == nil {
+		t.Errorf("ComponentConn error: expected error of component 3")
+	}
+}
+
+func TestAgentCheckAuth(t *testing.T) {
+	a, b := newTestAgents(t, Config{})
+	// The checks signed with wrong passwords are rejected.
+	a.SetRemoteCredentials(b.ufrag, "wrong password of 22 chars")
+	b.SetRemoteCredentials(a.ufrag, "wrong password of 22 chars")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := a.Connect(ctx)
+		errs <- err
+	}()
+	if _, err := b.Connect(ctx); err != ErrChecksFailed {
+		t.Errorf("Connect error: expected ErrChecksFailed, get %v", err)
+	}
+	if err := <-errs; err != ErrChecksFailed {
+		t.Errorf("Connect error: expected ErrChecksFailed, get %v", err)
+	}
+}
+
+func TestAgentLite(t *testing.T) {
+	server := newTestServer(t, false)
+	lite, err := NewAgent(Config{Addrs: []netip.Addr{loopback}, STUNServers: []string{server}, Controlling: true, Lite: true})
+	if err != nil {
+		t.Fatalf("NewAgent error: %v", err)
+	}
+	defer lite.Close()
+	candidates, err := lite.Gather()
+	if err != nil || len(candidates) != 1 || candidates[0].Type != Host {
+		t.Fatalf("Gather error: lite %v, %v", candidates, err)
+	}
+	full, err := NewAgent(Config{Addrs: []netip.Addr{loopback}, Controlling: true})
+	if err != nil {
+		t.Fatalf("NewAgent error: %v", err)
+	}
+	defer full.Close()
+	if _, err := full.Gather(); err != nil {
+		t.Fatalf("Gather error: %v", err)
+	}
+	full.SetRemoteCredentials(lite.LocalCredentials())
+	full.AddRemoteCandidate(candidates[0])
+	fc, lc := connect(t, full, lite)
+	if _, remote, _ := lite.Selected(); remote.Type != PeerReflexive || remote.Addr.String() != fc.LocalAddr().String() {
+		t.Errorf("Connect error: lite selected %v", remote)
+	}
+	buf := make([]byte, 64)
+	if _, err := lc.Write([]byte("pong")); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	fc.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := fc.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("Read error: read %q, %v", buf[:n], err)
+	}
+}
+
+func TestAgentTrickle(t *testing.T) {
+	server := newTestServer(t, false)
+	var agents [2]*Agent
+	for i := range agents {
+		nat, _ := newTestNAT(t, server)
+		a, err := NewAgent(Config{Addrs: []netip.Addr{loopback}, STUNServers: []string{nat}, Controlling: i == 0, Trickle: true})
+		if err != nil {
+			t.Fatalf("NewAgent error: %v", err)
+		}
+		defer a.Close()
+		agents[i] = a
+	}
+	trickled := make(chan int, 2)
+	for i, a := range agents {
+		ch, err := a.Trickle()
+		if err != nil {
+			t.Fatalf("Trickle error: %v", err)
+		}
+		peer := agents[1-i]
+		peer.SetRemoteCredentials(a.LocalCredentials())
+		go func() {
+			n := 0
+			for c := range ch {
+				peer.AddRemoteCandidate(c)
+				n++
+			}
+			peer.EndOfRemoteCandidates()
+			trickled <- n
+		}()
+	}
+	connect(t, agents[0], agents[1])
+	for range agents {
+		if n := <-trickled; n != 2 {
+			t.Errorf("Trickle error: %d candidates trickled", n)
+		}
+	}
+}
+
+func TestAgentRestart(t *testing.T) {
+	a, b := newTestAgents(t, Config{})
+	ac, bc := connect(t, a, b)
+	ufrag, _ := a.LocalCredentials()
+	for _, agent := range []*Agent{a, b} {
+		if _, _, err := agent.Restart(); err != nil {
+			t.Fatalf("Restart error: %v", err)
+		}
+		if _, _, ok := agent.Selected(); !ok {
+			t.Errorf("Restart error: selected pair not kept")
+		}
+	}
+	if u, _ := a.LocalCredentials(); u == ufrag {
+		t.Errorf("Restart error: ufrag %q kept", u)
+	}
+	buf := make([]byte, 64)
+	ping := func() {
+		for _, c := range [][2]*Conn{{ac, bc}, {bc, ac}} {
+			if _, err := c[0].Write([]byte("ping")); err != nil {
+				t.Fatalf("Write error: %v", err)
+			}
+			c[1].SetReadDeadline(time.Now().Add(time.Second))
+			n, err := c[1].Read(buf)
+			if err != nil || string(buf[:n]) != "ping" {
+				t.Fatalf("Read error: read %q, %v", buf[:n], err)
+			}
+		}
+	}
+	// The selected pair is kept while the checks are restarted.
+	ping()
+	for i, agent := range []*Agent{a, b} {
+		peer := [2]*Agent{b, a}[i]
+		agent.SetRemoteCredentials(peer.LocalCredentials())
+		for _, c := range peer.LocalCandidates() {
+			if err := agent.AddRemoteCandidate(c); err != nil {
+				t.Fatalf("AddRemoteCandidate error: %v", err)
+			}
+		}
+	}
+	connect(t, a, b)
+	a.mu.Lock()
+	if p := a.selected[1]; p == nil || p.gen != a.gen {
+		t.Errorf("Restart error: pair of the restart not selected")
+	}
+	a.mu.Unlock()
+	ping()
+
+	// The selected pair is kept if the checks of a restart fail.
+	a.Restart()
+	a.SetRemoteCredentials(b.ufrag, "wrong password of 22 chars")
+	for _, c := range b.LocalCandidates() {
+		a.AddRemoteCandidate(c)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := a.Connect(ctx); err != ErrChecksFailed {
+		t.Errorf("Connect error: expected ErrChecksFailed, get %v", err)
+	}
+	if _, _, ok := a.Selected(); !ok {
+		t.Errorf("Restart error: selected pair not kept")
+	}
+}
+
+func TestAgentRotateCredentials(t *testing.T) {
+	a, b := newTestAgents(t, Config{ConsentInterval: 20 * time.Millisecond, ConsentTimeout: 200 * time.Millisecond})
+	connect(t, a, b)
+	old, _ := a.LocalCredentials()
+	ufrag, pwd, err := a.RotateCredentials()
+	if err != nil || ufrag == old {
+		t.Fatalf("RotateCredentials error: %q, %v", ufrag, err)
+	}
+	// The consent checks of the peer are of the previous credentials until
+	// it is signaled the new ones.
+	time.Sleep(300 * time.Millisecond)
+	if _, state := b.State(); state != ConnectionConnected {
+		t.Errorf("RotateCredentials error: previous credentials rejected, %v", state)
+	}
+	b.SetRemoteCredentials(ufrag, pwd)
+	time.Sleep(300 * time.Millisecond)
+	if _, state := b.State(); state != ConnectionConnected {
+		t.Errorf("RotateCredentials error: new credentials rejected, %v", state)
+	}
+	a.mu.Lock()
+	prev := a.prevUfrag
+	a.mu.Unlock()
+	if prev != "" {
+		t.Errorf("RotateCredentials error: previous credentials kept")
+	}
+	for _, creds := range [][2]string{{"abc", pwd}, {"abcd", "short"}, {"abc:", pwd}, {ufrag, pwd}} {
+		if err := a.SetLocalCredentials(creds[0], creds[1]); err == nil {
+			t.Errorf("SetLocalCredentials error: expected error of %q %q", creds[0], creds[1])
+		}
+	}
+}
+
+func TestPairPriority(t *testing.T) {
+	if p := pairPriority(1, 2); p != 1<<32+4 {
+		t.Errorf("pairPriority error: %d", p)
+	}
+	if pairPriority(2, 1) != pairPriority(1, 2)+1 {
+		t.Errorf("pairPriority error: controlling candidate not preferred")
+	}
+}
+
+// testSpan is a span of testTracer, recorded once ended.
+type testSpan struct {
+	t     *testTracer
+	name  string
+	attrs map[string]interface{}
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+
+func (s *testSpan) End(err error) {
+	s.t.mu.Lock()
+	s.t.ended = append(s.t.ended, *s)
+	s.t.mu.Unlock()
+}
+
+// testTracer records the spans ended.
+type testTracer struct {
+	mu    sync.Mutex
+	ended []testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, stun.Span) {
+	return ctx, &testSpan{t: t, name: name, attrs: make(map[string]interface{})}
+}
+
+func TestAgentTracer(t *testing.T) {
+	server := newTestServer(t, false)
+	tracer := &testTracer{}
+	a, b := newTestAgents(t, Config{STUNServers: []string{server}, Tracer: tracer})
+	connect(t, a, b)
+	var gathered, checked bool
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	for _, s := range tracer.ended {
+		if s.attrs["stun.outcome"] != "responded" || s.attrs["ice.component"] != 1 {
+			continue
+		}
+		switch s.name {
+		case "STUN Binding":
+			gathered = gathered || s.attrs["stun.server"] == server
+		case "ICE check":
+			checked = checked || s.attrs["ice.remote"] != nil
+		}
+	}
+	if !gathered || !checked {
+		t.Errorf("Tracer error: gathering %v, checks %v, of %d spans", gathered, checked, len(tracer.ended))
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// CandidateType is the type of an ICE candidate (RFC 8445 section 5.1.1).
+type CandidateType int
+
+// Candidate types.
+const (
+	Host CandidateType = iota
+	ServerReflexive
+	PeerReflexive
+	Relay
+)
+
+var candidateTypeStr = map[CandidateType]string{
+	Host:            "host",
+	ServerReflexive: "srflx",
+	PeerReflexive:   "prflx",
+	Relay:           "relay",
+}
+
+func (t CandidateType) String() string {
+	if s, ok := candidateTypeStr[t]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// preference returns the type preference of the candidates of the type
+// (RFC 8445 section 5.1.2.2).
+func (t CandidateType) preference() uint32 {
+	switch t {
+	case Host:
+		return 126
+	case PeerReflexive:
+		return 110
+	case ServerReflexive:
+		return 100
+	}
+	return 0
+}
+
+// Candidate is an ICE candidate, a transport address of a peer to be
+// checked for connectivity.
+type Candidate struct {
+	Foundation string
+	Component  int
+	Protocol   string // "udp" or "tcp"
+	// TCPType is the type of a TCP candidate, TCPActive, TCPPassive or
+	// TCPSimultaneousOpen (RFC 6544 section 4.5).
+	TCPType  string
+	Priority uint32
+	Type     CandidateType
+	Addr     netip.AddrPort
+	// Name is the mDNS name hiding the address of a host candidate, if
+	// any, to be signaled in place of it. The address of a remote candidate
+	// of a name has the port only, until resolved.
+	Name string
+	// Related is the base of a server reflexive candidate, and the mapped
+	// address of a relay candidate (RFC 8839 section 5.1). It is zero for
+	// the host candidates.
+	Related netip.AddrPort
+}
+
+func (c Candidate) String() string {
+	addr := c.Addr.String()
+	if c.Name != "" {
+		addr = net.JoinHostPort(c.Name, strconv.Itoa(int(c.Addr.Port())))
+	}
+	s := c.Type.String() + " " + c.Protocol + " " + addr
+	if c.TCPType != "" {
+		s += " " + c.TCPType
+	}
+	if c.Related.IsValid() {
+		s += " from " + c.Related.String()
+	}
+	return s
+}
+
+// Marshal returns the candidate attribute of the candidate in SDP, without
+// the "a=" prefix (RFC 8839 section 5.1), of its mDNS name if any in place
+// of its address.
+func (c Candidate) Marshal() string {
+	addr := c.Addr.Addr().String()
+	if c.Name != "" {
+		addr = c.Name
+	}
+	protocol := c.Protocol
+	if protocol == "" {
+		protocol = "udp"
+	}
+	s := "candidate:" + c.Foundation + " " + strconv.Itoa(c.Component) + " " + protocol + " " +
+		strconv.FormatUint(uint64(c.Priority), 10) + " " + addr + " " + strconv.Itoa(int(c.Addr.Port())) +
+		" typ " + c.Type.String()
+	if c.Related.IsValid() {
+		s += " raddr " + c.Related.Addr().String() + " rport " + strconv.Itoa(int(c.Related.Port()))
+	}
+	if c.TCPType != "" {
+		s += " tcptype " + c.TCPType
+	}
+	return s
+}
+
+// ParseCandidate parses the candidate attribute s in SDP, with or without
+// the "a=" prefix (RFC 8839 section 5.1). The candidate of an address not of
+// an IP has the address as Name, to be resolved, and the unknown
+// extensions are ignored.
+func ParseCandidate(s string) (Candidate, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "a=")
+	if !strings.HasPrefix(s, "candidate:") {
+		return Candidate{}, errors.New("Not an ICE candidate attribute.")
+	}
+	f := strings.Fields(strings.TrimPrefix(s, "candidate:"))
+	if len(f) < 8 || f[6] != "typ" {
+		return Candidate{}, errors.New("Malformed ICE candidate attribute.")
+	}
+	c := Candidate{Foundation: f[0], Protocol: strings.ToLower(f[2])}
+	var err error
+	if c.Component, err = strconv.Atoi(f[1]); err != nil || c.Component < 1 || c.Component > 256 {
+		return Candidate{}, errors.New("Invalid ICE candidate component.")
+	}
+	priority, err := strconv.ParseUint(f[3], 10, 32)
+	if err != nil {
+		return Candidate{}, errors.New("Invalid ICE candidate priority.")
+	}
+	c.Priority = uint32(priority)
+	port, err := strconv.ParseUint(f[5], 10, 16)
+	if err != nil {
+		return Candidate{}, errors.New("Invalid ICE candidate port.")
+	}
+	if ip, err := netip.ParseAddr(f[4]); err == nil {
+		c.Addr = netip.AddrPortFrom(ip.Unmap(), uint16(port))
+	} else {
+		c.Name = f[4]
+		c.Addr = netip.AddrPortFrom(netip.Addr{}, uint16(port))
+	}
+	typeOK := false
+	for t, name := range candidateTypeStr {
+		if name == f[7] {
+			c.Type, typeOK = t, true
+		}
+	}
+	if !typeOK {
+		return Candidate{}, errors.New("Unknown ICE candidate type.")
+	}
+	// The extensions are pairs of a name and a value.
+	var raddr netip.Addr
+	var rport uint64
+	for i := 8; i+1 < len(f); i += 2 {
+		switch f[i] {
+		case "raddr":
+			if raddr, err = netip.ParseAddr(f[i+1]); err != nil {
+				return Candidate{}, errors.New("Invalid ICE candidate related address.")
+			}
+		case "rport":
+			if rport, err = strconv.ParseUint(f[i+1], 10, 16); err != nil {
+				return Candidate{}, errors.New("Invalid ICE candidate related port.")
+			}
+		case "tcptype":
+			c.TCPType = f[i+1]
+		}
+	}
+	if raddr.IsValid() {
+		c.Related = netip.AddrPortFrom(raddr.Unmap(), uint16(rport))
+	}
+	return c, nil
+}
+
+// priority returns the priority of a candidate of the type, the local
+// preference and the component (RFC 8445 section 5.1.2.1).
+func priority(t CandidateType, local uint16, component int) uint32 {
+	return t.preference()<<24 | uint32(local)<<8 | uint32(256-component)
+}
+
+// foundation returns the foundation of a candidate, which is the same for
+// the candidates of the same type, base address, server and protocol (RFC
+// 8445 section 5.1.1.3).
+func foundation(t CandidateType, base netip.Addr, server, protocol string) string {
+	h := fnv.New32a()
+	h.Write([]byte(t.String() + " " + base.String() + " " + server + " " + protocol))
+	return strconv.FormatUint(uint64(h.Sum32()), 10)
+}
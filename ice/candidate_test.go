@@ -0,0 +1,99 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPriority(t *testing.T) {
+	if p := priority(Host, 0xffff, 1); p != 126<<24|0xffff<<8|255 {
+		t.Errorf("priority error: host %d", p)
+	}
+	if priority(PeerReflexive, 0, 1) <= priority(ServerReflexive, 0xffff, 1) || priority(Relay, 0xffff, 1) >= priority(ServerReflexive, 0, 2) {
+		t.Errorf("priority error: type preferences out of order")
+	}
+	if priority(Host, 0xffff, 1) <= priority(Host, 0xffff, 2) {
+		t.Errorf("priority error: component 1 not preferred")
+	}
+}
+
+func TestFoundation(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+	f := foundation(ServerReflexive, ip, "198.51.100.1", "udp")
+	if f != foundation(ServerReflexive, ip, "198.51.100.1", "udp") {
+		t.Errorf("foundation error: not stable")
+	}
+	for _, other := range []string{
+		foundation(Host, ip, "198.51.100.1", "udp"),
+		foundation(ServerReflexive, netip.MustParseAddr("192.0.2.2"), "198.51.100.1", "udp"),
+		foundation(ServerReflexive, ip, "198.51.100.2", "udp"),
+		foundation(ServerReflexive, ip, "198.51.100.1", "tcp"),
+	} {
+		if other == f {
+			t.Errorf("foundation error: %s shared", f)
+		}
+	}
+}
+
+func TestCandidateMarshal(t *testing.T) {
+	for _, tc := range []struct {
+		c Candidate
+		s string
+	}{
+		{
+			Candidate{Foundation: "1", Component: 1, Protocol: "udp", Priority: 2130706431, Type: Host, Addr: netip.MustParseAddrPort("192.0.2.1:5000")},
+			"candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host",
+		},
+		{
+			Candidate{Foundation: "2", Component: 2, Protocol: "udp", Priority: 1694498815, Type: ServerReflexive,
+				Addr: netip.MustParseAddrPort("[2001:db8::1]:5001"), Related: netip.MustParseAddrPort("[fd00::1]:6000")},
+			"candidate:2 2 udp 1694498815 2001:db8::1 5001 typ srflx raddr fd00::1 rport 6000",
+		},
+		{
+			Candidate{Foundation: "3", Component: 1, Protocol: "udp", Priority: 2122260223, Type: Host,
+				Addr: netip.AddrPortFrom(netip.Addr{}, 5002), Name: "1f0c2b4e-8d9a-4b3c-9e2f-0a1b2c3d4e5f.local"},
+			"candidate:3 1 udp 2122260223 1f0c2b4e-8d9a-4b3c-9e2f-0a1b2c3d4e5f.local 5002 typ host",
+		},
+		{
+			Candidate{Foundation: "4", Component: 1, Protocol: "tcp", TCPType: TCPActive, Priority: 2128609535, Type: Host,
+				Addr: netip.MustParseAddrPort("192.0.2.1:9")},
+			"candidate:4 1 tcp 2128609535 192.0.2.1 9 typ host tcptype active",
+		},
+	} {
+		if s := tc.c.Marshal(); s != tc.s {
+			t.Errorf("Marshal error: %q, %q expected", s, tc.s)
+		}
+		c, err := ParseCandidate("a=" + tc.s + " generation 0")
+		if err != nil || c != tc.c {
+			t.Errorf("ParseCandidate error: %v from %q, %v", c, tc.s, err)
+		}
+	}
+	for _, s := range []string{
+		"candidate:1 1 udp 2130706431 192.0.2.1 5000",
+		"candidate:1 0 udp 2130706431 192.0.2.1 5000 typ host",
+		"candidate:1 1 udp 2130706431 192.0.2.1 70000 typ host",
+		"candidate:1 1 udp 2130706431 192.0.2.1 5000 typ other",
+		"candidate:1 1 udp 2130706431 192.0.2.1 5000 typ srflx raddr host rport 0",
+		"ice-ufrag:abcd",
+	} {
+		if _, err := ParseCandidate(s); err == nil {
+			t.Errorf("ParseCandidate error: %q accepted", s)
+		}
+	}
+}
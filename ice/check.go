@@ -0,0 +1,700 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// The default and the minimum intervals between the transactions started by
+// an agent (RFC 8445 section 14.2), the minimum RTO of the checks (RFC 8445
+// section 14.3), and the maximum number of the pairs of the check list (RFC
+// 8445 section 6.1.2.5).
+const (
+	defaultTa = 50 * time.Millisecond
+	minTa     = 5 * time.Millisecond
+	minRTO    = 500 * time.Millisecond
+	maxPairs  = 100
+)
+
+// PairState is the state of a candidate pair in the check list (RFC 8445
+// section 6.1.2.6).
+type PairState int
+
+// Candidate pair states.
+const (
+	Frozen PairState = iota
+	Waiting
+	InProgress
+	Succeeded
+	Failed
+)
+
+var pairStateStr = map[PairState]string{
+	Frozen:     "frozen",
+	Waiting:    "waiting",
+	InProgress: "in-progress",
+	Succeeded:  "succeeded",
+	Failed:     "failed",
+}
+
+func (s PairState) String() string {
+	if str, ok := pairStateStr[s]; ok {
+		return str
+	}
+	return "unknown"
+}
+
+// pair is a candidate pair of the check list of an agent, guarded by the
+// lock of the agent.
+type pair struct {
+	local        localCandidate
+	remote       Candidate
+	state        PairState
+	nominate     bool  // checked with USE-CANDIDATE, if controlling
+	useCandidate bool  // USE-CANDIDATE received, if controlled
+	gen          int   // of the checks, as of Restart
+	valid        *pair // of a peer reflexive local candidate, learned by the check
+	consented    time.Time
+	expired      bool // the consent, once selected
+	stats        pairStats
+}
+
+// validPair returns the valid pair of p, once checked successfully.
+func (p *pair) validPair() *pair {
+	if p.valid != nil {
+		return p.valid
+	}
+	return p
+}
+
+// foundation returns the foundation of the pair, which the pairs frozen
+// with it share.
+func (p *pair) foundation() string {
+	return p.local.Foundation + ":" + p.remote.Foundation
+}
+
+// priority returns the priority of the pair, for the agent controlling or
+// not.
+func (p *pair) priority(controlling bool) uint64 {
+	if controlling {
+		return pairPriority(p.local.Priority, p.remote.Priority)
+	}
+	return pairPriority(p.remote.Priority, p.local.Priority)
+}
+
+// pairPriority returns the priority of a pair of the candidate priority g
+// of the controlling agent and d of the controlled one (RFC 8445 section
+// 6.1.2.3).
+func pairPriority(g, d uint32) uint64 {
+	min, max := g, d
+	if min > max {
+		min, max = max, min
+	}
+	p := uint64(min)<<32 + 2*uint64(max)
+	if g > d {
+		p++
+	}
+	return p
+}
+
+// pair pairs the local candidate lc with the remote candidate rc, unless of
+// another family or redundant, i.e. of the same base and remote candidate
+// as a pair of a higher priority (RFC 8445 section 6.1.2.4). The server
+// reflexive candidates are checked from their bases, the relay ones through
+// their allocations, with the permissions of the remote candidates, and the
+// host ones not by GatherRelay. The active TCP candidates are paired with
+// the passive ones, and the simultaneous-open ones together (RFC 6544
+// section 6.2). It is called with a.mu held.
+func (a *Agent) pair(lc localCandidate, rc Candidate) {
+	if lc.Type != Host && lc.Type != Relay || lc.base == nil || lc.Component != rc.Component ||
+		a.cfg.Policy == GatherRelay && lc.Type != Relay ||
+		lc.Addr.Addr().Is4() != rc.Addr.Addr().Is4() || lc.Protocol != rc.Protocol ||
+		lc.Protocol == "tcp" && rc.TCPType != remoteTCPType(lc.TCPType) {
+		return
+	}
+	for _, q := range a.pairs {
+		if q.local.base == lc.base && q.remote.Addr == rc.Addr {
+			return
+		}
+	}
+	if lc.base.relay != nil {
+		go a.permit(lc.base, rc)
+	}
+	p := &pair{local: lc, remote: rc, state: Frozen, gen: a.gen}
+	a.pairs = append(a.pairs, p)
+	a.sortPairs()
+	if len(a.pairs) > maxPairs {
+		a.trimPairs()
+	}
+	a.unfreeze(p.foundation())
+}
+
+// sortPairs orders the check list by priority. It is called with a.mu
+// held.
+func (a *Agent) sortPairs() {
+	sort.SliceStable(a.pairs, func(i, j int) bool {
+		return a.pairs[i].priority(a.controlling) > a.pairs[j].priority(a.controlling)
+	})
+}
+
+// trimPairs removes the pairs of the lowest priorities left to check beyond
+// maxPairs. It is called with a.mu held.
+func (a *Agent) trimPairs() {
+	for i := len(a.pairs) - 1; i >= 0 && len(a.pairs) > maxPairs; i-- {
+		if p := a.pairs[i]; p.state == Frozen || p.state == Waiting {
+			a.pairs = append(a.pairs[:i], a.pairs[i+1:]...)
+		}
+	}
+}
+
+// unfreeze sets the states of the pairs of the foundation yet to be checked:
+// the pair of the lowest component, then of the highest priority, is
+// waiting and the others frozen until a pair of the foundation succeeded,
+// after which all are waiting (RFC 8445 section 6.1.2.6 and RFC 8838
+// section 11). It is called with a.mu held.
+func (a *Agent) unfreeze(foundation string) {
+	var succeeded, checked bool
+	for _, p := range a.pairs {
+		if p.foundation() == foundation {
+			succeeded = succeeded || p.state == Succeeded
+			checked = checked || p.state == InProgress || p.state == Failed
+		}
+	}
+	if checked && !succeeded {
+		return
+	}
+	var first *pair
+	for _, p := range a.pairs {
+		if p.foundation() != foundation || p.state != Frozen && p.state != Waiting {
+			continue
+		}
+		// The check list is ordered by priority.
+		if first == nil || p.local.Component < first.local.Component {
+			first = p
+		}
+	}
+	for _, p := range a.pairs {
+		if p.foundation() != foundation || p.state != Frozen && p.state != Waiting {
+			continue
+		}
+		if succeeded || p == first {
+			p.state = Waiting
+		} else {
+			p.state = Frozen
+		}
+	}
+}
+
+// rto returns the RTO of a check, longer once more checks are to be sent
+// (RFC 8445 section 14.3). It is called with a.mu held.
+func (a *Agent) rto() time.Duration {
+	n := 0
+	for _, p := range a.pairs {
+		if p.state == Waiting || p.state == InProgress {
+			n++
+		}
+	}
+	if rto := time.Duration(n) * a.cfg.Ta; rto > minRTO {
+		return rto
+	}
+	return minRTO
+}
+
+// run starts the checks of the generation gen, one every Ta at most, until
+// a pair of each component is selected, all the pairs of a component
+// failed, or the agent is closed or restarted.
+func (a *Agent) run(gen int) {
+	for {
+		select {
+		case <-a.done:
+			return
+		default:
+		}
+		a.mu.Lock()
+		if a.gen != gen || a.selectedAll() {
+			a.mu.Unlock()
+			return
+		}
+		if a.controlling && a.cfg.Nomination == RegularNomination {
+			if !a.nominateNext(gen) {
+				a.mu.Unlock()
+				return
+			}
+		}
+		p := a.next()
+		if p == nil && a.exhausted() {
+			// The pairs selected before the restart, if any, are kept.
+			if len(a.selected) < a.cfg.Components {
+				a.setConnection(ConnectionFailed)
+			}
+			a.mu.Unlock()
+			close(a.failed)
+			return
+		}
+		var nominate bool
+		var rto time.Duration
+		if p != nil {
+			p.state = InProgress
+			nominate = p.nominate || a.controlling && a.cfg.Nomination == AggressiveNomination
+			rto = a.rto()
+		}
+		a.mu.Unlock()
+		if p == nil {
+			select {
+			case <-a.done:
+				return
+			case <-time.After(a.cfg.Ta):
+			}
+			continue
+		}
+		a.pace()
+		go a.check(p, nominate, rto)
+	}
+}
+
+// next returns the pair to check next: the first triggered one, or else the
+// waiting or frozen one of the highest priority. It is called with a.mu
+// held.
+func (a *Agent) next() *pair {
+	if len(a.triggered) > 0 {
+		p := a.triggered[0]
+		a.triggered = a.triggered[1:]
+		return p
+	}
+	// The check list is ordered by priority.
+	for _, state := range []PairState{Waiting, Frozen} {
+		for _, p := range a.pairs {
+			if p.state == state {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// unchecked reports whether a pair of the component of a priority higher
+// than min is left to check. It is called with a.mu held.
+func (a *Agent) unchecked(component int, min uint64) bool {
+	for _, p := range a.pairs {
+		if p.local.Component == component && p.priority(a.controlling) > min &&
+			(p.state == Frozen || p.state == Waiting || p.state == InProgress) {
+			return true
+		}
+	}
+	return false
+}
+
+// exhausted reports whether all the pairs of a component not selected yet
+// failed, at the end of the candidates. It is called with a.mu held.
+func (a *Agent) exhausted() bool {
+	if !a.gatherDone || a.cfg.Trickle && !a.remoteDone || a.resolving > 0 || len(a.triggered) > 0 {
+		return false
+	}
+	for c := 1; c <= a.cfg.Components; c++ {
+		if p := a.selected[c]; p != nil && p.gen == a.gen {
+			continue
+		}
+		failed := true
+		for _, p := range a.pairs {
+			if p.local.Component == c && p.state != Failed {
+				failed = false
+				break
+			}
+		}
+		if failed {
+			return true
+		}
+	}
+	return false
+}
+
+// check sends the connectivity check of the pair p, with USE-CANDIDATE if
+// nominate, from the timeout rto, and updates the pair on its response: it
+// succeeds on an authenticated success response from the remote candidate
+// (RFC 8445 section 7.2.5).
+func (a *Agent) check(p *pair, nominate bool, rto time.Duration) {
+	req, err := a.newCheck(p, nominate)
+	if err != nil {
+		a.fail(p)
+		return
+	}
+	a.mu.Lock()
+	key := stun.ShortTermKey(a.remotePwd)
+	a.mu.Unlock()
+	resp, from, err := a.transact(p.local.base, req, key, p.remote.Addr, rto, &p.stats)
+	if err != nil {
+		a.logger.Debugln("ICE check of", p.local.Addr, "to", p.remote.Addr, ":", err)
+		if err != ErrAgentClosed {
+			a.fail(p)
+		}
+		return
+	}
+	if resp.Type() == stun.TypeBindingErrorResponse && resp.ErrorCode() == 487 &&
+		from == p.remote.Addr && resp.CheckIntegrity(key) {
+		a.repair(p, req)
+		return
+	}
+	if resp.Type() != stun.TypeBindingResponse || from != p.remote.Addr || !resp.CheckIntegrity(key) {
+		a.logger.Debugln("ICE check of", p.local.Addr, "to", p.remote.Addr, "failed:", resp.ErrorCode())
+		a.fail(p)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if p.gen != a.gen {
+		// The check is left from before a restart.
+		return
+	}
+	p.state = Succeeded
+	a.unfreeze(p.foundation())
+	v := a.learn(p, resp)
+	if nominate || !a.controlling && p.useCandidate {
+		a.selectPair(v)
+	}
+}
+
+// learn returns the valid pair of the pair p, checked successfully with the
+// response resp: p itself, unless the mapped address of the response is of
+// no local candidate, which is then added as a peer reflexive one of the
+// base of p, paired with the remote candidate of p (RFC 8445 section
+// 7.2.5.3.1). It is called with a.mu held.
+func (a *Agent) learn(p *pair, resp *stun.Message) *pair {
+	if p.valid != nil {
+		return p.valid
+	}
+	mapped := resp.XorAddress(stun.AttributeXorMappedAddress)
+	if mapped == nil || p.local.base.tcpType != "" {
+		// The mapped address of an active TCP candidate is of another
+		// port than the candidate (RFC 6544 section 7.2).
+		return p
+	}
+	addr := unmap(mapped.AddrPort())
+	for _, lc := range a.local {
+		if lc.Addr == addr && lc.Protocol == p.local.Protocol {
+			return p
+		}
+	}
+	b := p.local.base
+	lc := localCandidate{
+		Candidate: Candidate{
+			Foundation: foundation(PeerReflexive, b.addr.Addr(), "", b.protocol()),
+			Component:  b.component,
+			Protocol:   b.protocol(),
+			Type:       PeerReflexive,
+			Priority:   priority(PeerReflexive, b.local, b.component),
+			Addr:       addr,
+			Related:    b.addr,
+		},
+		base: b,
+		// The peer learns the candidate from the checks, so that it is
+		// never signaled (RFC 8445 section 7.2.5.3.1).
+		hidden: true,
+	}
+	a.local = append(a.local, lc)
+	p.valid = &pair{local: lc, remote: p.remote, state: Succeeded, gen: p.gen}
+	a.pairs = append(a.pairs, p.valid)
+	a.sortPairs()
+	a.logger.Debugln("ICE peer reflexive candidate learned:", addr, "of", b.addr)
+	return p.valid
+}
+
+// newCheck returns the connectivity check of the pair p, with USE-CANDIDATE
+// if nominate (RFC 8445 section 7.1.1).
+func (a *Agent) newCheck(p *pair, nominate bool) (*stun.Message, error) {
+	req, err := stun.NewMessage(stun.TypeBindingRequest)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	username := a.remoteUfrag + ":" + a.ufrag
+	controlling := a.controlling
+	a.mu.Unlock()
+	req.AddAttribute(stun.AttributeUsername, []byte(username))
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, priority(PeerReflexive, p.local.base.local, p.local.Component))
+	req.AddAttribute(stun.AttributePriority, b[:4])
+	binary.BigEndian.PutUint64(b, a.tieBreaker)
+	if controlling {
+		req.AddAttribute(stun.AttributeICEControlling, b)
+	} else {
+		req.AddAttribute(stun.AttributeICEControlled, b)
+	}
+	if nominate {
+		req.AddAttribute(stun.AttributeUseCandidate, nil)
+	}
+	return req, nil
+}
+
+// repair switches the role of the agent from the one of the check req of
+// the pair p, answered with a 487 (Role Conflict), and checks the pair again
+// (RFC 8445 section 7.2.5.1).
+func (a *Agent) repair(p *pair, req *stun.Message) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if p.gen != a.gen {
+		return
+	}
+	_, controlling := req.Attribute(stun.AttributeICEControlling)
+	if a.controlling == controlling {
+		a.switchRole(!controlling)
+	}
+	p.state = Waiting
+	a.triggered = append(a.triggered, p)
+}
+
+// conflict resolves the role conflict of the check m, if any, from the
+// tie-breakers: it reports whether the check is to be answered with a 487
+// (Role Conflict), or else switches the role of the agent if needed (RFC
+// 8445 section 7.3.1.1). An ICE-lite agent is always controlled.
+func (a *Agent) conflict(m *stun.Message) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	attr := uint16(stun.AttributeICEControlled)
+	if a.controlling {
+		attr = stun.AttributeICEControlling
+	}
+	v, ok := m.Attribute(attr)
+	if !ok || len(v) != 8 {
+		return false
+	}
+	wins := !a.cfg.Lite && a.tieBreaker >= binary.BigEndian.Uint64(v)
+	if a.controlling == wins {
+		return true
+	}
+	a.switchRole(!a.controlling)
+	return false
+}
+
+// switchRole makes the agent controlling or not, and orders the check list
+// by the priorities of the role. It is called with a.mu held.
+func (a *Agent) switchRole(controlling bool) {
+	a.logger.Debugln("ICE role switched, controlling:", controlling)
+	a.controlling = controlling
+	a.nominating = make(map[int]*pair)
+	for _, p := range a.pairs {
+		p.nominate = false
+	}
+	a.sortPairs()
+}
+
+// fail marks the pair p failed, which the controlling agent nominates
+// another pair than.
+func (a *Agent) fail(p *pair) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p.state = Failed
+	if a.nominating[p.local.Component] == p {
+		delete(a.nominating, p.local.Component)
+	}
+}
+
+// selectPair selects the pair p of its component, once nominated, in place
+// of the one selected before a restart, or of a lower priority, of several
+// nominated (RFC 8445 section 8.1.1). It is called with a.mu held.
+func (a *Agent) selectPair(p *pair) {
+	component := p.local.Component
+	cur := a.selected[component]
+	if cur != nil && cur.gen == p.gen && (cur == p || p.priority(a.controlling) <= cur.priority(a.controlling)) {
+		return
+	}
+	a.selected[component] = p
+	p.consented = time.Now()
+	if !a.cfg.Lite {
+		go a.consent(p)
+	}
+	a.logger.Debugln("ICE pair selected of component", component, ":", p.local.Addr, "to", p.remote.Addr)
+	a.notify(StateEvent{Component: component, Selected: CandidatePair{Local: p.local.Candidate, Remote: p.remote}})
+	if !a.selectedAll() {
+		return
+	}
+	expired := false
+	for _, q := range a.selected {
+		expired = expired || q.expired
+	}
+	if !expired {
+		a.setConnection(ConnectionConnected)
+	}
+	if cur == nil || cur.gen != p.gen {
+		close(a.connected)
+	}
+}
+
+// selectedAll reports whether a pair of the checks since the last restart
+// is selected of each component. It is called with a.mu held.
+func (a *Agent) selectedAll() bool {
+	for c := 1; c <= a.cfg.Components; c++ {
+		if p := a.selected[c]; p == nil || p.gen != a.gen {
+			return false
+		}
+	}
+	return true
+}
+
+// handleCheck answers the connectivity check m received on the base b from
+// the address, once authenticated, and checks the pair back, or selects it
+// once nominated (RFC 8445 section 7.3).
+func (a *Agent) handleCheck(b *base, m *stun.Message, from netip.AddrPort) {
+	username, ok := m.Attribute(stun.AttributeUsername)
+	if !ok {
+		a.reject(b, m, from, 400, nil)
+		return
+	}
+	key := a.authenticate(m, string(username))
+	switch {
+	case key == nil:
+		a.reject(b, m, from, 401, nil)
+		return
+	case a.conflict(m):
+		a.reject(b, m, from, 487, key)
+		return
+	}
+	resp := m.NewResponse(stun.TypeBindingResponse)
+	resp.AddXorAddress(stun.AttributeXorMappedAddress, stun.NewHost(from))
+	if _, err := b.conn.WriteTo(resp.Encode(key), net.UDPAddrFromAddrPort(from)); err != nil {
+		return
+	}
+	_, useCandidate := m.Attribute(stun.AttributeUseCandidate)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var p *pair
+	for _, q := range a.pairs {
+		// The pairs of the peer reflexive local candidates are valid ones
+		// of pairs checked with their bases.
+		if q.local.base == b && q.remote.Addr == from && q.local.Type != PeerReflexive {
+			p = q
+			break
+		}
+	}
+	if a.cfg.Lite {
+		// An ICE-lite agent takes the pairs the peer checks as valid, and
+		// selects the one nominated (RFC 8445 section 7.3.1.5).
+		if p == nil {
+			p = a.peerReflexive(b, m, from)
+			p.state = Succeeded
+		}
+		p.stats.requestsReceived.Add(1)
+		p.stats.responsesSent.Add(1)
+		if useCandidate {
+			a.selectPair(p)
+		}
+		return
+	}
+	if p == nil {
+		// The check of an address of no remote candidate is of a peer
+		// reflexive one, e.g. behind a NAT, or of an active TCP candidate
+		// of the peer checking from another port (RFC 6544 section 7.2).
+		p = a.peerReflexive(b, m, from)
+	}
+	p.stats.requestsReceived.Add(1)
+	p.stats.responsesSent.Add(1)
+	if useCandidate && !a.controlling {
+		p.useCandidate = true
+		if p.state == Succeeded {
+			a.selectPair(p.validPair())
+			return
+		}
+	}
+	// The pair is checked back right away (RFC 8445 section 7.3.1.4).
+	switch p.state {
+	case Frozen, Waiting, Failed:
+		p.state = Waiting
+		for _, q := range a.triggered {
+			if q == p {
+				return
+			}
+		}
+		a.triggered = append(a.triggered, p)
+	}
+}
+
+// peerReflexive adds the peer reflexive candidate from which the check m is
+// received on the base b, of the priority of the check, unless the address
+// is of a remote candidate already, and returns its pair with the host or
+// relay candidate of b (RFC 8445 section 7.3.1.3). It is called with a.mu
+// held.
+func (a *Agent) peerReflexive(b *base, m *stun.Message, from netip.AddrPort) *pair {
+	var lc localCandidate
+	for _, c := range a.local {
+		if c.base == b && (c.Type == Host || c.Type == Relay) {
+			lc = c
+		}
+	}
+	for _, rc := range a.remote {
+		if rc.Addr == from && rc.Component == b.component && rc.Protocol == b.protocol() {
+			// The pair of the remote candidate was trimmed or is of another
+			// local candidate.
+			p := &pair{local: lc, remote: rc, state: Waiting, gen: a.gen}
+			a.pairs = append(a.pairs, p)
+			a.sortPairs()
+			return p
+		}
+	}
+	rc := Candidate{
+		Foundation: foundation(PeerReflexive, from.Addr(), "", b.protocol()),
+		Component:  b.component,
+		Protocol:   b.protocol(),
+		TCPType:    remoteTCPType(b.tcpType),
+		Type:       PeerReflexive,
+		Addr:       from,
+	}
+	if v, ok := m.Attribute(stun.AttributePriority); ok && len(v) == 4 {
+		rc.Priority = binary.BigEndian.Uint32(v)
+	}
+	a.remote = append(a.remote, rc)
+	p := &pair{local: lc, remote: rc, state: Waiting, gen: a.gen}
+	a.pairs = append(a.pairs, p)
+	a.sortPairs()
+	return p
+}
+
+// authenticate returns the key of the local credentials of the check m of
+// the username, current or previous, with which the integrity of m checks,
+// or nil. The previous credentials are dropped once the peer uses the
+// current ones.
+func (a *Agent) authenticate(m *stun.Message, username string) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := stun.ShortTermKey(a.pwd)
+	if strings.HasPrefix(username, a.ufrag+":") && m.CheckIntegrity(key) {
+		a.prevUfrag, a.prevPwd = "", ""
+		return key
+	}
+	if a.prevUfrag == "" {
+		return nil
+	}
+	key = stun.ShortTermKey(a.prevPwd)
+	if strings.HasPrefix(username, a.prevUfrag+":") && m.CheckIntegrity(key) {
+		return key
+	}
+	return nil
+}
+
+// reject answers the request m with an error response of the code, signed
+// with the key if not nil.
+func (a *Agent) reject(b *base, m *stun.Message, from netip.AddrPort, code int, key []byte) {
+	resp := m.NewResponse(stun.TypeBindingErrorResponse)
+	resp.AddErrorCode(code, "")
+	b.conn.WriteTo(resp.Encode(key), net.UDPAddrFromAddrPort(from))
+}
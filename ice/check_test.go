@@ -0,0 +1,179 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheckList(t *testing.T) {
+	a, err := NewAgent(Config{Controlling: true})
+	if err != nil {
+		t.Fatalf("NewAgent error: %v", err)
+	}
+	local := func(ip string, pref uint16) localCandidate {
+		addr := netip.MustParseAddrPort(ip)
+		return localCandidate{
+			Candidate: Candidate{
+				Foundation: foundation(Host, addr.Addr(), "", "udp"),
+				Component:  1,
+				Type:       Host,
+				Priority:   priority(Host, pref, 1),
+				Addr:       addr,
+			},
+			base: &base{addr: addr, local: pref},
+		}
+	}
+	remote := func(ip string, t CandidateType, pref uint16) Candidate {
+		addr := netip.MustParseAddrPort(ip)
+		return Candidate{
+			Foundation: foundation(t, addr.Addr(), "", "udp"),
+			Component:  1,
+			Type:       t,
+			Priority:   priority(t, pref, 1),
+			Addr:       addr,
+		}
+	}
+	l1, l2 := local("192.0.2.1:1000", 0xffff), local("192.0.2.1:2000", 0xfffe)
+	r1, r2 := remote("198.51.100.1:1000", Host, 0xffff), remote("203.0.113.1:1000", ServerReflexive, 0xffff)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// The pairs of a foundation are frozen but that of the highest
+	// priority, even if paired later.
+	a.pair(l2, r1)
+	a.pair(l1, r2)
+	a.pair(l1, r1)
+	a.pair(l1, r1)
+	want := []struct {
+		local, remote string
+		state         PairState
+	}{
+		{"192.0.2.1:1000", "198.51.100.1:1000", Waiting},
+		{"192.0.2.1:2000", "198.51.100.1:1000", Frozen},
+		{"192.0.2.1:1000", "203.0.113.1:1000", Waiting},
+	}
+	if len(a.pairs) != len(want) {
+		t.Fatalf("pair error: %d pairs", len(a.pairs))
+	}
+	for i, w := range want {
+		if p := a.pairs[i]; p.local.Addr.String() != w.local || p.remote.Addr.String() != w.remote || p.state != w.state {
+			t.Errorf("pair error: pair %d %v to %v %v", i, p.local.Addr, p.remote.Addr, p.state)
+		}
+	}
+	if p := a.next(); p != a.pairs[0] {
+		t.Errorf("next error: %v to %v", p.local.Addr, p.remote.Addr)
+	}
+	a.pairs[0].state = Succeeded
+	a.unfreeze(a.pairs[0].foundation())
+	if a.pairs[1].state != Waiting {
+		t.Errorf("unfreeze error: %v", a.pairs[1].state)
+	}
+
+	for i := 0; i < maxPairs; i++ {
+		a.pair(l1, remote("198.51.100.2:"+strconv.Itoa(1000+i), Relay, uint16(i)))
+	}
+	if len(a.pairs) != maxPairs || a.pairs[len(a.pairs)-1].remote.Priority != priority(Relay, 3, 1) {
+		t.Errorf("trimPairs error: %d pairs", len(a.pairs))
+	}
+	if rto := a.rto(); rto != minRTO {
+		t.Errorf("rto error: %v with the relay pairs frozen", rto)
+	}
+	for _, p := range a.pairs[1:] {
+		p.state = Waiting
+	}
+	if rto := a.rto(); rto != time.Duration(maxPairs-1)*defaultTa {
+		t.Errorf("rto error: %v", rto)
+	}
+}
+
+func TestAgentPace(t *testing.T) {
+	a, err := NewAgent(Config{Ta: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewAgent error: %v", err)
+	}
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		a.pace()
+	}
+	if d := time.Since(start); d < 60*time.Millisecond {
+		t.Errorf("pace error: 4 transactions in %v", d)
+	}
+	if _, err := NewAgent(Config{Ta: time.Millisecond}); err == nil {
+		t.Errorf("NewAgent error: expected error of Ta below 5ms")
+	}
+}
+
+func TestAgentRoleConflict(t *testing.T) {
+	for _, controlling := range []bool{true, false} {
+		a, b := newTestAgents(t, Config{})
+		// Both agents take the same role, which the one of the higher
+		// tie-breaker is left controlling of.
+		a.mu.Lock()
+		a.controlling = controlling
+		a.mu.Unlock()
+		b.mu.Lock()
+		b.controlling = controlling
+		b.mu.Unlock()
+		connect(t, a, b)
+		a.mu.Lock()
+		b.mu.Lock()
+		if a.controlling == b.controlling || a.controlling != (a.tieBreaker > b.tieBreaker) {
+			t.Errorf("Role conflict error: controlling %v, tie-breakers %d and %d", a.controlling, a.tieBreaker, b.tieBreaker)
+		}
+		b.mu.Unlock()
+		a.mu.Unlock()
+	}
+}
+
+func TestAgentPeerReflexive(t *testing.T) {
+	// The controlled agent learns the controlling one from its checks only,
+	// which come through a NAT from another address.
+	var agents [2]*Agent
+	for i := range agents {
+		a, err := NewAgent(Config{Addrs: []netip.Addr{loopback}, Controlling: i == 0, Trickle: i == 1})
+		if err != nil {
+			t.Fatalf("NewAgent error: %v", err)
+		}
+		t.Cleanup(func() { a.Close() })
+		if _, err := a.Gather(); err != nil {
+			t.Fatalf("Gather error: %v", err)
+		}
+		agents[i] = a
+	}
+	a, b := agents[0], agents[1]
+	a.SetRemoteCredentials(b.LocalCredentials())
+	b.SetRemoteCredentials(a.LocalCredentials())
+	c := b.LocalCandidates()[0]
+	inside, outside := newTestNAT(t, c.Addr.String())
+	c.Addr = netip.MustParseAddrPort(inside)
+	if err := a.AddRemoteCandidate(c); err != nil {
+		t.Fatalf("AddRemoteCandidate error: %v", err)
+	}
+	connect(t, a, b)
+	if local, _, _ := a.Selected(); local.Type != PeerReflexive || local.Addr.String() != outside {
+		t.Errorf("Selected error: local %v, expected peer reflexive %v", local, outside)
+	}
+	if _, remote, _ := b.Selected(); remote.Type != PeerReflexive || remote.Addr.String() != outside {
+		t.Errorf("Selected error: remote %v, expected peer reflexive %v", remote, outside)
+	}
+	if n := len(a.LocalCandidates()); n != 1 {
+		t.Errorf("LocalCandidates error: %d candidates, peer reflexive signaled", n)
+	}
+}
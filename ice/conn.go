@@ -0,0 +1,149 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Conn is the connection of an agent over its selected pair, which is a
+// net.Conn. The data from the other remote candidates is read as well.
+type Conn struct {
+	a         *Agent
+	component int
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	wake          chan struct{} // closed when the read deadline is changed
+}
+
+// Read reads a packet of data from the peer into b.
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		deadline, wake := c.readDeadline, c.wake
+		c.mu.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			expired = timer.C
+		}
+		select {
+		case p := <-c.a.data[c.component-1]:
+			if timer != nil {
+				timer.Stop()
+			}
+			c.a.mu.Lock()
+			selected := c.a.selected[c.component]
+			c.a.mu.Unlock()
+			if selected != nil && selected.remote.Addr == p.from {
+				selected.stats.packetsReceived.Add(1)
+				selected.stats.bytesReceived.Add(uint64(len(p.buf)))
+			}
+			return copy(b, p.buf), nil
+		case <-c.a.done:
+			return 0, ErrAgentClosed
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		case <-wake:
+			// The deadline is changed.
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// Write sends b to the peer over the selected pair, unless the consent of
+// the peer expired.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.a.mu.Lock()
+	p, closed := c.a.selected[c.component], c.a.closed
+	expired := p != nil && p.expired
+	c.a.mu.Unlock()
+	switch {
+	case closed:
+		return 0, ErrAgentClosed
+	case expired:
+		return 0, ErrConsentExpired
+	}
+	n, err := p.local.base.conn.WriteTo(b, net.UDPAddrFromAddrPort(p.remote.Addr))
+	if err == nil {
+		p.stats.packetsSent.Add(1)
+		p.stats.bytesSent.Add(uint64(n))
+	}
+	return n, err
+}
+
+// Close closes the agent.
+func (c *Conn) Close() error {
+	return c.a.Close()
+}
+
+// LocalAddr returns the address of the local candidate of the selected
+// pair.
+func (c *Conn) LocalAddr() net.Addr {
+	local, _, _ := c.a.SelectedComponent(c.component)
+	return netAddr(local.Protocol, local.Addr)
+}
+
+// RemoteAddr returns the address of the remote candidate of the selected
+// pair.
+func (c *Conn) RemoteAddr() net.Addr {
+	_, remote, _ := c.a.SelectedComponent(c.component)
+	return netAddr(remote.Protocol, remote.Addr)
+}
+
+// SetDeadline sets the read and write deadlines of the connection.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of Read, including the calls blocked
+// already. A zero t means no deadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of Write. A zero t means no deadline.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
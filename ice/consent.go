@@ -0,0 +1,114 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// Consent freshness (RFC 7675 section 5.1).
+const (
+	defaultConsentInterval = 5 * time.Second
+	defaultConsentTimeout  = 30 * time.Second
+)
+
+// consentEventBuffer is the capacity of the channels of SubscribeConsent.
+const consentEventBuffer = 4
+
+// ConsentEvent reports the consent of the peer to receive over the selected
+// pair expired, after which the connection does not send anymore.
+type ConsentEvent struct {
+	Local  Candidate
+	Remote Candidate
+}
+
+// SubscribeConsent returns a channel receiving the ConsentEvents of the
+// agent, closed by Close. Events are dropped if the subscriber does not keep
+// up.
+func (a *Agent) SubscribeConsent() <-chan ConsentEvent {
+	ch := make(chan ConsentEvent, consentEventBuffer)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		close(ch)
+	} else {
+		a.consentSubs = append(a.consentSubs, ch)
+	}
+	return ch
+}
+
+// consent checks the consent of the peer over the selected pair p, about
+// every ConsentInterval, until the pair is replaced or the consent expires,
+// without a response for ConsentTimeout.
+func (a *Agent) consent(p *pair) {
+	for {
+		// The interval is randomized by 20% either way.
+		d := a.cfg.ConsentInterval*4/5 + time.Duration(rand.Int63n(int64(a.cfg.ConsentInterval*2/5)+1))
+		select {
+		case <-a.done:
+			return
+		case <-time.After(d):
+		}
+		a.mu.Lock()
+		if a.selected[p.local.Component] != p {
+			a.mu.Unlock()
+			return
+		}
+		if time.Since(p.consented) > a.cfg.ConsentTimeout {
+			p.expired = true
+			ev := ConsentEvent{Local: p.local.Candidate, Remote: p.remote}
+			for _, ch := range a.consentSubs {
+				select {
+				case ch <- ev:
+				default:
+				}
+			}
+			a.setConnection(ConnectionDisconnected)
+			a.mu.Unlock()
+			a.logger.Debugln("ICE consent expired:", p.local.Addr, "to", p.remote.Addr)
+			return
+		}
+		a.mu.Unlock()
+		go a.freshen(p)
+	}
+}
+
+// freshen sends a consent check over the pair p, which refreshes the
+// consent on an authenticated success response from the remote candidate.
+func (a *Agent) freshen(p *pair) {
+	req, err := a.newCheck(p, false)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	key := stun.ShortTermKey(a.remotePwd)
+	a.mu.Unlock()
+	resp, from, err := a.transact(p.local.base, req, key, p.remote.Addr, minRTO, &p.stats)
+	if err != nil {
+		a.logger.Debugln("ICE consent check of", p.local.Addr, "to", p.remote.Addr, ":", err)
+		return
+	}
+	if resp.Type() != stun.TypeBindingResponse || from != p.remote.Addr || !resp.CheckIntegrity(key) {
+		return
+	}
+	a.mu.Lock()
+	p.consented = time.Now()
+	a.mu.Unlock()
+}
@@ -0,0 +1,57 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAgentConsent(t *testing.T) {
+	a, b := newTestAgents(t, Config{ConsentInterval: 20 * time.Millisecond, ConsentTimeout: 200 * time.Millisecond})
+	ac, _ := connect(t, a, b)
+	events := a.SubscribeConsent()
+	select {
+	case ev := <-events:
+		t.Fatalf("Consent error: expired, %v", ev)
+	case <-time.After(400 * time.Millisecond):
+	}
+	if _, err := ac.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	// The consent expires once the peer is gone.
+	b.Close()
+	select {
+	case ev := <-events:
+		local, remote, _ := a.Selected()
+		if ev.Local != local || ev.Remote != remote {
+			t.Errorf("Consent error: %v to %v expired, selected %v to %v", ev.Local, ev.Remote, local, remote)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Consent error: not expired")
+	}
+	if _, err := ac.Write([]byte("ping")); err != ErrConsentExpired {
+		t.Errorf("Write error: expected ErrConsentExpired, get %v", err)
+	}
+	if _, state := a.State(); state != ConnectionDisconnected {
+		t.Errorf("State error: %v, expected disconnected", state)
+	}
+	a.Close()
+	if _, ok := <-events; ok {
+		t.Errorf("SubscribeConsent error: channel not closed")
+	}
+}
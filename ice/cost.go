@@ -0,0 +1,71 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// InterfaceCost is the cost of the network of an interface, e.g. metered:
+// the candidates of the interfaces of lower costs are of higher priorities,
+// so that their pairs are selected first.
+type InterfaceCost int
+
+// Interface costs, by the type of the network.
+const (
+	CostEthernet InterfaceCost = 10
+	CostWiFi     InterfaceCost = 20
+	CostCellular InterfaceCost = 40
+	CostVPN      InterfaceCost = 80
+)
+
+// interfaceNames returns the names of the interfaces by their addresses. It
+// is replaced by the tests.
+var interfaceNames = func() (map[netip.Addr]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[netip.Addr]string)
+	for _, iface := range ifaces {
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, ifaddr := range ifaddrs {
+			if prefix, err := netip.ParsePrefix(ifaddr.String()); err == nil {
+				names[prefix.Addr().Unmap()] = iface.Name
+			}
+		}
+	}
+	return names, nil
+}
+
+// sortByCost orders the addresses by the costs of their interfaces, of the
+// names of costs, or else of cost 0, and in their order otherwise.
+func sortByCost(addrs []netip.Addr, costs map[string]InterfaceCost) error {
+	names, err := interfaceNames()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return costs[names[addrs[i]]] < costs[names[addrs[j]]]
+	})
+	return nil
+}
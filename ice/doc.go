@@ -0,0 +1,38 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+// Package ice is an ICE (RFC 8445) agent on top of the STUN and TURN clients
+// of package stun, which establishes a path between two peers behind NATs.
+//
+// The agent gathers the candidates of the peer to be exchanged over the
+// signaling of the application with its credentials, and checks them
+// against those of the other peer to connect.
+//
+//	agent, err := ice.NewAgent(ice.Config{STUNServers: []string{"stun.example.org:3478"}})
+//	candidates, err := agent.Gather()
+//	ufrag, pwd := agent.LocalCredentials()
+//	// Signal the candidates, e.g. in SDP with Marshal, and the credentials,
+//	// and add those of the peer.
+//	agent.SetRemoteCredentials(remoteUfrag, remotePwd)
+//	remote, err := ice.ParseCandidate(line)
+//	agent.AddRemoteCandidate(remote)
+//	conn, err := agent.Connect(ctx)
+//
+// Dial runs all of it over a Signaler of the application instead, which
+// exchanges the candidates and the credentials as opaque blobs.
+//
+//	conn, err := ice.Dial(ctx, signaler, ice.Config{STUNServers: servers})
+package ice
@@ -0,0 +1,434 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// MDNSMode is the use of the mDNS names of the host candidates of an agent
+// (draft-ietf-mmusic-mdns-ice-candidates), which hide their addresses.
+type MDNSMode int
+
+// mDNS modes.
+const (
+	// MDNSQuery resolves the names of the remote candidates, e.g. of the
+	// browsers.
+	MDNSQuery MDNSMode = iota
+	// MDNSGather also names the local host candidates, and answers the
+	// queries of the peer.
+	MDNSGather
+	// MDNSDisabled rejects the remote candidates of names.
+	MDNSDisabled
+)
+
+// The names are queried every mdnsInterval, until resolved or mdnsTimeout,
+// and answered with the TTL mdnsTTL (RFC 6762 section 10).
+const (
+	mdnsInterval = time.Second
+	mdnsTimeout  = 5 * time.Second
+	mdnsTTL      = 120
+)
+
+// DNS record types and class (RFC 1035 section 3.2).
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeANY  = 255
+	dnsClassIN  = 1
+	// dnsCacheFlush is the cache-flush bit of the class of the unique
+	// records, and the unicast-response bit of the questions (RFC 6762
+	// sections 10.2 and 5.4).
+	dnsCacheFlush = 0x8000
+	dnsResponse   = 0x8400 // QR and AA
+)
+
+// mdnsSocket is a socket joined to an mDNS group, of the address group.
+type mdnsSocket struct {
+	conn  net.PacketConn
+	group net.Addr
+}
+
+// listenMDNS listens to the mDNS groups of IPv4 and IPv6 (RFC 6762 section
+// 3), of which one at least.
+var listenMDNS = func() ([]mdnsSocket, error) {
+	var socks []mdnsSocket
+	var err error
+	for _, group := range []*net.UDPAddr{
+		{IP: net.IPv4(224, 0, 0, 251), Port: 5353},
+		{IP: net.ParseIP("ff02::fb"), Port: 5353},
+	} {
+		network := "udp4"
+		if group.IP.To4() == nil {
+			network = "udp6"
+		}
+		var conn *net.UDPConn
+		if conn, err = net.ListenMulticastUDP(network, nil, group); err == nil {
+			socks = append(socks, mdnsSocket{conn, group})
+		}
+	}
+	if len(socks) == 0 {
+		return nil, err
+	}
+	return socks, nil
+}
+
+// mdns is an mDNS querier (RFC 6762 section 5) of the names of the remote
+// candidates, and responder (RFC 6762 section 6) of the names of the local
+// ones.
+type mdns struct {
+	logger *stun.Logger
+	socks  []mdnsSocket
+
+	mu      sync.Mutex
+	names   map[string]netip.Addr        // local, by name in lower case
+	queries map[string][]chan netip.Addr // by name in lower case
+}
+
+// newMDNS returns an mDNS querier and responder on the mDNS groups.
+func newMDNS(logger *stun.Logger) (*mdns, error) {
+	socks, err := listenMDNS()
+	if err != nil {
+		return nil, err
+	}
+	m := &mdns{
+		logger:  logger,
+		socks:   socks,
+		names:   make(map[string]netip.Addr),
+		queries: make(map[string][]chan netip.Addr),
+	}
+	for _, s := range socks {
+		go m.read(s)
+	}
+	return m, nil
+}
+
+// newMDNSName returns a random mDNS name, of a version 4 UUID.
+func newMDNSName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:] + ".local", nil
+}
+
+// isMDNSName reports whether the name is an mDNS one, of the ".local"
+// domain.
+func isMDNSName(name string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(name, ".")), ".local")
+}
+
+// announce answers the queries of the name with the address.
+func (m *mdns) announce(name string, addr netip.Addr) {
+	m.mu.Lock()
+	m.names[strings.ToLower(name)] = addr
+	m.mu.Unlock()
+}
+
+// resolve queries the name, until answered or mdnsTimeout, or done is
+// closed.
+func (m *mdns) resolve(name string, done <-chan struct{}) (netip.Addr, error) {
+	key := strings.ToLower(strings.TrimSuffix(name, "."))
+	ch := make(chan netip.Addr, 1)
+	m.mu.Lock()
+	m.queries[key] = append(m.queries[key], ch)
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		chs := m.queries[key]
+		for i, c := range chs {
+			if c == ch {
+				chs = append(chs[:i], chs[i+1:]...)
+				break
+			}
+		}
+		if len(chs) == 0 {
+			delete(m.queries, key)
+		} else {
+			m.queries[key] = chs
+		}
+	}()
+	query := newDNSQuery(key)
+	ticker := time.NewTicker(mdnsInterval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(mdnsTimeout)
+	defer timeout.Stop()
+	for {
+		for _, s := range m.socks {
+			if _, err := s.conn.WriteTo(query, s.group); err != nil {
+				m.logger.Debugln("Query mDNS name", name, ":", err)
+			}
+		}
+		select {
+		case addr := <-ch:
+			return addr, nil
+		case <-ticker.C:
+		case <-timeout.C:
+			return netip.Addr{}, errors.New("mDNS name not resolved.")
+		case <-done:
+			return netip.Addr{}, ErrAgentClosed
+		}
+	}
+}
+
+// read answers the queries and dispatches the responses received on the
+// socket s, until closed.
+func (m *mdns) read(s mdnsSocket) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		msg := buf[:n]
+		if len(msg) < 12 {
+			continue
+		}
+		if binary.BigEndian.Uint16(msg[2:])&0x8000 != 0 {
+			m.handleResponse(msg)
+		} else {
+			m.handleQuery(s, msg)
+		}
+	}
+}
+
+// handleQuery answers the questions of the query msg of the local names on
+// the socket s, to its group.
+func (m *mdns) handleQuery(s mdnsSocket, msg []byte) {
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return
+		}
+		types := binary.BigEndian.Uint16(msg[next:])
+		off = next + 4
+		m.mu.Lock()
+		addr, ok := m.names[name]
+		m.mu.Unlock()
+		if !ok || !(types == dnsTypeANY || types == dnsTypeA && addr.Is4() || types == dnsTypeAAAA && addr.Is6()) {
+			continue
+		}
+		if _, err := s.conn.WriteTo(newDNSAnswer(name, addr), s.group); err != nil {
+			m.logger.Debugln("Answer mDNS name", name, ":", err)
+		}
+	}
+}
+
+// handleResponse resolves the names queried of the address records of the
+// response msg.
+func (m *mdns) handleResponse(msg []byte) {
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return
+		}
+		off = next + 4
+	}
+	records := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	for i := 0; i < records; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return
+		}
+		types := binary.BigEndian.Uint16(msg[next:])
+		rdlength := int(binary.BigEndian.Uint16(msg[next+8:]))
+		off = next + 10 + rdlength
+		if off > len(msg) {
+			return
+		}
+		addr, ok := netip.AddrFromSlice(msg[next+10 : off])
+		if !ok || types == dnsTypeA && !addr.Is4() || types == dnsTypeAAAA && !addr.Is6() ||
+			types != dnsTypeA && types != dnsTypeAAAA {
+			continue
+		}
+		m.mu.Lock()
+		for _, ch := range m.queries[name] {
+			select {
+			case ch <- addr:
+			default:
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// close closes the sockets.
+func (m *mdns) close() {
+	for _, s := range m.socks {
+		s.conn.Close()
+	}
+}
+
+// newDNSQuery returns an mDNS query of the addresses of the name, of the
+// questions A and AAAA.
+func newDNSQuery(name string) []byte {
+	msg := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(msg[4:], 2)
+	for _, types := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		msg = appendDNSName(msg, name)
+		msg = binary.BigEndian.AppendUint16(msg, types)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	}
+	return msg
+}
+
+// newDNSAnswer returns an mDNS response of the address record of the name.
+func newDNSAnswer(name string, addr netip.Addr) []byte {
+	msg := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(msg[2:], dnsResponse)
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	msg = appendDNSName(msg, name)
+	types, rdata := uint16(dnsTypeAAAA), addr.AsSlice()
+	if addr.Is4() {
+		types = dnsTypeA
+	}
+	msg = binary.BigEndian.AppendUint16(msg, types)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN|dnsCacheFlush)
+	msg = binary.BigEndian.AppendUint32(msg, mdnsTTL)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	return append(msg, rdata...)
+}
+
+// appendDNSName appends the name encoded in labels to msg (RFC 1035
+// section 3.1).
+func appendDNSName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
+
+// readDNSName returns the name in lower case at the offset off of msg,
+// following the compression pointers (RFC 1035 section 4.1.4), and the
+// offset after it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("DNS name out of the message.")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), next, nil
+		case n&0xc0 == 0xc0:
+			if off+2 > len(msg) || jumps > 16 {
+				return "", 0, errors.New("Invalid DNS name pointer.")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		case off+1+n > len(msg):
+			return "", 0, errors.New("DNS label out of the message.")
+		default:
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// multicastDNS returns the mDNS querier and responder of the agent, started
+// once needed.
+func (a *Agent) multicastDNS() (*mdns, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, ErrAgentClosed
+	}
+	if a.mdns == nil {
+		m, err := newMDNS(a.logger)
+		if err != nil {
+			return nil, err
+		}
+		a.mdns = m
+	}
+	return a.mdns, nil
+}
+
+// announce returns a new mDNS name of the local address ip, answered to the
+// queries of the peer.
+func (a *Agent) announce(ip netip.Addr) (string, error) {
+	m, err := a.multicastDNS()
+	if err != nil {
+		return "", err
+	}
+	name, err := newMDNSName()
+	if err != nil {
+		return "", err
+	}
+	m.announce(name, ip)
+	return name, nil
+}
+
+// resolveCandidate adds the remote candidate c of an mDNS name once
+// resolved, in the background. The checks do not fail before.
+func (a *Agent) resolveCandidate(c Candidate) error {
+	switch {
+	case a.cfg.MDNS == MDNSDisabled:
+		return errors.New("mDNS ICE candidates disabled.")
+	case !isMDNSName(c.Name):
+		return errors.New("Invalid mDNS ICE candidate name.")
+	}
+	m, err := a.multicastDNS()
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.resolving++
+	a.mu.Unlock()
+	go func() {
+		defer func() {
+			a.mu.Lock()
+			a.resolving--
+			a.mu.Unlock()
+		}()
+		addr, err := m.resolve(c.Name, a.done)
+		if err != nil {
+			a.logger.Debugln("Resolve ICE candidate", c.Name, ":", err)
+			return
+		}
+		c.Addr = netip.AddrPortFrom(addr, c.Addr.Port())
+		if err := a.AddRemoteCandidate(c); err != nil {
+			a.logger.Debugln("Add ICE candidate", c.Name, ":", err)
+		}
+	}()
+	return nil
+}
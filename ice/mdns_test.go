@@ -0,0 +1,128 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+// newTestMDNS replaces the mDNS groups with a hub on the loopback, which
+// forwards the packets to all the sockets listened.
+func newTestMDNS(t *testing.T) {
+	hub, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP error: %v", err)
+	}
+	var mu sync.Mutex
+	var members []net.Addr
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, _, err := hub.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			for _, m := range members {
+				hub.WriteTo(buf[:n], m)
+			}
+			mu.Unlock()
+		}
+	}()
+	listen := listenMDNS
+	listenMDNS = func() ([]mdnsSocket, error) {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		members = append(members, conn.LocalAddr())
+		mu.Unlock()
+		return []mdnsSocket{{conn, hub.LocalAddr()}}, nil
+	}
+	t.Cleanup(func() {
+		listenMDNS = listen
+		hub.Close()
+	})
+}
+
+func TestDNSName(t *testing.T) {
+	msg := appendDNSName(make([]byte, 12), "Host.Local")
+	// A name of a label and a pointer to the first name.
+	msg = append(msg, 1, 'a', 0xc0, 12)
+	name, off, err := readDNSName(msg, 12)
+	if err != nil || name != "host.local" || off != 24 {
+		t.Errorf("readDNSName error: %q at %d, %v", name, off, err)
+	}
+	name, off, err = readDNSName(msg, 24)
+	if err != nil || name != "a.host.local" || off != len(msg) {
+		t.Errorf("readDNSName error: %q at %d, %v", name, off, err)
+	}
+	if _, _, err := readDNSName([]byte{0xc0, 0}, 0); err == nil {
+		t.Errorf("readDNSName error: pointer loop accepted")
+	}
+}
+
+func TestMDNSName(t *testing.T) {
+	name, err := newMDNSName()
+	if err != nil {
+		t.Fatalf("newMDNSName error: %v", err)
+	}
+	if len(name) != 42 || !isMDNSName(name) || name[14] != '4' {
+		t.Errorf("newMDNSName error: %q", name)
+	}
+	if isMDNSName("example.org") {
+		t.Errorf("isMDNSName error: example.org")
+	}
+}
+
+func TestAgentMDNS(t *testing.T) {
+	newTestMDNS(t)
+	a, b := newTestAgents(t, Config{MDNS: MDNSGather})
+	for _, c := range a.LocalCandidates() {
+		if !isMDNSName(c.Name) {
+			t.Fatalf("Gather error: %v without mDNS name", c)
+		}
+	}
+	// The peer is signaled the names of the candidates only.
+	b.mu.Lock()
+	b.remote, b.pairs = nil, nil
+	b.mu.Unlock()
+	for _, c := range a.LocalCandidates() {
+		c.Addr = netip.AddrPortFrom(netip.Addr{}, c.Addr.Port())
+		if err := b.AddRemoteCandidate(c); err != nil {
+			t.Fatalf("AddRemoteCandidate error: %v", err)
+		}
+	}
+	connect(t, a, b)
+	local, _, _ := a.Selected()
+	if _, remote, _ := b.Selected(); remote.Addr != local.Addr || remote.Name != local.Name {
+		t.Errorf("Connect error: %v selected, %v expected", remote, local)
+	}
+
+	c, err := NewAgent(Config{MDNS: MDNSDisabled})
+	if err != nil {
+		t.Fatalf("NewAgent error: %v", err)
+	}
+	defer c.Close()
+	if err := c.AddRemoteCandidate(Candidate{Name: local.Name}); err == nil {
+		t.Errorf("AddRemoteCandidate error: mDNS candidate added while disabled")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+// NominationPolicy is how the controlling agent nominates the pair to be
+// selected.
+type NominationPolicy int
+
+// Nomination policies.
+const (
+	// RegularNomination checks a valid pair again with USE-CANDIDATE, of
+	// the highest priority once no pair of a higher one is left to check
+	// (RFC 8445 section 8.1.1), or the one chosen by Config.Nominate.
+	RegularNomination NominationPolicy = iota
+	// AggressiveNomination checks all the pairs with USE-CANDIDATE, so that
+	// the first valid one is selected, sooner but maybe not of the highest
+	// priority (RFC 5245 section 8.1.1.2).
+	AggressiveNomination
+)
+
+// CandidatePair is a pair of a local and a remote candidate.
+type CandidatePair struct {
+	Local  Candidate
+	Remote Candidate
+}
+
+// nominateNext nominates the pairs of the regular nomination of the checks
+// of the generation gen, one of each component not nominated yet, if any,
+// and reports whether the checks go on. It is called with a.mu held, which
+// it releases while calling Config.Nominate.
+func (a *Agent) nominateNext(gen int) bool {
+	for c := 1; c <= a.cfg.Components; c++ {
+		if p := a.selected[c]; p != nil && p.gen == gen || a.nominating[c] != nil {
+			continue
+		}
+		if !a.nominateComponent(gen, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// nominateComponent nominates the pair of the regular nomination of the
+// component, if any, and reports whether the checks go on. It is called
+// with a.mu held, which it releases while calling Config.Nominate.
+func (a *Agent) nominateComponent(gen, component int) bool {
+	var valid []*pair
+	for _, p := range a.pairs {
+		// The pair of a peer reflexive local candidate is valid in place
+		// of the pair checked (RFC 8445 section 7.2.5.3.2).
+		if p.state == Succeeded && p.valid == nil && p.local.Component == component {
+			valid = append(valid, p)
+		}
+	}
+	if len(valid) == 0 {
+		return true
+	}
+	// The check list is ordered by priority.
+	left := a.unchecked(component, valid[0].priority(a.controlling))
+	if a.cfg.Nominate == nil {
+		if !left {
+			a.nominate(valid[0])
+		}
+		return true
+	}
+	left = a.unchecked(component, 0)
+	if len(valid) == a.offered[component] && left {
+		return true
+	}
+	a.offered[component] = len(valid)
+	pairs := make([]CandidatePair, len(valid))
+	for i, p := range valid {
+		pairs[i] = CandidatePair{Local: p.local.Candidate, Remote: p.remote}
+	}
+	a.mu.Unlock()
+	i := a.cfg.Nominate(pairs)
+	a.mu.Lock()
+	if a.gen != gen || a.closed {
+		return false
+	}
+	if (i < 0 || i >= len(valid)) && !left {
+		i = 0
+	}
+	if i >= 0 && i < len(valid) && valid[i].state == Succeeded && a.controlling &&
+		a.nominating[component] == nil {
+		a.nominate(valid[i])
+	}
+	return true
+}
+
+// nominate checks the pair p again with USE-CANDIDATE, right away. It is
+// called with a.mu held.
+func (a *Agent) nominate(p *pair) {
+	p.nominate = true
+	a.nominating[p.local.Component] = p
+	a.triggered = append(a.triggered, p)
+}
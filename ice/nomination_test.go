@@ -0,0 +1,98 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newTestPeers returns a controlling and a controlled agent of cfg with the
+// host candidates of two loopback addresses, exchanged.
+func newTestPeers(t *testing.T, cfg Config) (*Agent, *Agent) {
+	var agents [2]*Agent
+	for i := range agents {
+		cfg := cfg
+		cfg.Addrs = []netip.Addr{loopback, netip.MustParseAddr("127.0.0.2")}
+		cfg.Controlling = i == 0
+		if i == 1 {
+			cfg.Nominate = nil
+		}
+		a, err := NewAgent(cfg)
+		if err != nil {
+			t.Fatalf("NewAgent error: %v", err)
+		}
+		t.Cleanup(func() { a.Close() })
+		if _, err := a.Gather(); err != nil {
+			t.Fatalf("Gather error: %v", err)
+		}
+		agents[i] = a
+	}
+	for i, a := range agents {
+		peer := agents[1-i]
+		a.SetRemoteCredentials(peer.LocalCredentials())
+		for _, c := range peer.LocalCandidates() {
+			if err := a.AddRemoteCandidate(c); err != nil {
+				t.Fatalf("AddRemoteCandidate error: %v", err)
+			}
+		}
+	}
+	return agents[0], agents[1]
+}
+
+func TestAgentNominate(t *testing.T) {
+	second := netip.MustParseAddr("127.0.0.2")
+	calls := 0
+	a, b := newTestPeers(t, Config{Nominate: func(valid []CandidatePair) int {
+		calls++
+		for i, p := range valid {
+			if p.Local.Addr.Addr() == second && p.Remote.Addr.Addr() == second {
+				return i
+			}
+		}
+		return -1
+	}})
+	connect(t, a, b)
+	local, remote, _ := a.Selected()
+	if local.Addr.Addr() != second || remote.Addr.Addr() != second {
+		t.Errorf("Nominate error: %v to %v selected", local, remote)
+	}
+	if bl, br, _ := b.Selected(); bl != remote || br.Addr != local.Addr {
+		t.Errorf("Nominate error: %v to %v selected by the controlled agent", bl, br)
+	}
+	if calls == 0 {
+		t.Errorf("Nominate error: not called")
+	}
+}
+
+func TestAgentAggressiveNomination(t *testing.T) {
+	a, b := newTestPeers(t, Config{Nomination: AggressiveNomination})
+	connect(t, a, b)
+	// The agents select the same pair, of the highest priority nominated.
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		local, remote, _ := a.Selected()
+		bl, br, _ := b.Selected()
+		if bl == remote && br.Addr == local.Addr {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Nomination error: %v to %v and %v to %v selected", local, remote, bl, br)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
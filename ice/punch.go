@@ -0,0 +1,272 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults of TCPPunchOptions.
+const (
+	defaultTCPPunchInterval = 100 * time.Millisecond
+	defaultTCPPunchTimeout  = time.Second
+)
+
+// tcpPunchTokenSize is the size of the random tokens exchanged over the
+// connections of PunchTCP, which elect the side keeping the first one.
+const tcpPunchTokenSize = 8
+
+// TCPPunchOptions are the options of PunchTCP. The zero values are the
+// defaults.
+type TCPPunchOptions struct {
+	// Start is the time the connects start at, agreed with the peer over
+	// signaling so that the SYNs of both sides cross the NATs at about the
+	// same time; now by default.
+	Start time.Time
+	// Interval is the time between the connects to each remote address,
+	// 100ms by default.
+	Interval time.Duration
+	// Timeout is the timeout of each connect, and of the handshake over
+	// the connection, 1s by default.
+	Timeout time.Duration
+}
+
+// TCPPunchResult is the connection established by PunchTCP.
+type TCPPunchResult struct {
+	Conn net.Conn
+	// Accepted reports whether the peer connected to the local port, or
+	// else the connect from it succeeded, e.g. by simultaneous open.
+	Accepted bool
+	// Attempts is the number of the connects.
+	Attempts int
+}
+
+// TCPPunchError is the failure of PunchTCP, once ctx is done.
+type TCPPunchError struct {
+	Attempts int                      // connects
+	Errs     map[netip.AddrPort]error // the last ones of the connects, by remote address
+	Err      error                    // of ctx
+}
+
+func (e *TCPPunchError) Error() string {
+	return "TCP simultaneous-open failed after " + strconv.Itoa(e.Attempts) + " connects: " + e.Err.Error()
+}
+
+// Unwrap returns the error of ctx.
+func (e *TCPPunchError) Unwrap() error {
+	return e.Err
+}
+
+// tcpPunch is the state of PunchTCP.
+type tcpPunch struct {
+	token   []byte
+	timeout time.Duration
+	result  chan *TCPPunchResult
+
+	mu       sync.Mutex
+	chosen   bool // a connection, of the side of the larger token
+	done     bool // once PunchTCP returns
+	attempts int
+	dialing  map[netip.AddrPort]bool
+	errs     map[netip.AddrPort]error
+}
+
+// PunchTCP establishes a TCP connection with the peer between two NATs, by
+// simultaneous open: from the local address, of a port mapped by the NAT
+// as discovered or predicted, it connects to each remote address, of the
+// ports of the peer predicted, every Interval from Start, while the peer
+// does the same, and accepts the connections of the peer to the local port
+// meanwhile. The connections are exchanged random tokens, so that both
+// sides keep the same one, the first of the side of the larger token. It
+// returns a TCPPunchError once ctx is done without connection.
+func PunchTCP(ctx context.Context, local netip.AddrPort, remotes []netip.AddrPort, opts *TCPPunchOptions) (*TCPPunchResult, error) {
+	o := TCPPunchOptions{Interval: defaultTCPPunchInterval, Timeout: defaultTCPPunchTimeout}
+	if opts != nil {
+		o.Start = opts.Start
+		if opts.Interval > 0 {
+			o.Interval = opts.Interval
+		}
+		if opts.Timeout > 0 {
+			o.Timeout = opts.Timeout
+		}
+	}
+	if len(remotes) == 0 {
+		return nil, errors.New("No remote address to connect to.")
+	}
+	p := &tcpPunch{
+		token:   make([]byte, tcpPunchTokenSize),
+		timeout: o.Timeout,
+		result:  make(chan *TCPPunchResult, 1),
+		dialing: make(map[netip.AddrPort]bool),
+		errs:    make(map[netip.AddrPort]error),
+	}
+	if _, err := rand.Read(p.token); err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{Control: reuseControl}
+	ln, err := lc.Listen(ctx, "tcp", local.String())
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go p.accept(ln, remotes)
+	d := net.Dialer{Timeout: o.Timeout, LocalAddr: ln.Addr(), Control: reuseControl}
+	wait := time.Until(o.Start)
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case res := <-p.result:
+			timer.Stop()
+			p.mu.Lock()
+			p.done = true
+			p.mu.Unlock()
+			return res, nil
+		case <-ctx.Done():
+			timer.Stop()
+			return p.fail(ctx.Err())
+		case <-timer.C:
+		}
+		for _, addr := range remotes {
+			p.mu.Lock()
+			dial := !p.dialing[addr]
+			if dial {
+				p.dialing[addr] = true
+				p.attempts++
+			}
+			p.mu.Unlock()
+			if dial {
+				go p.dial(ctx, &d, addr)
+			}
+		}
+		wait = o.Interval
+	}
+}
+
+// fail returns the connection chosen meanwhile, if any, or else the
+// TCPPunchError of err.
+func (p *tcpPunch) fail(err error) (*TCPPunchResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = true
+	select {
+	case res := <-p.result:
+		return res, nil
+	default:
+	}
+	errs := make(map[netip.AddrPort]error, len(p.errs))
+	for addr, err := range p.errs {
+		errs[addr] = err
+	}
+	return nil, &TCPPunchError{Attempts: p.attempts, Errs: errs, Err: err}
+}
+
+// accept accepts the connections from the addresses of the remote ones,
+// until the listener is closed.
+func (p *tcpPunch) accept(ln net.Listener, remotes []netip.AddrPort) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		from := addrPort(conn.RemoteAddr()).Addr()
+		known := false
+		for _, addr := range remotes {
+			known = known || addr.Addr() == from
+		}
+		if !known {
+			conn.Close()
+			continue
+		}
+		go p.handshake(conn, true)
+	}
+}
+
+// dial connects to the address with d.
+func (p *tcpPunch) dial(ctx context.Context, d *net.Dialer, addr netip.AddrPort) {
+	conn, err := d.DialContext(ctx, "tcp", addr.String())
+	p.mu.Lock()
+	delete(p.dialing, addr)
+	if err != nil {
+		p.errs[addr] = err
+	}
+	p.mu.Unlock()
+	if err == nil {
+		p.handshake(conn, false)
+	}
+}
+
+// handshake exchanges the tokens over the connection, accepted or not, and
+// keeps it if chosen: by the side of the larger token, the first one, which
+// it tells the other side with a byte of 1, or 0 to close it.
+func (p *tcpPunch) handshake(conn net.Conn, accepted bool) {
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	peer := make([]byte, tcpPunchTokenSize)
+	if _, err := conn.Write(p.token); err != nil {
+		conn.Close()
+		return
+	}
+	if _, err := io.ReadFull(conn, peer); err != nil {
+		conn.Close()
+		return
+	}
+	decision := []byte{0}
+	switch bytes.Compare(p.token, peer) {
+	case 0:
+		conn.Close()
+		return
+	case 1:
+		p.mu.Lock()
+		if !p.chosen && !p.done {
+			p.chosen, decision[0] = true, 1
+		}
+		p.mu.Unlock()
+		if _, err := conn.Write(decision); err != nil || decision[0] == 0 {
+			conn.Close()
+			if decision[0] == 1 {
+				p.mu.Lock()
+				p.chosen = false
+				p.mu.Unlock()
+			}
+			return
+		}
+	case -1:
+		if _, err := io.ReadFull(conn, decision); err != nil || decision[0] != 1 {
+			conn.Close()
+			return
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done || len(p.result) > 0 {
+		conn.Close()
+		return
+	}
+	p.chosen = true
+	p.result <- &TCPPunchResult{Conn: conn, Accepted: accepted, Attempts: p.attempts}
+}
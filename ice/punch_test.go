@@ -0,0 +1,92 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// freeTCPAddr returns a loopback address of a TCP port free.
+func freeTCPAddr(t *testing.T) netip.AddrPort {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return addrPort(ln.Addr())
+}
+
+func TestPunchTCP(t *testing.T) {
+	c, err := listenTCP(loopback, TCPSimultaneousOpen)
+	if err != nil {
+		t.Skipf("TCP simultaneous-open unsupported: %v", err)
+	}
+	c.Close()
+	addrs := [2]netip.AddrPort{freeTCPAddr(t), freeTCPAddr(t)}
+	// The first port predicted of each peer is wrong.
+	wrong := freeTCPAddr(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := &TCPPunchOptions{Start: time.Now().Add(50 * time.Millisecond), Interval: 20 * time.Millisecond}
+	type result struct {
+		res *TCPPunchResult
+		err error
+	}
+	results := make(chan result, 2)
+	for i := range addrs {
+		local, remote := addrs[i], addrs[1-i]
+		go func() {
+			res, err := PunchTCP(ctx, local, []netip.AddrPort{wrong, remote}, opts)
+			results <- result{res, err}
+		}()
+	}
+	var conns [2]net.Conn
+	for i := range conns {
+		r := <-results
+		if r.err != nil {
+			t.Fatalf("PunchTCP error: %v", r.err)
+		}
+		defer r.res.Conn.Close()
+		conns[i] = r.res.Conn
+	}
+	// Both sides keep the same connection.
+	if conns[0].LocalAddr().String() != conns[1].RemoteAddr().String() || conns[0].RemoteAddr().String() != conns[1].LocalAddr().String() {
+		t.Fatalf("PunchTCP error: %v to %v, %v to %v", conns[0].LocalAddr(), conns[0].RemoteAddr(), conns[1].LocalAddr(), conns[1].RemoteAddr())
+	}
+	if _, err := conns[0].Write([]byte("ping")); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	buf := make([]byte, 4)
+	conns[1].SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conns[1].Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Read error: read %q, %v", buf[:n], err)
+	}
+
+	// Without the peer, the connects fail until ctx is done.
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = PunchTCP(ctx, freeTCPAddr(t), []netip.AddrPort{wrong}, opts)
+	var perr *TCPPunchError
+	if !errors.As(err, &perr) || perr.Attempts == 0 || perr.Errs[wrong] == nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("PunchTCP error: expected TCPPunchError, get %v", err)
+	}
+}
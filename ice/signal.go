@@ -0,0 +1,129 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// Signaler exchanges opaque blobs with the peer over the signaling of the
+// application, e.g. a rendezvous server or a chat channel, for Exchange.
+type Signaler interface {
+	// Send sends the blob to the peer.
+	Send(ctx context.Context, blob []byte) error
+	// Receive receives the next blob of the peer.
+	Receive(ctx context.Context) ([]byte, error)
+}
+
+// description is the blob signaled by Exchange.
+type description struct {
+	Ufrag      string   `json:"ufrag"`
+	Pwd        string   `json:"pwd"`
+	TieBreaker uint64   `json:"tieBreaker"`
+	Lite       bool     `json:"lite,omitempty"`
+	Components int      `json:"components"`
+	Candidates []string `json:"candidates"`
+}
+
+// Dial connects to the peer over the signaling of s, as an agent of cfg
+// exchanging its candidates and credentials with Exchange, without the
+// application handling them. The connection closes the agent once closed.
+func Dial(ctx context.Context, s Signaler, cfg Config) (*Conn, error) {
+	a, err := NewAgent(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.Exchange(ctx, s); err != nil {
+		a.Close()
+		return nil, err
+	}
+	conn, err := a.Connect(ctx)
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Exchange gathers the candidates of the agent unless gathered, signals
+// them with the credentials to the peer over s, and sets those the peer
+// signals back, before Connect. The peers send first, so that neither
+// waits for the other. The roles are of the tie-breakers, Controlling
+// being ignored, unless one of the peers is an ICE-lite one. The
+// candidates trickled after are not signaled.
+func (a *Agent) Exchange(ctx context.Context, s Signaler) error {
+	a.mu.Lock()
+	gathered := a.gathered
+	a.mu.Unlock()
+	if !gathered {
+		if _, err := a.Gather(); err != nil {
+			return err
+		}
+	}
+	ufrag, pwd := a.LocalCredentials()
+	local := description{
+		Ufrag:      ufrag,
+		Pwd:        pwd,
+		TieBreaker: a.tieBreaker,
+		Lite:       a.cfg.Lite,
+		Components: a.cfg.Components,
+	}
+	for _, c := range a.LocalCandidates() {
+		local.Candidates = append(local.Candidates, c.Marshal())
+	}
+	blob, err := json.Marshal(&local)
+	if err != nil {
+		return err
+	}
+	if err := s.Send(ctx, blob); err != nil {
+		return err
+	}
+	if blob, err = s.Receive(ctx); err != nil {
+		return err
+	}
+	var remote description
+	if err := json.Unmarshal(blob, &remote); err != nil {
+		return errors.New("Invalid ICE description: " + err.Error())
+	}
+	switch {
+	case remote.Components != local.Components:
+		return errors.New("ICE components mismatched.")
+	case local.Lite && remote.Lite:
+		return errors.New("ICE-lite peers.")
+	case !local.Lite && !remote.Lite && remote.TieBreaker == local.TieBreaker:
+		return errors.New("ICE tie-breakers equal.")
+	}
+	controlling := !local.Lite && (remote.Lite || local.TieBreaker > remote.TieBreaker)
+	a.mu.Lock()
+	if a.controlling != controlling {
+		a.switchRole(controlling)
+	}
+	a.mu.Unlock()
+	a.SetRemoteCredentials(remote.Ufrag, remote.Pwd)
+	for _, line := range remote.Candidates {
+		c, err := ParseCandidate(line)
+		if err != nil {
+			return err
+		}
+		if err := a.AddRemoteCandidate(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// testSignaler is a Signaler of channels.
+type testSignaler struct {
+	send, receive chan []byte
+}
+
+func newTestSignalers() (*testSignaler, *testSignaler) {
+	a, b := make(chan []byte, 1), make(chan []byte, 1)
+	return &testSignaler{a, b}, &testSignaler{b, a}
+}
+
+func (s *testSignaler) Send(ctx context.Context, blob []byte) error {
+	select {
+	case s.send <- blob:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *testSignaler) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case blob := <-s.receive:
+		return blob, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestDial(t *testing.T) {
+	sa, sb := newTestSignalers()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cfg := Config{Addrs: []netip.Addr{loopback}}
+	errs := make(chan error, 1)
+	var bc *Conn
+	go func() {
+		var err error
+		bc, err = Dial(ctx, sb, cfg)
+		errs <- err
+	}()
+	ac, err := Dial(ctx, sa, cfg)
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	defer ac.Close()
+	if err := <-errs; err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	defer bc.Close()
+	if ac.a.controlling == bc.a.controlling || ac.a.controlling != (ac.a.tieBreaker > bc.a.tieBreaker) {
+		t.Errorf("Dial error: controlling %v, tie-breakers %d and %d", ac.a.controlling, ac.a.tieBreaker, bc.a.tieBreaker)
+	}
+	if _, err := ac.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	buf := make([]byte, 64)
+	bc.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := bc.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Read error: read %q, %v", buf[:n], err)
+	}
+}
+
+func TestExchangeMismatch(t *testing.T) {
+	sa, sb := newTestSignalers()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a, err := NewAgent(Config{Addrs: []netip.Addr{loopback}})
+	if err != nil {
+		t.Fatalf("NewAgent error: %v", err)
+	}
+	defer a.Close()
+	b, err := NewAgent(Config{Addrs: []netip.Addr{loopback}, Components: 2})
+	if err != nil {
+		t.Fatalf("NewAgent error: %v", err)
+	}
+	defer b.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- b.Exchange(ctx, sb) }()
+	if err := a.Exchange(ctx, sa); err == nil {
+		t.Errorf("Exchange error: expected error of the components")
+	}
+	if err := <-errs; err == nil {
+		t.Errorf("Exchange error: expected error of the components")
+	}
+	// A blob other than a description is rejected.
+	sb.Send(ctx, []byte("hello"))
+	if err := a.Exchange(ctx, sa); err == nil {
+		t.Errorf("Exchange error: expected error of the blob")
+	}
+}
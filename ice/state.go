@@ -0,0 +1,148 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+// stateEventBuffer is the capacity of the channels of SubscribeState.
+const stateEventBuffer = 4
+
+// GatheringState is the state of the gathering of the local candidates, as
+// the RTCIceGatheringState of WebRTC.
+type GatheringState int
+
+// Gathering states.
+const (
+	GatheringNew GatheringState = iota
+	GatheringInProgress
+	GatheringComplete
+)
+
+var gatheringStateStr = map[GatheringState]string{
+	GatheringNew:        "new",
+	GatheringInProgress: "gathering",
+	GatheringComplete:   "complete",
+}
+
+func (s GatheringState) String() string {
+	if str, ok := gatheringStateStr[s]; ok {
+		return str
+	}
+	return "unknown"
+}
+
+// ConnectionState is the state of the connection of an agent, as the
+// RTCIceConnectionState of WebRTC.
+type ConnectionState int
+
+// Connection states.
+const (
+	// ConnectionNew is the state until Connect.
+	ConnectionNew ConnectionState = iota
+	// ConnectionChecking is the state from Connect until a pair of each
+	// component is selected.
+	ConnectionChecking
+	// ConnectionConnected is the state once a pair of each component is
+	// selected.
+	ConnectionConnected
+	// ConnectionFailed is the state once all the pairs of a component
+	// failed, until Connect again after Restart.
+	ConnectionFailed
+	// ConnectionDisconnected is the state once the consent of the peer
+	// expired over a selected pair, until another one is selected.
+	ConnectionDisconnected
+	// ConnectionClosed is the state once the agent is closed.
+	ConnectionClosed
+)
+
+var connectionStateStr = map[ConnectionState]string{
+	ConnectionNew:          "new",
+	ConnectionChecking:     "checking",
+	ConnectionConnected:    "connected",
+	ConnectionFailed:       "failed",
+	ConnectionDisconnected: "disconnected",
+	ConnectionClosed:       "closed",
+}
+
+func (s ConnectionState) String() string {
+	if str, ok := connectionStateStr[s]; ok {
+		return str
+	}
+	return "unknown"
+}
+
+// StateEvent reports a change of the gathering state, of the connection
+// state, or of the selected pair of a component of an agent, with the
+// states as of the change.
+type StateEvent struct {
+	Gathering  GatheringState
+	Connection ConnectionState
+	// Component is the component of which the pair Selected is selected,
+	// or 0 if a state changed.
+	Component int
+	Selected  CandidatePair
+}
+
+// SubscribeState returns a channel receiving the StateEvents of the agent,
+// closed by Close. Events are dropped if the subscriber does not keep up.
+func (a *Agent) SubscribeState() <-chan StateEvent {
+	ch := make(chan StateEvent, stateEventBuffer)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		close(ch)
+	} else {
+		a.stateSubs = append(a.stateSubs, ch)
+	}
+	return ch
+}
+
+// State returns the gathering and the connection states of the agent.
+func (a *Agent) State() (GatheringState, ConnectionState) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.gathering, a.state
+}
+
+// setGathering changes the gathering state to s. It is called with a.mu
+// held.
+func (a *Agent) setGathering(s GatheringState) {
+	if a.gathering != s {
+		a.gathering = s
+		a.notify(StateEvent{})
+	}
+}
+
+// setConnection changes the connection state to s. It is called with a.mu
+// held.
+func (a *Agent) setConnection(s ConnectionState) {
+	if a.state != s {
+		a.state = s
+		a.logger.Debugln("ICE connection", s)
+		a.notify(StateEvent{})
+	}
+}
+
+// notify sends the event ev, with the current states, to the subscribers.
+// It is called with a.mu held.
+func (a *Agent) notify(ev StateEvent) {
+	ev.Gathering, ev.Connection = a.gathering, a.state
+	for _, ch := range a.stateSubs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestAgentState(t *testing.T) {
+	a, err := NewAgent(Config{Addrs: []netip.Addr{loopback}})
+	if err != nil {
+		t.Fatalf("NewAgent error: %v", err)
+	}
+	defer a.Close()
+	events := a.SubscribeState()
+	if _, err := a.Gather(); err != nil {
+		t.Fatalf("Gather error: %v", err)
+	}
+	for _, want := range []GatheringState{GatheringInProgress, GatheringComplete} {
+		if ev := <-events; ev.Gathering != want || ev.Connection != ConnectionNew {
+			t.Errorf("SubscribeState error: %v %v, expected %v", ev.Gathering, ev.Connection, want)
+		}
+	}
+
+	a, b := newTestAgents(t, Config{})
+	events = a.SubscribeState()
+	connect(t, a, b)
+	if ev := <-events; ev.Connection != ConnectionChecking || ev.Component != 0 {
+		t.Errorf("SubscribeState error: %+v, expected checking", ev)
+	}
+	local, remote, _ := a.Selected()
+	if ev := <-events; ev.Component != 1 || ev.Selected != (CandidatePair{local, remote}) {
+		t.Errorf("SubscribeState error: %+v, expected the pair selected", ev)
+	}
+	if ev := <-events; ev.Connection != ConnectionConnected {
+		t.Errorf("SubscribeState error: %+v, expected connected", ev)
+	}
+	if g, c := a.State(); g != GatheringComplete || c != ConnectionConnected {
+		t.Errorf("State error: %v %v", g, c)
+	}
+	a.Close()
+	if ev := <-events; ev.Connection != ConnectionClosed {
+		t.Errorf("SubscribeState error: %+v, expected closed", ev)
+	}
+	if _, ok := <-events; ok {
+		t.Errorf("SubscribeState error: channel not closed")
+	}
+}
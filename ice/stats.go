@@ -0,0 +1,90 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// CandidatePairStats is a snapshot of the state and the counters of a
+// candidate pair, as the RTCIceCandidatePairStats of WebRTC.
+type CandidatePairStats struct {
+	CandidatePair
+	State             PairState
+	Nominated         bool          // checked or received with USE-CANDIDATE
+	Selected          bool          // for the data of the component
+	RequestsSent      uint64        // checks, retransmissions and consent included
+	RequestsReceived  uint64        // checks authenticated
+	ResponsesSent     uint64        // success responses
+	ResponsesReceived uint64        // to the requests sent
+	RTT               time.Duration // of the last response received
+	TotalRTT          time.Duration // of all the responses received
+	PacketsSent       uint64        // of data
+	BytesSent         uint64
+	PacketsReceived   uint64 // of data, once the pair is selected
+	BytesReceived     uint64
+}
+
+// pairStats aggregates the traffic of a pair for Agent.Stats.
+type pairStats struct {
+	requestsSent      atomic.Uint64
+	requestsReceived  atomic.Uint64
+	responsesSent     atomic.Uint64
+	responsesReceived atomic.Uint64
+	rtt               atomic.Int64
+	totalRTT          atomic.Int64
+	packetsSent       atomic.Uint64
+	bytesSent         atomic.Uint64
+	packetsReceived   atomic.Uint64
+	bytesReceived     atomic.Uint64
+}
+
+// roundTrip counts a response received after the round-trip time rtt.
+func (s *pairStats) roundTrip(rtt time.Duration) {
+	s.responsesReceived.Add(1)
+	s.rtt.Store(int64(rtt))
+	s.totalRTT.Add(int64(rtt))
+}
+
+// Stats returns a snapshot of the pairs of the check list, ordered by
+// priority, with their counters.
+func (a *Agent) Stats() []CandidatePairStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := make([]CandidatePairStats, len(a.pairs))
+	for i, p := range a.pairs {
+		s := &p.stats
+		stats[i] = CandidatePairStats{
+			CandidatePair:     CandidatePair{Local: p.local.Candidate, Remote: p.remote},
+			State:             p.state,
+			Nominated:         p.nominate || p.useCandidate,
+			Selected:          a.selected[p.local.Component] == p,
+			RequestsSent:      s.requestsSent.Load(),
+			RequestsReceived:  s.requestsReceived.Load(),
+			ResponsesSent:     s.responsesSent.Load(),
+			ResponsesReceived: s.responsesReceived.Load(),
+			RTT:               time.Duration(s.rtt.Load()),
+			TotalRTT:          time.Duration(s.totalRTT.Load()),
+			PacketsSent:       s.packetsSent.Load(),
+			BytesSent:         s.bytesSent.Load(),
+			PacketsReceived:   s.packetsReceived.Load(),
+			BytesReceived:     s.bytesReceived.Load(),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,52 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAgentStats(t *testing.T) {
+	a, b := newTestAgents(t, Config{})
+	ac, bc := connect(t, a, b)
+	if _, err := ac.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	buf := make([]byte, 64)
+	bc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bc.Read(buf); err != nil {
+		t.Fatalf("Read error: %v", err)
+	}
+	selected := func(agent *Agent) CandidatePairStats {
+		for _, s := range agent.Stats() {
+			if s.Selected {
+				return s
+			}
+		}
+		t.Fatalf("Stats error: no pair selected")
+		return CandidatePairStats{}
+	}
+	s := selected(a)
+	if s.State != Succeeded || !s.Nominated || s.RequestsSent == 0 || s.ResponsesReceived == 0 ||
+		s.RTT <= 0 || s.TotalRTT < s.RTT || s.PacketsSent != 1 || s.BytesSent != 4 {
+		t.Errorf("Stats error: controlling %+v", s)
+	}
+	if s := selected(b); s.RequestsReceived == 0 || s.ResponsesSent == 0 || s.PacketsReceived != 1 || s.BytesReceived != 4 {
+		t.Errorf("Stats error: controlled %+v", s)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// TCP candidate types (RFC 6544 section 4.5).
+const (
+	TCPActive  = "active"
+	TCPPassive = "passive"
+	// TCPSimultaneousOpen connects to the peer from the port listened,
+	// where supported.
+	TCPSimultaneousOpen = "so"
+)
+
+// tcpDialTimeout is the timeout of the connections of the active and the
+// simultaneous-open candidates.
+const tcpDialTimeout = 5 * time.Second
+
+// tcpActivePort is the port of the active candidates, which do not listen
+// (RFC 6544 section 4.5).
+const tcpActivePort = 9
+
+// tcpPreference returns the local preference of a TCP host candidate of the
+// type, from its direction preference and the other preference other (RFC
+// 6544 section 4.2), below those of the UDP ones.
+func tcpPreference(tcpType string, other uint16) uint16 {
+	direction := uint16(2)
+	switch tcpType {
+	case TCPActive:
+		direction = 6
+	case TCPPassive:
+		direction = 4
+	}
+	return direction<<13 | other&0x1fff
+}
+
+// remoteTCPType returns the type of the remote TCP candidates paired with
+// the local ones of the type tcpType (RFC 6544 section 6.2), or empty of UDP.
+func remoteTCPType(tcpType string) string {
+	switch tcpType {
+	case TCPActive:
+		return TCPPassive
+	case TCPPassive:
+		return TCPActive
+	}
+	return tcpType
+}
+
+// tcpConn is a net.PacketConn over the TCP connections of a TCP candidate,
+// by remote address, of packets framed by their length (RFC 4571). The
+// active and the simultaneous-open candidates connect on the first write to
+// an address, which is dropped until connected.
+type tcpConn struct {
+	tcpType string
+	addr    *net.TCPAddr
+	ln      net.Listener // of the passive and the simultaneous-open ones
+	data    chan packet
+	done    chan struct{}
+
+	mu      sync.Mutex
+	conns   map[netip.AddrPort]net.Conn
+	dialing map[netip.AddrPort]bool
+	closed  bool
+}
+
+// listenTCP returns a TCP candidate socket of the type on the address ip.
+func listenTCP(ip netip.Addr, tcpType string) (*tcpConn, error) {
+	c := &tcpConn{
+		tcpType: tcpType,
+		addr:    net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, tcpActivePort)),
+		data:    make(chan packet, dataQueueSize),
+		done:    make(chan struct{}),
+		conns:   make(map[netip.AddrPort]net.Conn),
+		dialing: make(map[netip.AddrPort]bool),
+	}
+	if tcpType == TCPActive {
+		return c, nil
+	}
+	var lc net.ListenConfig
+	if tcpType == TCPSimultaneousOpen {
+		lc.Control = reuseControl
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	c.ln, c.addr = ln, ln.Addr().(*net.TCPAddr)
+	go c.accept()
+	return c, nil
+}
+
+// accept accepts the connections of the peer, until closed.
+func (c *tcpConn) accept() {
+	for {
+		conn, err := c.ln.Accept()
+		if err != nil {
+			return
+		}
+		c.add(conn)
+	}
+}
+
+// dial connects to the address from the candidate.
+func (c *tcpConn) dial(addr netip.AddrPort) {
+	d := net.Dialer{Timeout: tcpDialTimeout, LocalAddr: &net.TCPAddr{IP: c.addr.IP}}
+	if c.tcpType == TCPSimultaneousOpen {
+		d.LocalAddr, d.Control = c.addr, reuseControl
+	}
+	conn, err := d.Dial("tcp", addr.String())
+	c.mu.Lock()
+	delete(c.dialing, addr)
+	c.mu.Unlock()
+	if err == nil {
+		c.add(conn)
+	}
+}
+
+// add reads the connection, unless closed or connected to its address
+// already.
+func (c *tcpConn) add(conn net.Conn) {
+	addr := addrPort(conn.RemoteAddr())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.conns[addr] != nil {
+		conn.Close()
+		return
+	}
+	c.conns[addr] = conn
+	go c.read(conn, addr)
+}
+
+// read queues the packets of the connection from the address, until closed.
+func (c *tcpConn) read(conn net.Conn, addr netip.AddrPort) {
+	defer func() {
+		c.mu.Lock()
+		if c.conns[addr] == conn {
+			delete(c.conns, addr)
+		}
+		c.mu.Unlock()
+		conn.Close()
+	}()
+	header := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		select {
+		case c.data <- packet{buf, addr}:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// ReadFrom reads a packet of the connections into b.
+func (c *tcpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.data:
+		return copy(b, p.buf), net.TCPAddrFromAddrPort(p.from), nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteTo writes the packet b over the connection to the address.
+func (c *tcpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > 0xffff {
+		return 0, errors.New("Packet too large for TCP framing.")
+	}
+	to := addrPort(addr)
+	c.mu.Lock()
+	conn := c.conns[to]
+	switch {
+	case c.closed:
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	case conn == nil && c.tcpType == TCPPassive:
+		c.mu.Unlock()
+		return 0, errors.New("No TCP connection to the address.")
+	case conn == nil:
+		if !c.dialing[to] {
+			c.dialing[to] = true
+			go c.dial(to)
+		}
+		c.mu.Unlock()
+		return len(b), nil
+	}
+	c.mu.Unlock()
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	if _, err := conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the listener and the connections.
+func (c *tcpConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.ln != nil {
+		c.ln.Close()
+	}
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// LocalAddr returns the address of the candidate.
+func (c *tcpConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// The deadlines are not used by the agent.
+func (c *tcpConn) SetDeadline(t time.Time) error      { return nil }
+func (c *tcpConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *tcpConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// addrPort returns the unmapped address of a UDP or a TCP address.
+func addrPort(addr net.Addr) netip.AddrPort {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return unmap(addr.AddrPort())
+	case *net.TCPAddr:
+		return unmap(addr.AddrPort())
+	}
+	return netip.AddrPort{}
+}
+
+// netAddr returns the address of the protocol, "udp" or "tcp".
+func netAddr(protocol string, addr netip.AddrPort) net.Addr {
+	if protocol == "tcp" {
+		return net.TCPAddrFromAddrPort(addr)
+	}
+	return net.UDPAddrFromAddrPort(addr)
+}
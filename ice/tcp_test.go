@@ -0,0 +1,96 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package ice
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAgentTCP(t *testing.T) {
+	a, b := newTestAgents(t, Config{Protocols: []string{"tcp"}})
+	for _, c := range a.LocalCandidates() {
+		if c.Protocol != "tcp" || c.TCPType == TCPActive && c.Addr.Port() != tcpActivePort {
+			t.Errorf("Gather error: %v", c)
+		}
+	}
+	ac, bc := connect(t, a, b)
+	local, remote, _ := a.Selected()
+	// The active candidate of the controlling agent connects to the passive
+	// one, of the highest priority.
+	if local.TCPType != TCPActive || remote.TCPType != TCPPassive {
+		t.Errorf("Connect error: %v to %v selected", local, remote)
+	}
+	if _, ok := ac.LocalAddr().(*net.TCPAddr); !ok {
+		t.Errorf("LocalAddr error: %v", ac.LocalAddr())
+	}
+	buf := make([]byte, 64)
+	for _, c := range [][2]*Conn{{ac, bc}, {bc, ac}} {
+		if _, err := c[0].Write([]byte("ping")); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		c[1].SetReadDeadline(time.Now().Add(time.Second))
+		n, err := c[1].Read(buf)
+		if err != nil || string(buf[:n]) != "ping" {
+			t.Fatalf("Read error: read %q, %v", buf[:n], err)
+		}
+	}
+}
+
+func TestTCPConnSimultaneousOpen(t *testing.T) {
+	a, err := listenTCP(loopback, TCPSimultaneousOpen)
+	if err != nil {
+		t.Skipf("TCP simultaneous-open unsupported: %v", err)
+	}
+	defer a.Close()
+	b, err := listenTCP(loopback, TCPSimultaneousOpen)
+	if err != nil {
+		t.Fatalf("listenTCP error: %v", err)
+	}
+	defer b.Close()
+	// The first writes are dropped while connecting.
+	read := make(chan string, 2)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, from, err := b.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if addrPort(from) == addrPort(a.LocalAddr()) {
+				read <- string(buf[:n])
+			}
+		}
+	}()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if _, err := a.WriteTo([]byte("ping"), b.LocalAddr()); err != nil {
+			t.Fatalf("WriteTo error: %v", err)
+		}
+		select {
+		case s := <-read:
+			if s != "ping" {
+				t.Fatalf("ReadFrom error: %q", s)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("WriteTo error: not connected")
+		}
+	}
+}
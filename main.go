@@ -28,6 +28,7 @@ func main() {
 	var v = flag.Bool("v", false, "verbose mode")
 	var vv = flag.Bool("vv", false, "double verbose mode (includes -v)")
 	var vvv = flag.Bool("vvv", false, "triple verbose mode (includes -v and -vv)")
+	var iface = flag.String("i", "", "network interface to bind to")
 	flag.Parse()
 
 	// Creates a STUN client. NewClientWithConnection can also be used if
@@ -36,6 +37,7 @@ func main() {
 	// The default addr (stun.DefaultServerAddr) will be used unless we
 	// call SetServerAddr.
 	client.SetServerAddr(*serverAddr)
+	client.SetInterface(*iface)
 	// Non verbose mode will be used by default unless we call
 	// SetVerbose(true) or SetVVerbose(true).
 	client.SetVerbose(*v || *vv || *vvv)
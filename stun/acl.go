@@ -0,0 +1,87 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net/netip"
+)
+
+// ACL is an access control list of a server. The requests it denies are
+// dropped silently before any other processing.
+type ACL struct {
+	// Allow lists the source networks served, or all if empty.
+	Allow []netip.Prefix
+	// Deny lists the source networks never served, even if allowed.
+	Deny []netip.Prefix
+	// Realms lists the realms accepted in the REALM attribute of the
+	// requests, or all if empty.
+	Realms []string
+	// DenyUsernames lists the users whose requests are dropped.
+	DenyUsernames []string
+}
+
+// allowAddr reports whether the requests from ip are served.
+func (a *ACL) allowAddr(ip netip.Addr) bool {
+	for _, p := range a.Deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, p := range a.Allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowRequest reports whether the USERNAME and REALM of req are allowed.
+// The requests without them, e.g. before the authentication challenge, are
+// allowed.
+func (a *ACL) allowRequest(req *packet) bool {
+	if len(a.DenyUsernames) > 0 && req.hasAttribute(attributeUsername) {
+		username := req.getString(attributeUsername)
+		for _, u := range a.DenyUsernames {
+			if u == username {
+				return false
+			}
+		}
+	}
+	if len(a.Realms) == 0 || !req.hasAttribute(attributeRealm) {
+		return true
+	}
+	realm := req.getString(attributeRealm)
+	for _, r := range a.Realms {
+		if r == realm {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a copy of the ACL, so that the caller can reuse its slices.
+func (a *ACL) clone() *ACL {
+	return &ACL{
+		Allow:         append([]netip.Prefix(nil), a.Allow...),
+		Deny:          append([]netip.Prefix(nil), a.Deny...),
+		Realms:        append([]string(nil), a.Realms...),
+		DenyUsernames: append([]string(nil), a.DenyUsernames...),
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestServerACL(t *testing.T) {
+	s := NewServer()
+	acl := &ACL{
+		Allow:         []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		Deny:          []netip.Prefix{netip.MustParsePrefix("192.0.2.128/25")},
+		DenyUsernames: []string{"mallory"},
+	}
+	s.SetACL(acl)
+	acl.Allow = nil
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	for ip, served := range map[string]bool{
+		"192.0.2.1":        true,
+		"::ffff:192.0.2.1": true,
+		"192.0.2.200":      false,
+		"198.51.100.1":     false,
+	} {
+		addr := &net.UDPAddr{IP: net.ParseIP(ip), Port: 5678}
+		if b, _, _ := s.handle(req.bytes(), addr, &listener{}, time.Now()); (b != nil) != served {
+			t.Errorf("handle error: %s served %v", ip, b != nil)
+		}
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5678}
+	req.addAttribute(*newAttribute(attributeUsername, []byte("mallory")))
+	if b, _, _ := s.handle(req.bytes(), addr, &listener{}, time.Now()); b != nil {
+		t.Errorf("handle error: denied user served")
+	}
+	s.SetACL(nil)
+	if b, _, _ := s.handle(req.bytes(), addr, &listener{}, time.Now()); b == nil {
+		t.Errorf("handle error: request dropped without ACL")
+	}
+}
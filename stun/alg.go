@@ -0,0 +1,81 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+)
+
+// ALGReport is the comparison of MAPPED-ADDRESS with XOR-MAPPED-ADDRESS in
+// a Binding response, made by DetectALG.
+type ALGReport struct {
+	// Mapped and XorMapped are the addresses of the attributes, nil if
+	// not in the response.
+	Mapped    *Host
+	XorMapped *Host
+	// Compared is whether the response carries both attributes, which
+	// most servers of RFC 5389 do for the clients of RFC 3489.
+	Compared bool
+	// Rewritten is whether the addresses mismatch. XOR-MAPPED-ADDRESS
+	// exists for the NAT ALGs rewriting the addresses they find in the
+	// payloads, e.g. the external address of MAPPED-ADDRESS back to the
+	// internal one, which breaks the protocols carrying it, while the
+	// XORed address is not recognized and left as is.
+	Rewritten bool
+}
+
+// DetectALG sends a Binding request to the STUN server and reports
+// whether an ALG on the path rewrote the mapped address of the response.
+// The connection passed by NewClientWithConnection is used if any.
+func (c *Client) DetectALG() (*ALGReport, error) {
+	if c.serverAddr == "" {
+		c.SetServerAddr(DefaultServerAddr)
+	}
+	addr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn := c.conn
+	if conn == nil {
+		conn, err = listenUDP(c.iface)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+	}
+	resp, err := c.test1(conn, addr)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.packet == nil {
+		return nil, errors.New("failed to contact")
+	}
+	r := newALGReport(resp.packet)
+	if r.Rewritten {
+		c.logger.Debugln("ALG rewrote MAPPED-ADDRESS:", r.Mapped, "of XOR-MAPPED-ADDRESS", r.XorMapped)
+	}
+	return r, nil
+}
+
+// newALGReport compares the mapped addresses of the response.
+func newALGReport(pkt *packet) *ALGReport {
+	r := &ALGReport{Mapped: pkt.getMappedAddr(), XorMapped: pkt.getXorMappedAddr()}
+	r.Compared = r.Mapped != nil && r.XorMapped != nil
+	r.Rewritten = r.Compared && !sameHost(r.Mapped, r.XorMapped)
+	return r
+}
@@ -0,0 +1,61 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import "testing"
+
+// newALGServer returns the address of a server responding with both
+// MAPPED-ADDRESS and XOR-MAPPED-ADDRESS, the former rewritten to the
+// address if not nil, as by an ALG.
+func newALGServer(t *testing.T, rewritten *Host) string {
+	return newRespondingServer(t, func(w ResponseWriter, r *Request) {
+		mapped := r.Source
+		if rewritten != nil {
+			mapped = rewritten
+		}
+		w.AddAttribute(attributeMappedAddress, newAddrAttribute(attributeMappedAddress, mapped).value)
+		addXorMapped(w, r, r.Source)
+	})
+}
+
+func TestDetectALG(t *testing.T) {
+	c := NewClient()
+	c.SetServerAddr(newALGServer(t, nil))
+	r, err := c.DetectALG()
+	if err != nil {
+		t.Fatalf("DetectALG error: %v", err)
+	}
+	if !r.Compared || r.Rewritten {
+		t.Errorf("DetectALG error: %+v, expected no rewriting", r)
+	}
+	c.SetServerAddr(newALGServer(t, newHostFromStr("10.0.0.1:1234")))
+	if r, err = c.DetectALG(); err != nil {
+		t.Fatalf("DetectALG error: %v", err)
+	}
+	if !r.Compared || !r.Rewritten || r.Mapped.String() != "10.0.0.1:1234" {
+		t.Errorf("DetectALG error: %+v, expected rewriting", r)
+	}
+	// The server of RFC 5389 responds with XOR-MAPPED-ADDRESS only.
+	_, addr := newTestServer(t)
+	c.SetServerAddr(addr)
+	if r, err = c.DetectALG(); err != nil {
+		t.Fatalf("DetectALG error: %v", err)
+	}
+	if r.Compared || r.Rewritten || r.XorMapped == nil {
+		t.Errorf("DetectALG error: %+v, expected no comparison", r)
+	}
+}
@@ -19,7 +19,7 @@ package stun
 import (
 	"encoding/binary"
 	"hash/crc32"
-	"net"
+	"net/netip"
 )
 
 type attribute struct {
@@ -32,12 +32,18 @@ func newAttribute(types uint16, value []byte) *attribute {
 	att := new(attribute)
 	att.types = types
 	att.value = padding(value)
-	att.length = uint16(len(att.value))
+	// The length excludes the padding.
+	att.length = uint16(len(value))
 	return att
 }
 
+// newFingerprintAttribute returns the FINGERPRINT attribute of packet, which
+// must be added right after it. The CRC covers the message with the length
+// of the header counting the attribute itself.
 func newFingerprintAttribute(packet *packet) *attribute {
-	crc := crc32.ChecksumIEEE(packet.bytes()) ^ fingerprint
+	b := packet.bytes()
+	binary.BigEndian.PutUint16(b[2:4], packet.length+8)
+	crc := crc32.ChecksumIEEE(b) ^ fingerprint
 	buf := make([]byte, 4)
 	binary.BigEndian.PutUint32(buf, crc)
 	return newAttribute(attributeFingerprint, buf)
@@ -47,6 +53,12 @@ func newSoftwareAttribute(name string) *attribute {
 	return newAttribute(attributeSoftware, []byte(name))
 }
 
+// newPaddingAttribute returns a PADDING attribute (RFC 5780) of size bytes,
+// which is used to enlarge the request for path MTU probing.
+func newPaddingAttribute(size int) *attribute {
+	return newAttribute(attributePadding, make([]byte, size))
+}
+
 func newChangeReqAttribute(changeIP bool, changePort bool) *attribute {
 	value := make([]byte, 4)
 	if changeIP {
@@ -58,6 +70,59 @@ func newChangeReqAttribute(changeIP bool, changePort bool) *attribute {
 	return newAttribute(attributeChangeRequest, value)
 }
 
+// newAddrAttribute returns an attribute of type types in the format of
+// MAPPED-ADDRESS, which is shared by the other address attributes of RFC 3489
+// and RFC 5780.
+func newAddrAttribute(types uint16, host *Host) *attribute {
+	value := make([]byte, 4, 20)
+	value[1] = byte(host.Family())
+	binary.BigEndian.PutUint16(value[2:4], host.Port())
+	value = append(value, host.Addr().AsSlice()...)
+	return newAttribute(types, value)
+}
+
+// newXorAddrAttribute returns an attribute of type types in the format of
+// XOR-MAPPED-ADDRESS, where transID is the magic cookie and the transaction
+// ID of the message.
+func newXorAddrAttribute(types uint16, host *Host, transID []byte) *attribute {
+	a := newAddrAttribute(types, host)
+	a.value[2] ^= transID[0]
+	a.value[3] ^= transID[1]
+	for i := 4; i < len(a.value); i++ {
+		a.value[i] ^= transID[i-4]
+	}
+	return a
+}
+
+// newErrorCodeAttribute returns an ERROR-CODE attribute with the given code
+// (300-699) and reason phrase.
+func newErrorCodeAttribute(code int, reason string) *attribute {
+	value := make([]byte, 4, 4+len(reason))
+	value[2] = byte(code / 100)
+	value[3] = byte(code % 100)
+	value = append(value, reason...)
+	return newAttribute(attributeErrorCode, value)
+}
+
+// newAddressErrorCodeAttribute returns the ADDRESS-ERROR-CODE attribute of
+// the family not allocated (RFC 8656 section 18.18).
+func newAddressErrorCodeAttribute(family uint16, code int) *attribute {
+	a := newErrorCodeAttribute(code, errorStr[code])
+	a.types = attributeAddressErrorCode
+	a.value[0] = byte(family)
+	return a
+}
+
+// newUnknownAttributesAttribute returns an UNKNOWN-ATTRIBUTES attribute
+// listing the given types.
+func newUnknownAttributesAttribute(types []uint16) *attribute {
+	value := make([]byte, 2*len(types))
+	for i, t := range types {
+		binary.BigEndian.PutUint16(value[2*i:], t)
+	}
+	return newAttribute(attributeUnknownAttributes, value)
+}
+
 //      0                   1                   2                   3
 //      0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
 //     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
@@ -69,17 +134,13 @@ func newChangeReqAttribute(changeIP bool, changePort bool) *attribute {
 //             Figure 6: Format of XOR-MAPPED-ADDRESS Attribute
 func (v *attribute) xorAddr(transID []byte) *Host {
 	xorIP := make([]byte, 16)
-	for i := 0; i < len(v.value)-4; i++ {
+	for i := 0; i < len(v.value)-4 && i < len(xorIP); i++ {
 		xorIP[i] = v.value[i+4] ^ transID[i]
 	}
 	family := uint16(v.value[1])
 	port := binary.BigEndian.Uint16(v.value[2:4])
-	// Truncate if IPv4, otherwise net.IP sometimes renders it as an IPv6 address.
-	if family == attributeFamilyIPv4 {
-		xorIP = xorIP[:4]
-	}
 	x := binary.BigEndian.Uint16(transID[:2])
-	return &Host{family, net.IP(xorIP).String(), port ^ x}
+	return newHost(netip.AddrPortFrom(familyAddr(family, xorIP), port^x))
 }
 
 //       0                   1                   2                   3
@@ -94,13 +155,18 @@ func (v *attribute) xorAddr(transID []byte) *Host {
 //
 //               Figure 5: Format of MAPPED-ADDRESS Attribute
 func (v *attribute) rawAddr() *Host {
-	host := new(Host)
-	host.family = uint16(v.value[1])
-	host.port = binary.BigEndian.Uint16(v.value[2:4])
-	// Truncate if IPv4, otherwise net.IP sometimes renders it as an IPv6 address.
-	if host.family == attributeFamilyIPv4 {
-		v.value = v.value[:8]
+	family := uint16(v.value[1])
+	port := binary.BigEndian.Uint16(v.value[2:4])
+	return newHost(netip.AddrPortFrom(familyAddr(family, v.value[4:]), port))
+}
+
+// familyAddr returns the address of the given family stored in b, which is
+// padded to at least 4 bytes for IPv4.
+func familyAddr(family uint16, b []byte) netip.Addr {
+	if family == attributeFamilyIPv4 {
+		return netip.AddrFrom4([4]byte(b[:4]))
 	}
-	host.ip = net.IP(v.value[4:]).String()
-	return host
+	var ip [16]byte
+	copy(ip[:], b)
+	return netip.AddrFrom16(ip)
 }
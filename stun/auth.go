@@ -0,0 +1,298 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default lifetime of the nonces issued by the server, which is also
+	// the period of rotation of the secret they are made with.
+	nonceLifetime = 10 * time.Minute
+	// Time during which the retransmissions of an authenticated request
+	// are answered, see RFC 5389 section 7.2.1.
+	replayWindow = 39500 * time.Millisecond
+	// Maximum number of transactions remembered for replay detection.
+	maxReplayEntries = 65536
+)
+
+// CredentialStore looks up the credentials of the users of a server, e.g.
+// from a user database.
+type CredentialStore interface {
+	// Key returns the key of the user in the realm, see LongTermKey, and
+	// false if the user is unknown. The realm is empty for short-term
+	// credentials, whose key is given by ShortTermKey.
+	Key(username, realm string) ([]byte, bool)
+}
+
+// StaticCredentials is a CredentialStore of a fixed user table, mapping
+// usernames to passwords.
+type StaticCredentials map[string]string
+
+// Key returns the key of the user in the realm.
+func (c StaticCredentials) Key(username, realm string) ([]byte, bool) {
+	password, ok := c[username]
+	if !ok {
+		return nil, false
+	}
+	if realm == "" {
+		return ShortTermKey(password), true
+	}
+	return LongTermKey(username, realm, password), true
+}
+
+// serverAuth implements the server side of the long-term credential
+// mechanism (RFC 5389 section 10.2).
+type serverAuth struct {
+	realm string
+
+	mu       sync.Mutex
+	store    CredentialStore
+	lifetime time.Duration
+	secrets  [2][]byte // current and previous secrets
+	rotated  time.Time
+	rand     io.Reader // of the secrets, crypto/rand if nil
+	seen     map[[12]byte]transaction
+}
+
+// transaction is an authenticated transaction seen by the server.
+type transaction struct {
+	source netip.AddrPort
+	at     time.Time
+}
+
+func newServerAuth(realm string, store CredentialStore) *serverAuth {
+	a := &serverAuth{
+		realm:    realm,
+		store:    store,
+		lifetime: nonceLifetime,
+		seen:     make(map[[12]byte]transaction),
+	}
+	return a
+}
+
+// clone returns a copy of a, with its secrets and the transactions it has
+// seen, so that the nonces issued stay valid. The settings of a new snapshot
+// change the copy, while the requests in progress complete with a.
+func (a *serverAuth) clone() *serverAuth {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b := &serverAuth{
+		realm:    a.realm,
+		store:    a.store,
+		lifetime: a.lifetime,
+		secrets:  a.secrets,
+		rotated:  a.rotated,
+		rand:     a.rand,
+		seen:     make(map[[12]byte]transaction, len(a.seen)),
+	}
+	for id, t := range a.seen {
+		b.seen[id] = t
+	}
+	return b
+}
+
+func (a *serverAuth) credentials() CredentialStore {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.store
+}
+
+func (a *serverAuth) setLifetime(d time.Duration) {
+	if d <= 0 {
+		d = nonceLifetime
+	}
+	a.mu.Lock()
+	a.lifetime = d
+	a.mu.Unlock()
+}
+
+// rotate replaces the secret of the nonces, keeping the previous one so that
+// the nonces issued just before stay valid until they expire.
+func (a *serverAuth) rotate(now time.Time) {
+	r := a.rand
+	if r == nil {
+		r = rand.Reader
+	}
+	secret := make([]byte, 16)
+	io.ReadFull(r, secret)
+	a.secrets[1], a.secrets[0] = a.secrets[0], secret
+	a.rotated = now
+}
+
+// secret returns the current and previous secrets, rotating them if due.
+func (a *serverAuth) secret(now time.Time) ([]byte, []byte, time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// The secrets are made on the first use, of the clock of the server.
+	if a.secrets[0] == nil || now.Sub(a.rotated) >= a.lifetime {
+		a.rotate(now)
+	}
+	return a.secrets[0], a.secrets[1], a.lifetime
+}
+
+// nonce returns a nonce for the client at ip, which is made of the time of
+// issue and a MAC binding it to the client, so that it can be verified
+// without keeping state.
+func (a *serverAuth) nonce(ip netip.Addr, now time.Time) string {
+	secret, _, _ := a.secret(now)
+	ts := strconv.FormatInt(now.Unix(), 16)
+	return ts + "-" + nonceMAC(secret, ts, ip)
+}
+
+func nonceMAC(secret []byte, ts string, ip netip.Addr) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write([]byte(ts))
+	b, _ := ip.MarshalBinary()
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// checkNonce reports whether nonce was issued to the client at ip with one
+// of the current secrets and has not expired.
+func (a *serverAuth) checkNonce(nonce string, ip netip.Addr, now time.Time) bool {
+	ts, sum, ok := strings.Cut(nonce, "-")
+	if !ok {
+		return false
+	}
+	cur, prev, lifetime := a.secret(now)
+	if !hmac.Equal([]byte(sum), []byte(nonceMAC(cur, ts, ip))) &&
+		(prev == nil || !hmac.Equal([]byte(sum), []byte(nonceMAC(prev, ts, ip)))) {
+		return false
+	}
+	issued, err := strconv.ParseInt(ts, 16, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(issued, 0))
+	return age < lifetime && age > -time.Minute
+}
+
+// replayed reports whether the authenticated request with the transaction
+// ID from source is a replay: the retransmissions from the same source are
+// accepted during replayWindow, and any other reuse of the ID is not.
+func (a *serverAuth) replayed(transID []byte, source netip.AddrPort, now time.Time) bool {
+	var id [12]byte
+	copy(id[:], transID)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if t, ok := a.seen[id]; ok {
+		return t.source != source || now.Sub(t.at) >= replayWindow
+	}
+	if len(a.seen) >= maxReplayEntries {
+		a.sweep(now)
+	}
+	a.seen[id] = transaction{source, now}
+	return false
+}
+
+// sweep forgets the transactions too old to be retransmitted, whose nonces
+// expire soon as well. The IDs are kept for the lifetime of the nonces if
+// there is room, so that a request cannot be replayed with its nonce.
+func (a *serverAuth) sweep(now time.Time) {
+	for id, t := range a.seen {
+		if now.Sub(t.at) >= a.lifetime {
+			delete(a.seen, id)
+		}
+	}
+	if len(a.seen) < maxReplayEntries {
+		return
+	}
+	for id, t := range a.seen {
+		if now.Sub(t.at) >= replayWindow {
+			delete(a.seen, id)
+		}
+	}
+}
+
+// middleware returns the handler authenticating the requests before passing
+// them to next. Replayed requests are dropped.
+func (a *serverAuth) middleware(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		now := r.cfg.now()
+		key, resp := a.authenticate(r.w.req, r.Bytes(), r.Source, now)
+		if resp != nil {
+			r.w.resp = resp
+			return
+		}
+		if a.replayed(r.TransactionID(), r.Source.AddrPort(), now) {
+			r.w.dropped, r.w.reason = true, DroppedReplay
+			return
+		}
+		r.w.key = key
+		next.ServeSTUN(w, r)
+	})
+}
+
+// authenticate checks the credentials of the request req, whose raw bytes are
+// b, sent from host at now. It returns the key to sign the response with, or
+// the error response to send instead.
+func (a *serverAuth) authenticate(req *packet, b []byte, host *Host, now time.Time) ([]byte, *packet) {
+	if a.realm == "" {
+		return a.authenticateShortTerm(req, b)
+	}
+	if !req.hasAttribute(attributeMessageIntegrity) {
+		return nil, a.challenge(req, errorUnauthorized, host, now)
+	}
+	username := req.getString(attributeUsername)
+	realm := req.getString(attributeRealm)
+	nonce := req.getString(attributeNonce)
+	if username == "" || realm == "" || nonce == "" {
+		return nil, newErrorResponse(req, errorBadRequest)
+	}
+	if !a.checkNonce(nonce, host.Addr(), now) {
+		return nil, a.challenge(req, errorStaleNonce, host, now)
+	}
+	key, ok := a.credentials().Key(username, a.realm)
+	if !ok || !checkMessageIntegrity(b, key) {
+		return nil, a.challenge(req, errorUnauthorized, host, now)
+	}
+	return key, nil
+}
+
+// authenticateShortTerm checks the short-term credentials of the request
+// (RFC 5389 section 10.1.2), which need no challenge as they are provisioned
+// to the clients beforehand.
+func (a *serverAuth) authenticateShortTerm(req *packet, b []byte) ([]byte, *packet) {
+	username := req.getString(attributeUsername)
+	if username == "" || !req.hasAttribute(attributeMessageIntegrity) {
+		return nil, newErrorResponse(req, errorBadRequest)
+	}
+	key, ok := a.credentials().Key(username, "")
+	if !ok || !checkMessageIntegrity(b, key) {
+		return nil, newErrorResponse(req, errorUnauthorized)
+	}
+	return key, nil
+}
+
+// challenge returns the error response carrying the realm and a fresh nonce.
+func (a *serverAuth) challenge(req *packet, code int, host *Host, now time.Time) *packet {
+	resp := newErrorResponse(req, code)
+	resp.addAttribute(*newAttribute(attributeRealm, []byte(a.realm)))
+	resp.addAttribute(*newAttribute(attributeNonce, []byte(a.nonce(host.Addr(), now))))
+	return resp
+}
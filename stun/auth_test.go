@@ -0,0 +1,162 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newAuthRequest(t *testing.T, username, realm, nonce, password string) []byte {
+	req, err := newPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.types = typeBindingRequest
+	req.addAttribute(*newAttribute(attributeUsername, []byte(username)))
+	req.addAttribute(*newAttribute(attributeRealm, []byte(realm)))
+	req.addAttribute(*newAttribute(attributeNonce, []byte(nonce)))
+	req.addAttribute(*newMessageIntegrityAttribute(req, LongTermKey(username, realm, password)))
+	return req.bytes()
+}
+
+func TestServerAuth(t *testing.T) {
+	s := NewServer()
+	s.SetAuth("example.org", StaticCredentials{"alice": "secret"})
+	addr := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678}
+	handle := func(b []byte) *packet {
+		resp, _, _ := s.handle(b, addr, &listener{}, time.Now())
+		p, err := newPacketFromBytes(resp)
+		if err != nil {
+			t.Fatalf("handle error: %v", err)
+		}
+		return p
+	}
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	resp := handle(req.bytes())
+	if resp.getErrorCode() != errorUnauthorized {
+		t.Fatalf("handle error: expected 401, get %d", resp.getErrorCode())
+	}
+	realm, nonce := resp.getString(attributeRealm), resp.getString(attributeNonce)
+	if realm != "example.org" || nonce == "" {
+		t.Fatalf("handle error: realm %q nonce %q", realm, nonce)
+	}
+	b := newAuthRequest(t, "alice", realm, nonce, "secret")
+	resp = handle(b)
+	if resp.types != typeBindingResponse {
+		t.Fatalf("handle error: expected success, get %d", resp.getErrorCode())
+	}
+	raw := resp.bytes()
+	if !checkMessageIntegrity(raw, LongTermKey("alice", realm, "secret")) {
+		t.Errorf("handle error: response integrity")
+	}
+	if resp = handle(newAuthRequest(t, "alice", realm, nonce, "wrong")); resp.getErrorCode() != errorUnauthorized {
+		t.Errorf("handle error: expected 401, get %d", resp.getErrorCode())
+	}
+	if resp = handle(newAuthRequest(t, "alice", realm, "0-0", "secret")); resp.getErrorCode() != errorStaleNonce {
+		t.Errorf("handle error: expected 438, get %d", resp.getErrorCode())
+	}
+	if resp = handle(newAuthRequest(t, "bob", realm, nonce, "secret")); resp.getErrorCode() != errorUnauthorized {
+		t.Errorf("handle error: expected 401, get %d", resp.getErrorCode())
+	}
+}
+
+func TestServerShortTermAuth(t *testing.T) {
+	s := NewServer()
+	s.SetAuth("", StaticCredentials{"alice": "secret"})
+	s.SetRequireFingerprint(true)
+	addr := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678}
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	if b, _, _ := s.handle(req.bytes(), addr, &listener{}, time.Now()); b != nil {
+		t.Errorf("handle error: request without fingerprint answered")
+	}
+	req.addAttribute(*newAttribute(attributeUsername, []byte("alice")))
+	req.addAttribute(*newMessageIntegrityAttribute(req, ShortTermKey("secret")))
+	req.addAttribute(*newFingerprintAttribute(req))
+	b, _, _ := s.handle(req.bytes(), addr, &listener{}, time.Now())
+	resp, err := newPacketFromBytes(b)
+	if err != nil || resp.types != typeBindingResponse {
+		t.Fatalf("handle error: %v", err)
+	}
+	if !checkMessageIntegrity(b, ShortTermKey("secret")) || !checkFingerprint(b) {
+		t.Errorf("handle error: response not protected")
+	}
+	if b, _, _ = s.handle(req.bytes(), addr, &listener{}, time.Now()); b == nil {
+		t.Errorf("handle error: retransmission not answered")
+	}
+	other := &net.UDPAddr{IP: net.ParseIP("5.6.7.8"), Port: 5678}
+	if b, _, _ = s.handle(req.bytes(), other, &listener{}, time.Now()); b != nil {
+		t.Errorf("handle error: replayed request answered")
+	}
+}
+
+func TestNonceRotation(t *testing.T) {
+	a := newServerAuth("example.org", StaticCredentials{})
+	ip := netip.MustParseAddr("1.2.3.4")
+	now := time.Now()
+	nonce := a.nonce(ip, now)
+	if !a.checkNonce(nonce, ip, now) || a.checkNonce(nonce, netip.MustParseAddr("5.6.7.8"), now) {
+		t.Errorf("checkNonce error: nonce not bound to the client")
+	}
+	a.lifetime = time.Minute
+	now = now.Add(30 * time.Second)
+	a.rotate(now)
+	if !a.checkNonce(nonce, ip, now) {
+		t.Errorf("checkNonce error: nonce invalid after rotation")
+	}
+	if now = now.Add(time.Minute); a.checkNonce(nonce, ip, now) {
+		t.Errorf("checkNonce error: nonce valid after expiry")
+	}
+	if a.secrets[1] == nil {
+		t.Errorf("nonce error: secret not rotated")
+	}
+}
+
+// fakeClock is a clock of the time set by the test.
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestServerAuthClock(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := NewServer()
+	s.SetClock(clock)
+	s.SetAuth("example.org", StaticCredentials{"alice": "secret"})
+	addr := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678}
+	handle := func(b []byte) *packet {
+		resp, _, _ := s.handle(b, addr, &listener{}, clock.now)
+		p, err := newPacketFromBytes(resp)
+		if err != nil {
+			t.Fatalf("handle error: %v", err)
+		}
+		return p
+	}
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	nonce := handle(req.bytes()).getString(attributeNonce)
+	if resp := handle(newAuthRequest(t, "alice", "example.org", nonce, "secret")); resp.types != typeBindingResponse {
+		t.Fatalf("handle error: expected success, get %d", resp.getErrorCode())
+	}
+	clock.now = clock.now.Add(2 * nonceLifetime)
+	if resp := handle(newAuthRequest(t, "alice", "example.org", nonce, "secret")); resp.getErrorCode() != errorStaleNonce {
+		t.Errorf("handle error: expected 438 after expiry, get %d", resp.getErrorCode())
+	}
+}
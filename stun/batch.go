@@ -0,0 +1,54 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"net/netip"
+)
+
+// relayBatchSize is the number of datagrams the relay reads and writes at
+// once.
+const relayBatchSize = 32
+
+// datagram is an UDP datagram of a batch: the payload buf[:n] received from
+// or sent to addr.
+type datagram struct {
+	buf  []byte
+	n    int
+	addr netip.AddrPort
+}
+
+// readOne reads one datagram into msgs[0].
+func readOne(conn *net.UDPConn, msgs []datagram) (int, error) {
+	n, addr, err := conn.ReadFromUDPAddrPort(msgs[0].buf)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].n, msgs[0].addr = n, addr
+	return 1, nil
+}
+
+// writeEach writes the datagrams one at a time.
+func writeEach(conn *net.UDPConn, msgs []datagram) error {
+	for _, m := range msgs {
+		if _, err := conn.WriteToUDPAddrPort(m.buf[:m.n], m.addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+//go:build linux && (amd64 || arm64)
+
+package stun
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr is the struct mmsghdr of recvmmsg(2) and sendmmsg(2).
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// batchConn reads and writes the datagrams of a batch with one recvmmsg or
+// sendmmsg system call. It is not safe for concurrent use.
+type batchConn struct {
+	conn  *net.UDPConn
+	rc    syscall.RawConn // nil if the socket is not available
+	ipv6  bool            // family of the socket
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrInet6
+
+	// The arguments and the results of the system call, kept here with
+	// the functions calling it so that no closure is allocated by call.
+	trap  uintptr
+	n     int
+	r     uintptr
+	errno syscall.Errno
+	call  func(fd uintptr) bool
+}
+
+func newBatchConn(conn *net.UDPConn, size int) *batchConn {
+	b := &batchConn{
+		conn:  conn,
+		hdrs:  make([]mmsghdr, size),
+		iovs:  make([]syscall.Iovec, size),
+		names: make([]syscall.RawSockaddrInet6, size),
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return b
+	}
+	var sa syscall.Sockaddr
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		sa, serr = syscall.Getsockname(int(fd))
+	}); err != nil || serr != nil {
+		return b
+	}
+	_, b.ipv6 = sa.(*syscall.SockaddrInet6)
+	b.rc = rc
+	b.call = func(fd uintptr) bool {
+		for {
+			b.r, _, b.errno = syscall.Syscall6(b.trap, fd, uintptr(unsafe.Pointer(&b.hdrs[0])), uintptr(b.n), syscall.MSG_DONTWAIT, 0, 0)
+			if b.errno != syscall.EINTR {
+				return b.errno != syscall.EAGAIN
+			}
+		}
+	}
+	return b
+}
+
+// prepare points the first n headers at the buffers of msgs.
+func (b *batchConn) prepare(msgs []datagram) int {
+	n := len(msgs)
+	if n > len(b.hdrs) {
+		n = len(b.hdrs)
+	}
+	for i := 0; i < n; i++ {
+		b.iovs[i].Base = &msgs[i].buf[0]
+		b.iovs[i].SetLen(len(msgs[i].buf))
+		h := &b.hdrs[i].hdr
+		h.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		h.Namelen = syscall.SizeofSockaddrInet6
+		h.Iov = &b.iovs[i]
+		h.Iovlen = 1
+	}
+	return n
+}
+
+// mmsg calls recvmmsg or sendmmsg on the first n headers, waiting until
+// the socket is ready, and returns the number of datagrams handled.
+func (b *batchConn) mmsg(trap uintptr, n int) (int, error) {
+	b.trap, b.n = trap, n
+	var err error
+	if trap == sysRecvmmsg {
+		err = b.rc.Read(b.call)
+	} else {
+		err = b.rc.Write(b.call)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if b.errno != 0 {
+		name := "recvmmsg"
+		if trap == sysSendmmsg {
+			name = "sendmmsg"
+		}
+		return 0, os.NewSyscallError(name, b.errno)
+	}
+	return int(b.r), nil
+}
+
+// read reads at least one datagram into msgs, and returns the number read.
+func (b *batchConn) read(msgs []datagram) (int, error) {
+	if b.rc == nil || len(msgs) == 0 {
+		return readOne(b.conn, msgs)
+	}
+	n, err := b.mmsg(sysRecvmmsg, b.prepare(msgs))
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		msgs[i].n = int(b.hdrs[i].len)
+		msgs[i].addr = sockaddrAddrPort(&b.names[i])
+	}
+	return n, nil
+}
+
+// write writes the datagrams.
+func (b *batchConn) write(msgs []datagram) error {
+	if b.rc == nil {
+		return writeEach(b.conn, msgs)
+	}
+	for len(msgs) > 0 {
+		n := b.prepare(msgs)
+		for i := 0; i < n; i++ {
+			b.iovs[i].SetLen(msgs[i].n)
+			b.hdrs[i].hdr.Namelen = putSockaddr(&b.names[i], msgs[i].addr, b.ipv6)
+		}
+		sent, err := b.mmsg(sysSendmmsg, n)
+		if err != nil {
+			return err
+		}
+		msgs = msgs[sent:]
+	}
+	return nil
+}
+
+// sockaddrAddrPort returns the address of the struct sockaddr_in or
+// sockaddr_in6 sa.
+func sockaddrAddrPort(sa *syscall.RawSockaddrInet6) netip.AddrPort {
+	if sa.Family == syscall.AF_INET {
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		return netip.AddrPortFrom(netip.AddrFrom4(sa4.Addr), sockaddrPort(sa4.Port))
+	}
+	return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), sockaddrPort(sa.Port))
+}
+
+// putSockaddr writes addr to sa as a struct sockaddr_in, or as a struct
+// sockaddr_in6 for an IPv6 socket, and returns its length.
+func putSockaddr(sa *syscall.RawSockaddrInet6, addr netip.AddrPort, ipv6 bool) uint32 {
+	if !ipv6 {
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		*sa4 = syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: addr.Addr().Unmap().As4()}
+		binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa4.Port))[:], addr.Port())
+		return syscall.SizeofSockaddrInet4
+	}
+	*sa = syscall.RawSockaddrInet6{Family: syscall.AF_INET6, Addr: addr.Addr().As16()}
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], addr.Port())
+	return syscall.SizeofSockaddrInet6
+}
+
+// sockaddrPort converts a port in network byte order.
+func sockaddrPort(port uint16) uint16 {
+	return binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&port))[:])
+}
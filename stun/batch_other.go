@@ -0,0 +1,43 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+//go:build !linux || !(amd64 || arm64)
+
+package stun
+
+import (
+	"net"
+)
+
+// batchConn reads and writes the datagrams of a batch one at a time, as
+// the platform has no system call for several.
+type batchConn struct {
+	conn *net.UDPConn
+}
+
+func newBatchConn(conn *net.UDPConn, size int) *batchConn {
+	return &batchConn{conn}
+}
+
+// read reads at least one datagram into msgs, and returns the number read.
+func (b *batchConn) read(msgs []datagram) (int, error) {
+	return readOne(b.conn, msgs)
+}
+
+// write writes the datagrams.
+func (b *batchConn) write(msgs []datagram) error {
+	return writeEach(b.conn, msgs)
+}
@@ -0,0 +1,69 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestBatchConn(t *testing.T) {
+	for _, network := range []string{"udp4", "udp"} {
+		recv, err := net.ListenUDP(network, &net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer recv.Close()
+		send, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer send.Close()
+		to := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(recv.LocalAddr().(*net.UDPAddr).Port))
+		msgs := []datagram{
+			{buf: []byte("one"), n: 3, addr: to},
+			{buf: []byte("two!"), n: 4, addr: to},
+		}
+		if err := newBatchConn(send, 4).write(msgs); err != nil {
+			t.Fatalf("%s: write error: %v", network, err)
+		}
+		in := newBatchConn(recv, 4)
+		got := make([]datagram, 4)
+		var payloads []string
+		recv.SetReadDeadline(time.Now().Add(time.Second))
+		for len(payloads) < 2 {
+			for i := range got {
+				got[i].buf = make([]byte, 16)
+			}
+			n, err := in.read(got)
+			if err != nil {
+				t.Fatalf("%s: read error: %v", network, err)
+			}
+			for _, m := range got[:n] {
+				if m.addr.Addr().Unmap() != to.Addr() || int(m.addr.Port()) != send.LocalAddr().(*net.UDPAddr).Port {
+					t.Errorf("%s: read error: from %v", network, m.addr)
+				}
+				payloads = append(payloads, string(m.buf[:m.n]))
+			}
+		}
+		if payloads[0] != "one" || payloads[1] != "two!" {
+			t.Errorf("%s: read error: %q", network, payloads)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// Behavior is the mapping or the filtering behavior of a NAT (RFC 4787).
+type Behavior int
+
+// Behaviors of RFC 4787 sections 4.1 and 5.
+const (
+	BehaviorUnknown Behavior = iota
+	BehaviorEndpointIndependent
+	BehaviorAddressDependent
+	BehaviorAddressPortDependent
+)
+
+var behaviorStr = map[Behavior]string{
+	BehaviorUnknown:              "Unknown",
+	BehaviorEndpointIndependent:  "Endpoint-independent",
+	BehaviorAddressDependent:     "Address-dependent",
+	BehaviorAddressPortDependent: "Address and port-dependent",
+}
+
+func (b Behavior) String() string {
+	if s, ok := behaviorStr[b]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+var behaviorName = map[Behavior]string{
+	BehaviorUnknown:              "unknown",
+	BehaviorEndpointIndependent:  "endpoint-independent",
+	BehaviorAddressDependent:     "address-dependent",
+	BehaviorAddressPortDependent: "address-port-dependent",
+}
+
+// MarshalText implements encoding.TextMarshaler, so that the behavior
+// marshals to its name, e.g. "endpoint-independent".
+func (b Behavior) MarshalText() ([]byte, error) {
+	if s, ok := behaviorName[b]; ok {
+		return []byte(s), nil
+	}
+	return []byte("unknown"), nil
+}
+
+// NATBehavior is the behavior of a NAT discovered by DiscoverBehavior.
+type NATBehavior struct {
+	// Mapping tells on which the NAT reuses a mapping for the packets of
+	// an internal address to other destinations, and Filtering from which
+	// sources it lets the packets in to a mapping.
+	Mapping   Behavior
+	Filtering Behavior
+	// Mapped is the address mapped for the primary address of the server.
+	Mapped *Host
+}
+
+// DiscoverBehavior discovers the mapping and filtering behaviors of the NAT
+// by the tests of RFC 5780 sections 4.3 and 4.4, against a STUN server of
+// an alternate address, i.e. which responds with OTHER-ADDRESS. The mapping
+// tests bind to the primary address and the alternate ones, and the
+// filtering tests ask the server to respond from these, of another socket
+// not to be let in by the mappings of the former. The connection passed by
+// NewClientWithConnection is used for the mapping tests if any.
+func (c *Client) DiscoverBehavior() (*NATBehavior, error) {
+	if c.serverAddr == "" {
+		c.SetServerAddr(DefaultServerAddr)
+	}
+	addr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn := c.conn
+	if conn == nil {
+		conn, err = listenUDP(c.iface)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+	}
+	b := &NATBehavior{}
+	// Test I: the address mapped for the primary address.
+	resp, err := c.test1(conn, addr)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.mappedAddr == nil {
+		return nil, errors.New("No response from the STUN server.")
+	}
+	b.Mapped = resp.mappedAddr
+	other := resp.otherAddr
+	if other == nil {
+		other = resp.changedAddr
+	}
+	if other == nil {
+		return nil, errors.New("Server error: no other address.")
+	}
+	if resp.identical {
+		b.Mapping = BehaviorEndpointIndependent
+	} else {
+		b.Mapping, err = c.mappingBehavior(conn, addr, other, b.Mapped)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fconn, err := listenUDP(c.iface)
+	if err != nil {
+		return nil, err
+	}
+	defer fconn.Close()
+	b.Filtering, err = c.filteringBehavior(fconn, addr)
+	if err != nil {
+		return nil, err
+	}
+	c.logger.Debugln("Mapping:", b.Mapping, "filtering:", b.Filtering)
+	return b, nil
+}
+
+// mappingBehavior compares the mapped addresses of the alternate address
+// of the primary port, Test II, and of the alternate port, Test III, with
+// the one of the primary address.
+func (c *Client) mappingBehavior(conn net.PacketConn, addr *net.UDPAddr, other, mapped *Host) (Behavior, error) {
+	altIP := net.UDPAddrFromAddrPort(netip.AddrPortFrom(other.Addr(), uint16(addr.Port)))
+	resp, err := c.test1(conn, altIP)
+	if err != nil {
+		return BehaviorUnknown, err
+	}
+	if resp == nil || resp.mappedAddr == nil {
+		return BehaviorUnknown, errors.New("No response from the alternate address.")
+	}
+	if sameHost(resp.mappedAddr, mapped) {
+		return BehaviorEndpointIndependent, nil
+	}
+	mapped = resp.mappedAddr
+	resp, err = c.test1(conn, net.UDPAddrFromAddrPort(other.AddrPort()))
+	if err != nil {
+		return BehaviorUnknown, err
+	}
+	if resp == nil || resp.mappedAddr == nil {
+		return BehaviorUnknown, errors.New("No response from the alternate address.")
+	}
+	if sameHost(resp.mappedAddr, mapped) {
+		return BehaviorAddressDependent, nil
+	}
+	return BehaviorAddressPortDependent, nil
+}
+
+// filteringBehavior asks the server to respond from the alternate address
+// and port, Test II, and from the alternate port, Test III.
+func (c *Client) filteringBehavior(conn net.PacketConn, addr *net.UDPAddr) (Behavior, error) {
+	resp, err := c.test1(conn, addr)
+	if err != nil {
+		return BehaviorUnknown, err
+	}
+	if resp == nil {
+		return BehaviorUnknown, errors.New("No response from the STUN server.")
+	}
+	resp, err = c.test2(conn, addr)
+	if err != nil {
+		return BehaviorUnknown, err
+	}
+	if resp != nil {
+		return BehaviorEndpointIndependent, nil
+	}
+	resp, err = c.test3(conn, addr)
+	if err != nil {
+		return BehaviorUnknown, err
+	}
+	if resp != nil {
+		return BehaviorAddressDependent, nil
+	}
+	return BehaviorAddressPortDependent, nil
+}
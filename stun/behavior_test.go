@@ -0,0 +1,58 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDiscoverBehavior(t *testing.T) {
+	conns, err := listenAlternate("127.0.0.1:0", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("listenAlternate: %v", err)
+	}
+	s := NewServer()
+	go s.ServeAlternate(conns)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(conns[0][0].LocalAddr().String())
+	b, err := c.DiscoverBehavior()
+	if err != nil {
+		t.Fatalf("DiscoverBehavior error: %v", err)
+	}
+	if b.Mapping != BehaviorEndpointIndependent || b.Filtering != BehaviorEndpointIndependent || b.Mapped == nil {
+		t.Errorf("DiscoverBehavior error: %+v", b)
+	}
+	// The mapping of the alternate address taken for another one.
+	conn, err := listenUDP("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := conns[0][0].LocalAddr().(*net.UDPAddr)
+	other := hostFromAddr(conns[1][1].LocalAddr())
+	if m, err := c.mappingBehavior(conn, addr, other, newHostFromStr("192.0.2.1:1")); err != nil || m != BehaviorAddressDependent {
+		t.Errorf("mappingBehavior error: %v, %v", m, err)
+	}
+	// A server of a single address.
+	_, single := newTestServer(t)
+	c.SetServerAddr(single)
+	if _, err := c.DiscoverBehavior(); err == nil {
+		t.Error("DiscoverBehavior error: expected no other address")
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults of BenchOptions.
+const (
+	defaultBenchRequests    = 1000
+	defaultBenchConcurrency = 10
+)
+
+// BenchOptions are the options of Bench. The zero values are the defaults.
+type BenchOptions struct {
+	// Requests is the number of the Binding transactions, 1000 by
+	// default, or unlimited if Duration is set.
+	Requests int
+	// Duration is the time after which no transaction is started anymore,
+	// none by default.
+	Duration time.Duration
+	// Concurrency is the number of the transactions in flight, each of a
+	// socket, 10 by default.
+	Concurrency int
+	// Rate is the number of the transactions started per second, as many
+	// as the concurrency allows by default.
+	Rate float64
+	// Size is the size of the requests, padded with the PADDING attribute
+	// of RFC 5780, that of a plain request if less.
+	Size int
+	// Timeout is the time a transaction is waited for, 1s by default,
+	// after which it is lost.
+	Timeout time.Duration
+}
+
+// BenchResult are the latencies and the loss of the transactions of Bench.
+type BenchResult struct {
+	Server string
+	// Sent is the number of the transactions, of which Responded are
+	// responded to, and Errors by an error response.
+	Sent      int
+	Responded int
+	Errors    int
+	// Elapsed is the duration of the run.
+	Elapsed time.Duration
+	// The round-trip times of the transactions responded to: the mean,
+	// the extremes and the percentiles.
+	Mean time.Duration
+	Min  time.Duration
+	P50  time.Duration
+	P90  time.Duration
+	P99  time.Duration
+	Max  time.Duration
+}
+
+// Loss is the fraction of the transactions lost.
+func (r *BenchResult) Loss() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.Sent-r.Responded) / float64(r.Sent)
+}
+
+// Rate is the number of the transactions per second of the run.
+func (r *BenchResult) Rate() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Sent) / r.Elapsed.Seconds()
+}
+
+// MarshalJSON implements json.Marshaler, with Loss and Rate.
+func (r BenchResult) MarshalJSON() ([]byte, error) {
+	type benchResult BenchResult
+	return json.Marshal(struct {
+		benchResult
+		Loss float64
+		Rate float64
+	}{benchResult(r), r.Loss(), r.Rate()})
+}
+
+// Bench generates a load of Binding transactions to the STUN server, the
+// server of the client if empty, and returns their latencies and loss, to
+// validate the capacity of a server. The transactions are not
+// retransmitted, and a lost one is waited for until the timeout before the
+// socket is used again, so the rate is at most the concurrency over the
+// round-trip time. Canceling ctx stops the run, the result so far returned
+// with the error of ctx.
+func (c *Client) Bench(ctx context.Context, server string, opts *BenchOptions) (*BenchResult, error) {
+	o := BenchOptions{Requests: defaultBenchRequests, Concurrency: defaultBenchConcurrency, Timeout: defaultPingTimeout}
+	if opts != nil {
+		o.Duration, o.Rate, o.Size = opts.Duration, opts.Rate, opts.Size
+		if opts.Requests > 0 {
+			o.Requests = opts.Requests
+		} else if opts.Duration > 0 {
+			o.Requests = 0
+		}
+		if opts.Concurrency > 0 {
+			o.Concurrency = opts.Concurrency
+		}
+		if opts.Timeout > 0 {
+			o.Timeout = opts.Timeout
+		}
+	}
+	if server == "" {
+		if c.serverAddr == "" {
+			c.SetServerAddr(DefaultServerAddr)
+		}
+		server = c.serverAddr
+	}
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	conns := make([]net.PacketConn, o.Concurrency)
+	for i := range conns {
+		if conns[i], err = listenUDP(c.iface); err != nil {
+			closeConns(conns[:i])
+			return nil, err
+		}
+	}
+	defer closeConns(conns)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	res := &BenchResult{Server: server}
+	var rtts []time.Duration
+	var mu sync.Mutex
+	var failure error
+	jobs := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn net.PacketConn) {
+			defer wg.Done()
+			buf := make([]byte, maxPacketSize+o.Size)
+			for range jobs {
+				pkt, err := c.newPaddedBindingReq(o.Size)
+				var resp *packet
+				var rtt time.Duration
+				if err == nil {
+					resp, _, rtt, err = c.roundTrip(ctx, conn, addr, pkt, buf, o.Timeout)
+				}
+				mu.Lock()
+				switch {
+				case err != nil:
+					if failure == nil && ctx.Err() == nil {
+						failure = err
+						cancel()
+					}
+				case resp == nil:
+					res.Sent++
+				default:
+					res.Sent++
+					res.Responded++
+					if resp.types&classMask == classError {
+						res.Errors++
+					}
+					rtts = append(rtts, rtt)
+				}
+				mu.Unlock()
+			}
+		}(conn)
+	}
+	start := time.Now()
+	dispatchBench(ctx, jobs, o)
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	if len(rtts) > 0 {
+		res.summarize(rtts)
+	}
+	if failure != nil {
+		return res, failure
+	}
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	if res.Responded == 0 {
+		return res, errors.New("No response from the STUN server.")
+	}
+	return res, nil
+}
+
+// dispatchBench starts the transactions of the options on jobs, at the
+// rate of the options if any, until ctx is done, and closes jobs.
+func dispatchBench(ctx context.Context, jobs chan<- struct{}, o BenchOptions) {
+	defer close(jobs)
+	var ticks <-chan time.Time
+	if o.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / o.Rate))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	var deadline <-chan time.Time
+	if o.Duration > 0 {
+		timer := time.NewTimer(o.Duration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for i := 0; o.Requests == 0 || i < o.Requests; i++ {
+		if ticks != nil && i > 0 {
+			select {
+			case <-ticks:
+			case <-deadline:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case jobs <- struct{}{}:
+		case <-deadline:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newPaddedBindingReq returns a Binding request of the software name,
+// padded to size bytes if larger.
+func (c *Client) newPaddedBindingReq(size int) (*packet, error) {
+	pkt, err := newPacketRand(c.rand)
+	if err != nil {
+		return nil, err
+	}
+	pkt.types = typeBindingRequest
+	pkt.addAttribute(*newSoftwareAttribute(c.softwareName))
+	// The padding header and the fingerprint.
+	if pad := size - len(pkt.bytes()) - 4 - 8; pad > 0 {
+		pkt.addAttribute(*newPaddingAttribute(pad))
+	}
+	pkt.addAttribute(*newFingerprintAttribute(pkt))
+	return pkt, nil
+}
+
+// summarize computes the statistics of the round-trip times.
+func (r *BenchResult) summarize(rtts []time.Duration) {
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	var sum time.Duration
+	for _, rtt := range rtts {
+		sum += rtt
+	}
+	r.Mean = sum / time.Duration(len(rtts))
+	r.Min, r.Max = rtts[0], rtts[len(rtts)-1]
+	r.P50, r.P90, r.P99 = percentile(rtts, 50), percentile(rtts, 90), percentile(rtts, 99)
+}
+
+// percentile returns the p-th percentile of the sorted durations, of the
+// nearest rank.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return sorted[i-1]
+}
+
+// closeConns closes the connections.
+func closeConns(conns []net.PacketConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
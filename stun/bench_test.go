@@ -0,0 +1,87 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBench(t *testing.T) {
+	_, addr := newTestServer(t)
+	c := NewClient()
+	res, err := c.Bench(context.Background(), addr, &BenchOptions{Requests: 200, Concurrency: 4, Size: 600})
+	if err != nil {
+		t.Fatalf("Bench error: %v", err)
+	}
+	if res.Sent != 200 || res.Responded != 200 || res.Errors != 0 || res.Loss() != 0 {
+		t.Errorf("Bench error: %d sent, %d responded, %d errors", res.Sent, res.Responded, res.Errors)
+	}
+	if res.Min <= 0 || res.Min > res.P50 || res.P50 > res.P90 || res.P90 > res.P99 || res.P99 > res.Max {
+		t.Errorf("Bench error: min %v, p50 %v, p90 %v, p99 %v, max %v", res.Min, res.P50, res.P90, res.P99, res.Max)
+	}
+	// 10 transactions at 200 per second take 45ms at least.
+	res, err = c.Bench(context.Background(), addr, &BenchOptions{Requests: 10, Rate: 200})
+	if err != nil {
+		t.Fatalf("Bench error: %v", err)
+	}
+	if res.Sent != 10 || res.Elapsed < 45*time.Millisecond {
+		t.Errorf("Bench error: %d sent in %v", res.Sent, res.Elapsed)
+	}
+	// The transactions are not retransmitted.
+	res, err = c.Bench(context.Background(), newLossyServer(t), &BenchOptions{Requests: 4, Timeout: 20 * time.Millisecond})
+	if err == nil || res.Sent != 4 || res.Loss() != 1 {
+		t.Errorf("Bench error: %v, %d sent, loss %v", err, res.Sent, res.Loss())
+	}
+}
+
+func TestBenchDuration(t *testing.T) {
+	_, addr := newTestServer(t)
+	c := NewClient()
+	res, err := c.Bench(context.Background(), addr, &BenchOptions{Duration: 50 * time.Millisecond, Concurrency: 2})
+	if err != nil {
+		t.Fatalf("Bench error: %v", err)
+	}
+	if res.Sent == 0 || res.Elapsed < 50*time.Millisecond {
+		t.Errorf("Bench error: %d sent in %v", res.Sent, res.Elapsed)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	res, err = c.Bench(ctx, addr, &BenchOptions{Duration: time.Hour})
+	if err != context.DeadlineExceeded || res == nil || res.Sent == 0 {
+		t.Errorf("Bench error: %v, expected the result so far", err)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	rtts := make([]time.Duration, 100)
+	for i := range rtts {
+		rtts[i] = time.Duration(i + 1)
+	}
+	for _, c := range []struct {
+		p    int
+		want time.Duration
+	}{{50, 50}, {90, 90}, {99, 99}, {100, 100}, {0, 1}} {
+		if got := percentile(rtts, c.p); got != c.want {
+			t.Errorf("percentile error: %d-th %v, expected %v", c.p, got, c.want)
+		}
+	}
+	if got := percentile(rtts[:1], 99); got != 1 {
+		t.Errorf("percentile error: %v of one", got)
+	}
+}
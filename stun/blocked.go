@@ -0,0 +1,102 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	// blockedTimeout is the timeout in ms of the checks over TCP and TLS
+	// when UDP is blocked.
+	blockedTimeout = 5000
+	// defaultTLSPort is the port of STUN over TLS of RFC 5389.
+	defaultTLSPort = "5349"
+)
+
+// blockedVerdict tells, once every UDP test timed out, a firewall blocking
+// UDP, NATBlocked, from no connectivity at all, NATUnreachable, by binding
+// to the STUN server over TCP, of the same address, and TLS, of the port
+// 5349, at once. Of a ReplayConn, the bindings recorded are replayed in
+// turn instead.
+func (c *Client) blockedVerdict() NATType {
+	addrs := map[string]string{TransportTCP: c.serverAddr}
+	if host, _, err := net.SplitHostPort(c.serverAddr); err == nil {
+		addrs[TransportTLS] = net.JoinHostPort(host, defaultTLSPort)
+	}
+	if rc, ok := c.conn.(*ReplayConn); ok {
+		return c.replayBlockedVerdict(rc, addrs)
+	}
+	var mu sync.Mutex
+	reached := false
+	var wg sync.WaitGroup
+	for transport, addr := range addrs {
+		wg.Add(1)
+		go func(transport, addr string) {
+			defer wg.Done()
+			host, err := c.bindStream(transport, addr)
+			if err != nil {
+				c.logger.Debugln("Binding over", transport, "to", addr, ":", err)
+				return
+			}
+			c.logger.Debugln("UDP is blocked, mapped over", transport, ":", host)
+			mu.Lock()
+			reached = true
+			mu.Unlock()
+		}(transport, addr)
+	}
+	wg.Wait()
+	if reached {
+		return NATBlocked
+	}
+	return NATUnreachable
+}
+
+// bindStream sends a Binding request over TCP or TLS of blockedTimeout.
+func (c *Client) bindStream(transport, addr string) (*Host, error) {
+	sc, err := dialStreamTimeout(transport, addr, c.tlsOptions, blockedTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer sc.Close()
+	resp, err := c.test1(sc, sc.RemoteAddr())
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.mappedAddr == nil {
+		return nil, errors.New("No mapped address from the STUN server.")
+	}
+	return resp.mappedAddr, nil
+}
+
+// replayBlockedVerdict is blockedVerdict of the bindings over TCP and TLS
+// to addrs recorded by rc, written to the capture as datagrams.
+func (c *Client) replayBlockedVerdict(rc *ReplayConn, addrs map[string]string) NATType {
+	for _, addr := range addrs {
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			continue
+		}
+		resp, err := c.test1(rc, raddr)
+		if err == nil && resp != nil && resp.mappedAddr != nil {
+			return NATBlocked
+		}
+	}
+	return NATUnreachable
+}
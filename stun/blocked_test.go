@@ -0,0 +1,47 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBlockedVerdict(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	go s.ServeListener(ln)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(ln.Addr().String())
+	if nat := c.blockedVerdict(); nat != NATBlocked {
+		t.Errorf("blockedVerdict error: %v, expected %v", nat, NATBlocked)
+	}
+	// Nothing listening.
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	c.SetServerAddr(ln.Addr().String())
+	if nat := c.blockedVerdict(); nat != NATUnreachable {
+		t.Errorf("blockedVerdict error: %v, expected %v", nat, NATUnreachable)
+	}
+}
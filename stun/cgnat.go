@@ -0,0 +1,220 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// sharedAddrSpace is the shared address space of the carrier-grade NATs
+// (RFC 6598).
+var sharedAddrSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// The hops traced by DetectCGNAT, and the time to wait for the ICMP error
+// of each.
+const (
+	traceHops    = 4
+	traceTimeout = 300 * time.Millisecond
+	// gatewayTimeout is the time to wait for the external address of the
+	// gateway.
+	gatewayTimeout = time.Second
+)
+
+// CGNATReport is the evidence of a carrier-grade NAT between the host and
+// the STUN server, and of the layers of NAT.
+type CGNATReport struct {
+	// Local is the local address of the route to the server.
+	Local netip.Addr
+	// Mapped is the mapped address of the server.
+	Mapped *Host
+	// GatewayExternal is the external address of the gateway by NAT-PMP,
+	// invalid if unknown.
+	GatewayExternal netip.Addr
+	// Hops are the routers of the first hops to the server, of the ICMP
+	// time exceeded errors, invalid of the hops silent, up to the first
+	// public one. They are traced on Linux only.
+	Hops []netip.Addr
+	// BehindCGNAT is whether an address of the shared address space of
+	// RFC 6598, 100.64.0.0/10, is the local one, of a hop, or the external
+	// one of the gateway, which is not the mapped one then.
+	BehindCGNAT bool
+	// Layers is the number of the NATs estimated, e.g. 2 of a router
+	// behind the NAT of the ISP, or 0 without a NAT, by natLayers.
+	Layers int
+}
+
+// DetectCGNAT detects a carrier-grade NAT between the host and the STUN
+// server, from the local address, the routers of the first hops and the
+// external address of the gateway, of a new socket.
+func (c *Client) DetectCGNAT(ctx context.Context) (*CGNATReport, error) {
+	if c.serverAddr == "" {
+		c.SetServerAddr(DefaultServerAddr)
+	}
+	addr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenUDP(c.iface)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	resp, err := c.test1(conn, addr)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.mappedAddr == nil {
+		return nil, errors.New("No mapped address from the STUN server.")
+	}
+	r := &CGNATReport{Mapped: resp.mappedAddr}
+	if r.Local, err = localAddrTo(addr); err != nil {
+		return nil, err
+	}
+	if r.Local != r.Mapped.Addr() {
+		// Without a NAT, there is no hop nor gateway to look at.
+		if r.Hops, err = c.traceHops(addr, traceHops); err != nil {
+			return nil, err
+		}
+		gctx, cancel := context.WithTimeout(ctx, gatewayTimeout)
+		r.GatewayExternal, _ = (&NATPMPMapper{}).exchangeAddress(gctx)
+		cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.BehindCGNAT = behindCGNAT(r)
+	r.Layers = natLayers(r)
+	return r, nil
+}
+
+// behindCGNAT reports whether the evidence of the report is of the shared
+// address space.
+func behindCGNAT(r *CGNATReport) bool {
+	if sharedAddrSpace.Contains(r.Local) {
+		return true
+	}
+	for _, hop := range r.Hops {
+		if sharedAddrSpace.Contains(hop) {
+			return true
+		}
+	}
+	return sharedAddrSpace.Contains(r.GatewayExternal) && r.Mapped != nil && r.GatewayExternal != r.Mapped.Addr()
+}
+
+// natLayers estimates the number of the NATs of the report: a router of
+// each private network of the path, the local one included, up to the
+// first public hop, as the networks of the hops of a NAT are private ones
+// of another subnet, and one more if the external address of the gateway
+// is not the mapped one, of the gateway behind another NAT. Without a
+// NAT, of the mapped address local, it is 0.
+func natLayers(r *CGNATReport) int {
+	if r.Mapped == nil || r.Mapped.Addr() == r.Local {
+		return 0
+	}
+	networks := make(map[netip.Prefix]bool)
+	for _, addr := range append([]netip.Addr{r.Local}, r.Hops...) {
+		if publicAddr(addr) {
+			break
+		}
+		if p, ok := privateNetwork(addr); ok {
+			networks[p] = true
+		}
+	}
+	layers := len(networks)
+	if r.GatewayExternal.IsValid() && r.GatewayExternal != r.Mapped.Addr() && layers < 2 {
+		layers = 2
+	}
+	if layers == 0 {
+		layers = 1
+	}
+	return layers
+}
+
+// privateNetwork returns the subnet of a private or shared address, of the
+// /24 of IPv4 and the /64 of IPv6, the usual ones of the routers.
+func privateNetwork(addr netip.Addr) (netip.Prefix, bool) {
+	if !addr.IsPrivate() && !sharedAddrSpace.Contains(addr) {
+		return netip.Prefix{}, false
+	}
+	bits := 64
+	if addr.Is4() {
+		bits = 24
+	}
+	p, err := addr.Prefix(bits)
+	return p, err == nil
+}
+
+// publicAddr reports whether addr is a global unicast address of neither a
+// private nor the shared address space.
+func publicAddr(addr netip.Addr) bool {
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddrSpace.Contains(addr)
+}
+
+// traceHops returns the routers of the hops to addr up to max, of the ICMP
+// time exceeded errors of the Binding requests of the TTLs from 1, until
+// the first public router or the server responds, of a new socket.
+func (c *Client) traceHops(addr *net.UDPAddr, max int) ([]netip.Addr, error) {
+	conn, err := listenUDP(c.iface)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	enableICMPErrors(conn)
+	var hops []netip.Addr
+	buf := make([]byte, maxPacketSize)
+	for ttl := 1; ttl <= max; ttl++ {
+		if err := setTTL(conn, ttl); err != nil {
+			return nil, err
+		}
+		pkt, err := c.newBindingReq(false, false)
+		if err != nil {
+			return nil, err
+		}
+		req := pkt.bytes()
+		if _, err := conn.WriteTo(req, addr); err != nil {
+			return nil, err
+		}
+		c.capture.capture(req, conn.LocalAddr(), addr, c.logger)
+		conn.SetReadDeadline(c.now().Add(traceTimeout))
+		reached := false
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			c.capture.capture(buf[:n], from, conn.LocalAddr(), c.logger)
+			if p, err := newPacketFromBytes(buf[:n]); err == nil && string(p.transID) == string(pkt.transID) {
+				reached = true
+				break
+			}
+		}
+		if reached {
+			return hops, nil
+		}
+		router, _ := readTimeExceeded(conn)
+		c.logger.Debugln("Hop", ttl, ":", router)
+		hops = append(hops, router)
+		if publicAddr(router) {
+			break
+		}
+	}
+	return hops, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestBehindCGNAT(t *testing.T) {
+	mapped := newHost(netip.MustParseAddrPort("203.0.113.7:4242"))
+	for _, tc := range []struct {
+		r      CGNATReport
+		behind bool
+	}{
+		{CGNATReport{Local: netip.MustParseAddr("192.168.1.2"), Mapped: mapped}, false},
+		// The ISP assigns a shared address to the host.
+		{CGNATReport{Local: netip.MustParseAddr("100.64.3.4"), Mapped: mapped}, true},
+		{CGNATReport{Local: netip.MustParseAddr("192.168.1.2"), Mapped: mapped, Hops: []netip.Addr{
+			netip.MustParseAddr("192.168.1.1"), {}, netip.MustParseAddr("100.127.0.1"),
+		}}, true},
+		{CGNATReport{Local: netip.MustParseAddr("192.168.1.2"), Mapped: mapped, Hops: []netip.Addr{
+			netip.MustParseAddr("192.168.1.1"), netip.MustParseAddr("198.51.100.1"),
+		}}, false},
+		{CGNATReport{Local: netip.MustParseAddr("192.168.1.2"), Mapped: mapped, GatewayExternal: netip.MustParseAddr("100.80.1.2")}, true},
+		// Outside of the shared address space.
+		{CGNATReport{Local: netip.MustParseAddr("192.168.1.2"), Mapped: mapped, GatewayExternal: netip.MustParseAddr("100.128.1.2")}, false},
+	} {
+		if behind := behindCGNAT(&tc.r); behind != tc.behind {
+			t.Errorf("behindCGNAT error: %+v, got %v", tc.r, behind)
+		}
+	}
+}
+
+func TestDetectCGNAT(t *testing.T) {
+	_, addr := newTestServer(t)
+	c := NewClient()
+	c.SetServerAddr(addr)
+	r, err := c.DetectCGNAT(context.Background())
+	if err != nil {
+		t.Fatalf("DetectCGNAT error: %v", err)
+	}
+	local := netip.MustParseAddr("127.0.0.1")
+	if r.BehindCGNAT || r.Local != local || r.Mapped.Addr() != local || len(r.Hops) != 0 || r.Layers != 0 {
+		t.Errorf("DetectCGNAT error: %+v", r)
+	}
+	// The server is reached of TTL 1.
+	hops, err := c.traceHops(net.UDPAddrFromAddrPort(netip.MustParseAddrPort(addr)), traceHops)
+	if err != nil || len(hops) != 0 {
+		t.Errorf("traceHops error: %v, %v", hops, err)
+	}
+}
+
+func TestNATLayers(t *testing.T) {
+	mapped := newHost(netip.MustParseAddrPort("203.0.113.7:4242"))
+	addrs := func(s ...string) []netip.Addr {
+		var a []netip.Addr
+		for _, s := range s {
+			if s == "" {
+				a = append(a, netip.Addr{})
+			} else {
+				a = append(a, netip.MustParseAddr(s))
+			}
+		}
+		return a
+	}
+	local := netip.MustParseAddr("192.168.1.2")
+	for _, tc := range []struct {
+		r      CGNATReport
+		layers int
+	}{
+		{CGNATReport{Local: mapped.Addr(), Mapped: mapped}, 0},
+		{CGNATReport{Local: local, Mapped: mapped}, 1},
+		{CGNATReport{Local: local, Mapped: mapped, Hops: addrs("192.168.1.1", "198.51.100.1")}, 1},
+		// A router behind another one, both of 192.168.0.0/16.
+		{CGNATReport{Local: local, Mapped: mapped, Hops: addrs("192.168.1.1", "192.168.0.1", "198.51.100.1")}, 2},
+		// Behind a CGNAT, the hops past the first public one not counted.
+		{CGNATReport{Local: local, Mapped: mapped, Hops: addrs("192.168.1.1", "", "100.64.0.1", "198.51.100.1", "10.0.0.1")}, 2},
+		// The gateway is behind another NAT, of the hops silent.
+		{CGNATReport{Local: local, Mapped: mapped, GatewayExternal: netip.MustParseAddr("10.1.2.3")}, 2},
+		{CGNATReport{Local: local, Mapped: mapped, GatewayExternal: mapped.Addr()}, 1},
+	} {
+		if layers := natLayers(&tc.r); layers != tc.layers {
+			t.Errorf("natLayers error: %+v, got %d, expected %d", tc.r, layers, tc.layers)
+		}
+	}
+}
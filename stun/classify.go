@@ -0,0 +1,175 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+)
+
+// defaultClassifyRounds is the number of the discoveries of Classify.
+const defaultClassifyRounds = 3
+
+// Names of the tests of the discovery, in the order of RFC 3489.
+const (
+	testFirst         = "test1"
+	testChangeAddr    = "test2"
+	testChangedServer = "test1-changed"
+	testChangePort    = "test3"
+)
+
+// TestOutcomes are the outcomes of a test of the discovery over the rounds
+// of Classify it was run in.
+type TestOutcomes struct {
+	Name string
+	// Responses, Timeouts and Errors are the numbers of the rounds of a
+	// response, of none after the retransmissions, and of an error.
+	Responses int
+	Timeouts  int
+	Errors    int
+}
+
+// Classification is the NAT type of the discoveries of Classify, and how
+// much they agree on it.
+type Classification struct {
+	// Type is the type of the most rounds, NATError only if all failed.
+	Type NATType
+	// Host is the mapped address of the last round of Type.
+	Host *Host
+	// Confidence is the share of the rounds of Type, or 0 if all failed.
+	// Below 1, the rounds disagree, e.g. as a response lost is taken for
+	// filtering, and the caller may classify again.
+	Confidence float64
+	// Votes are the numbers of the rounds by type.
+	Votes map[NATType]int
+	// Tests are the outcomes of the tests run, in order; the timeouts of
+	// those of the rounds disagreeing are of the packets lost or filtered.
+	Tests []TestOutcomes
+	// BehindCGNAT is whether a carrier-grade NAT is detected, by
+	// DetectCGNAT, behind a NAT of Type.
+	BehindCGNAT bool
+	// NATLayers is the number of the layers of NAT estimated, e.g. 2 of a
+	// double NAT, 1 if unknown behind a NAT of Type, or 0 without.
+	NATLayers int
+	// Err is the error of the last round failing, if any.
+	Err error
+}
+
+// Classify discovers the NAT type for the number of rounds, 3 if 0, each of
+// a new socket, and returns the type of the most rounds with the share of
+// them as a confidence, and the outcomes of the tests, instead of the type
+// of one discovery, possibly wrong of a packet lost. Behind a NAT, it
+// detects a carrier-grade one and the layers of NAT too.
+func (c *Client) Classify(rounds int) (*Classification, error) {
+	if rounds <= 0 {
+		rounds = defaultClassifyRounds
+	}
+	if c.serverAddr == "" {
+		c.SetServerAddr(DefaultServerAddr)
+	}
+	addr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	res := &Classification{Type: NATError, Votes: make(map[NATType]int)}
+	tests := make(map[string]int) // the indexes of the outcomes
+	cc := *c
+	cc.observe = func(test string, responded bool, err error) {
+		i, ok := tests[test]
+		if !ok {
+			i = len(res.Tests)
+			tests[test] = i
+			res.Tests = append(res.Tests, TestOutcomes{Name: test})
+		}
+		t := &res.Tests[i]
+		switch {
+		case err != nil:
+			t.Errors++
+		case responded:
+			t.Responses++
+		default:
+			t.Timeouts++
+		}
+	}
+	hosts := make(map[NATType]*Host)
+	for i := 0; i < rounds; i++ {
+		conn, err := listenUDP(c.iface)
+		if err != nil {
+			return nil, err
+		}
+		nat, host, err := cc.discover(conn, addr)
+		conn.Close()
+		if err != nil {
+			c.logger.Debugln("Classify round", i, ":", err)
+			res.Err = err
+			nat = NATError
+		}
+		res.Votes[nat]++
+		if host != nil {
+			hosts[nat] = host
+		}
+	}
+	for nat, n := range res.Votes {
+		if nat == NATError {
+			continue
+		}
+		if m := res.Votes[res.Type]; res.Type == NATError || n > m || n == m && nat < res.Type {
+			res.Type = nat
+		}
+	}
+	res.Host = hosts[res.Type]
+	if res.Type == NATBlocked {
+		res.Type = c.blockedVerdict()
+	}
+	if res.Type != NATError {
+		res.Confidence = float64(res.Votes[res.Type]) / float64(rounds)
+	}
+	switch res.Type {
+	case NATError:
+		return res, errors.New("All the rounds of the classification failed: " + res.Err.Error())
+	case NATNone, NATBlocked, NATUnreachable, NATSymetricUDPFirewall:
+		return res, nil
+	}
+	res.NATLayers = 1
+	if r, err := c.DetectCGNAT(context.Background()); err == nil {
+		res.BehindCGNAT = r.BehindCGNAT
+		if r.Layers > 1 {
+			res.NATLayers = r.Layers
+		}
+	} else {
+		c.logger.Debugln("Detect CGNAT:", err)
+	}
+	return res, nil
+}
+
+// observeTest reports the outcome of a test of the discovery to Classify.
+func (c *Client) observeTest(test string, resp *response, err error) {
+	if c.observe != nil {
+		c.observe(test, resp != nil, err)
+	}
+}
+
+// MarshalJSON implements json.Marshaler, of Err as its message.
+func (c Classification) MarshalJSON() ([]byte, error) {
+	type classification Classification
+	return json.Marshal(struct {
+		classification
+		Err string `json:",omitempty"`
+	}{classification(c), errorText(c.Err)})
+}
@@ -0,0 +1,62 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	conns, err := listenAlternate("127.0.0.1:0", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("listenAlternate: %v", err)
+	}
+	s := NewServer()
+	go s.ServeAlternate(conns)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(conns[0][0].LocalAddr().String())
+	res, err := c.Classify(0)
+	if err != nil {
+		t.Fatalf("Classify error: %v", err)
+	}
+	if res.Type != NATNone || res.Confidence != 1 || res.Votes[NATNone] != 3 || res.Host == nil {
+		t.Errorf("Classify error: %+v", res)
+	}
+	if len(res.Tests) != 2 || res.Tests[0].Name != testFirst || res.Tests[1].Name != testChangeAddr {
+		t.Fatalf("Classify error: tests %+v", res.Tests)
+	}
+	for _, test := range res.Tests {
+		if test.Responses != 3 || test.Timeouts != 0 || test.Errors != 0 {
+			t.Errorf("Classify error: test %+v", test)
+		}
+	}
+}
+
+func TestClassifyFailed(t *testing.T) {
+	// The server of one address fails the discovery after test1.
+	_, addr := newTestServer(t)
+	c := NewClient()
+	c.SetServerAddr(addr)
+	res, err := c.Classify(2)
+	if err == nil || res == nil {
+		t.Fatalf("Classify error: expected error, %+v", res)
+	}
+	if res.Type != NATError || res.Confidence != 0 || res.Err == nil || len(res.Tests) != 1 || res.Tests[0].Responses != 2 {
+		t.Errorf("Classify error: %+v", res)
+	}
+}
@@ -18,6 +18,7 @@ package stun
 
 import (
 	"errors"
+	"io"
 	"net"
 	"strconv"
 )
@@ -29,12 +30,23 @@ type Client struct {
 	softwareName string
 	conn         net.PacketConn
 	logger       *Logger
+	ttl          int
+	iface        string
+	tlsOptions   *TLSOptions
+	observe      func(test string, responded bool, err error) // of the tests of Classify
+	stats        *clientStats
+	txObserver   func(tx *Transaction)
+	capture      *PcapWriter
+	tracer       Tracer
+	clock        Clock
+	rand         io.Reader
 }
 
 // NewClient returns a client without network connection. The network
 // connection will be build when calling Discover function.
 func NewClient() *Client {
 	c := new(Client)
+	c.stats = newClientStats()
 	c.SetSoftwareName(DefaultSoftwareName)
 	c.logger = NewLogger()
 	return c
@@ -42,9 +54,13 @@ func NewClient() *Client {
 
 // NewClientWithConnection returns a client which uses the given connection.
 // Please note the connection should be acquired via net.Listen* method.
+// The reports of the ICMP errors are enabled on the connection once, with
+// IP_RECVERR on Linux, and stay on it.
 func NewClientWithConnection(conn net.PacketConn) *Client {
 	c := new(Client)
 	c.conn = conn
+	enableICMPErrors(conn)
+	c.stats = newClientStats()
 	c.SetSoftwareName(DefaultSoftwareName)
 	c.logger = NewLogger()
 	return c
@@ -57,7 +73,8 @@ func (c *Client) SetVerbose(v bool) {
 }
 
 // SetVVerbose sets the client to be in the double verbose mode, which prints
-// information and packet in the discover process.
+// information and the messages decoded in the discover process. SetCapture
+// writes the messages to a pcap file instead.
 func (c *Client) SetVVerbose(v bool) {
 	c.logger.SetInfo(v)
 }
@@ -78,8 +95,39 @@ func (c *Client) SetSoftwareName(name string) {
 	c.softwareName = name
 }
 
+// SetTTL sets the IP TTL (hop limit for IPv6) of the outgoing binding
+// requests, which can be used to probe the NATs and middleboxes on the path
+// hop by hop. A TTL of 0 leaves the system default untouched. The TTL of the
+// connection passed by NewClientWithConnection is set for each transaction
+// and restored after it.
+func (c *Client) SetTTL(ttl int) {
+	c.ttl = ttl
+}
+
+// SetInterface binds the connections created by the client to the network
+// interface of the given name (SO_BINDTODEVICE on Linux, IP_BOUND_IF on
+// Darwin), so that the NAT behind each uplink of a multi-homed host can be
+// discovered separately. It has no effect on the connection passed by
+// NewClientWithConnection.
+func (c *Client) SetInterface(name string) {
+	c.iface = name
+}
+
+// SetCapture sets the client to write the STUN messages it sends and
+// receives to the pcap writer, or none if nil.
+func (c *Client) SetCapture(p *PcapWriter) {
+	c.capture = p
+}
+
+// SetTLSOptions configures the certificate verification and the ALPN of the
+// TLS transport.
+func (c *Client) SetTLSOptions(opts *TLSOptions) {
+	c.tlsOptions = opts
+}
+
 // Discover contacts the STUN server and gets the response of NAT type, host
-// for UDP punching.
+// for UDP punching. If UDP is blocked, it binds to the server over TCP and
+// TLS, and returns NATUnreachable if these fail too.
 func (c *Client) Discover() (NATType, *Host, error) {
 	if c.serverAddr == "" {
 		c.SetServerAddr(DefaultServerAddr)
@@ -92,13 +140,17 @@ func (c *Client) Discover() (NATType, *Host, error) {
 	// create a connection and close it at the end.
 	conn := c.conn
 	if conn == nil {
-		conn, err = net.ListenUDP("udp", nil)
+		conn, err = listenUDP(c.iface)
 		if err != nil {
 			return NATError, nil, err
 		}
 		defer conn.Close()
 	}
-	return c.discover(conn, serverUDPAddr)
+	nat, host, err := c.discover(conn, serverUDPAddr)
+	if nat == NATBlocked && err == nil {
+		nat = c.blockedVerdict()
+	}
+	return nat, host, err
 }
 
 func (c *Client) DiscoverIptables() (NATType, *Host, error) {
@@ -111,7 +163,7 @@ func (c *Client) DiscoverIptables() (NATType, *Host, error) {
 	}
 	conn := c.conn
 	if conn == nil {
-		conn, err = net.ListenUDP("udp", nil)
+		conn, err = listenUDP(c.iface)
 		if err != nil {
 			return NATError, nil, err
 		}
@@ -143,3 +195,45 @@ func (c *Client) Keepalive() (*Host, error) {
 	}
 	return resp.mappedAddr, nil
 }
+
+// Bind sends a binding request to the STUN server over the given transport
+// (TransportUDP, TransportTCP or TransportTLS) and returns the mapped
+// address, without discovering the NAT type. The connection passed by
+// NewClientWithConnection is used for UDP only.
+func (c *Client) Bind(transport string) (*Host, error) {
+	if c.serverAddr == "" {
+		c.SetServerAddr(DefaultServerAddr)
+	}
+	var conn net.PacketConn
+	var addr net.Addr
+	var err error
+	if transport == TransportUDP {
+		addr, err = net.ResolveUDPAddr("udp", c.serverAddr)
+		if err != nil {
+			return nil, err
+		}
+		conn = c.conn
+		if conn == nil {
+			conn, err = listenUDP(c.iface)
+			if err != nil {
+				return nil, err
+			}
+			defer conn.Close()
+		}
+	} else {
+		sc, err := dialStream(transport, c.serverAddr, c.tlsOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer sc.Close()
+		conn, addr = sc, sc.RemoteAddr()
+	}
+	resp, err := c.test1(conn, addr)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.packet == nil {
+		return nil, errors.New("failed to contact")
+	}
+	return resp.mappedAddr, nil
+}
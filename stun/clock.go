@@ -0,0 +1,82 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"io"
+	"time"
+)
+
+// Clock tells the time of the retransmission timers of a client and of the
+// nonces of a server. The read deadlines of the connections are set in its
+// time, so a clock other than the system one only suits connections that
+// honor it, such as those of the stuntest package.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the clock of the system, the default.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SetClock sets the clock of the client, the system clock if nil.
+func (c *Client) SetClock(clock Clock) {
+	c.clock = clock
+}
+
+// SetRand sets the source of the transaction IDs of the client, crypto/rand
+// if nil. A seeded source makes the transactions reproducible in tests.
+func (c *Client) SetRand(r io.Reader) {
+	c.rand = r
+}
+
+// now returns the time of the clock of the client.
+func (c *Client) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
+
+// SetClock sets the clock of the server, which receives the requests and
+// expires the nonces, the system clock if nil.
+func (s *Server) SetClock(clock Clock) {
+	s.update(func(c *settings) {
+		c.clock = clock
+	})
+}
+
+// SetRand sets the source of the nonce secrets of the server, crypto/rand if
+// nil.
+func (s *Server) SetRand(r io.Reader) {
+	s.update(func(c *settings) {
+		c.rand = r
+		if c.auth != nil {
+			c.auth = c.auth.clone()
+			c.auth.rand = r
+		}
+	})
+}
+
+// now returns the time of the clock of the settings.
+func (c *settings) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
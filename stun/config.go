@@ -0,0 +1,73 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"time"
+)
+
+// Config is the configuration of a server which can be reloaded while
+// serving, e.g. to rotate the credentials or adjust the limits without
+// restarting. The fields are those of the setters of Server.
+type Config struct {
+	SoftwareName       string          // see SetSoftwareName
+	Realm              string          // see SetAuth
+	Credentials        CredentialStore // see SetAuth
+	NonceLifetime      time.Duration   // see SetNonceLifetime
+	RequireFingerprint bool            // see SetRequireFingerprint
+	RateLimit          float64         // see SetRateLimit
+	RateBurst          int             // see SetRateLimit
+	MaxAmplification   float64         // see SetMaxAmplification
+	DropPolicy         DropPolicy      // see SetDropPolicy
+	ACL                *ACL            // see SetACL
+}
+
+// Reload applies the configuration at once: the requests in progress
+// complete with the previous one, and the next ones see the new one. The
+// nonces issued and the rate limits of the clients are kept if the realm and
+// the limits are unchanged. It is safe to call while serving.
+func (s *Server) Reload(cfg Config) {
+	acl := cfg.ACL
+	if acl != nil {
+		acl = acl.clone()
+	}
+	s.update(func(c *settings) {
+		c.softwareName = cfg.SoftwareName
+		switch {
+		case cfg.Credentials == nil:
+			c.auth = nil
+		case c.auth != nil && c.auth.realm == cfg.Realm:
+			c.auth = c.auth.clone()
+			c.auth.store = cfg.Credentials
+		default:
+			c.auth = newServerAuth(cfg.Realm, cfg.Credentials)
+			c.auth.rand = c.rand
+		}
+		if c.auth != nil {
+			c.auth.setLifetime(cfg.NonceLifetime)
+		}
+		c.requireFP = cfg.RequireFingerprint
+		if cfg.RateLimit <= 0 {
+			c.limiter = nil
+		} else if c.limiter == nil || !c.limiter.same(cfg.RateLimit, cfg.RateBurst) {
+			c.limiter = newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+		}
+		c.amplify = cfg.MaxAmplification
+		c.dropPolicy = cfg.DropPolicy
+		c.acl = acl
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerReload(t *testing.T) {
+	s := NewServer()
+	cfg := Config{
+		Realm:       "example.org",
+		Credentials: StaticCredentials{"alice": "secret"},
+		RateLimit:   10,
+		RateBurst:   5,
+	}
+	s.Reload(cfg)
+	auth, limiter := s.cfg.Load().auth, s.cfg.Load().limiter
+	addr := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678}
+	nonce := auth.nonce(addr.AddrPort().Addr().Unmap(), time.Now())
+	cfg.Credentials = StaticCredentials{"alice": "rotated"}
+	s.Reload(cfg)
+	if s.cfg.Load().limiter != limiter {
+		t.Fatalf("Reload error: state not kept")
+	}
+	// The previous snapshot keeps its credentials.
+	if s.cfg.Load().auth == auth || auth.credentials().(StaticCredentials)["alice"] != "secret" {
+		t.Errorf("Reload error: previous credentials changed")
+	}
+	b, _, _ := s.handle(newAuthRequest(t, "alice", "example.org", nonce, "rotated"), addr, &listener{}, time.Now())
+	resp, err := newPacketFromBytes(b)
+	if err != nil || resp.types != typeBindingResponse {
+		t.Errorf("handle error: rotated credentials refused")
+	}
+	if resp.hasAttribute(attributeSoftware) {
+		t.Errorf("handle error: software not reloaded")
+	}
+	s.Reload(Config{})
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	b, _, _ = s.handle(req.bytes(), addr, &listener{}, time.Now())
+	if resp, err = newPacketFromBytes(b); err != nil || resp.types != typeBindingResponse {
+		t.Errorf("handle error: authentication not disabled")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// ServerAnswer is the external IP address reported by a STUN server, or
+// the error of the query.
+type ServerAnswer struct {
+	Server string
+	IP     netip.Addr
+	Err    error
+}
+
+// IPConsensus is the external IP address agreed on by the STUN servers
+// queried by ExternalIP.
+type IPConsensus struct {
+	// IP is the address of the quorum, invalid if none.
+	IP netip.Addr
+	// Votes is the number of the servers reporting IP.
+	Votes int
+	// Disagreement is whether a server responding reported another
+	// address than the others, e.g. through an ALG rewriting the
+	// responses, a split tunnel, or a lying server.
+	Disagreement bool
+	// Answers are the answers of the servers, in order.
+	Answers []ServerAnswer
+}
+
+// ExternalIP queries the STUN servers in parallel, of a socket each, and
+// returns the external IP address reported by a quorum of them, a majority
+// if quorum is 0. Without a quorum, it returns the answers with an error.
+func (c *Client) ExternalIP(servers []string, quorum int) (*IPConsensus, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("No STUN server.")
+	}
+	if quorum <= 0 {
+		quorum = len(servers)/2 + 1
+	}
+	if quorum > len(servers) {
+		return nil, errors.New("Quorum larger than the servers.")
+	}
+	res := &IPConsensus{Answers: make([]ServerAnswer, len(servers))}
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(a *ServerAnswer, server string) {
+			defer wg.Done()
+			a.Server = server
+			a.IP, a.Err = c.queryIP(server)
+		}(&res.Answers[i], server)
+	}
+	wg.Wait()
+	votes := make(map[netip.Addr]int)
+	for _, a := range res.Answers {
+		if a.Err != nil {
+			c.logger.Debugln("External IP of", a.Server, ":", a.Err)
+			continue
+		}
+		votes[a.IP]++
+		if votes[a.IP] > res.Votes {
+			res.IP, res.Votes = a.IP, votes[a.IP]
+		}
+	}
+	res.Disagreement = len(votes) > 1
+	if res.Votes < quorum {
+		res.IP = netip.Addr{}
+		return res, errors.New("No quorum of the external IP.")
+	}
+	return res, nil
+}
+
+// queryIP returns the IP address mapped by the server.
+func (c *Client) queryIP(server string) (netip.Addr, error) {
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	conn, err := listenUDP(c.iface)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	resp, err := c.test1(conn, addr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if resp == nil || resp.mappedAddr == nil {
+		return netip.Addr{}, errors.New("No mapped address from " + server + ".")
+	}
+	return resp.mappedAddr.Addr(), nil
+}
+
+// MarshalJSON implements json.Marshaler, of Err as its message.
+func (a ServerAnswer) MarshalJSON() ([]byte, error) {
+	type answer ServerAnswer
+	return json.Marshal(struct {
+		answer
+		Err string `json:",omitempty"`
+	}{answer(a), errorText(a.Err)})
+}
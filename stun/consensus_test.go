@@ -0,0 +1,58 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// newLyingServer returns the address of a server mapping every request to
+// 192.0.2.1.
+func newLyingServer(t *testing.T) string {
+	return newRespondingServer(t, func(w ResponseWriter, r *Request) {
+		addXorMapped(w, r, newHost(netip.MustParseAddrPort("192.0.2.1:4242")))
+	})
+}
+
+func TestExternalIP(t *testing.T) {
+	var servers []string
+	for i := 0; i < 2; i++ {
+		_, addr := newTestServer(t)
+		servers = append(servers, addr)
+	}
+	servers = append(servers, newLyingServer(t))
+	c := NewClient()
+	res, err := c.ExternalIP(servers, 0)
+	if err != nil {
+		t.Fatalf("ExternalIP error: %v", err)
+	}
+	if res.IP != netip.MustParseAddr("127.0.0.1") || res.Votes != 2 || !res.Disagreement || len(res.Answers) != 3 {
+		t.Errorf("ExternalIP error: %+v", res)
+	}
+	if a := res.Answers[2]; a.Server != servers[2] || a.IP != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("ExternalIP error: answer %+v", a)
+	}
+	// All the servers are not enough.
+	res, err = c.ExternalIP(servers, 3)
+	if err == nil || res == nil || res.IP.IsValid() || res.Votes != 2 {
+		t.Errorf("ExternalIP error: %+v of quorum 3, %v", res, err)
+	}
+	if _, err := c.ExternalIP(servers, 4); err == nil {
+		t.Errorf("ExternalIP error: expected error of quorum 4")
+	}
+}
@@ -16,6 +16,11 @@
 
 package stun
 
+import (
+	"errors"
+	"strconv"
+)
+
 // Default server address and client name.
 const (
 	DefaultServerAddr   = "stun.ekiga.net:3478"
@@ -41,6 +46,7 @@ const (
 	NATRestricted
 	NATPortRestricted
 	NATSymetricUDPFirewall
+	NATUnreachable
 )
 
 var natStr map[NATType]string
@@ -56,6 +62,7 @@ func init() {
 		NATPortRestricted:      "Port restricted NAT",
 		NATNone:                "Not behind a NAT",
 		NATSymetricUDPFirewall: "Symetric UDP firewall",
+		NATUnreachable:         "No connectivity to the STUN server",
 	}
 }
 
@@ -66,12 +73,78 @@ func (nat NATType) String() string {
 	return "Unknown"
 }
 
+// natName are the names of the NAT types in the text and JSON encodings.
+var natName = map[NATType]string{
+	NATError:               "error",
+	NATUnknown:             "unknown",
+	NATNone:                "none",
+	NATBlocked:             "blocked",
+	NATFull:                "full-cone",
+	NATSymetric:            "symmetric",
+	NATRestricted:          "restricted",
+	NATPortRestricted:      "port-restricted",
+	NATSymetricUDPFirewall: "symmetric-udp-firewall",
+	NATUnreachable:         "unreachable",
+}
+
+// MarshalText implements encoding.TextMarshaler, so that the NAT type
+// marshals to its name, e.g. "full-cone".
+func (nat NATType) MarshalText() ([]byte, error) {
+	if s, ok := natName[nat]; ok {
+		return []byte(s), nil
+	}
+	return []byte(strconv.Itoa(int(nat))), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, of the names or the
+// numbers of the types.
+func (nat *NATType) UnmarshalText(b []byte) error {
+	for t, s := range natName {
+		if s == string(b) {
+			*nat = t
+			return nil
+		}
+	}
+	n, err := strconv.Atoi(string(b))
+	if err != nil {
+		return errors.New("Unknown NAT type: " + string(b))
+	}
+	*nat = NATType(n)
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, which accepts the numbers the
+// types were encoded to before they had names as well.
+func (nat *NATType) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	if len(b) > 0 && b[0] == '"' {
+		s, err := strconv.Unquote(string(b))
+		if err != nil {
+			return err
+		}
+		b = []byte(s)
+	}
+	return nat.UnmarshalText(b)
+}
+
+// Message classes, which are encoded in bits 4 and 8 of the message type.
+const (
+	classRequest    = 0x0000
+	classIndication = 0x0010
+	classSuccess    = 0x0100
+	classError      = 0x0110
+	classMask       = 0x0110
+)
+
 const (
 	errorTryAlternate                 = 300
 	errorBadRequest                   = 400
 	errorUnauthorized                 = 401
 	errorUnassigned402                = 402
 	errorForbidden                    = 403
+	errorMobilityForbidden            = 405
 	errorUnknownAttribute             = 420
 	errorAllocationMismatch           = 437
 	errorStaleNonce                   = 438
@@ -87,54 +160,79 @@ const (
 	errorServerError                  = 500
 	errorInsufficientCapacity         = 508
 )
+
+var errorStr = map[int]string{
+	errorTryAlternate:                 "Try Alternate",
+	errorBadRequest:                   "Bad Request",
+	errorUnauthorized:                 "Unauthorized",
+	errorForbidden:                    "Forbidden",
+	errorMobilityForbidden:            "Mobility Forbidden",
+	errorUnknownAttribute:             "Unknown Attribute",
+	errorAllocationMismatch:           "Allocation Mismatch",
+	errorStaleNonce:                   "Stale Nonce",
+	errorAddressFamilyNotSupported:    "Address Family not Supported",
+	errorWrongCredentials:             "Wrong Credentials",
+	errorUnsupportedTransportProtocol: "Unsupported Transport Protocol",
+	errorPeerAddressFamilyMismatch:    "Peer Address Family Mismatch",
+	errorConnectionAlreadyExists:      "Connection Already Exists",
+	errorConnectionTimeoutOrFailure:   "Connection Timeout or Failure",
+	errorAllocationQuotaReached:       "Allocation Quota Reached",
+	errorRoleConflict:                 "Role Conflict",
+	errorServerError:                  "Server Error",
+	errorInsufficientCapacity:         "Insufficient Capacity",
+}
+
 const (
 	attributeFamilyIPv4 = 0x01
 	attributeFamilyIPV6 = 0x02
 )
 
 const (
-	attributeMappedAddress          = 0x0001
-	attributeResponseAddress        = 0x0002
-	attributeChangeRequest          = 0x0003
-	attributeSourceAddress          = 0x0004
-	attributeChangedAddress         = 0x0005
-	attributeUsername               = 0x0006
-	attributePassword               = 0x0007
-	attributeMessageIntegrity       = 0x0008
-	attributeErrorCode              = 0x0009
-	attributeUnknownAttributes      = 0x000a
-	attributeReflectedFrom          = 0x000b
-	attributeChannelNumber          = 0x000c
-	attributeLifetime               = 0x000d
-	attributeBandwidth              = 0x0010
-	attributeXorPeerAddress         = 0x0012
-	attributeData                   = 0x0013
-	attributeRealm                  = 0x0014
-	attributeNonce                  = 0x0015
-	attributeXorRelayedAddress      = 0x0016
-	attributeRequestedAddressFamily = 0x0017
-	attributeEvenPort               = 0x0018
-	attributeRequestedTransport     = 0x0019
-	attributeDontFragment           = 0x001a
-	attributeXorMappedAddress       = 0x0020
-	attributeTimerVal               = 0x0021
-	attributeReservationToken       = 0x0022
-	attributePriority               = 0x0024
-	attributeUseCandidate           = 0x0025
-	attributePadding                = 0x0026
-	attributeResponsePort           = 0x0027
-	attributeConnectionID           = 0x002a
-	attributeXorMappedAddressExp    = 0x8020
-	attributeSoftware               = 0x8022
-	attributeAlternateServer        = 0x8023
-	attributeCacheTimeout           = 0x8027
-	attributeFingerprint            = 0x8028
-	attributeIceControlled          = 0x8029
-	attributeIceControlling         = 0x802a
-	attributeResponseOrigin         = 0x802b
-	attributeOtherAddress           = 0x802c
-	attributeEcnCheckStun           = 0x802d
-	attributeCiscoFlowdata          = 0xc000
+	attributeMappedAddress           = 0x0001
+	attributeResponseAddress         = 0x0002
+	attributeChangeRequest           = 0x0003
+	attributeSourceAddress           = 0x0004
+	attributeChangedAddress          = 0x0005
+	attributeUsername                = 0x0006
+	attributePassword                = 0x0007
+	attributeMessageIntegrity        = 0x0008
+	attributeErrorCode               = 0x0009
+	attributeUnknownAttributes       = 0x000a
+	attributeReflectedFrom           = 0x000b
+	attributeChannelNumber           = 0x000c
+	attributeLifetime                = 0x000d
+	attributeBandwidth               = 0x0010
+	attributeXorPeerAddress          = 0x0012
+	attributeData                    = 0x0013
+	attributeRealm                   = 0x0014
+	attributeNonce                   = 0x0015
+	attributeXorRelayedAddress       = 0x0016
+	attributeRequestedAddressFamily  = 0x0017
+	attributeEvenPort                = 0x0018
+	attributeRequestedTransport      = 0x0019
+	attributeDontFragment            = 0x001a
+	attributeXorMappedAddress        = 0x0020
+	attributeTimerVal                = 0x0021
+	attributeReservationToken        = 0x0022
+	attributePriority                = 0x0024
+	attributeUseCandidate            = 0x0025
+	attributePadding                 = 0x0026
+	attributeResponsePort            = 0x0027
+	attributeConnectionID            = 0x002a
+	attributeAdditionalAddressFamily = 0x8000
+	attributeAddressErrorCode        = 0x8001
+	attributeXorMappedAddressExp     = 0x8020
+	attributeSoftware                = 0x8022
+	attributeAlternateServer         = 0x8023
+	attributeCacheTimeout            = 0x8027
+	attributeFingerprint             = 0x8028
+	attributeIceControlled           = 0x8029
+	attributeIceControlling          = 0x802a
+	attributeResponseOrigin          = 0x802b
+	attributeOtherAddress            = 0x802c
+	attributeEcnCheckStun            = 0x802d
+	attributeMobilityTicket          = 0x8030
+	attributeCiscoFlowdata           = 0xc000
 )
 
 const (
@@ -0,0 +1,240 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// Decode parses the STUN message of the hex text s, as pasted from a
+// capture. The hex may be separated by spaces, colons or commas and prefixed
+// by 0x, or be in the hex dump format of Wireshark, hexdump -C and xxd, of
+// which the offsets and the text columns are skipped.
+func Decode(s string) (*Message, error) {
+	var digits strings.Builder
+	for _, line := range strings.Split(s, "\n") {
+		if i := strings.IndexByte(line, '|'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if width := dumpWidth(fields); width > 0 {
+			n := 0
+			for _, f := range fields[1:] {
+				if n == 32 || len(f) > width || len(f)%2 != 0 || !isHex(f) {
+					break
+				}
+				digits.WriteString(f)
+				n += len(f)
+			}
+			continue
+		}
+		for _, f := range fields {
+			f = strings.NewReplacer(":", "", ",", "", "0x", "", "0X", "").Replace(f)
+			digits.WriteString(f)
+		}
+	}
+	b, err := hex.DecodeString(digits.String())
+	if err != nil {
+		return nil, errors.New("Invalid hex message.")
+	}
+	return ParseMessage(b)
+}
+
+// dumpWidth returns the width of the groups of hex digits if the fields are
+// of a hex dump line, i.e. an offset followed by bytes of two hex digits, or
+// by groups of four after the colon of xxd; otherwise 0.
+func dumpWidth(fields []string) int {
+	if len(fields) < 2 || len(fields[0]) < 4 || !isHex(strings.TrimSuffix(fields[0], ":")) || !isHex(fields[1]) {
+		return 0
+	}
+	switch {
+	case len(fields[1]) == 2:
+		return 2
+	case len(fields[1]) == 4 && strings.HasSuffix(fields[0], ":"):
+		return 4
+	}
+	return 0
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// annotator writes the fields of a raw message, a line each of the offset,
+// the bytes and the description.
+type annotator struct {
+	w   io.Writer
+	b   []byte
+	err error
+}
+
+// field describes the n bytes at off, wrapping the bytes at 8 a line.
+func (a *annotator) field(off, n int, format string, args ...interface{}) {
+	if a.err != nil {
+		return
+	}
+	v := a.b[off : off+n]
+	line := fmt.Sprintf("%04x  %-23s  %s\n", off, hexBytes(v, 8), fmt.Sprintf(format, args...))
+	for v = v[minInt(8, len(v)):]; len(v) > 0; v = v[minInt(8, len(v)):] {
+		line += fmt.Sprintf("      %s\n", hexBytes(v, 8))
+	}
+	_, a.err = io.WriteString(a.w, line)
+}
+
+// hexBytes formats at most n bytes of b separated by spaces.
+func hexBytes(b []byte, n int) string {
+	if len(b) > n {
+		b = b[:n]
+	}
+	s := make([]string, len(b))
+	for i, c := range b {
+		s[i] = fmt.Sprintf("%02x", c)
+	}
+	return strings.Join(s, " ")
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Annotate writes a field by field breakdown of the message to w: the
+// offset and the bytes of each header and attribute field, with the class
+// and the method of the type, the attribute names, the XOR-decoded
+// addresses and whether the FINGERPRINT matches.
+func (m *Message) Annotate(w io.Writer) error {
+	b := m.raw
+	if b == nil {
+		b = m.pkt.bytes()
+	}
+	a := &annotator{w: w, b: b}
+	types := binary.BigEndian.Uint16(b[0:2])
+	method := types &^ classMask
+	name, ok := methodStr[method]
+	if !ok {
+		name = "unknown"
+	}
+	a.field(0, 2, "Message Type: 0x%04x %s (method 0x%03x %s, class %s)",
+		types, TypeName(types), method, name, classStr[types&classMask])
+	a.field(2, 2, "Message Length: %d", binary.BigEndian.Uint16(b[2:4]))
+	if m.pkt.isLegacy() {
+		a.field(4, 16, "Transaction ID: %x (RFC 3489, no magic cookie)", b[4:20])
+	} else {
+		a.field(4, 4, "Magic Cookie: 0x%08x", magicCookie)
+		a.field(8, 12, "Transaction ID: %x", b[8:20])
+	}
+	for pos := messageHeaderSize; pos+4 <= len(b); {
+		at := binary.BigEndian.Uint16(b[pos:])
+		n := int(binary.BigEndian.Uint16(b[pos+2:]))
+		if pos+4+n > len(b) {
+			break
+		}
+		a.field(pos, 2, "Attribute Type: 0x%04x %s", at, attributeName(at))
+		a.field(pos+2, 2, "Attribute Length: %d", n)
+		attr := newAttribute(at, b[pos+4:pos+4+n])
+		a.value(pos+4, attr, m.pkt.transID)
+		next := pos + 4 + int(align(uint16(n)))
+		if pad := minInt(next, len(b)) - (pos + 4 + n); pad > 0 {
+			a.field(pos+4+n, pad, "Padding")
+		}
+		pos = next
+	}
+	return a.err
+}
+
+// value describes the value of the attribute at off, splitting the
+// addresses and the error code into their fields.
+func (a *annotator) value(off int, attr *attribute, transID []byte) {
+	v := attr.value[:attr.length]
+	n := len(v)
+	switch attr.types {
+	case attributeMappedAddress, attributeResponseAddress, attributeSourceAddress,
+		attributeChangedAddress, attributeReflectedFrom, attributeAlternateServer,
+		attributeResponseOrigin, attributeOtherAddress:
+		if n >= 8 {
+			h := attr.rawAddr()
+			a.field(off, 1, "Reserved")
+			a.field(off+1, 1, "Family: %s", familyName(v[1]))
+			a.field(off+2, 2, "Port: %d", h.Port())
+			a.field(off+4, n-4, "Address: %s", h.IP())
+			return
+		}
+	case attributeXorMappedAddress, attributeXorMappedAddressExp,
+		attributeXorPeerAddress, attributeXorRelayedAddress:
+		if n >= 8 {
+			h := attr.xorAddr(transID)
+			a.field(off, 1, "Reserved")
+			a.field(off+1, 1, "Family: %s", familyName(v[1]))
+			a.field(off+2, 2, "X-Port: 0x%04x -> %d", binary.BigEndian.Uint16(v[2:4]), h.Port())
+			a.field(off+4, n-4, "X-Address: %x -> %s", v[4:], h.IP())
+			return
+		}
+	case attributeErrorCode:
+		if n >= 4 {
+			a.field(off, 3, "Class: %d", v[2]&0x7)
+			a.field(off+3, 1, "Number: %d (error code %d)", v[3], int(v[2]&0x7)*100+int(v[3]))
+			if n > 4 {
+				a.field(off+4, n-4, "Reason Phrase: %q", v[4:])
+			}
+			return
+		}
+	case attributeFingerprint:
+		if n == 4 {
+			got := binary.BigEndian.Uint32(v)
+			want := crc32.ChecksumIEEE(a.b[:off-4]) ^ fingerprint
+			if got == want {
+				a.field(off, n, "CRC-32: 0x%08x (valid)", got)
+			} else {
+				a.field(off, n, "CRC-32: 0x%08x (invalid, expected 0x%08x)", got, want)
+			}
+			return
+		}
+	case attributeMessageIntegrity:
+		a.field(off, n, "HMAC-SHA1: %x", v)
+		return
+	}
+	if n > 0 {
+		a.field(off, n, "Value: %s", attributeValue(attr, transID))
+	} else {
+		a.field(off, 0, "Value: (no value)")
+	}
+}
+
+// familyName returns the name of the address family of the attribute.
+func familyName(family byte) string {
+	switch family {
+	case attributeFamilyIPv4:
+		return "IPv4"
+	case attributeFamilyIPV6:
+		return "IPv6"
+	}
+	return fmt.Sprintf("0x%02x", family)
+}
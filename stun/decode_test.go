@@ -0,0 +1,113 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	req, err := NewMessage(TypeBindingRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := req.NewResponse(TypeBindingResponse)
+	resp.AddXorAddress(AttributeXorMappedAddress, newHostFromStr("192.0.2.1:3478"))
+	b := resp.Encode(nil)
+	s := hex.EncodeToString(b)
+	var xxd strings.Builder
+	for i := 0; i < len(s); i += 4 {
+		if i%32 == 0 {
+			xxd.WriteString("\n00000000:")
+		}
+		xxd.WriteString(" " + s[i:minInt(i+4, len(s))])
+	}
+	xxd.WriteString("  ..!.B...")
+	var colons []string
+	for _, c := range b {
+		colons = append(colons, hex.EncodeToString([]byte{c}))
+	}
+	inputs := []string{
+		s,
+		"0x" + s,
+		strings.Join(colons, ":"),
+		"0x" + strings.Join(colons, ", 0x"),
+		hex.Dump(b),
+		xxd.String(),
+	}
+	for _, in := range inputs {
+		m, err := Decode(in)
+		if err != nil {
+			t.Errorf("Decode error of %q: %v", in, err)
+			continue
+		}
+		if !bytes.Equal(m.Bytes(), b) {
+			t.Errorf("Decode error of %q: %x", in, m.Bytes())
+		}
+	}
+	if _, err := Decode("not hex"); err == nil {
+		t.Error("Decode error: invalid hex accepted")
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	req, err := NewMessage(TypeBindingRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := req.NewResponse(TypeBindingErrorResponse)
+	resp.AddXorAddress(AttributeXorMappedAddress, newHostFromStr("192.0.2.1:3478"))
+	resp.AddErrorCode(errorUnknownAttribute, "")
+	resp.AddAttribute(attributeSoftware, []byte("test"))
+	b := resp.Encode(nil)
+	m, err := ParseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := m.Annotate(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"0000  01 11                    Message Type: 0x0111 Binding error response (method 0x001 Binding, class error response)",
+		"0004  21 12 a4 42              Magic Cookie: 0x2112a442",
+		"0014  00 20                    Attribute Type: 0x0020 XOR-MAPPED-ADDRESS",
+		"0019  01                       Family: IPv4",
+		"-> 3478\n",
+		"-> 192.0.2.1\n",
+		"Number: 20 (error code 420)",
+		`Reason Phrase: "Unknown Attribute"`,
+		"Padding\n",
+		"CRC-32: 0x",
+		"(valid)",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Annotate error: %q not found in\n%s", s, out.String())
+		}
+	}
+	b[len(b)-1] ^= 0xff
+	out.Reset()
+	if err := m.Annotate(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "(invalid, expected 0x") {
+		t.Errorf("Annotate error: invalid fingerprint not reported\n%s", out.String())
+	}
+}
@@ -70,6 +70,7 @@ func (c *Client) discover(conn net.PacketConn, addr *net.UDPAddr) (NATType, *Hos
 	c.logger.Debugln("Do Test1")
 	c.logger.Debugln("Send To:", addr)
 	resp, err := c.test1(conn, addr)
+	c.observeTest(testFirst, resp, err)
 	if err != nil {
 		return NATError, nil, err
 	}
@@ -84,8 +85,7 @@ func (c *Client) discover(conn net.PacketConn, addr *net.UDPAddr) (NATType, *Hos
 	// mappedAddr is used as the return value, its IP is used for tests
 	mappedAddr := resp.mappedAddr
 	// Make sure IP and port are not changed.
-	if resp.serverAddr.IP() != addr.IP.String() ||
-		resp.serverAddr.Port() != uint16(addr.Port) {
+	if resp.serverAddr.AddrPort() != udpAddrPort(addr) {
 		return NATError, mappedAddr, errors.New("Server error: response IP/port")
 	}
 	// if changedAddr is not available, use otherAddr as changedAddr,
@@ -102,13 +102,14 @@ func (c *Client) discover(conn net.PacketConn, addr *net.UDPAddr) (NATType, *Hos
 	c.logger.Debugln("Do Test2")
 	c.logger.Debugln("Send To:", addr)
 	resp, err = c.test2(conn, addr)
+	c.observeTest(testChangeAddr, resp, err)
 	if err != nil {
 		return NATError, mappedAddr, err
 	}
 	c.logger.Debugln("Received:", resp)
 	// Make sure IP and port are changed.
 	if resp != nil &&
-		(resp.serverAddr.IP() == addr.IP.String() ||
+		(resp.serverAddr.Addr() == udpAddrPort(addr).Addr() ||
 			resp.serverAddr.Port() == uint16(addr.Port)) {
 		return NATError, mappedAddr, errors.New("Server error: response IP/port")
 	}
@@ -125,8 +126,9 @@ func (c *Client) discover(conn net.PacketConn, addr *net.UDPAddr) (NATType, *Hos
 	// external IP.
 	c.logger.Debugln("Do Test1")
 	c.logger.Debugln("Send To:", changedAddr)
-	caddr, err := net.ResolveUDPAddr("udp", changedAddr.String())
+	caddr := net.UDPAddrFromAddrPort(changedAddr.AddrPort())
 	resp, err = c.test1(conn, caddr)
+	c.observeTest(testChangedServer, resp, err)
 	if err != nil {
 		return NATError, mappedAddr, err
 	}
@@ -137,16 +139,16 @@ func (c *Client) discover(conn net.PacketConn, addr *net.UDPAddr) (NATType, *Hos
 		return NATUnknown, mappedAddr, nil
 	}
 	// Make sure IP/port is not changed.
-	if resp.serverAddr.IP() != caddr.IP.String() ||
-		resp.serverAddr.Port() != uint16(caddr.Port) {
+	if resp.serverAddr.AddrPort() != udpAddrPort(caddr) {
 		return NATError, mappedAddr, errors.New("Server error: response IP/port")
 	}
-	if mappedAddr.IP() == resp.mappedAddr.IP() && mappedAddr.Port() == resp.mappedAddr.Port() {
+	if mappedAddr.AddrPort() == resp.mappedAddr.AddrPort() {
 		// Perform test3 to see if the client can receive packet sent
 		// from another port.
 		c.logger.Debugln("Do Test3")
 		c.logger.Debugln("Send To:", caddr)
 		resp, err = c.test3(conn, caddr)
+		c.observeTest(testChangePort, resp, err)
 		if err != nil {
 			return NATError, mappedAddr, err
 		}
@@ -155,7 +157,7 @@ func (c *Client) discover(conn net.PacketConn, addr *net.UDPAddr) (NATType, *Hos
 			return NATPortRestricted, mappedAddr, nil
 		}
 		// Make sure IP is not changed, and port is changed.
-		if resp.serverAddr.IP() != caddr.IP.String() ||
+		if resp.serverAddr.Addr() != udpAddrPort(caddr).Addr() ||
 			resp.serverAddr.Port() == uint16(caddr.Port) {
 			return NATError, mappedAddr, errors.New("Server error: response IP/port")
 		}
@@ -197,7 +199,7 @@ func (c *Client) discoverIptables(conn net.PacketConn, addr *net.UDPAddr) (NATTy
 	c.logger.Debugln("Received resp3:", resp)
 
 	localAddr2 := resp.mappedAddr
-	if localAddr1.IP() != localAddr2.IP() && localAddr1.Port() != localAddr2.Port() {
+	if localAddr1.Addr() != localAddr2.Addr() && localAddr1.Port() != localAddr2.Port() {
 		return NATSymetric, nil, nil
 	}
 
@@ -14,12 +14,16 @@
 //
 // Author: Cong Ding <dinggnu@gmail.com>
 
-// Package stun is a STUN (RFC 3489 and RFC 5389) client implementation in
-// golang.
+// Package stun is a STUN (RFC 3489 and RFC 5389) client and server
+// implementation in golang.
 //
 // It is extremely easy to use -- just one line of code.
 //
 // 	nat, host, err := stun.NewClient().Discover()
 //
+// A server can be embedded as easily.
+//
+// 	err := stun.NewServer().ListenAndServe(":3478")
+//
 // More details please go to `main.go`.
 package stun
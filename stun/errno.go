@@ -0,0 +1,50 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+//go:build unix || windows
+
+package stun
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errnoICMPError returns the ICMP error reported by the errno of err, or nil
+// if none, and whether err has an errno.
+func errnoICMPError(err error) (error, bool) {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return nil, false
+	}
+	switch errno {
+	case syscall.ECONNREFUSED:
+		return ErrPortUnreachable, true
+	case syscall.EHOSTUNREACH:
+		return ErrHostUnreachable, true
+	case syscall.ENETUNREACH:
+		return ErrNetworkUnreachable, true
+	case syscall.EACCES:
+		return ErrAdminProhibited, true
+	}
+	return nil, true
+}
+
+// isMessageSize reports whether err is EMSGSIZE, of a datagram larger than
+// the MTU of the local link or a cached path MTU with the DF bit set.
+func isMessageSize(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
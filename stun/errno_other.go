@@ -0,0 +1,31 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+//go:build !unix && !windows
+
+package stun
+
+// errnoICMPError returns nil and false: the other platforms, e.g. Plan 9,
+// report no errno of the ICMP errors.
+func errnoICMPError(err error) (error, bool) {
+	return nil, false
+}
+
+// isMessageSize returns false, as the DF bit cannot be set on the other
+// platforms.
+func isMessageSize(err error) bool {
+	return false
+}
@@ -0,0 +1,72 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// expvars is the counters of all the clients and servers of the process,
+// published by PublishExpvar.
+var expvars struct {
+	enabled atomic.Bool
+	once    sync.Once
+
+	requestsSent      expvar.Int
+	responsesReceived expvar.Int
+	timeouts          expvar.Int
+	malformed         expvar.Int
+	serverRequests    expvar.Int
+	serverResponses   expvar.Int
+	serverErrors      expvar.Int
+	serverDrops       expvar.Int
+	serverMalformed   expvar.Int
+}
+
+// PublishExpvar publishes the counters of all the clients and servers of
+// the process as the expvar map "stun", served by the expvar handler at
+// /debug/vars: the requests sent by the clients, the retransmissions
+// included, the responses received, the timeouts and the malformed packets
+// received, and the requests received by the servers, the responses, of
+// which the error ones, and the packets dropped, of which the malformed
+// ones. The counters are only kept once published, which can be done only
+// once; later calls do nothing.
+func PublishExpvar() {
+	expvars.once.Do(func() {
+		m := new(expvar.Map)
+		m.Set("RequestsSent", &expvars.requestsSent)
+		m.Set("ResponsesReceived", &expvars.responsesReceived)
+		m.Set("Timeouts", &expvars.timeouts)
+		m.Set("Malformed", &expvars.malformed)
+		m.Set("ServerRequests", &expvars.serverRequests)
+		m.Set("ServerResponses", &expvars.serverResponses)
+		m.Set("ServerErrors", &expvars.serverErrors)
+		m.Set("ServerDrops", &expvars.serverDrops)
+		m.Set("ServerMalformed", &expvars.serverMalformed)
+		expvar.Publish("stun", m)
+		expvars.enabled.Store(true)
+	})
+}
+
+// countExpvar adds n to the counter v once published.
+func countExpvar(v *expvar.Int, n int) {
+	if n != 0 && expvars.enabled.Load() {
+		v.Add(int64(n))
+	}
+}
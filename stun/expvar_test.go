@@ -0,0 +1,60 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"expvar"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	PublishExpvar()
+	PublishExpvar()
+	m, ok := expvar.Get("stun").(*expvar.Map)
+	if !ok {
+		t.Fatal("PublishExpvar error: stun not published")
+	}
+	get := func(key string) int64 { return m.Get(key).(*expvar.Int).Value() }
+	keys := []string{"RequestsSent", "ResponsesReceived", "ServerRequests", "ServerResponses", "ServerDrops", "ServerMalformed"}
+	before := make(map[string]int64)
+	for _, k := range keys {
+		before[k] = get(k)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s, addr := newTestServer(t)
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(addr)
+	if _, err := c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	conn.WriteTo([]byte("not a STUN message"), raddr)
+	for i := 0; i < 100 && s.Stats().Drops[DroppedMalformed] == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, k := range keys {
+		if get(k) < before[k]+1 {
+			t.Errorf("PublishExpvar error: %s %d, was %d", k, get(k), before[k])
+		}
+	}
+}
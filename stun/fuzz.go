@@ -0,0 +1,92 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"io"
+)
+
+// The entry points of the fuzzers of the parsers, of the signature of
+// go-fuzz and of the Go fuzzers of OSS-Fuzz: they return 1 if the input is
+// parsed, to be given priority in the corpus, and 0 otherwise, and panic if
+// an invariant of the parser is broken. The seeds are in testdata/fuzz.
+
+// FuzzMessage parses data as a STUN message, and reads its attributes as a
+// client reads those of a response.
+func FuzzMessage(data []byte) int {
+	m, err := ParseMessage(data)
+	if err != nil {
+		return 0
+	}
+	fuzzPacket(m.pkt)
+	m.Annotate(io.Discard)
+	return 1
+}
+
+// FuzzDecoder reads the STUN messages and the padded ChannelData messages of
+// the TCP stream data, up to the first malformed one.
+func FuzzDecoder(data []byte) int {
+	d := NewDecoder(bytes.NewReader(data))
+	read := 0
+	for {
+		b, err := d.readFrame()
+		if err != nil {
+			break
+		}
+		if b[0]&0xc0 != 0 {
+			if FuzzChannelData(b) == 0 {
+				panic("stun: frame of the decoder not a ChannelData message")
+			}
+		} else if FuzzMessage(b) == 0 {
+			break
+		}
+		read++
+	}
+	if read == 0 {
+		return 0
+	}
+	return 1
+}
+
+// FuzzChannelData parses data as a TURN ChannelData message, which is to
+// encode back to its prefix.
+func FuzzChannelData(data []byte) int {
+	number, payload, ok := parseChannelData(data)
+	if !ok {
+		return 0
+	}
+	if b := newChannelData(number, payload); !bytes.Equal(b, data[:len(b)]) {
+		panic("stun: ChannelData message not encoded back")
+	}
+	return 1
+}
+
+// fuzzPacket reads the attributes of the packet.
+func fuzzPacket(pkt *packet) {
+	pkt.getErrorCode()
+	pkt.getErrorReason()
+	pkt.getChangeRequest()
+	pkt.getSourceAddr()
+	pkt.getMappedAddr()
+	pkt.getChangedAddr()
+	pkt.getOtherAddr()
+	pkt.getXorMappedAddr()
+	pkt.getLifetime()
+	pkt.getConnectionID()
+	pkt.getPeerAddrs()
+}
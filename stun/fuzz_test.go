@@ -0,0 +1,57 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import "testing"
+
+// The seeds of the fuzzers are in testdata/fuzz, and run with the tests.
+
+func FuzzParseMessage(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		FuzzMessage(data)
+	})
+}
+
+func FuzzReadMessage(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		FuzzDecoder(data)
+	})
+}
+
+func FuzzParseChannelData(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		FuzzChannelData(data)
+	})
+}
+
+func TestFuzzSeeds(t *testing.T) {
+	if FuzzMessage([]byte{0, 1, 0, 0}) != 0 {
+		t.Errorf("FuzzMessage error: short message parsed")
+	}
+	req, _ := NewMessage(TypeBindingRequest)
+	b := req.Encode(nil)
+	if FuzzMessage(b) != 1 {
+		t.Errorf("FuzzMessage error: request not parsed")
+	}
+	stream := append(append([]byte{}, b...), padChannelData(newChannelData(0x4001, []byte("abc")))...)
+	if FuzzDecoder(stream) != 1 {
+		t.Errorf("FuzzDecoder error: stream not read")
+	}
+	if FuzzChannelData([]byte{0x40, 0, 0, 4, 1}) != 0 {
+		t.Errorf("FuzzChannelData error: truncated message parsed")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth0	00000000	0100A8C0	0003	0	0	0	00000000	0	0	0
+`
+	ip, err := parseRoutes(bufio.NewScanner(strings.NewReader(routes)))
+	if err != nil || ip.String() != "192.168.0.1" {
+		t.Errorf("parseRoutes error: %v %v", ip, err)
+	}
+	if _, err := parseRoutes(bufio.NewScanner(strings.NewReader(routes[:strings.LastIndex(routes[:len(routes)-1], "\n")+1]))); err == nil {
+		t.Errorf("parseRoutes error: expected error without default route")
+	}
+}
+
+func TestParseARP(t *testing.T) {
+	arp := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.0.7      0x1         0x2         aa:bb:cc:dd:ee:01     *        eth0
+192.168.0.1      0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+`
+	mac, err := parseARP(bufio.NewScanner(strings.NewReader(arp)), net.ParseIP("192.168.0.1"))
+	if err != nil || mac.String() != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("parseARP error: %v %v", mac, err)
+	}
+	if _, err := parseARP(bufio.NewScanner(strings.NewReader(arp)), net.ParseIP("192.168.0.2")); err == nil {
+		t.Errorf("parseARP error: expected error of missing address")
+	}
+}
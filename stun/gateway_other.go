@@ -0,0 +1,66 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+//go:build !linux
+
+package stun
+
+import (
+	"errors"
+	"net"
+)
+
+// defaultGateway guesses the gateway of the default route, without the
+// routing table, as the first address of the subnet of the first IPv4
+// address of an interface up, which is the gateway of most home networks.
+func defaultGateway() (net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipnet.IP.To4()
+			if ip == nil || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			gw := ip.Mask(ipnet.Mask)
+			if gw == nil {
+				continue
+			}
+			gw[3]++
+			return gw, nil
+		}
+	}
+	return nil, errors.New("No default gateway.")
+}
+
+// gatewayMAC is unavailable without the ARP table, the networks are keyed
+// by subnet instead.
+func gatewayMAC(ip net.IP) (net.HardwareAddr, error) {
+	return nil, errors.New("ARP table not supported on this platform.")
+}
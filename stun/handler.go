@@ -0,0 +1,109 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+// Handler answers the STUN requests received by a server.
+type Handler interface {
+	ServeSTUN(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc is an adapter to use an ordinary function as a Handler.
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+// ServeSTUN calls f(w, r).
+func (f HandlerFunc) ServeSTUN(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// Middleware wraps a handler, e.g. to log the requests, add attributes to
+// the responses or reject some requests, by deciding whether and when to
+// call the next handler.
+type Middleware func(next Handler) Handler
+
+// ResponseWriter builds the response to a request. The response starts as a
+// success response without attribute.
+type ResponseWriter interface {
+	// AddAttribute adds an attribute to the response. SOFTWARE,
+	// MESSAGE-INTEGRITY and FINGERPRINT are added by the server.
+	AddAttribute(types uint16, value []byte)
+	// Error turns the response into an error response with the code and
+	// the reason phrase, or the standard one if reason is empty. The
+	// attributes added before are discarded.
+	Error(code int, reason string)
+	// Drop discards the response, so that the request is not answered.
+	Drop()
+}
+
+// Request is a STUN request received by a server.
+type Request struct {
+	*Message
+	Source *Host // source transport address of the request
+	Local  *Host // local address it was received on, nil if unknown
+
+	l   *listener
+	w   *responder
+	cfg *settings // settings of the server when the request was received
+}
+
+// responder is the ResponseWriter of the server, which also carries the
+// state of the built-in handlers.
+type responder struct {
+	req     *packet
+	resp    *packet
+	out     *listener // listener to send the response from
+	port    int       // port to send the response to, 0 for the source one
+	key     []byte    // key to sign the response with
+	dropped bool
+	reason  DropReason
+}
+
+func newResponder(req *packet, l *listener) *responder {
+	return &responder{
+		req:    req,
+		resp:   newResponsePacket(req, req.types|classSuccess),
+		out:    l,
+		reason: DroppedPolicy,
+	}
+}
+
+func (w *responder) AddAttribute(types uint16, value []byte) {
+	w.resp.addAttribute(*newAttribute(types, value))
+}
+
+func (w *responder) Error(code int, reason string) {
+	if reason == "" {
+		reason = errorStr[code]
+	}
+	w.resp = newResponsePacket(w.req, w.req.types|classError)
+	w.resp.addAttribute(*newErrorCodeAttribute(code, reason))
+}
+
+func (w *responder) Drop() {
+	w.dropped = true
+}
+
+// serveMux dispatches the requests by message type, and rejects the others
+// with 400 Bad Request.
+type serveMux map[uint16]Handler
+
+func (m serveMux) ServeSTUN(w ResponseWriter, r *Request) {
+	if h, ok := m[r.Type()]; ok {
+		h.ServeSTUN(w, r)
+		return
+	}
+	w.Error(errorBadRequest, "")
+}
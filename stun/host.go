@@ -18,14 +18,24 @@ package stun
 
 import (
 	"net"
-	"strconv"
+	"net/netip"
 )
 
 // Host defines the network address including address family, IP address and port.
 type Host struct {
-	family uint16
-	ip     string
-	port   uint16
+	addr netip.AddrPort
+}
+
+// newHost returns the host of addr. IPv4-mapped IPv6 addresses are converted
+// to IPv4 ones, so that hosts compare equal regardless of the socket family.
+func newHost(addr netip.AddrPort) *Host {
+	return &Host{netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}
+}
+
+// NewHost returns the host of the transport address addr, e.g. to configure
+// the alternate servers of a Redirector.
+func NewHost(addr netip.AddrPort) *Host {
+	return newHost(addr)
 }
 
 func newHostFromStr(s string) *Host {
@@ -33,38 +43,75 @@ func newHostFromStr(s string) *Host {
 	if err != nil {
 		return nil
 	}
-	host := new(Host)
-	if udpAddr.IP.To4() != nil {
-		host.family = attributeFamilyIPv4
-	} else {
-		host.family = attributeFamilyIPV6
+	return newHost(udpAddr.AddrPort())
+}
+
+// hostFromAddr returns the host of a UDP or TCP address.
+func hostFromAddr(addr net.Addr) *Host {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return newHost(a.AddrPort())
+	case *net.TCPAddr:
+		return newHost(a.AddrPort())
 	}
-	host.ip = udpAddr.IP.String()
-	host.port = uint16(udpAddr.Port)
-	return host
+	return newHostFromStr(addr.String())
+}
+
+// udpAddrPort returns the normalized address and port of addr.
+func udpAddrPort(addr *net.UDPAddr) netip.AddrPort {
+	return newHost(addr.AddrPort()).addr
 }
 
 // Family returns the family type of a host (IPv4 or IPv6).
 func (h *Host) Family() uint16 {
-	return h.family
+	if h.addr.Addr().Is4() {
+		return attributeFamilyIPv4
+	}
+	return attributeFamilyIPV6
 }
 
 // IP returns the internet protocol address of the host.
 func (h *Host) IP() string {
-	return h.ip
+	return h.addr.Addr().String()
 }
 
 // Port returns the port number of the host.
 func (h *Host) Port() uint16 {
-	return h.port
+	return h.addr.Port()
+}
+
+// Addr returns the IP address of the host.
+func (h *Host) Addr() netip.Addr {
+	return h.addr.Addr()
+}
+
+// AddrPort returns the IP address and port of the host.
+func (h *Host) AddrPort() netip.AddrPort {
+	return h.addr
 }
 
 // TransportAddr returns the transport layer address of the host.
 func (h *Host) TransportAddr() string {
-	return net.JoinHostPort(h.ip, strconv.Itoa(int(h.port)))
+	return h.addr.String()
 }
 
 // String returns the string representation of the host address.
 func (h *Host) String() string {
 	return h.TransportAddr()
 }
+
+// MarshalText implements encoding.TextMarshaler, so that the host marshals
+// to its transport address, e.g. in JSON.
+func (h *Host) MarshalText() ([]byte, error) {
+	return h.addr.MarshalText()
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (h *Host) UnmarshalText(b []byte) error {
+	var addr netip.AddrPort
+	if err := addr.UnmarshalText(b); err != nil {
+		return err
+	}
+	*h = *newHost(addr)
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestNewHost(t *testing.T) {
+	h := newHost(netip.MustParseAddrPort("[::ffff:1.2.3.4]:5678"))
+	if h.Family() != attributeFamilyIPv4 {
+		t.Errorf("newHost error: family %d", h.Family())
+	}
+	if h.IP() != "1.2.3.4" || h.String() != "1.2.3.4:5678" {
+		t.Errorf("newHost error: %v", h)
+	}
+	if h.AddrPort() != netip.MustParseAddrPort("1.2.3.4:5678") {
+		t.Errorf("newHost error: mapped address not normalized")
+	}
+	h = newHost(netip.MustParseAddrPort("[fe80::1%eth0]:3478"))
+	if h.Family() != attributeFamilyIPV6 {
+		t.Errorf("newHost error: family %d", h.Family())
+	}
+	if h.String() != "[fe80::1%eth0]:3478" {
+		t.Errorf("newHost error: %v", h)
+	}
+}
+
+func TestUDPAddrPort(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("8.8.8.8"), Port: 3478}
+	if udpAddrPort(addr) != netip.MustParseAddrPort("8.8.8.8:3478") {
+		t.Errorf("udpAddrPort error: %v", udpAddrPort(addr))
+	}
+}
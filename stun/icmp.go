@@ -0,0 +1,58 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+)
+
+// Errors returned when the platform reports an ICMP error for a request sent
+// to the STUN server, instead of waiting for the retransmissions to time out.
+var (
+	ErrPortUnreachable    = errors.New("ICMP port unreachable.")
+	ErrHostUnreachable    = errors.New("ICMP host unreachable.")
+	ErrNetworkUnreachable = errors.New("ICMP network unreachable.")
+	ErrAdminProhibited    = errors.New("ICMP communication administratively prohibited.")
+)
+
+// icmpError translates err, returned by a read or write on conn, into one of
+// the ICMP errors above. The returned bool is false if the platform tells the
+// ICMP error is about a destination other than addr, in which case it should
+// be ignored. Errors unrelated to ICMP are returned unchanged.
+func icmpError(conn net.PacketConn, addr net.Addr, err error) (error, bool) {
+	ierr, isErrno := errnoICMPError(err)
+	if !isErrno {
+		return err, true
+	}
+	if ierr, ok, found := readICMPErrQueue(conn, addr); found {
+		return ierr, ok
+	}
+	if ierr != nil {
+		return ierr, true
+	}
+	return err, true
+}
+
+// sameUDPAddr reports whether a is the UDP address ip:port.
+func sameUDPAddr(a net.Addr, ip net.IP, port int) bool {
+	u, ok := a.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	return u.Port == port && u.IP.Equal(ip)
+}
@@ -0,0 +1,176 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// Origins of the extended socket errors, see linux/errqueue.h.
+const (
+	soEEOriginICMP  = 2
+	soEEOriginICMP6 = 3
+)
+
+// enableICMPErrors asks the kernel to report ICMP errors on the unconnected
+// conn, which Linux only does when IP_RECVERR is set.
+func enableICMPErrors(conn net.PacketConn) {
+	ipv6 := isIPv6Conn(conn)
+	controlConn(conn, func(fd uintptr) error {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVERR, 1)
+		if ipv6 {
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR, 1)
+		}
+		return nil
+	})
+}
+
+// readICMPErrQueue drains the socket error queue. found is false if the
+// queue holds no ICMP error, otherwise err is the ICMP error sent in reply to
+// a packet destined to addr, and ok tells whether there was one.
+func readICMPErrQueue(conn net.PacketConn, addr net.Addr) (err error, ok bool, found bool) {
+	b := make([]byte, maxPacketSize)
+	oob := make([]byte, 512)
+	controlConn(conn, func(fd uintptr) error {
+		for {
+			_, oobn, _, from, rerr := syscall.Recvmsg(int(fd), b, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+			if rerr != nil {
+				return nil
+			}
+			ierr := parseExtendedErr(oob[:oobn])
+			if ierr == nil {
+				continue
+			}
+			found = true
+			var ip net.IP
+			var port int
+			switch sa := from.(type) {
+			case *syscall.SockaddrInet4:
+				ip, port = net.IP(sa.Addr[:]), sa.Port
+			case *syscall.SockaddrInet6:
+				ip, port = net.IP(sa.Addr[:]), sa.Port
+			}
+			if !ok && sameUDPAddr(addr, ip, port) {
+				err, ok = ierr, true
+			}
+		}
+	})
+	return err, ok, found
+}
+
+// parseExtendedErr maps the sock_extended_err control message of an ICMP
+// error to the errors of this package.
+func parseExtendedErr(oob []byte) error {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		if !(m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_RECVERR) &&
+			!(m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_RECVERR) {
+			continue
+		}
+		// struct sock_extended_err: errno(4) origin(1) type(1) code(1)
+		if len(m.Data) < 7 {
+			continue
+		}
+		origin, typ, code := m.Data[4], m.Data[5], m.Data[6]
+		switch origin {
+		case soEEOriginICMP:
+			if typ != 3 { // destination unreachable
+				continue
+			}
+			switch code {
+			case 0:
+				return ErrNetworkUnreachable
+			case 1:
+				return ErrHostUnreachable
+			case 3:
+				return ErrPortUnreachable
+			case 9, 10, 13:
+				return ErrAdminProhibited
+			}
+		case soEEOriginICMP6:
+			if typ != 1 { // destination unreachable
+				continue
+			}
+			switch code {
+			case 0:
+				return ErrNetworkUnreachable
+			case 1:
+				return ErrAdminProhibited
+			case 3:
+				return ErrHostUnreachable
+			case 4:
+				return ErrPortUnreachable
+			}
+		}
+	}
+	return nil
+}
+
+// readTimeExceeded drains the socket error queue, and returns the address
+// of the router of the last ICMP time exceeded error, of a packet of a TTL
+// too small, from the offender following the sock_extended_err.
+func readTimeExceeded(conn net.PacketConn) (netip.Addr, bool) {
+	b := make([]byte, maxPacketSize)
+	oob := make([]byte, 512)
+	var router netip.Addr
+	controlConn(conn, func(fd uintptr) error {
+		for {
+			_, oobn, _, _, rerr := syscall.Recvmsg(int(fd), b, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+			if rerr != nil {
+				return nil
+			}
+			if addr, ok := parseTimeExceeded(oob[:oobn]); ok {
+				router = addr
+			}
+		}
+	})
+	return router, router.IsValid()
+}
+
+// parseTimeExceeded returns the offender of the sock_extended_err control
+// message of an ICMP time exceeded error.
+func parseTimeExceeded(oob []byte) (netip.Addr, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	for _, m := range msgs {
+		// struct sock_extended_err is of 16 bytes, followed by the
+		// sockaddr of the offender.
+		if len(m.Data) < 16+8 {
+			continue
+		}
+		origin, typ := m.Data[4], m.Data[5]
+		offender := m.Data[16:]
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_RECVERR &&
+			origin == soEEOriginICMP && typ == 11:
+			// struct sockaddr_in: family(2) port(2) addr(4)
+			return netip.AddrFrom4([4]byte(offender[4:8])), true
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_RECVERR &&
+			origin == soEEOriginICMP6 && typ == 3 && len(offender) >= 24:
+			// struct sockaddr_in6: family(2) port(2) flowinfo(4) addr(16)
+			return netip.AddrFrom16([16]byte(offender[8:24])).Unmap(), true
+		}
+	}
+	return netip.Addr{}, false
+}
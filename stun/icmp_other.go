@@ -0,0 +1,38 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+//go:build !linux
+
+package stun
+
+import (
+	"net"
+	"net/netip"
+)
+
+// enableICMPErrors is a no-op: other platforms report ICMP errors, if at
+// all, through the errno of the next socket call.
+func enableICMPErrors(conn net.PacketConn) {}
+
+func readICMPErrQueue(conn net.PacketConn, addr net.Addr) (error, bool, bool) {
+	return nil, false, false
+}
+
+// readTimeExceeded is unavailable: the errno of the next socket call does
+// not tell the router.
+func readTimeExceeded(conn net.PacketConn) (netip.Addr, bool) {
+	return netip.Addr{}, false
+}
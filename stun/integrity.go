@@ -0,0 +1,121 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const messageIntegritySize = 20
+
+// trailerSize is the size of the MESSAGE-INTEGRITY and FINGERPRINT
+// attributes which end the messages.
+const trailerSize = 4 + messageIntegritySize + 8
+
+// LongTermKey returns the key of the long-term credential mechanism, which
+// is MD5(username ":" realm ":" password) (RFC 5389 section 15.4).
+func LongTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+// ShortTermKey returns the key of the short-term credential mechanism, which
+// is the password itself (RFC 5389 section 15.4, SASLprep is not applied).
+func ShortTermKey(password string) []byte {
+	return []byte(password)
+}
+
+// newMessageIntegrityAttribute returns the MESSAGE-INTEGRITY attribute of
+// pkt, which must be added right after it. The HMAC covers the message with
+// the length of the header counting the attribute itself.
+func newMessageIntegrityAttribute(pkt *packet, key []byte) *attribute {
+	b := pkt.bytes()
+	binary.BigEndian.PutUint16(b[2:4], pkt.length+4+messageIntegritySize)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(b)
+	return newAttribute(attributeMessageIntegrity, mac.Sum(nil))
+}
+
+// appendEncode appends the packet in the wire format to buf, followed by the
+// MESSAGE-INTEGRITY attribute of key unless nil and the FINGERPRINT
+// attribute if fp, which are computed in place over the bytes appended, and
+// returns the extended buffer. The packet itself is not changed.
+func (v *packet) appendEncode(buf []byte, key []byte, fp bool) []byte {
+	start := len(buf)
+	buf = v.appendTo(buf)
+	if key != nil {
+		// The length of the header counts the attribute itself.
+		binary.BigEndian.PutUint16(buf[start+2:], uint16(len(buf)-start-messageHeaderSize+4+messageIntegritySize))
+		mac := hmac.New(sha1.New, key)
+		mac.Write(buf[start:])
+		buf = binary.BigEndian.AppendUint16(buf, attributeMessageIntegrity)
+		buf = binary.BigEndian.AppendUint16(buf, messageIntegritySize)
+		buf = mac.Sum(buf)
+	}
+	if fp {
+		binary.BigEndian.PutUint16(buf[start+2:], uint16(len(buf)-start-messageHeaderSize+8))
+		crc := crc32.ChecksumIEEE(buf[start:]) ^ fingerprint
+		buf = binary.BigEndian.AppendUint16(buf, attributeFingerprint)
+		buf = binary.BigEndian.AppendUint16(buf, 4)
+		buf = binary.BigEndian.AppendUint32(buf, crc)
+	}
+	return buf
+}
+
+// findAttribute returns the offset of the first attribute of the type in the
+// raw message b, or -1. The raw bytes are used since the integrity checks
+// cover them exactly as the peer encoded them.
+func findAttribute(b []byte, types uint16) int {
+	for pos := messageHeaderSize; pos+4 <= len(b); {
+		if binary.BigEndian.Uint16(b[pos:]) == types {
+			return pos
+		}
+		length := int(binary.BigEndian.Uint16(b[pos+2:]))
+		pos += 4 + (length+3)&^3
+	}
+	return -1
+}
+
+// checkMessageIntegrity verifies the MESSAGE-INTEGRITY attribute of the raw
+// message b with key.
+func checkMessageIntegrity(b []byte, key []byte) bool {
+	pos := findAttribute(b, attributeMessageIntegrity)
+	if pos < 0 || pos+4+messageIntegritySize > len(b) {
+		return false
+	}
+	msg := make([]byte, pos)
+	copy(msg, b[:pos])
+	binary.BigEndian.PutUint16(msg[2:4], uint16(pos+4+messageIntegritySize-messageHeaderSize))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	return hmac.Equal(mac.Sum(nil), b[pos+4:pos+4+messageIntegritySize])
+}
+
+// checkFingerprint verifies the FINGERPRINT attribute of the raw message b,
+// which must be the last attribute.
+func checkFingerprint(b []byte) bool {
+	pos := findAttribute(b, attributeFingerprint)
+	if pos < 0 || pos+8 != len(b) {
+		return false
+	}
+	crc := crc32.ChecksumIEEE(b[:pos]) ^ fingerprint
+	return binary.BigEndian.Uint32(b[pos+4:]) == crc
+}
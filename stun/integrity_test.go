@@ -0,0 +1,48 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"testing"
+)
+
+func TestIntegrityRoundTrip(t *testing.T) {
+	p, err := newPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.types = typeBindingRequest
+	p.addAttribute(*newSoftwareAttribute("abc"))
+	p.addAttribute(*newAttribute(attributeUsername, []byte("evtj:h6vY")))
+	key := ShortTermKey("VOkJxbRl1RmTxUk/WvJxBt")
+	p.addAttribute(*newMessageIntegrityAttribute(p, key))
+	p.addAttribute(*newFingerprintAttribute(p))
+	b := p.bytes()
+	if !checkMessageIntegrity(b, key) {
+		t.Errorf("checkMessageIntegrity error")
+	}
+	if checkMessageIntegrity(b, ShortTermKey("wrong")) {
+		t.Errorf("checkMessageIntegrity error: wrong key accepted")
+	}
+	if !checkFingerprint(b) {
+		t.Errorf("checkFingerprint error")
+	}
+	b[len(b)-1] ^= 1
+	if checkFingerprint(b) {
+		t.Errorf("checkFingerprint error: corrupted message accepted")
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Defaults of InteropOptions.
+const (
+	defaultInteropAttempts    = 3
+	defaultInteropTimeout     = 500 * time.Millisecond
+	defaultInteropConcurrency = 4
+)
+
+// interopUnknownAttribute is a comprehension-required attribute type not
+// assigned, which the servers of RFC 5389 are to reject.
+const interopUnknownAttribute = 0x7fff
+
+// PublicServers are STUN servers open to the public, as default of Interop
+// reports. Their operators may change their behaviors or retire them.
+var PublicServers = []string{
+	"stun.l.google.com:19302",
+	"stun1.l.google.com:19302",
+	"stun.cloudflare.com:3478",
+	"global.stun.twilio.com:3478",
+	"stun.stunprotocol.org:3478",
+	"stun.ekiga.net:3478",
+}
+
+// InteropOptions are the options of Interop. The zero values are the
+// defaults.
+type InteropOptions struct {
+	// Attempts is the number of the requests of a test before it fails,
+	// 3 by default.
+	Attempts int
+	// Timeout is the time a request is waited for, 500ms by default.
+	Timeout time.Duration
+	// Concurrency is the number of the servers tested at once, 4 by
+	// default.
+	Concurrency int
+	// TCP is whether the servers are tested over TCP as well.
+	TCP bool
+}
+
+// InteropReport is what a STUN server supports, as tested by Interop.
+type InteropReport struct {
+	Server string
+	// Err is the error of a server not responding to a Binding request,
+	// of which the other fields are zero.
+	Err error
+	// RTT is the round-trip time of the Binding request, of its
+	// retransmissions if any.
+	RTT time.Duration
+	// Software is the SOFTWARE attribute of the server, if any.
+	Software string
+	// Attributes are the names of the attributes of the response to the
+	// Binding request, in order.
+	Attributes []string
+	// RFC3489 is whether the Binding requests of no magic cookie are
+	// responded with MAPPED-ADDRESS, RFC5389 whether the others are with
+	// XOR-MAPPED-ADDRESS, and RFC5780 whether the server is of an
+	// OTHER-ADDRESS and responds from it when asked by CHANGE-REQUEST.
+	RFC3489 bool
+	RFC5389 bool
+	RFC5780 bool
+	// Fingerprint is whether the responses carry FINGERPRINT, and
+	// ResponseOrigin RESPONSE-ORIGIN.
+	Fingerprint    bool
+	ResponseOrigin bool
+	// OtherAddress is the OTHER-ADDRESS of the server, or CHANGED-ADDRESS
+	// of RFC 3489, and Alternate whether it responds to Binding requests.
+	OtherAddress *Host
+	Alternate    bool
+	// ChangeIP and ChangePort are whether the server responds from the
+	// other IP address and port, or the other port only, when asked by
+	// CHANGE-REQUEST.
+	ChangeIP   bool
+	ChangePort bool
+	// UnknownAttributes is whether a request of an unknown
+	// comprehension-required attribute is rejected with the error 420
+	// (RFC 5389 section 7.3.1).
+	UnknownAttributes bool
+	// TCP is whether a Binding request over TCP is responded, if tested.
+	TCP bool
+}
+
+// RFCs returns the RFCs the server supports, e.g. "RFC 5389".
+func (r *InteropReport) RFCs() []string {
+	var rfcs []string
+	for _, rfc := range []struct {
+		name string
+		ok   bool
+	}{{"RFC 3489", r.RFC3489}, {"RFC 5389", r.RFC5389}, {"RFC 5780", r.RFC5780}} {
+		if rfc.ok {
+			rfcs = append(rfcs, rfc.name)
+		}
+	}
+	return rfcs
+}
+
+// MarshalJSON implements json.Marshaler, of Err as its message.
+func (r InteropReport) MarshalJSON() ([]byte, error) {
+	type interopReport InteropReport
+	return json.Marshal(struct {
+		interopReport
+		Err string `json:",omitempty"`
+	}{interopReport(r), errorText(r.Err)})
+}
+
+// Interop tests the STUN servers, of a socket each, and reports the RFCs
+// and the attributes each supports, in order, to pick the reliable ones:
+// the Binding requests of RFC 5389 and of RFC 3489, the other address and
+// CHANGE-REQUEST, the rejection of the unknown attributes, and TCP if
+// asked. The other address is sent to before the CHANGE-REQUEST tests,
+// which a NAT filtering by the address would drop otherwise. Canceling
+// ctx stops the tests, the reports so far returned with the error of ctx.
+func (c *Client) Interop(ctx context.Context, servers []string, opts *InteropOptions) ([]*InteropReport, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("No STUN server.")
+	}
+	o := InteropOptions{Attempts: defaultInteropAttempts, Timeout: defaultInteropTimeout, Concurrency: defaultInteropConcurrency}
+	if opts != nil {
+		o.TCP = opts.TCP
+		if opts.Attempts > 0 {
+			o.Attempts = opts.Attempts
+		}
+		if opts.Timeout > 0 {
+			o.Timeout = opts.Timeout
+		}
+		if opts.Concurrency > 0 {
+			o.Concurrency = opts.Concurrency
+		}
+	}
+	reports := make([]*InteropReport, len(servers))
+	sem := make(chan struct{}, o.Concurrency)
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			reports[i] = c.interop(ctx, server, &o)
+			if err := reports[i].Err; err != nil {
+				c.logger.Debugln("Interop of", server, ":", err)
+			}
+		}(i, server)
+	}
+	wg.Wait()
+	return reports, ctx.Err()
+}
+
+// interop runs the tests of Interop against the server.
+func (c *Client) interop(ctx context.Context, server string, o *InteropOptions) *InteropReport {
+	r := &InteropReport{Server: server}
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	conn, err := listenUDP(c.iface)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	defer conn.Close()
+	primary := unmapAddrPort(addr.AddrPort())
+	// exchange sends the request of newReq to the address, and returns
+	// its response with its source, or nil if none.
+	exchange := func(to net.Addr, newReq func() (*packet, error)) (*packet, netip.AddrPort) {
+		pkt, err := newReq()
+		if err != nil {
+			return nil, netip.AddrPort{}
+		}
+		for i := 0; i < o.Attempts; i++ {
+			p, from, _, err := c.roundTrip(ctx, conn, to, pkt, make([]byte, maxPacketSize), o.Timeout)
+			if err != nil {
+				return nil, netip.AddrPort{}
+			}
+			if p != nil {
+				return p, unmapAddrPort(hostFromAddr(from).AddrPort())
+			}
+		}
+		return nil, netip.AddrPort{}
+	}
+	binding := func(changeIP, changePort bool) func() (*packet, error) {
+		return func() (*packet, error) { return c.newBindingReq(changeIP, changePort) }
+	}
+	// The Binding request of RFC 5389.
+	start := c.now()
+	resp, _ := exchange(addr, binding(false, false))
+	if resp == nil {
+		r.Err = ctx.Err()
+		if r.Err == nil {
+			r.Err = errors.New("No response from " + server + ".")
+		}
+		return r
+	}
+	r.RTT = c.now().Sub(start)
+	r.Software = resp.getString(attributeSoftware)
+	for _, a := range resp.attributes {
+		r.Attributes = append(r.Attributes, attributeName(a.types))
+	}
+	r.RFC5389 = resp.getXorMappedAddr() != nil
+	r.Fingerprint = resp.hasAttribute(attributeFingerprint)
+	r.ResponseOrigin = resp.hasAttribute(attributeResponseOrigin)
+	r.OtherAddress = resp.getOtherAddr()
+	hasOther := r.OtherAddress != nil
+	if !hasOther {
+		r.OtherAddress = resp.getChangedAddr()
+	}
+	// The Binding request of RFC 3489.
+	if p, _ := exchange(addr, c.newLegacyBindingReq); p != nil {
+		r.RFC3489 = p.types == typeBindingResponse && p.getMappedAddr() != nil
+	}
+	// An unknown comprehension-required attribute.
+	if p, _ := exchange(addr, c.newUnknownAttributeReq); p != nil {
+		r.UnknownAttributes = p.getErrorCode() == errorUnknownAttribute
+	}
+	if r.OtherAddress != nil {
+		other := net.UDPAddrFromAddrPort(r.OtherAddress.AddrPort())
+		if p, _ := exchange(other, binding(false, false)); p != nil {
+			r.Alternate = p.types == typeBindingResponse
+		}
+		if p, from := exchange(addr, binding(true, true)); p != nil && p.types == typeBindingResponse {
+			r.ChangeIP = from.Addr() != primary.Addr()
+		}
+		if p, from := exchange(addr, binding(false, true)); p != nil && p.types == typeBindingResponse {
+			r.ChangePort = from.Addr() == primary.Addr() && from.Port() != primary.Port()
+		}
+	}
+	r.RFC5780 = hasOther && r.ChangeIP && r.ChangePort
+	if o.TCP && ctx.Err() == nil {
+		r.TCP = c.interopTCP(server, o.Timeout)
+	}
+	return r
+}
+
+// interopTCP tells whether a Binding request to the server over TCP is
+// responded.
+func (c *Client) interopTCP(server string, timeout time.Duration) bool {
+	sc, err := dialStreamTimeout(TransportTCP, server, nil, int(timeout/time.Millisecond))
+	if err != nil {
+		return false
+	}
+	defer sc.Close()
+	resp, err := c.test1(sc, sc.RemoteAddr())
+	return err == nil && resp != nil && resp.mappedAddr != nil
+}
+
+// newLegacyBindingReq constructs a binding request of RFC 3489, of a
+// transaction ID of no magic cookie.
+func (c *Client) newLegacyBindingReq() (*packet, error) {
+	pkt, err := newPacketRand(c.rand)
+	if err != nil {
+		return nil, err
+	}
+	pkt.types = typeBindingRequest
+	copy(pkt.transID[:4], pkt.transID[4:8])
+	if binary.BigEndian.Uint32(pkt.transID[:4]) == magicCookie {
+		pkt.transID[0] ^= 0xff
+	}
+	return pkt, nil
+}
+
+// newUnknownAttributeReq constructs a binding request of an attribute
+// unknown to the servers.
+func (c *Client) newUnknownAttributeReq() (*packet, error) {
+	pkt, err := newPacketRand(c.rand)
+	if err != nil {
+		return nil, err
+	}
+	pkt.types = typeBindingRequest
+	pkt.addAttribute(*newAttribute(interopUnknownAttribute, make([]byte, 4)))
+	pkt.addAttribute(*newFingerprintAttribute(pkt))
+	return pkt, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInterop(t *testing.T) {
+	conns, err := listenAlternate("127.0.0.1:0", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("listenAlternate: %v", err)
+	}
+	s := NewServer()
+	go s.ServeAlternate(conns)
+	defer s.Close()
+	primary := conns[0][0].LocalAddr().String()
+	tcp := false
+	if ln, err := net.Listen("tcp", primary); err == nil {
+		go s.ServeListener(ln)
+		tcp = true
+	}
+	_, single := newTestServer(t)
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	c := NewClient()
+	reports, err := c.Interop(context.Background(), []string{primary, single, silent.LocalAddr().String()},
+		&InteropOptions{Attempts: 1, Timeout: 200 * time.Millisecond, TCP: true})
+	if err != nil {
+		t.Fatalf("Interop error: %v", err)
+	}
+	r := reports[0]
+	if r.Err != nil || !r.RFC3489 || !r.RFC5389 || !r.RFC5780 || !r.Fingerprint || !r.ResponseOrigin || !r.Alternate || r.TCP != tcp {
+		t.Errorf("Interop error of the alternate server: %+v", r)
+	}
+	if got := strings.Join(r.RFCs(), ","); got != "RFC 3489,RFC 5389,RFC 5780" {
+		t.Errorf("RFCs error: %s", got)
+	}
+	if r.OtherAddress == nil || r.OtherAddress.String() != conns[1][1].LocalAddr().String() {
+		t.Errorf("Interop error: other address %v", r.OtherAddress)
+	}
+	if r = reports[1]; r.Err != nil || !r.RFC5389 || r.RFC5780 || r.OtherAddress != nil || r.ChangeIP {
+		t.Errorf("Interop error of the single server: %+v", r)
+	}
+	if r = reports[2]; r.Err == nil || r.RFC5389 {
+		t.Errorf("Interop error of the silent server: %+v", r)
+	}
+	b, err := json.Marshal(reports[2])
+	if err != nil || !strings.Contains(string(b), `"Err":"No response`) {
+		t.Errorf("MarshalJSON error: %s, %v", b, err)
+	}
+	if _, err := c.Interop(context.Background(), nil, nil); err == nil {
+		t.Error("Interop error: expected no server")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestHostJSON(t *testing.T) {
+	b, err := json.Marshal(newHostFromStr("192.0.2.1:3478"))
+	if err != nil || string(b) != `"192.0.2.1:3478"` {
+		t.Fatalf("Marshal error: %s, %v", b, err)
+	}
+	var h Host
+	if err := json.Unmarshal([]byte(`"[2001:db8::1]:3478"`), &h); err != nil || h.String() != "[2001:db8::1]:3478" {
+		t.Errorf("Unmarshal error: %v, %v", &h, err)
+	}
+}
+
+func TestNATTypeJSON(t *testing.T) {
+	b, err := json.Marshal(map[NATType]NATType{NATFull: NATSymetric})
+	if err != nil || string(b) != `{"full-cone":"symmetric"}` {
+		t.Fatalf("Marshal error: %s, %v", b, err)
+	}
+	var m map[NATType]NATType
+	if err := json.Unmarshal(b, &m); err != nil || m[NATFull] != NATSymetric {
+		t.Errorf("Unmarshal error: %v, %v", m, err)
+	}
+	// The numbers of the profiles cached before.
+	var p NATProfile
+	if err := json.Unmarshal([]byte(`{"type":6}`), &p); err != nil || p.Type != NATRestricted {
+		t.Errorf("Unmarshal error: %v, %v", p.Type, err)
+	}
+	var nat NATType
+	if err := json.Unmarshal([]byte(`"cone"`), &nat); err == nil {
+		t.Error("Unmarshal error: expected unknown NAT type")
+	}
+}
+
+func TestResultsJSON(t *testing.T) {
+	tests := []struct {
+		v        interface{}
+		expected string
+	}{
+		{&NATBehavior{Mapping: BehaviorEndpointIndependent, Filtering: BehaviorAddressPortDependent, Mapped: newHostFromStr("192.0.2.1:1")},
+			`{"Mapping":"endpoint-independent","Filtering":"address-port-dependent","Mapped":"192.0.2.1:1"}`},
+		{&IPConsensus{Answers: []ServerAnswer{{Server: "a", Err: errors.New("Timeout.")}}},
+			`{"IP":"","Votes":0,"Disagreement":false,"Answers":[{"Server":"a","IP":"","Err":"Timeout."}]}`},
+		{&ExternalMapping{Mechanism: MechanismPCP, Mapper: &PCPMapper{}},
+			`{"Mechanism":"pcp","Protocol":"","InternalPort":0,"External":null,"Lifetime":0}`},
+		{ServerStats{Drops: map[DropReason]uint64{DroppedRateLimit: 1}},
+			`"Drops":{"rate limit":1}`},
+		{ConnectStrategy(PeerInfo{}, PeerInfo{}), `"relay"`},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(tt.v)
+		if err != nil {
+			t.Errorf("Marshal error: %v", err)
+			continue
+		}
+		if !strings.Contains(string(b), tt.expected) {
+			t.Errorf("Marshal error: %s, expected %s", b, tt.expected)
+		}
+	}
+}
+
+func TestMessageJSON(t *testing.T) {
+	req, err := NewMessage(TypeBindingRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddAttribute(attributeSoftware, []byte("test"))
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("Marshal error: %v", err)
+	}
+	if !strings.Contains(string(b), `"Type":"Binding request"`) || !strings.Contains(string(b), `"Attributes":[{"Type":"SOFTWARE","Value":"\"test\""}]`) {
+		t.Errorf("Marshal error: %s", b)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults of KeepaliveOptions.
+const (
+	defaultKeepaliveInterval    = 15 * time.Second
+	defaultKeepaliveConcurrency = 32
+	// minKeepaliveInterval is the interval at least of a binding lifetime.
+	minKeepaliveInterval = time.Second
+)
+
+// keepaliveLifetimeShare is the share of the binding lifetime the interval
+// of the keep-alives is of, safe of a keep-alive lost and of the lifetimes
+// measured too long.
+const keepaliveLifetimeShare = 0.5
+
+// The wheel of the keep-alives is of 100ms ticks, of a turn of about 100s.
+const (
+	keepaliveTick  = 100 * time.Millisecond
+	keepaliveSlots = 1024
+)
+
+// KeepaliveOptions are the options of NewKeepaliveManager. The zero values
+// are the defaults.
+type KeepaliveOptions struct {
+	// Interval is the interval between the keep-alives of a binding, 15s
+	// by default, below the binding lifetime of the NATs.
+	Interval time.Duration
+	// BindingLifetime is the binding lifetime measured of the NAT, e.g. by
+	// MeasureBindingLifetime or of a NATProfile, of which the interval is
+	// half unless Interval.
+	BindingLifetime time.Duration
+	// Attempts is the number of the requests of a keep-alive at most,
+	// retransmitted as of the discovery, 9 by default.
+	Attempts int
+	// MaxFailures is the number of the consecutive keep-alives without a
+	// response after which the binding fails, 1 by default.
+	MaxFailures int
+	// Concurrency is the number of the keep-alives in flight at most, 32
+	// by default.
+	Concurrency int
+}
+
+// KeepaliveManager keeps the bindings of many sockets alive, e.g. the
+// outbound pinholes of a server through its NAT, by Binding requests to
+// their STUN servers at an interval. The bindings share the timers of a
+// wheel, of a goroutine, and are spread over the interval.
+type KeepaliveManager struct {
+	opts  KeepaliveOptions
+	wheel *timerWheel
+	sem   chan struct{} // of the keep-alives in flight
+	done  chan struct{} // closed by Close
+	wg    sync.WaitGroup
+
+	mu       sync.Mutex
+	bindings map[*KeepaliveBinding]struct{}
+	closed   bool
+	addrs    addressFeed
+}
+
+// KeepaliveBinding is a binding kept alive by a KeepaliveManager.
+type KeepaliveBinding struct {
+	m         *KeepaliveManager
+	client    *Client
+	conn      net.PacketConn
+	addr      *net.UDPAddr
+	onFailure func(b *KeepaliveBinding, err error)
+
+	mu       sync.Mutex
+	mapped   *Host
+	failures int
+}
+
+// NewKeepaliveManager returns a manager of the options, the defaults if
+// nil.
+func NewKeepaliveManager(opts *KeepaliveOptions) *KeepaliveManager {
+	o := KeepaliveOptions{
+		Interval:    defaultKeepaliveInterval,
+		Attempts:    numRetransmit,
+		MaxFailures: 1,
+		Concurrency: defaultKeepaliveConcurrency,
+	}
+	if opts != nil {
+		if opts.BindingLifetime > 0 {
+			o.Interval = lifetimeInterval(opts.BindingLifetime)
+		}
+		if opts.Interval > 0 {
+			o.Interval = opts.Interval
+		}
+		if opts.Attempts > 0 {
+			o.Attempts = opts.Attempts
+		}
+		if opts.MaxFailures > 0 {
+			o.MaxFailures = opts.MaxFailures
+		}
+		if opts.Concurrency > 0 {
+			o.Concurrency = opts.Concurrency
+		}
+	}
+	m := &KeepaliveManager{
+		opts:     o,
+		wheel:    newTimerWheel(keepaliveTick, keepaliveSlots, time.Now()),
+		sem:      make(chan struct{}, o.Concurrency),
+		done:     make(chan struct{}),
+		bindings: make(map[*KeepaliveBinding]struct{}),
+	}
+	go m.wheel.run(m.done)
+	return m
+}
+
+// Add keeps the binding of conn to the STUN server alive, from a time at
+// random within the interval, until removed or failed. The conn is not to
+// be read from during the keep-alives. Once MaxFailures consecutive
+// keep-alives got no response, the binding is removed and onFailure, if
+// not nil, is called with the last error, e.g. to punch the pinhole again.
+func (m *KeepaliveManager) Add(conn net.PacketConn, server string, onFailure func(b *KeepaliveBinding, err error)) (*KeepaliveBinding, error) {
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	b := &KeepaliveBinding{
+		m:         m,
+		client:    NewClientWithConnection(conn),
+		conn:      conn,
+		addr:      addr,
+		onFailure: onFailure,
+	}
+	b.client.SetServerAddr(server)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, errors.New("Keepalive manager closed.")
+	}
+	m.bindings[b] = struct{}{}
+	m.wheel.schedule(time.Now().Add(time.Duration(rand.Int63n(int64(m.opts.Interval)))), b.fire)
+	return b, nil
+}
+
+// SetBindingLifetime sets the interval of the keep-alives to half of the
+// binding lifetime measured, e.g. once measured again after the network
+// changed, from the next keep-alive of each binding.
+func (m *KeepaliveManager) SetBindingLifetime(d time.Duration) {
+	m.mu.Lock()
+	m.opts.Interval = lifetimeInterval(d)
+	m.mu.Unlock()
+}
+
+// Interval returns the interval of the keep-alives.
+func (m *KeepaliveManager) Interval() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.opts.Interval
+}
+
+// lifetimeInterval returns the interval of the keep-alives of the binding
+// lifetime.
+func lifetimeInterval(d time.Duration) time.Duration {
+	if d = time.Duration(float64(d) * keepaliveLifetimeShare); d < minKeepaliveInterval {
+		d = minKeepaliveInterval
+	}
+	return d
+}
+
+// Len returns the number of the bindings kept alive.
+func (m *KeepaliveManager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.bindings)
+}
+
+// Subscribe returns a channel receiving the changes of the mapped addresses
+// of the bindings, the first ones included, e.g. of the NAT rebinding a
+// pinhole to another port. Events are dropped if the subscriber does not
+// keep up.
+func (m *KeepaliveManager) Subscribe() <-chan AddressEvent {
+	return m.addrs.subscribe()
+}
+
+// Close stops the keep-alives, waits for those in flight and closes the
+// channels returned by Subscribe. The connections are left open.
+func (m *KeepaliveManager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.bindings = make(map[*KeepaliveBinding]struct{})
+	close(m.done)
+	m.mu.Unlock()
+	m.wg.Wait()
+	m.addrs.close()
+	return nil
+}
+
+// active reports whether the binding is kept alive, and tracks the
+// keep-alive to be waited for by Close if so.
+func (m *KeepaliveManager) active(b *KeepaliveBinding) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.bindings[b]; !ok {
+		return false
+	}
+	m.wg.Add(1)
+	return true
+}
+
+// Remove stops keeping the binding alive.
+func (b *KeepaliveBinding) Remove() {
+	b.m.mu.Lock()
+	delete(b.m.bindings, b)
+	b.m.mu.Unlock()
+}
+
+// Mapped returns the mapped address of the last keep-alive responded to,
+// or nil before the first.
+func (b *KeepaliveBinding) Mapped() *Host {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.mapped
+}
+
+// Conn returns the connection of the binding.
+func (b *KeepaliveBinding) Conn() net.PacketConn {
+	return b.conn
+}
+
+// fire runs the keep-alive due of the binding, in the background once a
+// keep-alive of the concurrency is free, and schedules the next one.
+func (b *KeepaliveBinding) fire(now time.Time) {
+	m := b.m
+	if !m.active(b) {
+		return
+	}
+	go func() {
+		defer m.wg.Done()
+		select {
+		case m.sem <- struct{}{}:
+		case <-m.done:
+			return
+		}
+		err := b.keepalive()
+		<-m.sem
+		if err == nil {
+			m.wheel.schedule(time.Now().Add(m.Interval()), b.fire)
+			return
+		}
+		b.client.logger.Debugln("keep-alive of", b.conn.LocalAddr(), "failed:", err)
+		b.mu.Lock()
+		b.failures++
+		failed := b.failures >= m.opts.MaxFailures
+		b.mu.Unlock()
+		if !failed {
+			m.wheel.schedule(time.Now().Add(m.Interval()), b.fire)
+			return
+		}
+		m.mu.Lock()
+		_, ok := m.bindings[b]
+		delete(m.bindings, b)
+		m.mu.Unlock()
+		if ok && b.onFailure != nil {
+			b.onFailure(b, err)
+		}
+	}()
+}
+
+// keepalive sends a Binding request to the server, and records the mapped
+// address of the response.
+func (b *KeepaliveBinding) keepalive() error {
+	pkt, err := b.client.newBindingReq(false, false)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.transmit(pkt, b.conn, b.addr, b.m.opts.Attempts)
+	if err != nil {
+		return err
+	}
+	if resp == nil || resp.packet == nil {
+		return errors.New("No response from the STUN server.")
+	}
+	b.mu.Lock()
+	old := b.mapped
+	b.mapped = resp.mappedAddr
+	b.failures = 0
+	b.mu.Unlock()
+	if resp.mappedAddr != nil && !sameHost(old, resp.mappedAddr) {
+		b.m.addrs.publish(AddressEvent{Old: old, New: resp.mappedAddr, Binding: b})
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveManager(t *testing.T) {
+	_, server := newTestServer(t)
+	m := NewKeepaliveManager(&KeepaliveOptions{Interval: 100 * time.Millisecond, Concurrency: 4})
+	var bindings []*KeepaliveBinding
+	for i := 0; i < 20; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		b, err := m.Add(conn, server, func(b *KeepaliveBinding, err error) {
+			t.Errorf("Keepalive error: %v failed, %v", b.Conn().LocalAddr(), err)
+		})
+		if err != nil {
+			t.Fatalf("Add error: %v", err)
+		}
+		bindings = append(bindings, b)
+	}
+	// Closed before the connections.
+	defer m.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, b := range bindings {
+		for b.Mapped() == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if b.Mapped() == nil || b.Mapped().String() != b.Conn().LocalAddr().String() {
+			t.Errorf("Keepalive error: mapped %v, expected %v", b.Mapped(), b.Conn().LocalAddr())
+		}
+	}
+	bindings[0].Remove()
+	if n := m.Len(); n != 19 {
+		t.Errorf("Remove error: %d bindings", n)
+	}
+}
+
+func TestKeepaliveManagerFailure(t *testing.T) {
+	// The server never responds.
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m := NewKeepaliveManager(&KeepaliveOptions{Interval: 50 * time.Millisecond, Attempts: 1, MaxFailures: 2})
+	defer m.Close()
+	failed := make(chan error, 1)
+	b, err := m.Add(conn, silent.LocalAddr().String(), func(b *KeepaliveBinding, err error) {
+		failed <- err
+	})
+	if err != nil {
+		t.Fatalf("Add error: %v", err)
+	}
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Errorf("Keepalive error: failed without error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Keepalive error: no failure")
+	}
+	if m.Len() != 0 || b.Mapped() != nil {
+		t.Errorf("Keepalive error: %d bindings, mapped %v", m.Len(), b.Mapped())
+	}
+	m.Close()
+	if _, err := m.Add(conn, silent.LocalAddr().String(), nil); err == nil {
+		t.Errorf("Add error: expected error once closed")
+	}
+}
+
+func TestKeepaliveManagerSubscribe(t *testing.T) {
+	_, server := newTestServer(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m := NewKeepaliveManager(&KeepaliveOptions{Interval: 50 * time.Millisecond})
+	defer m.Close()
+	events := m.Subscribe()
+	b, err := m.Add(conn, server, nil)
+	if err != nil {
+		t.Fatalf("Add error: %v", err)
+	}
+	select {
+	case ev := <-events:
+		if ev.Old != nil || ev.New.String() != conn.LocalAddr().String() || ev.Binding != b {
+			t.Errorf("Subscribe error: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscribe error: no event")
+	}
+	// The keep-alives of the same mapping change nothing.
+	select {
+	case ev := <-events:
+		t.Errorf("Subscribe error: %+v of the same mapping", ev)
+	case <-time.After(200 * time.Millisecond):
+	}
+	m.Close()
+	if _, ok := <-events; ok {
+		t.Errorf("Close error: channel not closed")
+	}
+}
+
+func TestKeepaliveManagerLifetime(t *testing.T) {
+	m := NewKeepaliveManager(&KeepaliveOptions{BindingLifetime: 30 * time.Second})
+	defer m.Close()
+	if d := m.Interval(); d != 15*time.Second {
+		t.Errorf("Interval error: %v of the binding lifetime 30s", d)
+	}
+	m.SetBindingLifetime(500 * time.Millisecond)
+	if d := m.Interval(); d != minKeepaliveInterval {
+		t.Errorf("Interval error: %v of the binding lifetime 500ms", d)
+	}
+	// Interval is preferred.
+	m = NewKeepaliveManager(&KeepaliveOptions{Interval: time.Second, BindingLifetime: time.Minute})
+	defer m.Close()
+	if d := m.Interval(); d != time.Second {
+		t.Errorf("Interval error: %v", d)
+	}
+}
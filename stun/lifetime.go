@@ -0,0 +1,110 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultLifetimeProbes is the number of the probes of
+// MeasureBindingLifetime.
+const defaultLifetimeProbes = 8
+
+// MeasureBindingLifetime measures the time the NAT keeps an idle binding,
+// up to max, of probes at once, 8 if 0: each binds a new socket, stays idle
+// for its share of max, max/probes apart, and binds again, the binding
+// expired if mapped to another address. It returns the idle time of the
+// longest probe of the binding kept, of the resolution of max/probes, or
+// max if no binding expired. It takes max; a NAT reallocating the same
+// port to an expired binding is taken for keeping it.
+func (c *Client) MeasureBindingLifetime(ctx context.Context, max time.Duration, probes int) (time.Duration, error) {
+	if probes <= 0 {
+		probes = defaultLifetimeProbes
+	}
+	if max <= 0 {
+		return 0, errors.New("Invalid maximum binding lifetime.")
+	}
+	if c.serverAddr == "" {
+		c.SetServerAddr(DefaultServerAddr)
+	}
+	addr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if err != nil {
+		return 0, err
+	}
+	kept := make([]bool, probes)
+	errs := make([]error, probes)
+	var wg sync.WaitGroup
+	for i := 0; i < probes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			idle := max * time.Duration(i+1) / time.Duration(probes)
+			kept[i], errs[i] = c.probeBinding(ctx, addr, idle)
+		}(i)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	lifetime := time.Duration(0)
+	for i := 0; i < probes; i++ {
+		if errs[i] != nil {
+			return 0, errs[i]
+		}
+		if !kept[i] {
+			break
+		}
+		lifetime = max * time.Duration(i+1) / time.Duration(probes)
+	}
+	c.logger.Debugln("Binding lifetime:", lifetime)
+	return lifetime, nil
+}
+
+// probeBinding reports whether a binding idle for the time is kept, i.e.
+// mapped to the same address before and after.
+func (c *Client) probeBinding(ctx context.Context, addr *net.UDPAddr, idle time.Duration) (bool, error) {
+	conn, err := listenUDP(c.iface)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	var mapped [2]*Host
+	for i := range mapped {
+		if i > 0 {
+			timer := time.NewTimer(idle)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return false, ctx.Err()
+			}
+		}
+		resp, err := c.test1(conn, addr)
+		if err != nil {
+			return false, err
+		}
+		if resp == nil || resp.mappedAddr == nil {
+			return false, errors.New("No mapped address from the STUN server.")
+		}
+		mapped[i] = resp.mappedAddr
+	}
+	return sameHost(mapped[0], mapped[1]), nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newExpiringServer returns the address of a server mapping the clients to
+// their addresses, but of another port once bound for longer than the
+// lifetime, as a NAT expiring the bindings.
+func newExpiringServer(t *testing.T, lifetime time.Duration) string {
+	var mu sync.Mutex
+	first := make(map[string]time.Time)
+	return newRespondingServer(t, func(w ResponseWriter, r *Request) {
+		mu.Lock()
+		at, ok := first[r.Source.String()]
+		if !ok {
+			at = time.Now()
+			first[r.Source.String()] = at
+		}
+		mu.Unlock()
+		mapped := r.Source
+		if time.Since(at) > lifetime {
+			mapped = newHost(netip.AddrPortFrom(mapped.AddrPort().Addr(), mapped.AddrPort().Port()+1))
+		}
+		addXorMapped(w, r, mapped)
+	})
+}
+
+func TestMeasureBindingLifetime(t *testing.T) {
+	c := NewClient()
+	c.SetServerAddr(newExpiringServer(t, 250*time.Millisecond))
+	d, err := c.MeasureBindingLifetime(context.Background(), 400*time.Millisecond, 4)
+	if err != nil {
+		t.Fatalf("MeasureBindingLifetime error: %v", err)
+	}
+	if d != 200*time.Millisecond {
+		t.Errorf("MeasureBindingLifetime error: %v, expected 200ms", d)
+	}
+	// No binding expires.
+	_, addr := newTestServer(t)
+	c.SetServerAddr(addr)
+	if d, err := c.MeasureBindingLifetime(context.Background(), 100*time.Millisecond, 2); err != nil || d != 100*time.Millisecond {
+		t.Errorf("MeasureBindingLifetime error: %v, %v", d, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.MeasureBindingLifetime(ctx, time.Second, 2); err != context.Canceled {
+		t.Errorf("MeasureBindingLifetime error: %v, expected context.Canceled", err)
+	}
+}
@@ -17,14 +17,35 @@
 package stun
 
 import (
+	"fmt"
 	"log"
+	"strings"
 )
 
-// Logger is a simple logger specified for this STUN client.
+// Logger is a simple logger specified for this STUN client. Debug, Warnln
+// and Errorln print in the debug mode and Info and the messages dumped in the
+// info mode, unless SetSlog makes the logger write to a structured logger by
+// level instead.
 type Logger struct {
 	log.Logger
 	debug bool
 	info  bool
+	sink  sink // the structured logger of SetSlog, if any
+}
+
+// Levels of the messages, those of log/slog.
+const (
+	levelDebug = -4 // the progress and the messages sent and received
+	levelInfo  = 0  // the results
+	levelWarn  = 4  // the retransmissions and the transactions lost
+	levelError = 8  // the failures
+)
+
+// sink is a structured logger, which filters the messages by level
+// instead of SetDebug and SetInfo.
+type sink interface {
+	enabled(level int) bool
+	log(level int, msg string, args ...interface{})
 }
 
 type stdLogger struct{}
@@ -40,7 +61,7 @@ var std = &stdLogger{}
 
 // NewLogger creates a default logger.
 func NewLogger() *Logger {
-	logger := &Logger{*log.New(std, "", log.LstdFlags), false, false}
+	logger := &Logger{*log.New(std, "", log.LstdFlags), false, false, nil}
 	return logger
 }
 
@@ -56,42 +77,127 @@ func (l *Logger) SetInfo(v bool) {
 
 // Debug outputs the log in the format of log.Print.
 func (l *Logger) Debug(v ...interface{}) {
-	if l.debug {
+	if l.sink != nil {
+		if l.sink.enabled(levelDebug) {
+			l.sink.log(levelDebug, fmt.Sprint(v...))
+		}
+	} else if l.debug {
 		l.Print(v...)
 	}
 }
 
 // Debugf outputs the log in the format of log.Printf.
 func (l *Logger) Debugf(format string, v ...interface{}) {
-	if l.debug {
+	if l.sink != nil {
+		if l.sink.enabled(levelDebug) {
+			l.sink.log(levelDebug, fmt.Sprintf(format, v...))
+		}
+	} else if l.debug {
 		l.Printf(format, v...)
 	}
 }
 
 // Debugln outputs the log in the format of log.Println.
 func (l *Logger) Debugln(v ...interface{}) {
-	if l.debug {
+	if l.sink != nil {
+		if l.sink.enabled(levelDebug) {
+			l.sink.log(levelDebug, sprintln(v...))
+		}
+	} else if l.debug {
 		l.Println(v...)
 	}
 }
 
 // Info outputs the log in the format of log.Print.
 func (l *Logger) Info(v ...interface{}) {
-	if l.info {
+	if l.sink != nil {
+		if l.sink.enabled(levelInfo) {
+			l.sink.log(levelInfo, fmt.Sprint(v...))
+		}
+	} else if l.info {
 		l.Print(v...)
 	}
 }
 
 // Infof outputs the log in the format of log.Printf.
 func (l *Logger) Infof(format string, v ...interface{}) {
-	if l.info {
+	if l.sink != nil {
+		if l.sink.enabled(levelInfo) {
+			l.sink.log(levelInfo, fmt.Sprintf(format, v...))
+		}
+	} else if l.info {
 		l.Printf(format, v...)
 	}
 }
 
 // Infoln outputs the log in the format of log.Println.
 func (l *Logger) Infoln(v ...interface{}) {
-	if l.info {
+	if l.sink != nil {
+		if l.sink.enabled(levelInfo) {
+			l.sink.log(levelInfo, sprintln(v...))
+		}
+	} else if l.info {
+		l.Println(v...)
+	}
+}
+
+// dumpln outputs a message sent or received in full in the format of
+// log.Println, in the info mode, or at the debug level.
+func (l *Logger) dumpln(v ...interface{}) {
+	if l.sink != nil {
+		if l.sink.enabled(levelDebug) {
+			l.sink.log(levelDebug, sprintln(v...))
+		}
+	} else if l.info {
+		l.Println(v...)
+	}
+}
+
+// Warnln outputs the log of a retransmission or a lost transaction in the
+// format of log.Println, in the debug mode.
+func (l *Logger) Warnln(v ...interface{}) {
+	if l.sink != nil {
+		if l.sink.enabled(levelWarn) {
+			l.sink.log(levelWarn, sprintln(v...))
+		}
+	} else if l.debug {
 		l.Println(v...)
 	}
 }
+
+// Errorln outputs the log of a failure in the format of log.Println, in the
+// debug mode.
+func (l *Logger) Errorln(v ...interface{}) {
+	if l.sink != nil {
+		if l.sink.enabled(levelError) {
+			l.sink.log(levelError, sprintln(v...))
+		}
+	} else if l.debug {
+		l.Println(v...)
+	}
+}
+
+// logAttrs outputs the message of the level with the attributes, given as
+// keys and values in turn, to the structured logger, or in the format of
+// log.Println in the debug mode.
+func (l *Logger) logAttrs(level int, msg string, args ...interface{}) {
+	if l.sink != nil {
+		if l.sink.enabled(level) {
+			l.sink.log(level, msg, args...)
+		}
+		return
+	}
+	if l.debug {
+		var b strings.Builder
+		b.WriteString(msg)
+		for i := 0; i+1 < len(args); i += 2 {
+			fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+		}
+		l.Println(b.String())
+	}
+}
+
+// sprintln formats v as log.Println, without the trailing newline.
+func sprintln(v ...interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+}
@@ -0,0 +1,69 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+//go:build go1.21
+
+package stun
+
+import (
+	"context"
+	"log/slog"
+)
+
+// slogSink is a structured logger of log/slog.
+type slogSink struct {
+	l *slog.Logger
+}
+
+func (s slogSink) enabled(level int) bool {
+	return s.l.Enabled(context.Background(), slog.Level(level))
+}
+
+func (s slogSink) log(level int, msg string, args ...interface{}) {
+	s.l.Log(context.Background(), slog.Level(level), msg, args...)
+}
+
+// SetSlog makes the logger write to the structured logger sl, or print as
+// before if nil. The messages are of the levels: debug of Debug, the progress
+// and the messages sent and received in full, info of Info and the results
+// of the transactions, warn of the retransmissions and the transactions lost,
+// and error of the failures, filtered by the handler of sl in place of
+// SetDebug and SetInfo.
+func (l *Logger) SetSlog(sl *slog.Logger) {
+	if sl == nil {
+		l.sink = nil
+		return
+	}
+	l.sink = slogSink{sl}
+}
+
+// SetSlog makes the client log to the structured logger sl, by level. See
+// Logger.SetSlog.
+func (c *Client) SetSlog(sl *slog.Logger) {
+	c.logger.SetSlog(sl)
+}
+
+// SetSlog makes the server log to the structured logger sl, by level. See
+// Logger.SetSlog.
+func (s *Server) SetSlog(sl *slog.Logger) {
+	s.logger.SetSlog(sl)
+}
+
+// SetSlog makes the client log to the structured logger sl, by level. See
+// Logger.SetSlog.
+func (c *TURNClient) SetSlog(sl *slog.Logger) {
+	c.logger.SetSlog(sl)
+}
@@ -0,0 +1,106 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+//go:build go1.21
+
+package stun
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"testing"
+)
+
+func TestLoggerSlog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	c := NewClientWithConnection(conn)
+	c.SetSlog(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	_, addr := newTestServer(t)
+	c.SetServerAddr(addr)
+	if _, err := c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	pkt, err := c.newBindingReq(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.transmit(pkt, conn, silent.LocalAddr(), 2)
+
+	levels := make(map[string]int)
+	var result map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var r map[string]interface{}
+		if err := json.Unmarshal(line, &r); err != nil {
+			t.Fatalf("Slog error: %q, %v", line, err)
+		}
+		levels[r["level"].(string)]++
+		if r["msg"] == "STUN transaction" {
+			result = r
+		}
+	}
+	// The messages sent and received, the result, the retransmission and
+	// the loss.
+	if levels["DEBUG"] < 3 || levels["INFO"] < 1 || levels["WARN"] != 2 || levels["ERROR"] != 0 {
+		t.Errorf("Slog error: levels %v\n%s", levels, buf.String())
+	}
+	if result == nil || result["server"] != addr || result["attempts"] != 1.0 {
+		t.Errorf("Slog error: result %v", result)
+	}
+
+	buf.Reset()
+	c.SetSlog(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	if _, err := c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Slog error: logged below the level\n%s", buf.String())
+	}
+}
+
+func TestLoggerSlogLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger()
+	l.SetSlog(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	l.Debugln("debug")
+	l.Infoln("info")
+	l.dumpln("dump")
+	want := []string{"debug DEBUG", "info INFO", "dump DEBUG"}
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != len(want) {
+		t.Fatalf("Slog error: %d messages\n%s", len(lines), buf.String())
+	}
+	for i, line := range lines {
+		var r map[string]interface{}
+		if err := json.Unmarshal(line, &r); err != nil {
+			t.Fatalf("Slog error: %q, %v", line, err)
+		}
+		if got := r["msg"].(string) + " " + r["level"].(string); got != want[i] {
+			t.Errorf("Slog error: %q, want %q", got, want[i])
+		}
+	}
+}
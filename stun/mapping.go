@@ -0,0 +1,230 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Mapping mechanisms of ExternalMapping.
+const (
+	MechanismSTUN   = "stun"
+	MechanismNATPMP = "nat-pmp"
+	MechanismPCP    = "pcp"
+	MechanismUPnP   = "upnp"
+)
+
+// defaultMappingLifetime is the lifetime of the mappings requested by
+// Client.MapPort, which are to be renewed by the application meanwhile.
+const defaultMappingLifetime = 2 * time.Hour
+
+// Retransmissions of the requests to the gateway, doubling the interval
+// from the initial one (RFC 6886 section 3.1, RFC 6887 section 8.1.1).
+const (
+	gatewayAttempts = 4
+	gatewayInterval = 250 * time.Millisecond
+)
+
+// ExternalMapping is the external address of a local port on the NAT,
+// regardless of the mechanism by which it is discovered or mapped.
+type ExternalMapping struct {
+	// Mechanism is the mechanism of the mapping, e.g. MechanismSTUN of a
+	// mapping discovered by a Binding request, or MechanismPCP of one
+	// mapped explicitly.
+	Mechanism string
+	// Protocol is "udp" or "tcp".
+	Protocol string
+	// InternalPort is the local port mapped.
+	InternalPort int
+	// External is the external address of the mapping.
+	External *Host
+	// Lifetime is the lifetime granted of an explicit mapping, which is
+	// to be renewed before it expires, or 0 of a discovered or permanent
+	// one.
+	Lifetime time.Duration
+	// Mapper is the mapper of an explicit mapping, by which it is renewed
+	// or deleted, or nil of a discovered one.
+	Mapper Mapper `json:"-"`
+}
+
+// String returns the mapping in the form of "udp 4242 -> 1.2.3.4:4242 (pcp)".
+func (m *ExternalMapping) String() string {
+	return fmt.Sprintf("%s %d -> %v (%s)", m.Protocol, m.InternalPort, m.External, m.Mechanism)
+}
+
+// Mapper requests the explicit port mappings of a gateway, e.g. of
+// NAT-PMP, PCP or UPnP.
+type Mapper interface {
+	// Mechanism returns the mechanism of the mappings.
+	Mechanism() string
+	// AddMapping maps the internal port of protocol, "udp" or "tcp", for
+	// the lifetime, which the gateway may shorten.
+	AddMapping(ctx context.Context, protocol string, internalPort int, lifetime time.Duration) (*ExternalMapping, error)
+	// DeleteMapping deletes a mapping added.
+	DeleteMapping(ctx context.Context, m *ExternalMapping) error
+}
+
+// MapPort maps the internal port of protocol by the first of the mappers
+// that succeeds, in order, e.g. PCP before NAT-PMP.
+func MapPort(ctx context.Context, protocol string, internalPort int, lifetime time.Duration, mappers ...Mapper) (*ExternalMapping, error) {
+	if len(mappers) == 0 {
+		return nil, errors.New("No mapper.")
+	}
+	var errs []string
+	for _, mapper := range mappers {
+		m, err := mapper.AddMapping(ctx, protocol, internalPort, lifetime)
+		if err == nil {
+			return m, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, mapper.Mechanism()+": "+err.Error())
+	}
+	return nil, errors.New("Failed to map the port: " + strings.Join(errs, "; "))
+}
+
+// DefaultMappers returns the mappers of the default gateway, PCP first
+// then NAT-PMP, and of the UPnP IGD discovered, which MapPort falls back
+// on.
+func DefaultMappers() []Mapper {
+	return []Mapper{&PCPMapper{}, &NATPMPMapper{}, &UPnPMapper{}}
+}
+
+// MapPort discovers the NAT type and the mapped address of the connection
+// passed by NewClientWithConnection, and, behind a NAT unfriendly to hole
+// punching, maps its port explicitly by the first of the mappers that
+// succeeds, DefaultMappers if none. The mapping is of MechanismSTUN if the
+// NAT is friendly, or if none of the mappers succeeds while the mapped
+// address is discovered without error. Otherwise the error is of both the
+// discovery and the mappers.
+func (c *Client) MapPort(ctx context.Context, mappers ...Mapper) (NATType, *ExternalMapping, error) {
+	if c.conn == nil {
+		return NATError, nil, errors.New("No connection available.")
+	}
+	port := 0
+	if h := hostFromAddr(c.conn.LocalAddr()); h != nil {
+		port = int(h.Port())
+	}
+	nat, host, err := c.Discover()
+	if err == nil && host != nil && !unfriendly(nat) {
+		return nat, &ExternalMapping{Mechanism: MechanismSTUN, Protocol: "udp", InternalPort: port, External: host}, nil
+	}
+	if len(mappers) == 0 {
+		mappers = DefaultMappers()
+	}
+	m, merr := MapPort(ctx, "udp", port, defaultMappingLifetime, mappers...)
+	if merr == nil {
+		c.logger.Debugln("mapped", m)
+		return nat, m, nil
+	}
+	c.logger.Debugln(merr)
+	if err != nil {
+		// The mapped address of a failed discovery is not verified.
+		return nat, nil, errors.Join(err, merr)
+	}
+	if host != nil {
+		return nat, &ExternalMapping{Mechanism: MechanismSTUN, Protocol: "udp", InternalPort: port, External: host}, nil
+	}
+	return nat, nil, merr
+}
+
+// unfriendly returns whether the NAT type defeats hole punching by the
+// mapped address, i.e. of a mapping per destination, or is not discovered.
+func unfriendly(nat NATType) bool {
+	switch nat {
+	case NATNone, NATFull, NATRestricted, NATPortRestricted:
+		return false
+	}
+	return true
+}
+
+// gatewayAddr returns the UDP address of the gateway, with the port if
+// missing, or of the default gateway if empty.
+func gatewayAddr(gateway string, port int) (*net.UDPAddr, error) {
+	if gateway == "" {
+		ip, err := defaultGateway()
+		if err != nil {
+			return nil, err
+		}
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	if _, _, err := net.SplitHostPort(gateway); err != nil {
+		gateway = net.JoinHostPort(gateway, fmt.Sprint(port))
+	}
+	return net.ResolveUDPAddr("udp", gateway)
+}
+
+// gatewayExchange sends the request to the gateway, retransmitted with
+// the interval doubled, until a response accepted by valid is received or
+// ctx is done.
+func gatewayExchange(ctx context.Context, addr *net.UDPAddr, req []byte, valid func(resp []byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 1100) // the maximum size of a PCP message
+	interval := gatewayInterval
+	for i := 0; i < gatewayAttempts; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		end := time.Now().Add(interval)
+		for time.Now().Before(end) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			deadline := end
+			if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+				deadline = d
+			}
+			conn.SetReadDeadline(deadline)
+			n, err := conn.Read(buf)
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if valid(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		interval *= 2
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("Timed out waiting for the gateway.")
+}
+
+// localAddrTo returns the local address of the route to addr.
+func localAddrTo(addr *net.UDPAddr) (netip.Addr, error) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
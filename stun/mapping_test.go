@@ -0,0 +1,223 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGateway is a gateway of NAT-PMP, and of PCP unless pmpOnly, mapping
+// the ports of the external address 203.0.113.1 to the same ones.
+type testGateway struct {
+	conn    net.PacketConn
+	pmpOnly bool
+
+	mu       sync.Mutex
+	mappings map[int]uint32  // the lifetimes by internal port
+	clients  []netip.Addr    // the client addresses of PCP requests
+	nonces   map[string]bool // the nonces of PCP requests
+}
+
+func newTestGateway(t *testing.T, pmpOnly bool) (*testGateway, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &testGateway{conn: conn, pmpOnly: pmpOnly, mappings: make(map[int]uint32), nonces: make(map[string]bool)}
+	go g.serve()
+	t.Cleanup(func() { conn.Close() })
+	return g, conn.LocalAddr().String()
+}
+
+func (g *testGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := g.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := g.handle(buf[:n]); resp != nil {
+			g.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (g *testGateway) handle(req []byte) []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(req) < 2 {
+		return nil
+	}
+	if req[0] == pcpVersion && !g.pmpOnly && len(req) >= pcpHeaderSize+pcpMapSize {
+		resp := make([]byte, pcpHeaderSize+pcpMapSize)
+		resp[0] = pcpVersion
+		resp[1] = 0x80 | req[1]
+		copy(resp[4:8], req[4:8])
+		g.clients = append(g.clients, netip.AddrFrom16([16]byte(req[8:24])).Unmap())
+		m := req[pcpHeaderSize:]
+		g.nonces[string(m[:12])] = true
+		port := binary.BigEndian.Uint16(m[16:])
+		g.mappings[int(port)] = binary.BigEndian.Uint32(req[4:])
+		copy(resp[pcpHeaderSize:], m[:20])
+		binary.BigEndian.PutUint16(resp[pcpHeaderSize+18:], port)
+		external := netip.MustParseAddr("203.0.113.1").As16()
+		copy(resp[pcpHeaderSize+20:], external[:])
+		return resp
+	}
+	if req[0] != 0 {
+		// Unsupported version, of a NAT-PMP gateway.
+		return []byte{0, 0x80 | req[1], 0, 1, 0, 0, 0, 0}
+	}
+	switch req[1] {
+	case natpmpOpAddress:
+		return []byte{0, 128, 0, 0, 0, 0, 0, 1, 203, 0, 113, 1}
+	case natpmpOpMapUDP, natpmpOpMapTCP:
+		if len(req) < 12 {
+			return nil
+		}
+		resp := make([]byte, 16)
+		resp[1] = 128 + req[1]
+		copy(resp[8:10], req[4:6])
+		port := binary.BigEndian.Uint16(req[4:])
+		lifetime := binary.BigEndian.Uint32(req[8:])
+		g.mappings[int(port)] = lifetime
+		if lifetime != 0 {
+			binary.BigEndian.PutUint16(resp[10:], port)
+		}
+		binary.BigEndian.PutUint32(resp[12:], lifetime)
+		return resp
+	}
+	return []byte{0, 128 + req[1], 0, 5}
+}
+
+func (g *testGateway) lifetime(port int) uint32 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.mappings[port]
+}
+
+func TestNATPMPMapper(t *testing.T) {
+	g, addr := newTestGateway(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p := &NATPMPMapper{Gateway: addr}
+	m, err := p.AddMapping(ctx, "udp", 4242, time.Hour)
+	if err != nil {
+		t.Fatalf("AddMapping error: %v", err)
+	}
+	if m.Mechanism != MechanismNATPMP || m.External.String() != "203.0.113.1:4242" || m.Lifetime != time.Hour || m.Mapper != p {
+		t.Errorf("AddMapping error: %v", m)
+	}
+	if l := g.lifetime(4242); l != 3600 {
+		t.Errorf("AddMapping error: lifetime %d", l)
+	}
+	if err := p.DeleteMapping(ctx, m); err != nil {
+		t.Fatalf("DeleteMapping error: %v", err)
+	}
+	if l := g.lifetime(4242); l != 0 {
+		t.Errorf("DeleteMapping error: lifetime %d", l)
+	}
+	if _, err := p.AddMapping(ctx, "sctp", 4242, time.Hour); err == nil {
+		t.Errorf("AddMapping error: expected error of sctp")
+	}
+}
+
+func TestPCPMapper(t *testing.T) {
+	g, addr := newTestGateway(t, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p := &PCPMapper{Gateway: addr}
+	m, err := p.AddMapping(ctx, "tcp", 4242, time.Hour)
+	if err != nil {
+		t.Fatalf("AddMapping error: %v", err)
+	}
+	if m.Mechanism != MechanismPCP || m.External.String() != "203.0.113.1:4242" || m.Lifetime != time.Hour {
+		t.Errorf("AddMapping error: %v", m)
+	}
+	// A renewal is of the same nonce.
+	if _, err := p.AddMapping(ctx, "tcp", 4242, time.Hour); err != nil {
+		t.Fatalf("AddMapping error: %v", err)
+	}
+	if err := p.DeleteMapping(ctx, m); err != nil {
+		t.Fatalf("DeleteMapping error: %v", err)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.nonces) != 1 || len(g.clients) != 3 || g.clients[0] != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("PCPMapper error: nonces %d, clients %v", len(g.nonces), g.clients)
+	}
+	if g.mappings[4242] != 0 {
+		t.Errorf("DeleteMapping error: lifetime %d", g.mappings[4242])
+	}
+}
+
+func TestMapPort(t *testing.T) {
+	_, addr := newTestGateway(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// PCP is not supported by the gateway, which falls back on NAT-PMP.
+	m, err := MapPort(ctx, "udp", 4242, time.Hour, &PCPMapper{Gateway: addr}, &NATPMPMapper{Gateway: addr})
+	if err != nil {
+		t.Fatalf("MapPort error: %v", err)
+	}
+	if m.Mechanism != MechanismNATPMP {
+		t.Errorf("MapPort error: %v", m)
+	}
+	if _, err := MapPort(ctx, "udp", 4242, time.Hour, &PCPMapper{Gateway: addr}); err == nil {
+		t.Errorf("MapPort error: expected error of PCP")
+	}
+}
+
+func TestClientMapPort(t *testing.T) {
+	_, server := newTestServer(t)
+	_, gateway := newTestGateway(t, false)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(server)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	nat, m, err := c.MapPort(ctx, &PCPMapper{Gateway: gateway})
+	if err != nil {
+		t.Fatalf("MapPort error: %v", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if m.InternalPort != port {
+		t.Errorf("MapPort error: %v, expected port %d", m, port)
+	}
+	if unfriendly(nat) {
+		if m.Mechanism != MechanismPCP {
+			t.Errorf("MapPort error: %v behind %v", m, nat)
+		}
+	} else if m.Mechanism != MechanismSTUN || m.External.String() != conn.LocalAddr().String() {
+		t.Errorf("MapPort error: %v behind %v", m, nat)
+	}
+	// The discovery fails with a mapped address, and so does the mapper.
+	_, pmp := newTestGateway(t, true)
+	if _, m, err := c.MapPort(ctx, &PCPMapper{Gateway: pmp}); err == nil || m != nil {
+		t.Errorf("MapPort error: %v, %v, expected the errors of the discovery and PCP", m, err)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	messageHeaderSize = 20
+	maxMessageSize    = messageHeaderSize + 0xffff
+)
+
+// Message is a STUN message read from the network, or built with
+// NewMessage.
+type Message struct {
+	pkt *packet
+	raw []byte
+}
+
+// Type returns the message type, i.e. the method and the class.
+func (m *Message) Type() uint16 {
+	return m.pkt.types
+}
+
+// TransactionID returns the 96-bit transaction ID of the message, excluding
+// the magic cookie.
+func (m *Message) TransactionID() []byte {
+	return m.pkt.transID[4:]
+}
+
+// Attribute returns the value of the first attribute of the given type.
+func (m *Message) Attribute(types uint16) ([]byte, bool) {
+	a := m.pkt.getAttribute(types)
+	if a == nil {
+		return nil, false
+	}
+	return a.value[:a.length], true
+}
+
+// Bytes returns the message in the wire format.
+func (m *Message) Bytes() []byte {
+	return m.raw
+}
+
+// AppendTo appends the message in the wire format, as parsed or encoded if
+// so, to buf and returns the extended buffer. Nothing is allocated if buf
+// has the capacity of the message, so a buffer is reused across messages.
+// A message never encoded is appended with its attributes only, without
+// the MESSAGE-INTEGRITY and FINGERPRINT attributes of Encode: AppendEncode
+// appends them.
+func (m *Message) AppendTo(buf []byte) []byte {
+	if m.raw != nil {
+		return append(buf, m.raw...)
+	}
+	return m.pkt.appendTo(buf)
+}
+
+// Decoder reads STUN messages from a byte stream, i.e. a TCP or TLS
+// connection (RFC 5389 section 7.2.2), where messages may arrive in pieces
+// and several messages may arrive in one segment.
+type Decoder struct {
+	r *bufio.Reader
+}
+
+// NewDecoder returns a decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{bufio.NewReaderSize(r, channelDataHeaderSize+maxMessageSize)}
+}
+
+// ReadMessage blocks until a whole message is read. It returns io.EOF if the
+// stream ends between two messages, and io.ErrUnexpectedEOF if it ends in the
+// middle of one. Nothing is consumed on errors such as timeouts, so the read
+// can be retried, but as messages carry no delimiter, the stream cannot be
+// used any more after a malformed message.
+func (d *Decoder) ReadMessage() (*Message, error) {
+	b, err := d.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if b[0]&0xc0 != 0 {
+		return nil, errors.New("Received data is not a STUN message.")
+	}
+	pkt, err := newPacketFromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{pkt, b}, nil
+}
+
+// readFrame blocks until a whole STUN message or TURN ChannelData message
+// is read, and returns it with the padding of the ChannelData message over
+// streams (RFC 5766 section 11.5).
+func (d *Decoder) readFrame() ([]byte, error) {
+	header, err := d.peek(channelDataHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[2:4]))
+	var n int
+	switch header[0] & 0xc0 {
+	case 0x00:
+		// The most significant 2 bits of every STUN message are zeroes,
+		// and the length is a multiple of 4 as attributes are padded.
+		if length%4 != 0 {
+			return nil, errors.New("Received data format mismatch.")
+		}
+		n = messageHeaderSize + length
+	case 0x40:
+		// The channel numbers start with 01.
+		n = channelDataHeaderSize + (length+3)&^3
+	default:
+		return nil, errors.New("Received data is not a STUN message.")
+	}
+	buf, err := d.peek(n)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, len(buf))
+	copy(b, buf)
+	d.r.Discard(len(b))
+	return b, nil
+}
+
+// peek waits until n bytes are buffered without consuming them.
+func (d *Decoder) peek(n int) ([]byte, error) {
+	b, err := d.r.Peek(n)
+	if err == io.EOF && d.r.Buffered() > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+// Types of the Binding messages, e.g. of the connectivity checks of ICE
+// (RFC 8445 section 7.2), for NewMessage and Message.Type.
+const (
+	TypeBindingRequest       = typeBindingRequest
+	TypeBindingIndication    = typeBindingRequest | classIndication
+	TypeBindingResponse      = typeBindingResponse
+	TypeBindingErrorResponse = typeBindingErrorResponse
+)
+
+// Attribute types, for Message.Attribute and Message.AddAttribute.
+const (
+	AttributeMappedAddress    = attributeMappedAddress
+	AttributeChangedAddress   = attributeChangedAddress
+	AttributeUsername         = attributeUsername
+	AttributeErrorCode        = attributeErrorCode
+	AttributeXorMappedAddress = attributeXorMappedAddress
+	AttributeSoftware         = attributeSoftware
+	AttributeFingerprint      = attributeFingerprint
+	AttributeOtherAddress     = attributeOtherAddress
+	AttributePriority         = attributePriority
+	AttributeUseCandidate     = attributeUseCandidate
+	AttributeICEControlled    = attributeIceControlled
+	AttributeICEControlling   = attributeIceControlling
+)
+
+// NewMessage returns a message of the type with a random transaction ID, to
+// be built with the Add methods and sent as encoded by Encode.
+func NewMessage(types uint16) (*Message, error) {
+	pkt, err := newPacket()
+	if err != nil {
+		return nil, err
+	}
+	pkt.types = types
+	return &Message{pkt: pkt}, nil
+}
+
+// ParseMessage parses the STUN message b, which the message refers to.
+func ParseMessage(b []byte) (*Message, error) {
+	if len(b) < messageHeaderSize || b[0]&0xc0 != 0 {
+		return nil, errors.New("Received data is not a STUN message.")
+	}
+	pkt, err := newPacketFromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{pkt, b}, nil
+}
+
+// NewResponse returns a response of the type to the request m, which
+// carries its transaction ID.
+func (m *Message) NewResponse(types uint16) *Message {
+	return &Message{pkt: newResponsePacket(m.pkt, types)}
+}
+
+// AddAttribute appends an attribute of the type and the value.
+func (m *Message) AddAttribute(types uint16, value []byte) {
+	m.pkt.addAttribute(*newAttribute(types, value))
+}
+
+// AddXorAddress appends an XOR-encoded address attribute of the type, e.g.
+// XOR-MAPPED-ADDRESS.
+func (m *Message) AddXorAddress(types uint16, addr *Host) {
+	m.pkt.addAttribute(*newXorAddrAttribute(types, addr, m.pkt.transID))
+}
+
+// AddErrorCode appends the ERROR-CODE attribute of the code, with its
+// standard reason phrase if reason is empty.
+func (m *Message) AddErrorCode(code int, reason string) {
+	if reason == "" {
+		reason = errorStr[code]
+	}
+	m.pkt.addAttribute(*newErrorCodeAttribute(code, reason))
+}
+
+// XorAddress returns the address of the first XOR-encoded address attribute
+// of the type, or nil.
+func (m *Message) XorAddress(types uint16) *Host {
+	return m.pkt.getXorAddr(types)
+}
+
+// ErrorCode returns the code of the ERROR-CODE attribute, or 0.
+func (m *Message) ErrorCode() int {
+	return m.pkt.getErrorCode()
+}
+
+// Encode appends the MESSAGE-INTEGRITY attribute of the key unless nil, and
+// the FINGERPRINT attribute, and returns the message in the wire format. No
+// attribute is to be added after.
+func (m *Message) Encode(key []byte) []byte {
+	raw := m.AppendEncode(make([]byte, 0, m.pkt.size()+trailerSize), key)
+	// The message keeps the trailing attributes, of their values in raw.
+	n := len(raw)
+	if key != nil {
+		m.pkt.addAttribute(attribute{types: attributeMessageIntegrity, length: messageIntegritySize, value: raw[n-8-messageIntegritySize : n-8]})
+	}
+	m.pkt.addAttribute(attribute{types: attributeFingerprint, length: 4, value: raw[n-4:]})
+	m.raw = raw
+	return raw
+}
+
+// AppendEncode appends the message in the wire format to buf, followed by
+// the MESSAGE-INTEGRITY attribute of the key unless nil and the FINGERPRINT
+// attribute, computed in place, and returns the extended buffer. Unlike
+// Encode, it does not change the message, which can be encoded again, e.g.
+// into the next buffer of a send loop. Nothing but the HMAC is allocated if
+// buf has the capacity.
+func (m *Message) AppendEncode(buf []byte, key []byte) []byte {
+	return m.pkt.appendEncode(buf, key, true)
+}
+
+// CheckIntegrity reports whether the MESSAGE-INTEGRITY attribute of the
+// message is valid with the key, and its FINGERPRINT attribute if any.
+func (m *Message) CheckIntegrity(key []byte) bool {
+	if m.pkt.hasAttribute(attributeFingerprint) && !checkFingerprint(m.raw) {
+		return false
+	}
+	return checkMessageIntegrity(m.raw, key)
+}
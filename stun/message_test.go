@@ -0,0 +1,156 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecoderReadMessage(t *testing.T) {
+	var stream []byte
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		p, err := newPacket()
+		if err != nil {
+			t.Fatalf("newPacket error")
+		}
+		p.types = typeBindingRequest
+		p.addAttribute(*newSoftwareAttribute("abcde"))
+		p.addAttribute(*newFingerprintAttribute(p))
+		stream = append(stream, p.bytes()...)
+		ids = append(ids, p.transID[4:])
+	}
+	// Deliver the stream one byte per read.
+	d := NewDecoder(iotest.OneByteReader(bytes.NewReader(stream)))
+	for i := range ids {
+		m, err := d.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage error: %v", err)
+		}
+		if m.Type() != typeBindingRequest || !bytes.Equal(m.TransactionID(), ids[i]) {
+			t.Errorf("ReadMessage error: message %d mismatch", i)
+		}
+		if v, ok := m.Attribute(attributeSoftware); !ok || string(v[:5]) != "abcde" {
+			t.Errorf("ReadMessage error: software attribute")
+		}
+	}
+	if _, err := d.ReadMessage(); err != io.EOF {
+		t.Errorf("ReadMessage error: expected EOF, get %v", err)
+	}
+	d = NewDecoder(bytes.NewReader(stream[:len(stream)-3]))
+	d.ReadMessage()
+	d.ReadMessage()
+	if _, err := d.ReadMessage(); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadMessage error: expected ErrUnexpectedEOF, get %v", err)
+	}
+	d = NewDecoder(bytes.NewReader(append([]byte{0x80}, make([]byte, 19)...)))
+	if _, err := d.ReadMessage(); err == nil {
+		t.Errorf("ReadMessage error: expected error on non-STUN data")
+	}
+}
+
+func TestDecoderReadFrame(t *testing.T) {
+	p, err := newPacket()
+	if err != nil {
+		t.Fatalf("newPacket error")
+	}
+	p.types = typeBindingRequest
+	channelData := padChannelData(newChannelData(minChannelNumber, []byte("hello")))
+	stream := append(append(append([]byte{}, channelData...), p.bytes()...), channelData...)
+	d := NewDecoder(iotest.OneByteReader(bytes.NewReader(stream)))
+	for i, want := range [][]byte{channelData, p.bytes(), channelData} {
+		b, err := d.readFrame()
+		if err != nil || !bytes.Equal(b, want) {
+			t.Fatalf("readFrame error: frame %d is %x, %v", i, b, err)
+		}
+	}
+	d = NewDecoder(bytes.NewReader(channelData))
+	if _, err := d.ReadMessage(); err == nil {
+		t.Errorf("ReadMessage error: expected error on ChannelData")
+	}
+}
+
+func TestMessageEncode(t *testing.T) {
+	req, err := NewMessage(TypeBindingRequest)
+	if err != nil {
+		t.Fatalf("NewMessage error: %v", err)
+	}
+	req.AddAttribute(AttributeUsername, []byte("bob:alice"))
+	key := ShortTermKey("secret")
+	m, err := ParseMessage(req.Encode(key))
+	if err != nil {
+		t.Fatalf("ParseMessage error: %v", err)
+	}
+	if m.Type() != TypeBindingRequest || !bytes.Equal(m.TransactionID(), req.TransactionID()) || !m.CheckIntegrity(key) {
+		t.Fatalf("ParseMessage error: type %#x, transaction %x", m.Type(), m.TransactionID())
+	}
+	if m.CheckIntegrity(ShortTermKey("wrong")) {
+		t.Errorf("CheckIntegrity error: expected failure with a wrong key")
+	}
+
+	addr := NewHost(netip.MustParseAddrPort("192.0.2.1:3478"))
+	resp := m.NewResponse(TypeBindingErrorResponse)
+	resp.AddXorAddress(AttributeXorMappedAddress, addr)
+	resp.AddErrorCode(487, "")
+	m, err = ParseMessage(resp.Encode(nil))
+	if err != nil {
+		t.Fatalf("ParseMessage error: %v", err)
+	}
+	if got := m.XorAddress(AttributeXorMappedAddress); got == nil || got.String() != addr.String() || m.ErrorCode() != 487 {
+		t.Errorf("ParseMessage error: address %v, error %d", got, m.ErrorCode())
+	}
+	if _, err := ParseMessage([]byte{0x80, 0}); err == nil {
+		t.Errorf("ParseMessage error: expected error on non-STUN data")
+	}
+}
+
+func TestMessageAppendEncode(t *testing.T) {
+	m, err := NewMessage(TypeBindingRequest)
+	if err != nil {
+		t.Fatalf("NewMessage error: %v", err)
+	}
+	m.AddAttribute(AttributeUsername, []byte("bob:alice"))
+	key := ShortTermKey("secret")
+	// The trailers computed in place are those of the attributes.
+	p := *m.pkt
+	p.attributes = append([]attribute(nil), m.pkt.attributes...)
+	p.addAttribute(*newMessageIntegrityAttribute(&p, key))
+	p.addAttribute(*newFingerprintAttribute(&p))
+	expected := p.bytes()
+	plain := m.AppendTo(nil)
+	b := m.AppendEncode([]byte("prefix"), key)
+	if string(b[:6]) != "prefix" || !bytes.Equal(b[6:], expected) {
+		t.Errorf("AppendEncode error: %x, expected %x", b[6:], expected)
+	}
+	if got := m.AppendTo(nil); !bytes.Equal(got, plain) {
+		t.Errorf("AppendEncode error: message changed to %x", got)
+	}
+	buf := make([]byte, 0, maxPacketSize)
+	if n := testing.AllocsPerRun(100, func() { m.AppendEncode(buf, nil) }); n != 0 {
+		t.Errorf("AppendEncode error: %v allocations", n)
+	}
+	if raw := m.Encode(key); !bytes.Equal(raw, expected) || !bytes.Equal(m.AppendTo(nil), expected) {
+		t.Errorf("Encode error: %x, expected %x", raw, expected)
+	}
+	if len(m.pkt.attributes) != 3 || !m.pkt.hasAttribute(attributeFingerprint) || !m.CheckIntegrity(key) {
+		t.Errorf("Encode error: attributes %v", m.pkt.attributes)
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Changes of the network come in bursts, e.g. a link going up and its
+	// addresses being assigned, so wait for the network to settle.
+	monitorSettleTime = time.Second
+	// Interval to check the addresses where change notifications are
+	// unavailable.
+	monitorPollInterval = 5 * time.Second
+	monitorEventBuffer  = 4
+)
+
+// NetworkEvent is the result of a discovery performed by a Monitor after the
+// local network changed.
+type NetworkEvent struct {
+	NAT  NATType
+	Host *Host
+	Err  error
+}
+
+// AddressEvent is a change of the external address, of the mapped address
+// discovered by a Monitor or kept alive by a KeepaliveManager.
+type AddressEvent struct {
+	// Old is the address before, nil of the first one.
+	Old *Host
+	New *Host
+	// Binding is the binding of the address of a KeepaliveManager, nil of
+	// a Monitor.
+	Binding *KeepaliveBinding
+}
+
+// addressFeed sends the AddressEvents to the subscribers, dropped if they
+// do not keep up.
+type addressFeed struct {
+	mu   sync.Mutex
+	subs []chan AddressEvent
+}
+
+func (f *addressFeed) subscribe() <-chan AddressEvent {
+	ch := make(chan AddressEvent, monitorEventBuffer)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs = append(f.subs, ch)
+	return ch
+}
+
+func (f *addressFeed) publish(ev AddressEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ch := range f.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// close closes the channels of the subscribers.
+func (f *addressFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ch := range f.subs {
+		close(ch)
+	}
+	f.subs = nil
+}
+
+// sameHost reports whether the hosts are of the same address, or nil both.
+func sameHost(a, b *Host) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.AddrPort() == b.AddrPort()
+}
+
+// Monitor keeps the result of NAT discovery up to date: whenever the local
+// interfaces or addresses change (reported by netlink on Linux and routing
+// sockets on BSD and Darwin, polled elsewhere), it drops the cached result,
+// rebinds its socket and runs the discovery again.
+type Monitor struct {
+	client *Client
+
+	mu     sync.Mutex
+	conn   net.PacketConn
+	result *NetworkEvent
+	subs   []chan NetworkEvent
+
+	external *Host // the last mapped address discovered
+	addrs    addressFeed
+
+	stop chan struct{}
+	done chan struct{}
+
+	// The source of the changes of the network, the snapshot of the
+	// addresses and the times to settle and to poll, replaced by the tests.
+	watch    func() (<-chan struct{}, func(), error)
+	snapshot func() string
+	settle   time.Duration
+	poll     time.Duration
+}
+
+// NewMonitor returns a monitor which discovers with the server, interface
+// and logging settings of client. The connection passed by
+// NewClientWithConnection is not used, as the monitor rebinds its own one.
+func NewMonitor(client *Client) *Monitor {
+	return &Monitor{
+		client:   client,
+		watch:    watchNetwork,
+		snapshot: addrSnapshot,
+		settle:   monitorSettleTime,
+		poll:     monitorPollInterval,
+	}
+}
+
+// Start runs the first discovery and then watches the network in the
+// background until Stop is called.
+func (m *Monitor) Start() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stop != nil {
+		return errors.New("Monitor already started.")
+	}
+	changes, closer, err := m.watch()
+	if err != nil {
+		// Fall back to polling the interface addresses.
+		m.client.logger.Debugln("Watch network:", err)
+		changes, closer = pollNetwork(m.poll)
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.run(changes, closer)
+	return nil
+}
+
+// Stop stops watching the network, closes the socket and the channels
+// returned by Subscribe.
+func (m *Monitor) Stop() {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	if stop == nil {
+		m.mu.Unlock()
+		return
+	}
+	close(stop)
+	// Interrupt the discovery in progress, if any.
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+	m.mu.Unlock()
+	<-done
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ch := range m.subs {
+		close(ch)
+	}
+	m.subs = nil
+	m.addrs.close()
+	m.stop, m.done = nil, nil
+}
+
+// Result returns the result of the latest discovery. It returns false if no
+// discovery has completed since the last change of the network.
+func (m *Monitor) Result() (NetworkEvent, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.result == nil {
+		return NetworkEvent{}, false
+	}
+	return *m.result, true
+}
+
+// Conn returns the socket used by the latest discovery, which is replaced
+// after each change of the network.
+func (m *Monitor) Conn() net.PacketConn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conn
+}
+
+// Subscribe returns a channel receiving the result of each discovery. Events
+// are dropped if the subscriber does not keep up.
+func (m *Monitor) Subscribe() <-chan NetworkEvent {
+	ch := make(chan NetworkEvent, monitorEventBuffer)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subs = append(m.subs, ch)
+	return ch
+}
+
+// SubscribeAddress returns a channel receiving the changes of the mapped
+// address discovered, the first one included, e.g. to update a dynamic DNS
+// record. The discoveries failing change nothing. Events are dropped if the
+// subscriber does not keep up.
+func (m *Monitor) SubscribeAddress() <-chan AddressEvent {
+	return m.addrs.subscribe()
+}
+
+func (m *Monitor) run(changes <-chan struct{}, closer func()) {
+	defer close(m.done)
+	defer closer()
+	snapshot := m.snapshot()
+	m.rediscover()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-changes:
+		}
+		// Coalesce the notifications of a burst.
+		timer := time.NewTimer(m.settle)
+	settle:
+		for {
+			select {
+			case <-m.stop:
+				timer.Stop()
+				return
+			case <-changes:
+				timer.Reset(m.settle)
+			case <-timer.C:
+				break settle
+			}
+		}
+		s := m.snapshot()
+		if s == snapshot {
+			continue
+		}
+		snapshot = s
+		m.client.logger.Debugln("Network changed, rediscover")
+		m.rediscover()
+	}
+}
+
+// rediscover rebinds the socket and runs the discovery.
+func (m *Monitor) rediscover() {
+	ev := NetworkEvent{NAT: NATError}
+	conn, err := listenUDP(m.client.iface)
+	m.mu.Lock()
+	select {
+	case <-m.stop:
+		m.mu.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	default:
+	}
+	m.result = nil
+	if m.conn != nil {
+		m.conn.Close()
+	}
+	m.conn = conn
+	m.mu.Unlock()
+	if err == nil {
+		ev.NAT, ev.Host, ev.Err = m.discover(conn)
+	} else {
+		ev.Err = err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.stop:
+		return
+	default:
+	}
+	m.result = &ev
+	for _, ch := range m.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	if ev.Host != nil && !sameHost(ev.Host, m.external) {
+		m.addrs.publish(AddressEvent{Old: m.external, New: ev.Host})
+		m.external = ev.Host
+	}
+}
+
+func (m *Monitor) discover(conn net.PacketConn) (NATType, *Host, error) {
+	serverAddr := m.client.serverAddr
+	if serverAddr == "" {
+		serverAddr = DefaultServerAddr
+	}
+	// Resolve again, the network may have a different DNS view.
+	addr, err := net.ResolveUDPAddr("udp", serverAddr)
+	if err != nil {
+		return NATError, nil, err
+	}
+	return m.client.discover(conn, addr)
+}
+
+// addrSnapshot returns a canonical description of the addresses of the up
+// interfaces, to tell whether a notification changed anything relevant.
+func addrSnapshot() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var s []string
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			s = append(s, ifi.Name+" "+a.String())
+		}
+	}
+	sort.Strings(s)
+	return strings.Join(s, "\n")
+}
+
+// pollNetwork notifies on the returned channel every interval, and the
+// callers compare the address snapshots.
+func pollNetwork(interval time.Duration) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	ticker := time.NewTicker(interval)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				notify(ch)
+			}
+		}
+	}()
+	return ch, func() {
+		ticker.Stop()
+		close(stop)
+	}
+}
+
+// notify sends to ch without blocking, a pending notification is enough.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// readNotifications notifies on the returned channel whenever a message of
+// the routing socket f arrives, until f is closed.
+func readNotifications(f interface{ Read([]byte) (int, error) }) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	go func() {
+		b := make([]byte, 1<<16)
+		for {
+			if _, err := f.Read(b); err != nil {
+				return
+			}
+			notify(ch)
+		}
+	}()
+	return ch
+}
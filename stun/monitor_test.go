@@ -0,0 +1,181 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNetwork is the source of the changes of the network of a test
+// monitor, with the snapshot of its addresses.
+type fakeNetwork struct {
+	changes chan struct{}
+	mu      sync.Mutex
+	addrs   string
+	closed  bool
+}
+
+func (n *fakeNetwork) watch() (<-chan struct{}, func(), error) {
+	return n.changes, func() {
+		n.mu.Lock()
+		n.closed = true
+		n.mu.Unlock()
+	}, nil
+}
+
+func (n *fakeNetwork) snapshot() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.addrs
+}
+
+func (n *fakeNetwork) set(addrs string) {
+	n.mu.Lock()
+	n.addrs = addrs
+	n.mu.Unlock()
+}
+
+// newTestMonitor returns a monitor of the test server watching n, settling
+// in 200ms, and subscribed to.
+func newTestMonitor(t *testing.T, n *fakeNetwork) (*Monitor, <-chan NetworkEvent) {
+	_, addr := newTestServer(t)
+	c := NewClient()
+	c.SetServerAddr(addr)
+	m := NewMonitor(c)
+	m.watch, m.snapshot = n.watch, n.snapshot
+	m.settle = 200 * time.Millisecond
+	events := m.Subscribe()
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	t.Cleanup(m.Stop)
+	return m, events
+}
+
+// expectEvents waits for the events of n discoveries, and no more within
+// the wait after.
+func expectEvents(t *testing.T, events <-chan NetworkEvent, n int, wait time.Duration) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case ev := <-events:
+			if ev.Host == nil {
+				t.Errorf("Monitor error: discovery %v", ev.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Monitor error: %d discoveries, expected %d", i, n)
+		}
+	}
+	select {
+	case <-events:
+		t.Fatalf("Monitor error: more than %d discoveries", n)
+	case <-time.After(wait):
+	}
+}
+
+func TestMonitorSettle(t *testing.T) {
+	n := &fakeNetwork{changes: make(chan struct{}, 1), addrs: "eth0 192.0.2.1/24"}
+	m, events := newTestMonitor(t, n)
+	expectEvents(t, events, 1, 0)
+	if _, ok := m.Result(); !ok {
+		t.Errorf("Result error: no result")
+	}
+	first := m.Conn()
+
+	// The notifications changing no address.
+	for i := 0; i < 3; i++ {
+		n.changes <- struct{}{}
+	}
+	expectEvents(t, events, 0, 400*time.Millisecond)
+
+	// A burst of notifications, coalesced until the network settles.
+	n.set("eth0 192.0.2.2/24")
+	for i := 0; i < 5; i++ {
+		n.changes <- struct{}{}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if m.Conn() != first {
+		t.Errorf("Monitor error: rediscovered before the network settled")
+	}
+	expectEvents(t, events, 1, 400*time.Millisecond)
+	if m.Conn() == first {
+		t.Errorf("Monitor error: socket not rebound")
+	}
+
+	m.Stop()
+	if _, ok := <-events; ok {
+		t.Errorf("Stop error: channel not closed")
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.closed {
+		t.Errorf("Stop error: change source not closed")
+	}
+}
+
+func TestMonitorPoll(t *testing.T) {
+	n := &fakeNetwork{addrs: "eth0 192.0.2.1/24"}
+	_, addr := newTestServer(t)
+	c := NewClient()
+	c.SetServerAddr(addr)
+	m := NewMonitor(c)
+	m.watch = func() (<-chan struct{}, func(), error) {
+		return nil, nil, errors.New("Not supported.")
+	}
+	m.snapshot = n.snapshot
+	m.settle, m.poll = 10*time.Millisecond, 20*time.Millisecond
+	events := m.Subscribe()
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	defer m.Stop()
+	expectEvents(t, events, 1, 100*time.Millisecond)
+	// The change is found by polling, without notification.
+	n.set("eth0 192.0.2.2/24")
+	expectEvents(t, events, 1, 100*time.Millisecond)
+}
+
+func TestReadNotifications(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ch := readNotifications(r)
+	w.Write([]byte("route"))
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("readNotifications error: no notification")
+	}
+	r.Close()
+}
+
+func TestWatchNetwork(t *testing.T) {
+	changes, closer, err := watchNetwork()
+	if err != nil {
+		t.Skipf("watchNetwork: %v", err)
+	}
+	if changes == nil {
+		t.Errorf("watchNetwork error: no channel")
+	}
+	closer()
+}
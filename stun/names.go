@@ -0,0 +1,185 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var methodStr = map[uint16]string{
+	typeBindingRequest:      "Binding",
+	typeSharedSecretRequest: "Shared Secret",
+	typeAllocate:            "Allocate",
+	typeRefresh:             "Refresh",
+	typeSend:                "Send",
+	typeData:                "Data",
+	typeCreatePermisiion:    "CreatePermission",
+	typeChannelBinding:      "ChannelBind",
+	typeConnect:             "Connect",
+	typeConnectionBind:      "ConnectionBind",
+	typeConnectionAttempt:   "ConnectionAttempt",
+}
+
+var classStr = map[uint16]string{
+	classRequest:    "request",
+	classIndication: "indication",
+	classSuccess:    "success response",
+	classError:      "error response",
+}
+
+var attributeStr = map[uint16]string{
+	attributeMappedAddress:           "MAPPED-ADDRESS",
+	attributeResponseAddress:         "RESPONSE-ADDRESS",
+	attributeChangeRequest:           "CHANGE-REQUEST",
+	attributeSourceAddress:           "SOURCE-ADDRESS",
+	attributeChangedAddress:          "CHANGED-ADDRESS",
+	attributeUsername:                "USERNAME",
+	attributePassword:                "PASSWORD",
+	attributeMessageIntegrity:        "MESSAGE-INTEGRITY",
+	attributeErrorCode:               "ERROR-CODE",
+	attributeUnknownAttributes:       "UNKNOWN-ATTRIBUTES",
+	attributeReflectedFrom:           "REFLECTED-FROM",
+	attributeChannelNumber:           "CHANNEL-NUMBER",
+	attributeLifetime:                "LIFETIME",
+	attributeBandwidth:               "BANDWIDTH",
+	attributeXorPeerAddress:          "XOR-PEER-ADDRESS",
+	attributeData:                    "DATA",
+	attributeRealm:                   "REALM",
+	attributeNonce:                   "NONCE",
+	attributeXorRelayedAddress:       "XOR-RELAYED-ADDRESS",
+	attributeRequestedAddressFamily:  "REQUESTED-ADDRESS-FAMILY",
+	attributeEvenPort:                "EVEN-PORT",
+	attributeRequestedTransport:      "REQUESTED-TRANSPORT",
+	attributeDontFragment:            "DONT-FRAGMENT",
+	attributeXorMappedAddress:        "XOR-MAPPED-ADDRESS",
+	attributeTimerVal:                "TIMER-VAL",
+	attributeReservationToken:        "RESERVATION-TOKEN",
+	attributePriority:                "PRIORITY",
+	attributeUseCandidate:            "USE-CANDIDATE",
+	attributePadding:                 "PADDING",
+	attributeResponsePort:            "RESPONSE-PORT",
+	attributeConnectionID:            "CONNECTION-ID",
+	attributeAdditionalAddressFamily: "ADDITIONAL-ADDRESS-FAMILY",
+	attributeAddressErrorCode:        "ADDRESS-ERROR-CODE",
+	attributeXorMappedAddressExp:     "XOR-MAPPED-ADDRESS (draft)",
+	attributeSoftware:                "SOFTWARE",
+	attributeAlternateServer:         "ALTERNATE-SERVER",
+	attributeCacheTimeout:            "CACHE-TIMEOUT",
+	attributeFingerprint:             "FINGERPRINT",
+	attributeIceControlled:           "ICE-CONTROLLED",
+	attributeIceControlling:          "ICE-CONTROLLING",
+	attributeResponseOrigin:          "RESPONSE-ORIGIN",
+	attributeOtherAddress:            "OTHER-ADDRESS",
+	attributeEcnCheckStun:            "ECN-CHECK STUN",
+	attributeMobilityTicket:          "MOBILITY-TICKET",
+	attributeCiscoFlowdata:           "CISCO-STUN-FLOWDATA",
+}
+
+// TypeName returns the method and the class of the message type, e.g.
+// "Binding success response".
+func TypeName(types uint16) string {
+	method, ok := methodStr[types&^classMask]
+	if !ok {
+		method = fmt.Sprintf("Method 0x%03x", types&^classMask)
+	}
+	return method + " " + classStr[types&classMask]
+}
+
+// attributeName returns the name of the attribute type.
+func attributeName(types uint16) string {
+	if s, ok := attributeStr[types]; ok {
+		return s
+	}
+	return fmt.Sprintf("0x%04x", types)
+}
+
+// attributeValue formats the value of the attribute, of the transaction ID
+// for the XOR-encoded addresses.
+func attributeValue(a *attribute, transID []byte) string {
+	v := a.value[:a.length]
+	switch a.types {
+	case attributeMappedAddress, attributeResponseAddress, attributeSourceAddress,
+		attributeChangedAddress, attributeReflectedFrom, attributeAlternateServer,
+		attributeResponseOrigin, attributeOtherAddress:
+		if len(v) >= 8 {
+			return a.rawAddr().String()
+		}
+	case attributeXorMappedAddress, attributeXorMappedAddressExp,
+		attributeXorPeerAddress, attributeXorRelayedAddress:
+		if len(v) >= 8 {
+			return a.xorAddr(transID).String()
+		}
+	case attributeUsername, attributeRealm, attributeNonce, attributeSoftware:
+		return strconv.Quote(string(v))
+	case attributeErrorCode:
+		if len(v) >= 4 {
+			return fmt.Sprintf("%d %q", int(v[2]&0x7)*100+int(v[3]), v[4:])
+		}
+	case attributeLifetime, attributeChannelNumber, attributeCacheTimeout,
+		attributeFingerprint, attributeChangeRequest, attributePriority:
+		if len(v) == 4 {
+			return fmt.Sprintf("0x%08x (%d)", binary.BigEndian.Uint32(v), binary.BigEndian.Uint32(v))
+		}
+	case attributeUnknownAttributes:
+		names := make([]string, 0, len(v)/2)
+		for i := 0; i+2 <= len(v); i += 2 {
+			names = append(names, attributeName(binary.BigEndian.Uint16(v[i:])))
+		}
+		return strings.Join(names, ", ")
+	case attributeUseCandidate, attributeDontFragment:
+		if len(v) == 0 {
+			return "(no value)"
+		}
+	}
+	return hex.EncodeToString(v)
+}
+
+// String describes the message, one line of the type and the transaction
+// ID followed by a line per attribute.
+func (m *Message) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s, transaction ID %x", TypeName(m.pkt.types), m.TransactionID())
+	for i := range m.pkt.attributes {
+		a := &m.pkt.attributes[i]
+		fmt.Fprintf(&b, "\n  %s: %s", attributeName(a.types), attributeValue(a, m.pkt.transID))
+	}
+	return b.String()
+}
+
+// MarshalJSON implements json.Marshaler, of the type, the transaction ID
+// and the attributes as described by String.
+func (m *Message) MarshalJSON() ([]byte, error) {
+	type attr struct {
+		Type  string
+		Value string
+	}
+	attrs := make([]attr, len(m.pkt.attributes))
+	for i := range m.pkt.attributes {
+		a := &m.pkt.attributes[i]
+		attrs[i] = attr{attributeName(a.types), attributeValue(a, m.pkt.transID)}
+	}
+	return json.Marshal(struct {
+		Type          string
+		TransactionID string
+		Attributes    []attr
+	}{TypeName(m.pkt.types), hex.EncodeToString(m.TransactionID()), attrs})
+}
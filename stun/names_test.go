@@ -0,0 +1,53 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMessageString(t *testing.T) {
+	req, err := NewMessage(TypeBindingRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := req.NewResponse(TypeBindingErrorResponse)
+	resp.AddXorAddress(AttributeXorMappedAddress, newHostFromStr("192.0.2.1:3478"))
+	resp.AddErrorCode(errorUnknownAttribute, "")
+	resp.AddAttribute(attributeSoftware, []byte("test"))
+	m, err := ParseMessage(resp.Encode(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(m.String(), "\n")
+	expected := []string{
+		"Binding error response, transaction ID ",
+		"  XOR-MAPPED-ADDRESS: 192.0.2.1:3478",
+		`  ERROR-CODE: 420 "Unknown Attribute"`,
+		`  SOFTWARE: "test"`,
+		"  FINGERPRINT: 0x",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("String error: %q", lines)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, expected[i]) {
+			t.Errorf("String error: %q, expected %q", line, expected[i])
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"net/netip"
+)
+
+// ipv4OnlyName is the name of the well-known IPv4 addresses only, of which
+// the AAAA records are synthesized by DNS64 (RFC 7050 section 2).
+const ipv4OnlyName = "ipv4only.arpa"
+
+var (
+	// wellKnownPrefix is the Well-Known Prefix of NAT64 (RFC 6052).
+	wellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
+	// ipv4OnlyAddrs are the addresses of ipv4only.arpa.
+	ipv4OnlyAddrs = []netip.Addr{netip.MustParseAddr("192.0.0.170"), netip.MustParseAddr("192.0.0.171")}
+	// nat64PrefixLens are the lengths of the prefixes of RFC 6052.
+	nat64PrefixLens = []int{96, 64, 56, 48, 40, 32}
+)
+
+// lookupNetIP resolves the names of NAT64 detection, replaced in tests.
+var lookupNetIP = net.DefaultResolver.LookupNetIP
+
+// NAT64Report is the NAT64 and DNS64 environment of the host, e.g. of an
+// IPv6-only mobile network, where the candidates of IPv4 are of no use and
+// the IPv4 addresses of the peers are to be synthesized.
+type NAT64Report struct {
+	// IPv6Only is whether no interface up is of an IPv4 address but the
+	// loopback and the link-local ones.
+	IPv6Only bool
+	// DNS64 is whether the resolver synthesizes AAAA records of the IPv4
+	// addresses, of which Prefixes are the NAT64 prefixes (RFC 7050).
+	DNS64    bool
+	Prefixes []netip.Prefix
+	// NAT64 is whether a Binding request to the STUN server over IPv6, of
+	// its IPv4 address synthesized or of a prefix the server resolves to,
+	// is responded, and Mapped the IPv4 address it is mapped to then.
+	NAT64  bool
+	Mapped *Host
+}
+
+// DetectNAT64 detects a DNS64 resolver and its NAT64 prefixes by the AAAA
+// records of ipv4only.arpa, which the translation is confirmed of by a
+// Binding request to the STUN server over IPv6, also of the prefixes of the
+// addresses of the server in the Well-Known Prefix.
+func (c *Client) DetectNAT64(ctx context.Context) (*NAT64Report, error) {
+	r := &NAT64Report{IPv6Only: !hasIPv4()}
+	addrs, err := lookupNetIP(ctx, "ip6", ipv4OnlyName)
+	if err == nil {
+		r.Prefixes = nat64Prefixes(addrs)
+		r.DNS64 = len(r.Prefixes) > 0
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.serverAddr == "" {
+		c.SetServerAddr(DefaultServerAddr)
+	}
+	host, port, err := net.SplitHostPort(c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	servers, err := lookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	// The addresses of IPv6 to try, of the prefixes synthesized or of the
+	// Well-Known Prefix.
+	var targets []netip.Addr
+	for _, s := range servers {
+		s = s.Unmap()
+		switch {
+		case s.Is4():
+			for _, p := range r.Prefixes {
+				if a, ok := nat64Synthesize(p, s); ok {
+					targets = append(targets, a)
+				}
+			}
+		case wellKnownPrefix.Contains(s):
+			targets = append(targets, s)
+			if !containsPrefix(r.Prefixes, wellKnownPrefix) {
+				r.Prefixes = append(r.Prefixes, wellKnownPrefix)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return r, nil
+	}
+	conn, err := listenUDPNetwork("udp6", c.iface)
+	if err != nil {
+		// No IPv6 to be translated.
+		return r, nil
+	}
+	defer conn.Close()
+	for _, target := range targets {
+		addr, err := net.ResolveUDPAddr("udp6", net.JoinHostPort(target.String(), port))
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.test1(conn, addr)
+		if err != nil {
+			c.logger.Debugln("NAT64 of", target, ":", err)
+			continue
+		}
+		if resp != nil && resp.mappedAddr != nil {
+			r.NAT64, r.Mapped = true, resp.mappedAddr
+			break
+		}
+	}
+	return r, nil
+}
+
+// nat64Prefixes returns the NAT64 prefixes of the synthesized addresses of
+// ipv4only.arpa, of the lengths of RFC 6052 embedding one of its IPv4
+// addresses, the longest first (RFC 7050 section 3).
+func nat64Prefixes(addrs []netip.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, a := range addrs {
+		if !a.Is6() || a.Is4In6() {
+			continue
+		}
+		for _, n := range nat64PrefixLens {
+			v4, ok := nat64Extract(a, n)
+			if !ok || (v4 != ipv4OnlyAddrs[0] && v4 != ipv4OnlyAddrs[1]) {
+				continue
+			}
+			if p, err := a.Prefix(n); err == nil && !containsPrefix(prefixes, p) {
+				prefixes = append(prefixes, p)
+			}
+			break
+		}
+	}
+	return prefixes
+}
+
+// nat64Indexes returns the indexes of the bytes of the IPv4 address in the
+// IPv6 address of the prefix of n bits, skipping the bits 64 to 71 (RFC
+// 6052 section 2.2).
+func nat64Indexes(n int) ([]int, bool) {
+	switch n {
+	case 32:
+		return []int{4, 5, 6, 7}, true
+	case 40:
+		return []int{5, 6, 7, 9}, true
+	case 48:
+		return []int{6, 7, 9, 10}, true
+	case 56:
+		return []int{7, 9, 10, 11}, true
+	case 64:
+		return []int{9, 10, 11, 12}, true
+	case 96:
+		return []int{12, 13, 14, 15}, true
+	}
+	return nil, false
+}
+
+// nat64Extract returns the IPv4 address embedded in the IPv6 address of the
+// NAT64 prefix of n bits.
+func nat64Extract(a netip.Addr, n int) (netip.Addr, bool) {
+	idx, ok := nat64Indexes(n)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	b := a.As16()
+	if n < 96 && b[8] != 0 {
+		return netip.Addr{}, false
+	}
+	var v4 [4]byte
+	for i, j := range idx {
+		v4[i] = b[j]
+	}
+	return netip.AddrFrom4(v4), true
+}
+
+// nat64Synthesize returns the IPv6 address of the IPv4 address in the NAT64
+// prefix.
+func nat64Synthesize(p netip.Prefix, v4 netip.Addr) (netip.Addr, bool) {
+	idx, ok := nat64Indexes(p.Bits())
+	if !ok || !v4.Is4() {
+		return netip.Addr{}, false
+	}
+	b := p.Masked().Addr().As16()
+	v := v4.As4()
+	for i, j := range idx {
+		b[j] = v[i]
+	}
+	return netip.AddrFrom16(b), true
+}
+
+func containsPrefix(prefixes []netip.Prefix, p netip.Prefix) bool {
+	for _, q := range prefixes {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+// hasIPv4 reports whether an interface up is of an IPv4 address but the
+// loopback and the link-local ones.
+func hasIPv4() bool {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return true
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				if ip := ipnet.IP.To4(); ip != nil && !ip.IsLinkLocalUnicast() {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestNAT64Prefixes(t *testing.T) {
+	v4 := netip.MustParseAddr("192.0.0.171")
+	for _, s := range []string{"64:ff9b::/96", "2001:db8:100::/40", "2001:db8:122:344::/64", "2001:db8::/32"} {
+		p := netip.MustParsePrefix(s)
+		a, ok := nat64Synthesize(p, v4)
+		if !ok {
+			t.Fatalf("nat64Synthesize error: %v", p)
+		}
+		if got, ok := nat64Extract(a, p.Bits()); !ok || got != v4 {
+			t.Errorf("nat64Extract error: %v of %v, got %v", a, p, got)
+		}
+		if prefixes := nat64Prefixes([]netip.Addr{a}); len(prefixes) != 1 || prefixes[0] != p {
+			t.Errorf("nat64Prefixes error: %v, got %v", a, prefixes)
+		}
+	}
+	// RFC 6052 section 2.4: 192.0.2.33 of 2001:db8:122:344::/64.
+	a := netip.MustParseAddr("2001:db8:122:344:c0:2:2100:0")
+	if got, ok := nat64Extract(a, 64); !ok || got != netip.MustParseAddr("192.0.2.33") {
+		t.Errorf("nat64Extract error: %v, got %v", a, got)
+	}
+	if prefixes := nat64Prefixes([]netip.Addr{netip.MustParseAddr("2001:db8::1")}); len(prefixes) != 0 {
+		t.Errorf("nat64Prefixes error: %v of an address not synthesized", prefixes)
+	}
+}
+
+func TestDetectNAT64(t *testing.T) {
+	defer func(f func(ctx context.Context, network, host string) ([]netip.Addr, error)) { lookupNetIP = f }(lookupNetIP)
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		switch host {
+		case ipv4OnlyName:
+			return []netip.Addr{netip.MustParseAddr("64:ff9b::c000:aa"), netip.MustParseAddr("64:ff9b::c000:ab")}, nil
+		case "stun.example.org":
+			return []netip.Addr{netip.MustParseAddr("::1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	c := NewClient()
+	c.SetServerAddr("stun.example.org:3478")
+	r, err := c.DetectNAT64(context.Background())
+	if err != nil {
+		t.Fatalf("DetectNAT64 error: %v", err)
+	}
+	if !r.DNS64 || len(r.Prefixes) != 1 || r.Prefixes[0] != wellKnownPrefix || r.NAT64 {
+		t.Errorf("DetectNAT64 error: %+v", r)
+	}
+	c.SetServerAddr("missing.example.org:3478")
+	if _, err := c.DetectNAT64(context.Background()); err == nil {
+		t.Errorf("DetectNAT64 error: expected error of the server")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// natpmpPort is the port of NAT-PMP and PCP servers (RFC 6886, RFC 6887).
+const natpmpPort = 5351
+
+// NAT-PMP opcodes (RFC 6886 section 3).
+const (
+	natpmpOpAddress = 0
+	natpmpOpMapUDP  = 1
+	natpmpOpMapTCP  = 2
+)
+
+var natpmpResultStr = map[uint16]string{
+	1: "Unsupported version.",
+	2: "Not authorized.",
+	3: "Network failure.",
+	4: "Out of resources.",
+	5: "Unsupported opcode.",
+}
+
+// NATPMPMapper is a Mapper of NAT-PMP (RFC 6886).
+type NATPMPMapper struct {
+	// Gateway is the address of the gateway, with or without the port,
+	// or empty for the default gateway.
+	Gateway string
+}
+
+// Mechanism returns MechanismNATPMP.
+func (p *NATPMPMapper) Mechanism() string {
+	return MechanismNATPMP
+}
+
+// AddMapping maps the internal port on the gateway, of the external
+// address of the gateway.
+func (p *NATPMPMapper) AddMapping(ctx context.Context, protocol string, internalPort int, lifetime time.Duration) (*ExternalMapping, error) {
+	addr, err := p.exchangeAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	port, granted, err := p.exchangeMap(ctx, protocol, internalPort, internalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	return &ExternalMapping{
+		Mechanism:    MechanismNATPMP,
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		External:     newHost(netip.AddrPortFrom(addr, uint16(port))),
+		Lifetime:     granted,
+		Mapper:       p,
+	}, nil
+}
+
+// DeleteMapping deletes the mapping by a request of lifetime 0.
+func (p *NATPMPMapper) DeleteMapping(ctx context.Context, m *ExternalMapping) error {
+	_, _, err := p.exchangeMap(ctx, m.Protocol, m.InternalPort, 0, 0)
+	return err
+}
+
+// exchangeAddress returns the external address of the gateway.
+func (p *NATPMPMapper) exchangeAddress(ctx context.Context) (netip.Addr, error) {
+	resp, err := p.exchange(ctx, []byte{0, natpmpOpAddress}, 12)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr := netip.AddrFrom4([4]byte(resp[8:12]))
+	if addr.IsUnspecified() {
+		return netip.Addr{}, errors.New("No external address of the gateway.")
+	}
+	return addr, nil
+}
+
+// exchangeMap requests a mapping of the internal port, of the suggested
+// external port, and returns the external port and the lifetime granted.
+func (p *NATPMPMapper) exchangeMap(ctx context.Context, protocol string, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	req := make([]byte, 12)
+	switch protocol {
+	case "udp":
+		req[1] = natpmpOpMapUDP
+	case "tcp":
+		req[1] = natpmpOpMapTCP
+	default:
+		return 0, 0, errors.New("Unsupported protocol.")
+	}
+	binary.BigEndian.PutUint16(req[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	resp, err := p.exchange(ctx, req, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if int(binary.BigEndian.Uint16(resp[8:])) != internalPort {
+		return 0, 0, errors.New("Unexpected internal port of the mapping.")
+	}
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second
+	return int(binary.BigEndian.Uint16(resp[10:])), granted, nil
+}
+
+// exchange sends the request to the gateway and returns the response of
+// the opcode, of at least size bytes, or the error of its result code.
+func (p *NATPMPMapper) exchange(ctx context.Context, req []byte, size int) ([]byte, error) {
+	addr, err := gatewayAddr(p.Gateway, natpmpPort)
+	if err != nil {
+		return nil, err
+	}
+	op := 128 + req[1]
+	resp, err := gatewayExchange(ctx, addr, req, func(resp []byte) bool {
+		return len(resp) >= 4 && resp[0] == 0 && resp[1] == op
+	})
+	if err != nil {
+		return nil, err
+	}
+	if code := binary.BigEndian.Uint16(resp[2:]); code != 0 {
+		if s, ok := natpmpResultStr[code]; ok {
+			return nil, errors.New(s)
+		}
+		return nil, errors.New("Unexpected result code.")
+	}
+	if len(resp) < size {
+		return nil, errors.New("Response too short.")
+	}
+	return resp, nil
+}
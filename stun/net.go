@@ -18,7 +18,7 @@ package stun
 
 import (
 	"bytes"
-	"encoding/hex"
+	"context"
 	"errors"
 	"net"
 	"time"
@@ -32,8 +32,18 @@ const (
 )
 
 func (c *Client) sendBindingReq(conn net.PacketConn, addr net.Addr, changeIP bool, changePort bool) (*response, error) {
-	// Construct packet.
-	pkt, err := newPacket()
+	pkt, err := c.newBindingReq(changeIP, changePort)
+	if err != nil {
+		return nil, err
+	}
+	// Send packet.
+	return c.send(pkt, conn, addr)
+}
+
+// newBindingReq constructs a binding request of the software name, with
+// the CHANGE-REQUEST attribute if changeIP or changePort.
+func (c *Client) newBindingReq(changeIP bool, changePort bool) (*packet, error) {
+	pkt, err := newPacketRand(c.rand)
 	if err != nil {
 		return nil, err
 	}
@@ -46,8 +56,7 @@ func (c *Client) sendBindingReq(conn net.PacketConn, addr net.Addr, changeIP boo
 	}
 	attribute = newFingerprintAttribute(pkt)
 	pkt.addAttribute(*attribute)
-	// Send packet.
-	return c.send(pkt, conn, addr)
+	return pkt, nil
 }
 
 // RFC 3489: Clients SHOULD retransmit the request starting with an interval
@@ -55,19 +64,73 @@ func (c *Client) sendBindingReq(conn net.PacketConn, addr net.Addr, changeIP boo
 // Retransmissions continue with intervals of 1.6s until a response is
 // received, or a total of 9 requests have been sent.
 func (c *Client) send(pkt *packet, conn net.PacketConn, addr net.Addr) (*response, error) {
-	c.logger.Info("\n" + hex.Dump(pkt.bytes()))
+	return c.transmit(pkt, conn, addr, numRetransmit)
+}
+
+// transmit sends pkt at most attempts times, following the retransmission
+// schedule above, and returns the matched response or nil if none arrived.
+// The transaction is recorded in the statistics of the client.
+func (c *Client) transmit(pkt *packet, conn net.PacketConn, addr net.Addr, attempts int) (resp *response, err error) {
+	tx := &Transaction{Server: addr.String()}
+	_, span := startSpan(context.Background(), c.tracer, spanName("STUN", pkt.types))
+	start := c.now()
+	var sent time.Time // the time of the last attempt
+	defer func() {
+		tx.Responded = resp != nil
+		tx.Err = err
+		tx.Elapsed = c.now().Sub(start)
+		c.recordTransaction(tx)
+		c.logTransaction(tx)
+		tx.trace(span)
+		if resp != nil {
+			traceErrorCode(span, resp.packet)
+		}
+		span.End(err)
+	}()
+	c.logger.dumpln("Send to", addr, "\n"+(&Message{pkt: pkt}).String())
+	if c.ttl > 0 {
+		// The connection of NewClientWithConnection gets its TTL back.
+		if conn == c.conn {
+			if ttl, err := getTTL(conn); err == nil {
+				defer setTTL(conn, ttl)
+			}
+		}
+		if err := setTTL(conn, c.ttl); err != nil {
+			return nil, err
+		}
+	}
+	// The connection of NewClientWithConnection is enabled once.
+	if conn != c.conn {
+		enableICMPErrors(conn)
+	}
 	timeout := defaultTimeout
-	packetBytes := make([]byte, maxPacketSize)
-	for i := 0; i < numRetransmit; i++ {
+	// Requests are not retransmitted over reliable transports.
+	if sc, ok := conn.(*streamConn); ok {
+		attempts, timeout = 1, sc.timeout
+	}
+	req := pkt.bytes()
+	// Leave room for servers echoing the PADDING of large requests.
+	packetBytes := make([]byte, maxPacketSize+len(req))
+	for i := 0; i < attempts; i++ {
 		// Send packet to the server.
-		length, err := conn.WriteTo(pkt.bytes(), addr)
+		length, err := conn.WriteTo(req, addr)
 		if err != nil {
-			return nil, err
+			// A pending ICMP error may be reported by the write.
+			if ierr, ok := icmpError(conn, addr, err); ok {
+				return nil, ierr
+			}
+			length, err = conn.WriteTo(req, addr)
+			if err != nil {
+				return nil, err
+			}
 		}
-		if length != len(pkt.bytes()) {
+		if length != len(req) {
 			return nil, errors.New("Error in sending data.")
 		}
-		err = conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+		sent = c.now()
+		tx.Attempts++
+		c.capture.capture(req, conn.LocalAddr(), addr, c.logger)
+		err = conn.SetReadDeadline(c.now().Add(time.Duration(timeout) * time.Millisecond))
 		if err != nil {
 			return nil, err
 		}
@@ -78,23 +141,38 @@ func (c *Client) send(pkt *packet, conn net.PacketConn, addr net.Addr) (*respons
 			// Read from the port.
 			length, raddr, err := conn.ReadFrom(packetBytes)
 			if err != nil {
-				if err.(net.Error).Timeout() {
+				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+					tx.Timeouts++
+					if i+1 < attempts {
+						c.logger.Warnln("Retransmit to", addr, "attempt", i+2, "of", attempts)
+					}
 					break
 				}
-				return nil, err
+				// Fail fast if the server is unreachable, but
+				// ignore ICMP errors caused by other traffic.
+				ierr, ok := icmpError(conn, addr, err)
+				if !ok {
+					continue
+				}
+				return nil, ierr
 			}
+			rtt := c.now().Sub(sent)
+			c.capture.capture(packetBytes[0:length], raddr, conn.LocalAddr(), c.logger)
 			p, err := newPacketFromBytes(packetBytes[0:length])
 			if err != nil {
+				countExpvar(&expvars.malformed, 1)
 				return nil, err
 			}
 			// If transId mismatches, keep reading until get a
 			// matched packet or timeout.
 			if !bytes.Equal(pkt.transID, p.transID) {
+				tx.Stray++
 				continue
 			}
-			c.logger.Info("\n" + hex.Dump(packetBytes[0:length]))
-			resp := newResponse(p, conn)
-			resp.serverAddr = newHostFromStr(raddr.String())
+			tx.RTT = rtt
+			c.logger.dumpln("Received from", raddr, "\n"+(&Message{pkt: p}).String())
+			resp = newResponse(p, conn)
+			resp.serverAddr = hostFromAddr(raddr)
 			return resp, err
 		}
 	}
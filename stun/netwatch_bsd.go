@@ -0,0 +1,41 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package stun
+
+import (
+	"os"
+	"syscall"
+)
+
+// watchNetwork reads the routing socket, which receives messages about the
+// changes of interfaces, addresses and routes.
+func watchNetwork() (<-chan struct{}, func(), error) {
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+	// Non-blocking so that the runtime poller can interrupt the reads.
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, nil, os.NewSyscallError("setnonblock", err)
+	}
+	f := os.NewFile(uintptr(fd), "route")
+	return readNotifications(f), func() { f.Close() }, nil
+}
@@ -20,6 +20,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"io"
 )
 
 type packet struct {
@@ -30,10 +31,19 @@ type packet struct {
 }
 
 func newPacket() (*packet, error) {
+	return newPacketRand(nil)
+}
+
+// newPacketRand returns a packet of a transaction ID read from r, or of
+// crypto/rand if nil.
+func newPacketRand(r io.Reader) (*packet, error) {
+	if r == nil {
+		r = rand.Reader
+	}
 	v := new(packet)
 	v.transID = make([]byte, 16)
 	binary.BigEndian.PutUint32(v.transID[:4], magicCookie)
-	_, err := rand.Read(v.transID[4:])
+	_, err := io.ReadFull(r, v.transID[4:])
 	if err != nil {
 		return nil, err
 	}
@@ -42,8 +52,25 @@ func newPacket() (*packet, error) {
 	return v, nil
 }
 
+// newResponsePacket returns a response of the given type to req, which
+// carries the same transaction ID.
+func newResponsePacket(req *packet, types uint16) *packet {
+	v := new(packet)
+	v.types = types
+	v.transID = make([]byte, 16)
+	copy(v.transID, req.transID)
+	v.attributes = make([]attribute, 0, 10)
+	return v
+}
+
+// isLegacy reports whether the packet is sent by a RFC 3489 peer, which does
+// not use the magic cookie.
+func (v *packet) isLegacy() bool {
+	return binary.BigEndian.Uint32(v.transID[:4]) != magicCookie
+}
+
 func newPacketFromBytes(packetBytes []byte) (*packet, error) {
-	if len(packetBytes) < 24 {
+	if len(packetBytes) < messageHeaderSize {
 		return nil, errors.New("Received data length too short.")
 	}
 	pkt := new(packet)
@@ -51,16 +78,19 @@ func newPacketFromBytes(packetBytes []byte) (*packet, error) {
 	pkt.length = binary.BigEndian.Uint16(packetBytes[2:4])
 	pkt.transID = packetBytes[4:20]
 	pkt.attributes = make([]attribute, 0, 10)
-	for pos := uint16(20); pos < uint16(len(packetBytes)); {
+	for pos := 20; pos < len(packetBytes); {
+		if pos+4 > len(packetBytes) {
+			return nil, errors.New("Received data format mismatch.")
+		}
 		types := binary.BigEndian.Uint16(packetBytes[pos : pos+2])
-		length := binary.BigEndian.Uint16(packetBytes[pos+2 : pos+4])
-		if pos+4+length > uint16(len(packetBytes)) {
+		length := int(binary.BigEndian.Uint16(packetBytes[pos+2 : pos+4]))
+		if pos+4+length > len(packetBytes) {
 			return nil, errors.New("Received data format mismatch.")
 		}
 		value := packetBytes[pos+4 : pos+4+length]
 		attribute := newAttribute(types, value)
 		pkt.addAttribute(*attribute)
-		pos += align(length) + 4
+		pos += int(align(uint16(length))) + 4
 	}
 	return pkt, nil
 }
@@ -70,20 +100,87 @@ func (v *packet) addAttribute(a attribute) {
 	v.length += align(a.length) + 4
 }
 
+// bytes returns the packet in the wire format, of a single allocation.
 func (v *packet) bytes() []byte {
-	packetBytes := make([]byte, 4)
-	binary.BigEndian.PutUint16(packetBytes[0:2], v.types)
-	binary.BigEndian.PutUint16(packetBytes[2:4], v.length)
-	packetBytes = append(packetBytes, v.transID...)
+	return v.appendTo(make([]byte, 0, v.size()))
+}
+
+// appendTo appends the packet in the wire format to buf and returns the
+// extended buffer, which is not allocated if buf has the capacity of size.
+func (v *packet) appendTo(buf []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, v.types)
+	buf = binary.BigEndian.AppendUint16(buf, v.length)
+	buf = append(buf, v.transID...)
+	for i := range v.attributes {
+		a := &v.attributes[i]
+		buf = binary.BigEndian.AppendUint16(buf, a.types)
+		buf = binary.BigEndian.AppendUint16(buf, a.length)
+		buf = append(buf, a.value...)
+	}
+	return buf
+}
+
+// size returns the size of the packet in the wire format.
+func (v *packet) size() int {
+	n := 4 + len(v.transID)
+	for i := range v.attributes {
+		n += 4 + len(v.attributes[i].value)
+	}
+	return n
+}
+
+// getAttribute returns the first attribute of the type, or nil.
+func (v *packet) getAttribute(types uint16) *attribute {
+	for i := range v.attributes {
+		if v.attributes[i].types == types {
+			return &v.attributes[i]
+		}
+	}
+	return nil
+}
+
+// hasAttribute reports whether the packet carries an attribute of the type.
+func (v *packet) hasAttribute(types uint16) bool {
+	return v.getAttribute(types) != nil
+}
+
+// getString returns the value of the attribute of the type as a string,
+// e.g. USERNAME or REALM.
+func (v *packet) getString(types uint16) string {
+	a := v.getAttribute(types)
+	if a == nil {
+		return ""
+	}
+	return string(a.value[:a.length])
+}
+
+// getErrorCode returns the code of the ERROR-CODE attribute, or 0.
+func (v *packet) getErrorCode() int {
+	a := v.getAttribute(attributeErrorCode)
+	if a == nil || a.length < 4 {
+		return 0
+	}
+	return int(a.value[2]&0x07)*100 + int(a.value[3])
+}
+
+// getErrorReason returns the reason phrase of the ERROR-CODE attribute.
+func (v *packet) getErrorReason() string {
+	a := v.getAttribute(attributeErrorCode)
+	if a == nil || a.length < 4 {
+		return ""
+	}
+	return string(a.value[4:a.length])
+}
+
+// getChangeRequest returns the flags of the CHANGE-REQUEST attribute, and
+// whether the attribute is present.
+func (v *packet) getChangeRequest() (changeIP bool, changePort bool, ok bool) {
 	for _, a := range v.attributes {
-		buf := make([]byte, 2)
-		binary.BigEndian.PutUint16(buf, a.types)
-		packetBytes = append(packetBytes, buf...)
-		binary.BigEndian.PutUint16(buf, a.length)
-		packetBytes = append(packetBytes, buf...)
-		packetBytes = append(packetBytes, a.value...)
+		if a.types == attributeChangeRequest && len(a.value) >= 4 {
+			return a.value[3]&0x04 != 0, a.value[3]&0x02 != 0, true
+		}
 	}
-	return packetBytes
+	return false, false, false
 }
 
 func (v *packet) getSourceAddr() *Host {
@@ -105,6 +202,9 @@ func (v *packet) getOtherAddr() *Host {
 func (v *packet) getRawAddr(attribute uint16) *Host {
 	for _, a := range v.attributes {
 		if a.types == attribute {
+			if a.length < 8 {
+				return nil // truncated
+			}
 			return a.rawAddr()
 		}
 	}
@@ -122,6 +222,9 @@ func (v *packet) getXorMappedAddr() *Host {
 func (v *packet) getXorAddr(attribute uint16) *Host {
 	for _, a := range v.attributes {
 		if a.types == attribute {
+			if a.length < 8 {
+				return nil // truncated
+			}
 			return a.xorAddr(v.transID)
 		}
 	}
@@ -59,3 +59,74 @@ func TestPacketAll(t *testing.T) {
 		t.Errorf("newPacketFromBytes error")
 	}
 }
+
+// newAppendPacket returns a response of the usual attributes.
+func newAppendPacket(tb testing.TB) *packet {
+	p, err := newPacket()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	p.types = typeBindingResponse
+	p.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, newHostFromStr("192.0.2.1:3478"), p.transID))
+	p.addAttribute(*newSoftwareAttribute("go-stun"))
+	p.addAttribute(*newFingerprintAttribute(p))
+	return p
+}
+
+func TestPacketAppendTo(t *testing.T) {
+	p := newAppendPacket(t)
+	b := p.bytes()
+	if len(b) != p.size() || cap(b) != p.size() || len(b) != messageHeaderSize+int(p.length) {
+		t.Errorf("bytes error: %d bytes of capacity %d, expected %d", len(b), cap(b), p.size())
+	}
+	if !checkFingerprint(b) {
+		t.Errorf("bytes error: fingerprint")
+	}
+	buf := p.appendTo([]byte("prefix"))
+	if string(buf[:6]) != "prefix" || string(buf[6:]) != string(b) {
+		t.Errorf("appendTo error: %x", buf)
+	}
+	buf = make([]byte, 0, maxPacketSize)
+	if n := testing.AllocsPerRun(100, func() { p.appendTo(buf) }); n != 0 {
+		t.Errorf("appendTo error: %v allocations", n)
+	}
+	m := &Message{pkt: p}
+	if got := m.AppendTo(nil); string(got) != string(b) {
+		t.Errorf("AppendTo error: %x", got)
+	}
+}
+
+func BenchmarkPacketAppendTo(b *testing.B) {
+	p := newAppendPacket(b)
+	buf := make([]byte, 0, maxPacketSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = p.appendTo(buf[:0])
+	}
+}
+
+func BenchmarkPacketBytes(b *testing.B) {
+	p := newAppendPacket(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.bytes()
+	}
+}
+
+func BenchmarkMessageAppendEncode(b *testing.B) {
+	m, err := NewMessage(TypeBindingResponse)
+	if err != nil {
+		b.Fatal(err)
+	}
+	m.AddXorAddress(AttributeXorMappedAddress, newHostFromStr("192.0.2.1:3478"))
+	m.AddAttribute(AttributeSoftware, []byte("go-stun"))
+	key := ShortTermKey("secret")
+	buf := make([]byte, 0, maxPacketSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = m.AppendEncode(buf[:0], key)
+	}
+}
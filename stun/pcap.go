@@ -0,0 +1,319 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Link types of pcap: the pcap files written are of pcapLinkRaw, the IP
+// packets without link layer header.
+const (
+	pcapLinkNull     = 0
+	pcapLinkEthernet = 1
+	pcapLinkRaw      = 101
+	pcapLinkLinuxSLL = 113
+)
+
+// maxPcapRecord caps the records read from a pcap file, whatever its
+// snapshot length, so that a corrupted file cannot make a huge allocation.
+const maxPcapRecord = 256 << 10
+
+// PcapWriter writes the STUN messages sent and received to a pcap file, as
+// the UDP datagrams between their addresses, for the analysis in Wireshark.
+// The messages over TCP and TLS are written as UDP datagrams too, each
+// message in one.
+type PcapWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+// NewPcapWriter writes the file header to w and returns the writer of the
+// messages to it. The writes are not buffered, so w is to be buffered by
+// the caller for heavy traffic.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], maxMessageSize+40+8)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WriteMessage writes the message b sent from src to dst at t.
+func (p *PcapWriter) WriteMessage(t time.Time, src, dst netip.AddrPort, b []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = appendPcapRecord(p.buf[:0], t, src, dst, b)
+	_, err := p.w.Write(p.buf)
+	return err
+}
+
+// capture writes the message b sent from src to dst now, if p is not nil.
+func (p *PcapWriter) capture(b []byte, src, dst net.Addr, logger *Logger) {
+	if p == nil {
+		return
+	}
+	if err := p.WriteMessage(time.Now(), pcapAddr(src), pcapAddr(dst), b); err != nil {
+		logger.Debugln("Capture failed:", err)
+	}
+}
+
+// pcapAddr returns the address and port of addr, the unspecified IPv4
+// address if unknown.
+func pcapAddr(addr net.Addr) netip.AddrPort {
+	if addr != nil {
+		if h := hostFromAddr(addr); h != nil {
+			return h.AddrPort()
+		}
+	}
+	return netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+}
+
+// appendPcapRecord appends the record of the UDP datagram of the payload
+// from src to dst, over IPv4 if both addresses are of IPv4, taking the
+// unspecified address for either family, and IPv6 otherwise.
+func appendPcapRecord(b []byte, t time.Time, src, dst netip.AddrPort, payload []byte) []byte {
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	// The local address of a socket of both families is unspecified.
+	if srcIP.IsUnspecified() && dstIP.Is4() {
+		srcIP = netip.IPv4Unspecified()
+	}
+	if dstIP.IsUnspecified() && srcIP.Is4() {
+		dstIP = netip.IPv4Unspecified()
+	}
+	v4 := srcIP.Is4() && dstIP.Is4()
+	if !v4 {
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+	ipLen := 20
+	if !v4 {
+		ipLen = 40
+	}
+	udpLen := 8 + len(payload)
+	n := ipLen + udpLen
+	b = binary.LittleEndian.AppendUint32(b, uint32(t.Unix()))
+	b = binary.LittleEndian.AppendUint32(b, uint32(t.Nanosecond()/1000))
+	b = binary.LittleEndian.AppendUint32(b, uint32(n))
+	b = binary.LittleEndian.AppendUint32(b, uint32(n))
+	ip := len(b)
+	if v4 {
+		b = append(b, 0x45, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+		b = append(b, 0, 0, 0x40, 0, 64, 17, 0, 0)
+		b = append(b, srcIP.AsSlice()...)
+		b = append(b, dstIP.AsSlice()...)
+		binary.BigEndian.PutUint16(b[ip+10:], ^checksum(0, b[ip:ip+20]))
+	} else {
+		b = append(b, 0x60, 0, 0, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(udpLen))
+		b = append(b, 17, 64)
+		b = append(b, srcIP.AsSlice()...)
+		b = append(b, dstIP.AsSlice()...)
+	}
+	udp := len(b)
+	b = binary.BigEndian.AppendUint16(b, src.Port())
+	b = binary.BigEndian.AppendUint16(b, dst.Port())
+	b = binary.BigEndian.AppendUint16(b, uint16(udpLen))
+	b = append(b, 0, 0)
+	b = append(b, payload...)
+	// The checksum covers the pseudo header of the addresses, the
+	// protocol and the length.
+	sum := checksum(0, srcIP.AsSlice())
+	sum = checksum(sum, dstIP.AsSlice())
+	sum = checksum(sum, []byte{0, 17, byte(udpLen >> 8), byte(udpLen)})
+	sum = ^checksum(sum, b[udp:])
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[udp+6:], sum)
+	return b
+}
+
+// checksum adds b to the one's complement sum of the Internet checksum.
+func checksum(sum uint16, b []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
+
+// PcapPacket is a UDP datagram read from a pcap file.
+type PcapPacket struct {
+	Time     time.Time
+	Src, Dst netip.AddrPort
+	Payload  []byte
+}
+
+// PcapReader reads the UDP datagrams over IPv4 and IPv6 of a pcap file, of
+// the files of PcapWriter and of the captures of Ethernet, Linux cooked
+// and the loopback of BSD, skipping the other packets and the IP fragments
+// after the first.
+type PcapReader struct {
+	r       io.Reader
+	order   binary.ByteOrder
+	nano    bool
+	link    uint32
+	snaplen uint32 // maximum length of the records
+	record  []byte
+}
+
+// NewPcapReader reads the file header of r and returns the reader of the
+// datagrams of it.
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	p := &PcapReader{r: r, record: make([]byte, 16)}
+	switch magic := binary.LittleEndian.Uint32(header); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		p.order, p.nano = binary.LittleEndian, magic == 0xa1b23c4d
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		p.order, p.nano = binary.BigEndian, magic == 0x4d3cb2a1
+	default:
+		return nil, errors.New("Not a pcap file.")
+	}
+	p.snaplen = p.order.Uint32(header[16:20])
+	if p.snaplen == 0 || p.snaplen > maxPcapRecord {
+		p.snaplen = maxPcapRecord
+	}
+	p.link = p.order.Uint32(header[20:24])
+	return p, nil
+}
+
+// Next returns the next UDP datagram, or io.EOF at the end of the file.
+func (p *PcapReader) Next() (*PcapPacket, error) {
+	for {
+		if _, err := io.ReadFull(p.r, p.record); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, errors.New("Truncated pcap file.")
+			}
+			return nil, err
+		}
+		sec, frac := int64(p.order.Uint32(p.record[0:4])), int64(p.order.Uint32(p.record[4:8]))
+		if !p.nano {
+			frac *= 1000
+		}
+		n := p.order.Uint32(p.record[8:12])
+		if n > p.snaplen {
+			return nil, errors.New("Pcap record longer than the snapshot length.")
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(p.r, data); err != nil {
+			return nil, errors.New("Truncated pcap file.")
+		}
+		ip, ok := linkPayload(p.link, data)
+		if !ok {
+			continue
+		}
+		if pkt, ok := parseUDP(ip); ok {
+			pkt.Time = time.Unix(sec, frac)
+			return pkt, nil
+		}
+	}
+}
+
+// linkPayload returns the IP packet of the frame of the link type.
+func linkPayload(link uint32, b []byte) ([]byte, bool) {
+	switch link {
+	case pcapLinkNull:
+		if len(b) < 4 {
+			return nil, false
+		}
+		return b[4:], true
+	case pcapLinkEthernet:
+		if len(b) < 14 {
+			return nil, false
+		}
+		etherType, b := binary.BigEndian.Uint16(b[12:14]), b[14:]
+		for etherType == 0x8100 && len(b) >= 4 {
+			// Skip the VLAN tags.
+			etherType, b = binary.BigEndian.Uint16(b[2:4]), b[4:]
+		}
+		return b, etherType == 0x0800 || etherType == 0x86dd
+	case pcapLinkRaw:
+		return b, true
+	case pcapLinkLinuxSLL:
+		if len(b) < 16 {
+			return nil, false
+		}
+		return b[16:], true
+	}
+	return nil, false
+}
+
+// parseUDP returns the UDP datagram of the IP packet.
+func parseUDP(b []byte) (*PcapPacket, bool) {
+	var src, dst netip.Addr
+	if len(b) < 1 {
+		return nil, false
+	}
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return nil, false
+		}
+		ihl := int(b[0]&0x0f) * 4
+		// Drop the packets of other protocols, the fragments after the
+		// first and the headers of invalid lengths.
+		if b[9] != 17 || binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 || ihl < 20 || len(b) < ihl {
+			return nil, false
+		}
+		src, dst = netip.AddrFrom4([4]byte(b[12:16])), netip.AddrFrom4([4]byte(b[16:20]))
+		b = b[ihl:]
+	case 6:
+		if len(b) < 40 || b[6] != 17 {
+			return nil, false
+		}
+		src, dst = netip.AddrFrom16([16]byte(b[8:24])), netip.AddrFrom16([16]byte(b[24:40]))
+		b = b[40:]
+	default:
+		return nil, false
+	}
+	if len(b) < 8 {
+		return nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b[4:6]))
+	if n < 8 || n > len(b) {
+		// The datagram is truncated by the capture.
+		n = len(b)
+	}
+	return &PcapPacket{
+		Src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(b[0:2])),
+		Dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(b[2:4])),
+		Payload: b[8:n],
+	}, true
+}
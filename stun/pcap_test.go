@@ -0,0 +1,216 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// pcapPackets returns the IP packets of the records of the pcap file.
+func pcapPackets(t *testing.T, b []byte) [][]byte {
+	if len(b) < 24 || binary.LittleEndian.Uint32(b) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(b[20:]) != pcapLinkRaw {
+		t.Fatalf("pcap error: header %x", b)
+	}
+	var packets [][]byte
+	for b = b[24:]; len(b) > 0; {
+		if len(b) < 16 {
+			t.Fatalf("pcap error: record %x", b)
+		}
+		n := int(binary.LittleEndian.Uint32(b[8:]))
+		packets = append(packets, b[16:16+n])
+		b = b[16+n:]
+	}
+	return packets
+}
+
+// checkUDP checks the checksums of the IP packet of a UDP datagram, and
+// returns the payload.
+func checkUDP(t *testing.T, ip []byte) []byte {
+	var src, dst []byte
+	var udp []byte
+	if ip[0]>>4 == 4 {
+		if checksum(0, ip[:20]) != 0xffff {
+			t.Errorf("pcap error: IPv4 checksum of %x", ip[:20])
+		}
+		src, dst, udp = ip[12:16], ip[16:20], ip[20:]
+	} else {
+		src, dst, udp = ip[8:24], ip[24:40], ip[40:]
+	}
+	sum := checksum(0, src)
+	sum = checksum(sum, dst)
+	sum = checksum(sum, []byte{0, 17, byte(len(udp) >> 8), byte(len(udp))})
+	if checksum(sum, udp) != 0xffff {
+		t.Errorf("pcap error: UDP checksum of %x", udp)
+	}
+	return udp[8:]
+}
+
+func TestPcapCapture(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var serverCapture, clientCapture bytes.Buffer
+	s := NewServer()
+	sp, err := NewPcapWriter(&serverCapture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetCapture(sp)
+	go s.Serve(conn)
+	c := NewClient()
+	cp, err := NewPcapWriter(&clientCapture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetCapture(cp)
+	c.SetServerAddr(conn.LocalAddr().String())
+	if _, err := c.Bind(TransportUDP); err != nil {
+		t.Fatalf("Bind error: %v", err)
+	}
+	s.Close()
+	for _, b := range [][]byte{clientCapture.Bytes(), serverCapture.Bytes()} {
+		packets := pcapPackets(t, b)
+		if len(packets) != 2 {
+			t.Fatalf("pcap error: %d packets", len(packets))
+		}
+		types := []uint16{typeBindingRequest, typeBindingResponse}
+		for i, ip := range packets {
+			m, err := ParseMessage(checkUDP(t, ip))
+			if err != nil {
+				t.Fatalf("ParseMessage error: %v", err)
+			}
+			if m.Type() != types[i] {
+				t.Errorf("pcap error: message %d of type %#x", i, m.Type())
+			}
+		}
+	}
+}
+
+func TestPcapRecordIPv6(t *testing.T) {
+	src := netip.MustParseAddrPort("[2001:db8::1]:3478")
+	dst := netip.MustParseAddrPort("192.0.2.1:5000") // mapped to IPv6
+	b := appendPcapRecord(nil, time.Unix(1, 2000), src, dst, []byte{1, 2, 3})
+	if binary.LittleEndian.Uint32(b) != 1 || binary.LittleEndian.Uint32(b[4:]) != 2 {
+		t.Errorf("appendPcapRecord error: time %x", b[:8])
+	}
+	ip := b[16:]
+	if ip[0]>>4 != 6 || len(ip) != 40+8+3 {
+		t.Fatalf("appendPcapRecord error: %x", ip)
+	}
+	if payload := checkUDP(t, ip); !bytes.Equal(payload, []byte{1, 2, 3}) {
+		t.Errorf("appendPcapRecord error: payload %x", payload)
+	}
+}
+
+// pcapRecord returns the record of an Ethernet frame of the IPv4 packet of
+// the protocol and the payload, from 192.0.2.1:3478 to 192.0.2.2:5000.
+func pcapRecord(proto byte, payload []byte, ts time.Time) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], 3478)
+	binary.BigEndian.PutUint16(udp[2:], 5000)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+	ip := []byte{0x45, 0, 0, 0, 0, 0, 0, 0, 64, proto, 0, 0, 192, 0, 2, 1, 192, 0, 2, 2}
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)+len(udp)))
+	frame := append(make([]byte, 12), 0x08, 0x00)
+	frame = append(append(frame, ip...), udp...)
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+	return append(record, frame...)
+}
+
+func TestPcapReader(t *testing.T) {
+	m, err := NewMessage(TypeBindingRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := m.Encode(nil)
+	ts := time.Unix(1700000000, 123456000)
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkEthernet)
+	buf.Write(header)
+	buf.Write(pcapRecord(6, msg, ts)) // TCP
+	buf.Write(pcapRecord(17, msg, ts))
+	r, err := NewPcapReader(&buf)
+	if err != nil {
+		t.Fatalf("NewPcapReader error: %v", err)
+	}
+	p, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next error: %v", err)
+	}
+	if p.Src.String() != "192.0.2.1:3478" || p.Dst.String() != "192.0.2.2:5000" || !p.Time.Equal(ts) {
+		t.Errorf("Next error: %v -> %v at %v", p.Src, p.Dst, p.Time)
+	}
+	if !bytes.Equal(p.Payload, msg) {
+		t.Errorf("Next error: payload %x", p.Payload)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next error: expected EOF, get %v", err)
+	}
+	if _, err := NewPcapReader(bytes.NewReader(make([]byte, 24))); err == nil {
+		t.Error("NewPcapReader error: expected not a pcap file")
+	}
+
+	// The records longer than the snapshot length are rejected before
+	// they are read, and the IPv4 headers shorter than 20 bytes skipped.
+	buf.Reset()
+	buf.Write(header)
+	short := pcapRecord(17, msg, ts)
+	short[16+14] = 0x44
+	buf.Write(short)
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[8:], 65536)
+	buf.Write(record)
+	if r, err = NewPcapReader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Errorf("Next error: expected a too long record, get %v", err)
+	}
+
+	// The files of PcapWriter are read back.
+	buf.Reset()
+	w, err := NewPcapWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, dst := netip.MustParseAddrPort("[2001:db8::1]:5000"), netip.MustParseAddrPort("[2001:db8::2]:3478")
+	w.WriteMessage(ts, src, dst, msg)
+	if r, err = NewPcapReader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = r.Next(); err != nil || p.Src != src || p.Dst != dst || !bytes.Equal(p.Payload, msg) {
+		t.Errorf("Next error: %+v, %v", p, err)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// PCP constants (RFC 6887 sections 7 and 11).
+const (
+	pcpVersion    = 2
+	pcpOpMap      = 1
+	pcpHeaderSize = 24
+	pcpMapSize    = 36
+)
+
+var pcpResultStr = map[byte]string{
+	1:  "Unsupported version.",
+	2:  "Not authorized.",
+	3:  "Malformed request.",
+	4:  "Unsupported opcode.",
+	5:  "Unsupported option.",
+	6:  "Malformed option.",
+	7:  "Network failure.",
+	8:  "No resources.",
+	9:  "Unsupported protocol.",
+	10: "User exceeded quota.",
+	11: "Cannot provide external.",
+	12: "Address mismatch.",
+	13: "Excessive remote peers.",
+}
+
+// pcpKey is the key of the nonce of a mapping.
+type pcpKey struct {
+	protocol byte
+	port     int
+}
+
+// PCPMapper is a Mapper of the MAP opcode of PCP (RFC 6887).
+type PCPMapper struct {
+	// Gateway is the address of the gateway, with or without the port,
+	// or empty for the default gateway.
+	Gateway string
+
+	mu     sync.Mutex
+	nonces map[pcpKey][12]byte // the nonces of the mappings, to renew them
+}
+
+// Mechanism returns MechanismPCP.
+func (p *PCPMapper) Mechanism() string {
+	return MechanismPCP
+}
+
+// AddMapping maps or renews the mapping of the internal port on the
+// gateway.
+func (p *PCPMapper) AddMapping(ctx context.Context, protocol string, internalPort int, lifetime time.Duration) (*ExternalMapping, error) {
+	external, granted, err := p.exchangeMap(ctx, protocol, internalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	return &ExternalMapping{
+		Mechanism:    MechanismPCP,
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		External:     newHost(external),
+		Lifetime:     granted,
+		Mapper:       p,
+	}, nil
+}
+
+// DeleteMapping deletes the mapping by a request of lifetime 0.
+func (p *PCPMapper) DeleteMapping(ctx context.Context, m *ExternalMapping) error {
+	_, _, err := p.exchangeMap(ctx, m.Protocol, m.InternalPort, 0)
+	if err == nil {
+		proto, _ := pcpProtocol(m.Protocol)
+		p.mu.Lock()
+		delete(p.nonces, pcpKey{proto, m.InternalPort})
+		p.mu.Unlock()
+	}
+	return err
+}
+
+// nonce returns the nonce of the mapping, generated once.
+func (p *PCPMapper) nonce(key pcpKey) ([12]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n, ok := p.nonces[key]; ok {
+		return n, nil
+	}
+	var n [12]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return n, err
+	}
+	if p.nonces == nil {
+		p.nonces = make(map[pcpKey][12]byte)
+	}
+	p.nonces[key] = n
+	return n, nil
+}
+
+// exchangeMap sends a MAP request of the internal port, suggesting the
+// same external port, and returns the external address and the lifetime
+// granted.
+func (p *PCPMapper) exchangeMap(ctx context.Context, protocol string, internalPort int, lifetime time.Duration) (netip.AddrPort, time.Duration, error) {
+	proto, err := pcpProtocol(protocol)
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	nonce, err := p.nonce(pcpKey{proto, internalPort})
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	addr, err := gatewayAddr(p.Gateway, natpmpPort)
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	// The client address is of the socket the request is sent from,
+	// which is connected first to learn it.
+	local, err := localAddrTo(addr)
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	req := make([]byte, pcpHeaderSize+pcpMapSize)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+	client := local.As16()
+	copy(req[8:24], client[:])
+	m := req[pcpHeaderSize:]
+	copy(m[0:12], nonce[:])
+	m[12] = proto
+	binary.BigEndian.PutUint16(m[16:], uint16(internalPort))
+	binary.BigEndian.PutUint16(m[18:], uint16(internalPort))
+	if local.Is4() {
+		// The suggested external address is the IPv4 wildcard.
+		m[30], m[31] = 0xff, 0xff
+	}
+	resp, err := gatewayExchange(ctx, addr, req, func(resp []byte) bool {
+		// An error may be of a NAT-PMP gateway, of the same layout of
+		// the first bytes.
+		if len(resp) < 4 || resp[1] != 0x80|pcpOpMap {
+			return false
+		}
+		return resp[3] != 0 || len(resp) >= pcpHeaderSize+pcpMapSize &&
+			string(resp[pcpHeaderSize:pcpHeaderSize+12]) == string(nonce[:])
+	})
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	if code := resp[3]; code != 0 {
+		if s, ok := pcpResultStr[code]; ok {
+			return netip.AddrPort{}, 0, errors.New(s)
+		}
+		return netip.AddrPort{}, 0, errors.New("Unexpected result code.")
+	}
+	granted := time.Duration(binary.BigEndian.Uint32(resp[4:])) * time.Second
+	m = resp[pcpHeaderSize:]
+	external := netip.AddrFrom16([16]byte(m[20:36])).Unmap()
+	return netip.AddrPortFrom(external, binary.BigEndian.Uint16(m[18:])), granted, nil
+}
+
+// pcpProtocol returns the IANA protocol number of protocol.
+func pcpProtocol(protocol string) (byte, error) {
+	switch protocol {
+	case "udp":
+		return 17, nil
+	case "tcp":
+		return 6, nil
+	}
+	return 0, errors.New("Unsupported protocol.")
+}
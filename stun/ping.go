@@ -0,0 +1,235 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Defaults of PingOptions.
+const (
+	defaultPingSamples  = 5
+	defaultPingInterval = 200 * time.Millisecond
+	defaultPingTimeout  = time.Second
+)
+
+// PingOptions are the options of PingWithOptions. The zero values are the
+// defaults.
+type PingOptions struct {
+	// Samples is the number of the Binding transactions, 5 by default.
+	Samples int
+	// Interval is the time between the starts of the transactions, 200ms
+	// by default.
+	Interval time.Duration
+	// Timeout is the time a transaction is waited for, 1s by default,
+	// after which it is lost.
+	Timeout time.Duration
+}
+
+// PingResult is the round-trip time to a STUN server measured by Ping.
+type PingResult struct {
+	Server string
+	// RTTs are the round-trip times of the transactions responded to, in
+	// order.
+	RTTs []time.Duration
+	// RTT is the mean of RTTs, and Min and Max their extremes.
+	RTT time.Duration
+	Min time.Duration
+	Max time.Duration
+	// Jitter is the mean difference between consecutive RTTs, as the
+	// interarrival jitter of RFC 3550 without smoothing.
+	Jitter time.Duration
+	// Sent is the number of the transactions, of which len(RTTs) are
+	// responded to.
+	Sent int
+}
+
+// Loss is the fraction of the transactions lost.
+func (r *PingResult) Loss() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.Sent-len(r.RTTs)) / float64(r.Sent)
+}
+
+// Ping measures the round-trip time to the STUN server, the server of the
+// client if empty, as PingWithOptions with the default options.
+func (c *Client) Ping(ctx context.Context, server string) (*PingResult, error) {
+	return c.PingWithOptions(ctx, server, nil)
+}
+
+// PingWithOptions measures the round-trip time to the STUN server, the
+// server of the client if empty, over Binding transactions of a new
+// socket. The transactions are not retransmitted, so that an RTT is not
+// taken of a retransmission, and the responses to a lost transaction are
+// ignored once timed out. It fails if none is responded to.
+func (c *Client) PingWithOptions(ctx context.Context, server string, opts *PingOptions) (res *PingResult, err error) {
+	o := PingOptions{Samples: defaultPingSamples, Interval: defaultPingInterval, Timeout: defaultPingTimeout}
+	if opts != nil {
+		if opts.Samples > 0 {
+			o.Samples = opts.Samples
+		}
+		if opts.Interval > 0 {
+			o.Interval = opts.Interval
+		}
+		if opts.Timeout > 0 {
+			o.Timeout = opts.Timeout
+		}
+	}
+	if server == "" {
+		if c.serverAddr == "" {
+			c.SetServerAddr(DefaultServerAddr)
+		}
+		server = c.serverAddr
+	}
+	ctx, span := startSpan(ctx, c.tracer, "STUN Ping")
+	defer func() {
+		span.SetAttribute("stun.server", server)
+		if res != nil {
+			span.SetAttribute("stun.sent", res.Sent)
+			span.SetAttribute("stun.responded", len(res.RTTs))
+			if len(res.RTTs) > 0 {
+				span.SetAttribute("stun.rtt", res.RTT)
+			}
+		}
+		span.End(err)
+	}()
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenUDP(c.iface)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	res = &PingResult{Server: server}
+	buf := make([]byte, maxPacketSize)
+	for i := 0; i < o.Samples; i++ {
+		if i > 0 {
+			timer := time.NewTimer(o.Interval)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			}
+		}
+		rtt, ok, err := c.pingOnce(ctx, conn, addr, buf, o.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		res.Sent++
+		if ok {
+			res.RTTs = append(res.RTTs, rtt)
+		}
+		c.logger.Debugln("Ping", server, ":", rtt, ok)
+	}
+	if len(res.RTTs) == 0 {
+		return res, errors.New("No response from the STUN server.")
+	}
+	res.summarize()
+	return res, nil
+}
+
+// pingOnce runs a Binding transaction to the address and returns its
+// round-trip time, or false if not responded to within the timeout.
+func (c *Client) pingOnce(ctx context.Context, conn net.PacketConn, addr net.Addr, buf []byte, timeout time.Duration) (time.Duration, bool, error) {
+	pkt, err := c.newBindingReq(false, false)
+	if err != nil {
+		return 0, false, err
+	}
+	resp, _, rtt, err := c.roundTrip(ctx, conn, addr, pkt, buf, timeout)
+	return rtt, resp != nil, err
+}
+
+// roundTrip sends pkt to the address once and returns the response of its
+// transaction ID with its source and the round-trip time, or nil if none
+// within the timeout. The other packets read are ignored.
+func (c *Client) roundTrip(ctx context.Context, conn net.PacketConn, addr net.Addr, pkt *packet, buf []byte, timeout time.Duration) (*packet, net.Addr, time.Duration, error) {
+	req := pkt.appendTo(buf[:0])
+	start := c.now()
+	if _, err := conn.WriteTo(req, addr); err != nil {
+		return nil, nil, 0, err
+	}
+	countExpvar(&expvars.requestsSent, 1)
+	c.capture.capture(req, conn.LocalAddr(), addr, c.logger)
+	end := start.Add(timeout)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, 0, err
+		}
+		deadline := end
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		n, from, err := conn.ReadFrom(buf)
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			if err := ctx.Err(); err != nil {
+				return nil, nil, 0, err
+			}
+			countExpvar(&expvars.timeouts, 1)
+			return nil, nil, 0, nil
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		rtt := c.now().Sub(start)
+		c.capture.capture(buf[:n], from, conn.LocalAddr(), c.logger)
+		p, err := newPacketFromBytes(buf[:n])
+		if err != nil {
+			countExpvar(&expvars.malformed, 1)
+			continue
+		}
+		if !bytes.Equal(p.transID, pkt.transID) {
+			continue
+		}
+		countExpvar(&expvars.responsesReceived, 1)
+		return p, from, rtt, nil
+	}
+}
+
+// summarize computes the statistics of the RTTs.
+func (r *PingResult) summarize() {
+	var sum, diffs time.Duration
+	r.Min, r.Max = r.RTTs[0], r.RTTs[0]
+	for i, rtt := range r.RTTs {
+		sum += rtt
+		if rtt < r.Min {
+			r.Min = rtt
+		}
+		if rtt > r.Max {
+			r.Max = rtt
+		}
+		if i > 0 {
+			d := rtt - r.RTTs[i-1]
+			if d < 0 {
+				d = -d
+			}
+			diffs += d
+		}
+	}
+	r.RTT = sum / time.Duration(len(r.RTTs))
+	if len(r.RTTs) > 1 {
+		r.Jitter = diffs / time.Duration(len(r.RTTs)-1)
+	}
+}
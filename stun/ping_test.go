@@ -0,0 +1,64 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	_, addr := newTestServer(t)
+	c := NewClient()
+	res, err := c.PingWithOptions(context.Background(), addr, &PingOptions{Samples: 3, Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Ping error: %v", err)
+	}
+	if res.Sent != 3 || len(res.RTTs) != 3 || res.Loss() != 0 {
+		t.Errorf("Ping error: %d sent, %d responded", res.Sent, len(res.RTTs))
+	}
+	if res.Min <= 0 || res.Min > res.RTT || res.RTT > res.Max {
+		t.Errorf("Ping error: RTT %v, min %v, max %v", res.RTT, res.Min, res.Max)
+	}
+	// A server not responding.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	res, err = c.PingWithOptions(context.Background(), conn.LocalAddr().String(), &PingOptions{Samples: 2, Interval: time.Millisecond, Timeout: 20 * time.Millisecond})
+	if err == nil {
+		t.Fatal("Ping error: expected no response")
+	}
+	if res.Sent != 2 || res.Loss() != 1 {
+		t.Errorf("Ping error: %d sent, loss %v", res.Sent, res.Loss())
+	}
+}
+
+func TestPingSummarize(t *testing.T) {
+	r := &PingResult{RTTs: []time.Duration{10, 30, 20, 40}}
+	r.summarize()
+	if r.RTT != 25 || r.Min != 10 || r.Max != 40 {
+		t.Errorf("summarize error: RTT %v, min %v, max %v", r.RTT, r.Min, r.Max)
+	}
+	// |30-10|, |20-30|, |40-20|
+	if r.Jitter != 16 {
+		t.Errorf("summarize error: jitter %v, expected 16", r.Jitter)
+	}
+}
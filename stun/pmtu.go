@@ -0,0 +1,129 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+)
+
+const (
+	minMTUIPv4       = 576
+	minMTUIPv6       = 1280
+	defaultMaxMTU    = 1500
+	ipv4HeaderSize   = 20
+	ipv6HeaderSize   = 40
+	udpHeaderSize    = 8
+	mtuProbeAttempts = 3
+)
+
+// DiscoverPathMTU probes the path to the STUN server with binding requests
+// padded by the PADDING attribute (RFC 5780 section 7.6) and sent with the DF
+// bit set. It returns the largest IP packet size, not exceeding maxMTU, for
+// which a response was received. A maxMTU of 0 means 1500 bytes. The DF bit
+// stays on the connection passed by NewClientWithConnection.
+func (c *Client) DiscoverPathMTU(maxMTU int) (int, error) {
+	if c.serverAddr == "" {
+		c.SetServerAddr(DefaultServerAddr)
+	}
+	serverUDPAddr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if err != nil {
+		return 0, err
+	}
+	conn := c.conn
+	if conn == nil {
+		conn, err = listenUDP(c.iface)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+	}
+	if maxMTU <= 0 {
+		maxMTU = defaultMaxMTU
+	}
+	return c.discoverPathMTU(conn, serverUDPAddr, maxMTU)
+}
+
+func (c *Client) discoverPathMTU(conn net.PacketConn, addr *net.UDPAddr, maxMTU int) (int, error) {
+	err := setDontFragment(conn, true)
+	if err != nil {
+		return 0, err
+	}
+	headerSize, minMTU := ipv4HeaderSize, minMTUIPv4
+	if addr.IP.To4() == nil {
+		headerSize, minMTU = ipv6HeaderSize, minMTUIPv6
+	}
+	if maxMTU < minMTU {
+		return 0, errors.New("Maximum MTU too small.")
+	}
+	// Probe sizes are multiples of 4 as STUN attributes are 4-byte aligned.
+	lo, hi := minMTU, maxMTU&^3
+	ok, err := c.probeMTU(conn, addr, hi, headerSize)
+	if err != nil || ok {
+		return hi, err
+	}
+	ok, err = c.probeMTU(conn, addr, lo, headerSize)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errors.New("No response to the smallest MTU probe.")
+	}
+	// Invariant: lo received a response and hi did not.
+	for hi-lo > 4 {
+		mid := (lo + (hi-lo)/2) &^ 3
+		ok, err = c.probeMTU(conn, addr, mid, headerSize)
+		if err != nil {
+			return lo, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// probeMTU sends a binding request padded to an IP packet of size bytes and
+// reports whether a response was received.
+func (c *Client) probeMTU(conn net.PacketConn, addr net.Addr, size int, headerSize int) (bool, error) {
+	pkt, err := newPacketRand(c.rand)
+	if err != nil {
+		return false, err
+	}
+	pkt.types = typeBindingRequest
+	pkt.addAttribute(*newSoftwareAttribute(c.softwareName))
+	// The remaining header, padding header and fingerprint.
+	pad := size - headerSize - udpHeaderSize - len(pkt.bytes()) - 4 - 8
+	if pad < 0 {
+		pad = 0
+	}
+	pkt.addAttribute(*newPaddingAttribute(pad))
+	pkt.addAttribute(*newFingerprintAttribute(pkt))
+	c.logger.Debugln("Probe MTU:", size)
+	resp, err := c.transmit(pkt, conn, addr, mtuProbeAttempts)
+	if isMessageSize(err) {
+		// Larger than the MTU of the local link or a cached path MTU.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	c.logger.Debugln("Received:", resp)
+	return resp != nil, nil
+}
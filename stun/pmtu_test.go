@@ -0,0 +1,65 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+)
+
+// newMTUServer starts a server dropping the requests of the IPv4 packets
+// larger than mtu, as if behind a link of that MTU, and returns a client
+// of it.
+func newMTUServer(t *testing.T, mtu int) *Client {
+	s, addr := newTestServer(t)
+	s.Use(func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			if ipv4HeaderSize+udpHeaderSize+len(r.raw) > mtu {
+				w.Drop()
+				return
+			}
+			next.ServeSTUN(w, r)
+		})
+	})
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(addr)
+	return c
+}
+
+func TestDiscoverPathMTU(t *testing.T) {
+	c := newMTUServer(t, 1030)
+	if mtu, err := c.DiscoverPathMTU(1500); err != nil || mtu != 1028 {
+		t.Errorf("DiscoverPathMTU error: expected 1028, get %d, %v", mtu, err)
+	}
+	// The probes larger than the local link fail with EMSGSIZE, as if not
+	// answered.
+	addr, _ := net.ResolveUDPAddr("udp", c.serverAddr)
+	if ok, err := c.probeMTU(c.conn, addr, 65540, ipv4HeaderSize); ok || err != nil {
+		t.Errorf("probeMTU error: expected no response over 64 KiB, get %v, %v", ok, err)
+	}
+	if _, err := c.DiscoverPathMTU(500); err == nil {
+		t.Error("DiscoverPathMTU error: expected error below the minimum MTU")
+	}
+	if _, err := newMTUServer(t, 500).DiscoverPathMTU(1500); err == nil {
+		t.Error("DiscoverPathMTU error: expected error without response")
+	}
+}
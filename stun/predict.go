@@ -0,0 +1,169 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+)
+
+// predictCount is the number of the ports predicted of a NAT allocating
+// them by a delta, which skip the ports taken by other clients meanwhile.
+const predictCount = 8
+
+// PortAllocation is how a NAT allocates the external ports of the mappings
+// to new destinations, as modeled by PredictPorts.
+type PortAllocation int
+
+// Port allocations.
+const (
+	// AllocationIndependent reuses the mapping for all the destinations,
+	// i.e. the mapping is endpoint-independent (RFC 4787 section 4.1).
+	AllocationIndependent PortAllocation = iota
+	// AllocationSequential allocates the next port for each mapping.
+	AllocationSequential
+	// AllocationDelta allocates the port of a constant delta from the
+	// previous one other than 1.
+	AllocationDelta
+	// AllocationRandom allocates the ports at random, unpredictably.
+	AllocationRandom
+)
+
+var allocationStr = map[PortAllocation]string{
+	AllocationIndependent: "independent",
+	AllocationSequential:  "sequential",
+	AllocationDelta:       "delta",
+	AllocationRandom:      "random",
+}
+
+func (a PortAllocation) String() string {
+	if s, ok := allocationStr[a]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler, so that the allocation
+// marshals to its name.
+func (a PortAllocation) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// PortPrediction is the model of the port allocation of a NAT, and the
+// external ports it is likely to allocate to the next mapping.
+type PortPrediction struct {
+	Allocation PortAllocation
+	// Delta is the delta between the ports of consecutive mappings, of
+	// AllocationSequential and AllocationDelta.
+	Delta int
+	// Mapped are the mapped addresses probed, in order.
+	Mapped []*Host
+	// Ports are the ports predicted, the most likely first: the port of
+	// all the mappings of AllocationIndependent, the next ones by Delta,
+	// or none of AllocationRandom.
+	Ports []int
+}
+
+// PredictPorts probes a binding against each of the STUN servers in order,
+// at least 3, from the same socket, and models the port allocation of the
+// NAT from the mapped ports, of which it predicts the ports of the next
+// mappings, e.g. of the mapping to the peer for hole punching through a
+// symmetric NAT.
+func (c *Client) PredictPorts(servers []string) (*PortPrediction, error) {
+	if len(servers) < 3 {
+		return nil, errors.New("At least 3 servers needed to predict ports.")
+	}
+	conn := c.conn
+	if conn == nil {
+		var err error
+		conn, err = listenUDP(c.iface)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+	}
+	p := &PortPrediction{}
+	for _, server := range servers {
+		addr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.test1(conn, addr)
+		if err != nil {
+			return nil, err
+		}
+		if resp == nil || resp.mappedAddr == nil {
+			return nil, errors.New("No mapped address from " + server + ".")
+		}
+		c.logger.Debugln("Port prediction mapped by", server, ":", resp.mappedAddr)
+		p.Mapped = append(p.Mapped, resp.mappedAddr)
+	}
+	ports := make([]int, len(p.Mapped))
+	for i, h := range p.Mapped {
+		ports[i] = int(h.Port())
+	}
+	p.Allocation, p.Delta = modelPorts(ports)
+	last := ports[len(ports)-1]
+	switch p.Allocation {
+	case AllocationIndependent:
+		p.Ports = []int{last}
+	case AllocationSequential, AllocationDelta:
+		for i := 1; i <= predictCount; i++ {
+			p.Ports = append(p.Ports, wrapPort(last+i*p.Delta))
+		}
+	}
+	return p, nil
+}
+
+// modelPorts returns the allocation of the ports mapped in order, and its
+// delta: the one of more than half of the consecutive ports, as other
+// clients of the NAT may take some ports meanwhile.
+func modelPorts(ports []int) (PortAllocation, int) {
+	deltas := make(map[int]int)
+	for i := 1; i < len(ports); i++ {
+		deltas[ports[i]-ports[i-1]]++
+	}
+	delta, n := 0, 0
+	for d, m := range deltas {
+		if m > n || m == n && abs(d) < abs(delta) {
+			delta, n = d, m
+		}
+	}
+	switch {
+	case 2*n <= len(ports)-1:
+		return AllocationRandom, 0
+	case delta == 0:
+		return AllocationIndependent, 0
+	case delta == 1:
+		return AllocationSequential, 1
+	}
+	return AllocationDelta, delta
+}
+
+// wrapPort returns the port p wrapped into the range of 1024 to 65535, of
+// the ports allocated by the NATs.
+func wrapPort(p int) int {
+	const low, n = 1024, 65536 - 1024
+	return low + ((p-low)%n+n)%n
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,71 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+)
+
+func TestModelPorts(t *testing.T) {
+	for _, tc := range []struct {
+		ports      []int
+		allocation PortAllocation
+		delta      int
+	}{
+		{[]int{4000, 4000, 4000}, AllocationIndependent, 0},
+		{[]int{4000, 4001, 4002, 4003}, AllocationSequential, 1},
+		// A port is taken by another client meanwhile.
+		{[]int{4000, 4001, 4003, 4004}, AllocationSequential, 1},
+		{[]int{4000, 4004, 4008}, AllocationDelta, 4},
+		{[]int{4000, 3998, 3996}, AllocationDelta, -2},
+		{[]int{4000, 31337, 1234, 60000}, AllocationRandom, 0},
+	} {
+		if a, d := modelPorts(tc.ports); a != tc.allocation || d != tc.delta {
+			t.Errorf("modelPorts error: %v, got %v %d, expected %v %d", tc.ports, a, d, tc.allocation, tc.delta)
+		}
+	}
+	if p := wrapPort(65535 + 2); p != 1025 {
+		t.Errorf("wrapPort error: %d", p)
+	}
+}
+
+func TestPredictPorts(t *testing.T) {
+	var servers []string
+	for i := 0; i < 3; i++ {
+		_, addr := newTestServer(t)
+		servers = append(servers, addr)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	if _, err := c.PredictPorts(servers[:2]); err == nil {
+		t.Errorf("PredictPorts error: expected error of 2 servers")
+	}
+	p, err := c.PredictPorts(servers)
+	if err != nil {
+		t.Fatalf("PredictPorts error: %v", err)
+	}
+	// Without NAT, the mapping is of the local address.
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if p.Allocation != AllocationIndependent || len(p.Mapped) != 3 || len(p.Ports) != 1 || p.Ports[0] != port {
+		t.Errorf("PredictPorts error: %+v, expected port %d", p, port)
+	}
+}
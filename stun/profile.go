@@ -0,0 +1,254 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultProfileMaxAge is the age of the cached profiles after which they
+// are discovered again.
+const defaultProfileMaxAge = 24 * time.Hour
+
+// NATProfile is the characteristics of the NAT of a network, as discovered.
+type NATProfile struct {
+	Type NATType `json:"type"`
+	// BindingLifetime is the time the NAT keeps an idle binding, or 0 if
+	// unknown, e.g. as measured by the application.
+	BindingLifetime time.Duration `json:"bindingLifetime,omitempty"`
+	// Hairpinning is whether the NAT loops back the packets of its hosts
+	// to the mapped addresses of each other (RFC 4787 section 6).
+	Hairpinning bool `json:"hairpinning"`
+	// Discovered is the time the profile was discovered.
+	Discovered time.Time `json:"discovered"`
+}
+
+// NATProfileCache is a cache of the NAT profiles of the networks, by the
+// key of NetworkKey, persisted to a file, so that the discovery is skipped
+// on a network known.
+type NATProfileCache struct {
+	path   string
+	maxAge time.Duration
+
+	mu       sync.Mutex
+	profiles map[string]NATProfile
+}
+
+// OpenNATProfileCache opens the cache persisted to the file at path, or
+// go-stun/nat-profiles.json in the user cache directory if empty, of the
+// profiles discovered within maxAge, a day if 0. A missing file is an
+// empty cache.
+func OpenNATProfileCache(path string, maxAge time.Duration) (*NATProfileCache, error) {
+	if path == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, "go-stun", "nat-profiles.json")
+	}
+	if maxAge <= 0 {
+		maxAge = defaultProfileMaxAge
+	}
+	c := &NATProfileCache{path: path, maxAge: maxAge, profiles: make(map[string]NATProfile)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.profiles); err != nil {
+		return nil, errors.New("Invalid NAT profile cache: " + err.Error())
+	}
+	return c, nil
+}
+
+// Get returns the profile of the network, unless missing or stale.
+func (c *NATProfileCache) Get(key string) (NATProfile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.profiles[key]
+	if !ok || time.Since(p.Discovered) > c.maxAge {
+		return NATProfile{}, false
+	}
+	return p, true
+}
+
+// Put caches the profile of the network, and persists the cache.
+func (c *NATProfileCache) Put(key string, p NATProfile) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.profiles[key] = p
+	return c.save()
+}
+
+// Delete removes the profile of the network, e.g. once the NAT is seen to
+// change, and persists the cache.
+func (c *NATProfileCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.profiles, key)
+	return c.save()
+}
+
+// save writes the profiles to a temporary file renamed over the file, so
+// that it is never seen partly written. The stale profiles are kept, of
+// the binding lifetimes measured. It is called with c.mu held.
+func (c *NATProfileCache) save() error {
+	data, err := json.MarshalIndent(c.profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(c.path), ".nat-profiles-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
+
+// NetworkKey returns the key of the network the host is on: the hardware
+// address of the default gateway if known, as "mac:" followed by it, or the
+// subnet of the local address of the route to the gateway, as "subnet:"
+// followed by it.
+func NetworkKey() (string, error) {
+	gw, err := defaultGateway()
+	if err != nil {
+		return "", err
+	}
+	if mac, err := gatewayMAC(gw); err == nil {
+		return "mac:" + mac.String(), nil
+	}
+	local, err := localAddrTo(&net.UDPAddr{IP: gw, Port: natpmpPort})
+	if err != nil {
+		return "", err
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(net.IP(local.AsSlice())) {
+				subnet := net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}
+				return "subnet:" + subnet.String(), nil
+			}
+		}
+	}
+	return "", errors.New("No subnet of the gateway.")
+}
+
+// DiscoverProfile returns the profile of the NAT of the network of the
+// key, as cached unless missing or stale, or discovered by Discover and a
+// hairpinning test, and cached, otherwise, of the binding lifetime of the
+// profile before if any. An empty key is of NetworkKey. The cached profile
+// is reported by cached.
+func (c *Client) DiscoverProfile(cache *NATProfileCache, key string) (p NATProfile, cached bool, err error) {
+	if key == "" {
+		if key, err = NetworkKey(); err != nil {
+			return NATProfile{}, false, err
+		}
+	}
+	if p, ok := cache.Get(key); ok {
+		c.logger.Debugln("NAT profile cached of", key)
+		return p, true, nil
+	}
+	if c.serverAddr == "" {
+		c.SetServerAddr(DefaultServerAddr)
+	}
+	serverUDPAddr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if err != nil {
+		return NATProfile{}, false, err
+	}
+	conn := c.conn
+	if conn == nil {
+		conn, err = listenUDP(c.iface)
+		if err != nil {
+			return NATProfile{}, false, err
+		}
+		defer conn.Close()
+	}
+	nat, host, err := c.discover(conn, serverUDPAddr)
+	if err != nil {
+		return NATProfile{}, false, err
+	}
+	p = NATProfile{Type: nat, Discovered: time.Now()}
+	if host != nil {
+		p.Hairpinning = hairpinning(conn, host, c.iface)
+	}
+	// The binding lifetime measured before is kept.
+	cache.mu.Lock()
+	p.BindingLifetime = cache.profiles[key].BindingLifetime
+	cache.mu.Unlock()
+	return p, false, cache.Put(key, p)
+}
+
+// hairpinning tests whether the packets of another socket, bound to the
+// interface iface if not empty, to the mapped address of conn loop back to
+// conn through the NAT.
+func hairpinning(conn net.PacketConn, mapped *Host, iface string) bool {
+	other, err := listenUDP(iface)
+	if err != nil {
+		return false
+	}
+	defer other.Close()
+	defer conn.SetReadDeadline(time.Time{})
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return false
+	}
+	to := net.UDPAddrFromAddrPort(mapped.AddrPort())
+	buf := make([]byte, maxPacketSize)
+	for i := 0; i < 3; i++ {
+		if _, err := other.WriteTo(token, to); err != nil {
+			return false
+		}
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if string(buf[:n]) == string(token) {
+				return true
+			}
+		}
+	}
+	return false
+}
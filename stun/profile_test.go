@@ -0,0 +1,98 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNATProfileCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache", "profiles.json")
+	c, err := OpenNATProfileCache(path, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenNATProfileCache error: %v", err)
+	}
+	p := NATProfile{Type: NATPortRestricted, BindingLifetime: 2 * time.Minute, Hairpinning: true, Discovered: time.Now()}
+	if err := c.Put("mac:00:11:22:33:44:55", p); err != nil {
+		t.Fatalf("Put error: %v", err)
+	}
+	if err := c.Put("subnet:10.0.0.0/8", NATProfile{Type: NATFull, Discovered: time.Now().Add(-2 * time.Hour)}); err != nil {
+		t.Fatalf("Put error: %v", err)
+	}
+	// The profiles are persisted.
+	c, err = OpenNATProfileCache(path, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenNATProfileCache error: %v", err)
+	}
+	got, ok := c.Get("mac:00:11:22:33:44:55")
+	if !ok || got.Type != p.Type || got.BindingLifetime != p.BindingLifetime || !got.Hairpinning || !got.Discovered.Equal(p.Discovered) {
+		t.Errorf("Get error: %+v, expected %+v", got, p)
+	}
+	if _, ok := c.Get("subnet:10.0.0.0/8"); ok {
+		t.Errorf("Get error: stale profile cached")
+	}
+	if err := c.Delete("mac:00:11:22:33:44:55"); err != nil {
+		t.Fatalf("Delete error: %v", err)
+	}
+	if _, ok := c.Get("mac:00:11:22:33:44:55"); ok {
+		t.Errorf("Delete error: profile cached")
+	}
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenNATProfileCache(path, 0); err == nil {
+		t.Errorf("OpenNATProfileCache error: expected error of invalid file")
+	}
+}
+
+func TestDiscoverProfile(t *testing.T) {
+	conns, err := listenAlternate("127.0.0.1:0", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("listenAlternate: %v", err)
+	}
+	s := NewServer()
+	go s.ServeAlternate(conns)
+	defer s.Close()
+	cache, err := OpenNATProfileCache(filepath.Join(t.TempDir(), "profiles.json"), 0)
+	if err != nil {
+		t.Fatalf("OpenNATProfileCache error: %v", err)
+	}
+	cache.Put("test", NATProfile{BindingLifetime: time.Minute, Discovered: time.Now().Add(-48 * time.Hour)})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(conns[0][0].LocalAddr().String())
+	p, cached, err := c.DiscoverProfile(cache, "test")
+	if err != nil {
+		t.Fatalf("DiscoverProfile error: %v", err)
+	}
+	// Without NAT, the packets to the mapped address are of conn.
+	if cached || p.Type != NATNone || !p.Hairpinning || p.BindingLifetime != time.Minute {
+		t.Errorf("DiscoverProfile error: %+v, cached %v", p, cached)
+	}
+	again, cached, err := c.DiscoverProfile(cache, "test")
+	if err != nil || !cached || again.Type != p.Type || !again.Discovered.Equal(p.Discovered) {
+		t.Errorf("DiscoverProfile error: %+v, cached %v, %v", again, cached, err)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Defaults of PunchOptions.
+const (
+	defaultPunchBurst       = 3
+	defaultPunchInterval    = 50 * time.Millisecond
+	defaultPunchMaxInterval = time.Second
+)
+
+// PunchOptions are the options of PunchWithOptions. The zero values are
+// the defaults.
+type PunchOptions struct {
+	// Burst is the number of the Binding indications sent each round, 3 by
+	// default.
+	Burst int
+	// Interval is the time between the first rounds, 50ms by default,
+	// doubled each round up to MaxInterval, 1s by default.
+	Interval    time.Duration
+	MaxInterval time.Duration
+}
+
+// PunchResult is the hole punched by Punch.
+type PunchResult struct {
+	// Remote is the address the peer sends from, which is sent to once
+	// heard of, e.g. of another port than the remote address given behind
+	// a NAT of another mapping.
+	Remote *Host
+	// Mapped is the address the peer receives from, the local reflexive
+	// one unless of another mapping.
+	Mapped *Host
+	// Sent is the number of the Binding indications sent.
+	Sent int
+}
+
+// Punch punches a hole through the NATs between conn and the peer at the
+// remote address, as PunchWithOptions with the default options.
+func Punch(ctx context.Context, conn net.PacketConn, localReflexive, remoteAddr *Host) (*PunchResult, error) {
+	return PunchWithOptions(ctx, conn, localReflexive, remoteAddr, nil)
+}
+
+// PunchWithOptions punches a hole through the NATs between conn and the
+// peer at the remote address, as signaled with the local reflexive address
+// of conn, e.g. discovered by a Binding request, while the peer punches
+// back at the same time. Both send bursts of Binding indications, which
+// carry the address they are heard from once the peer is heard of, until
+// the peer hears back, i.e. the reachability is confirmed both ways, or
+// ctx is done. The peer is then sent a last burst to confirm its side. The
+// local reflexive address is carried in XOR-MAPPED-ADDRESS unless nil.
+// The conn is not to be read from meanwhile, and the other packets read
+// are dropped.
+func PunchWithOptions(ctx context.Context, conn net.PacketConn, localReflexive, remoteAddr *Host, opts *PunchOptions) (*PunchResult, error) {
+	o := PunchOptions{Burst: defaultPunchBurst, Interval: defaultPunchInterval, MaxInterval: defaultPunchMaxInterval}
+	if opts != nil {
+		if opts.Burst > 0 {
+			o.Burst = opts.Burst
+		}
+		if opts.Interval > 0 {
+			o.Interval = opts.Interval
+		}
+		if opts.MaxInterval > 0 {
+			o.MaxInterval = opts.MaxInterval
+		}
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	res := &PunchResult{}
+	var heard *Host // the address the peer is heard from
+	to := remoteAddr
+	interval := o.Interval
+	buf := make([]byte, maxPacketSize)
+	for {
+		for i := 0; i < o.Burst; i++ {
+			b, err := newPunchIndication(localReflexive, heard)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := conn.WriteTo(b, net.UDPAddrFromAddrPort(to.AddrPort())); err != nil {
+				return nil, err
+			}
+			res.Sent++
+		}
+		if res.Mapped != nil {
+			res.Remote = heard
+			return res, nil
+		}
+		end := time.Now().Add(interval)
+		for res.Mapped == nil && time.Now().Before(end) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			deadline := end
+			if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+				deadline = d
+			}
+			conn.SetReadDeadline(deadline)
+			n, addr, err := conn.ReadFrom(buf)
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			from := hostFromAddr(addr)
+			if from == nil || from.Addr() != remoteAddr.Addr() {
+				continue
+			}
+			m, err := ParseMessage(buf[:n])
+			if err != nil || m.Type() != TypeBindingIndication {
+				continue
+			}
+			heard, to = from, from
+			res.Mapped = m.pkt.getXorAddr(attributeXorPeerAddress)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if interval *= 2; interval > o.MaxInterval {
+			interval = o.MaxInterval
+		}
+	}
+}
+
+// newPunchIndication returns a Binding indication of Punch, of the local
+// reflexive address in XOR-MAPPED-ADDRESS and of the address the peer is
+// heard from in XOR-PEER-ADDRESS, unless nil.
+func newPunchIndication(localReflexive, heard *Host) ([]byte, error) {
+	m, err := NewMessage(TypeBindingIndication)
+	if err != nil {
+		return nil, err
+	}
+	if localReflexive != nil {
+		m.AddXorAddress(attributeXorMappedAddress, localReflexive)
+	}
+	if heard != nil {
+		m.AddXorAddress(attributeXorPeerAddress, heard)
+	}
+	return m.Encode(nil), nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPunch(t *testing.T) {
+	var conns [2]net.PacketConn
+	var hosts [2]*Host
+	for i := range conns {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i], hosts[i] = conn, hostFromAddr(conn.LocalAddr())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	type result struct {
+		res *PunchResult
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		// The peer starts punching later, as the first bursts are lost
+		// to the NATs.
+		time.Sleep(100 * time.Millisecond)
+		res, err := Punch(ctx, conns[1], hosts[1], hosts[0])
+		results <- result{res, err}
+	}()
+	res, err := PunchWithOptions(ctx, conns[0], hosts[0], hosts[1], &PunchOptions{Burst: 2, Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Punch error: %v", err)
+	}
+	if res.Remote.String() != hosts[1].String() || res.Mapped.String() != hosts[0].String() || res.Sent < 4 {
+		t.Errorf("Punch error: %+v", res)
+	}
+	r := <-results
+	if r.err != nil || r.res.Remote.String() != hosts[0].String() || r.res.Mapped.String() != hosts[1].String() {
+		t.Errorf("Punch error: peer %+v, %v", r.res, r.err)
+	}
+
+	// Without the peer, punching lasts until ctx is done.
+	silent, err := net.ListenPacket("udp4", "127.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := Punch(ctx, conns[0], hosts[0], hostFromAddr(silent.LocalAddr())); err != context.DeadlineExceeded {
+		t.Errorf("Punch error: expected DeadlineExceeded, get %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of sources tracked by the rate limiter, which bounds
+	// its memory under floods of spoofed sources.
+	maxRateLimitSources = 1 << 16
+	rateLimitSweep      = time.Minute
+)
+
+// DropPolicy selects the requests which the server drops silently instead of
+// answering with an error response, so that error responses cannot be
+// reflected to spoofed sources. Policies can be combined with |.
+type DropPolicy int
+
+// Drop policies.
+const (
+	// DropMalformed drops the requests which would be answered with 400
+	// Bad Request or 420 Unknown Attribute.
+	DropMalformed DropPolicy = 1 << iota
+	// DropUnauthorized drops the requests with wrong credentials. The
+	// requests without credentials are still challenged.
+	DropUnauthorized
+	// DropLegacy drops the RFC 3489 requests, which do not carry the magic
+	// cookie and are hard to tell from other traffic.
+	DropLegacy
+)
+
+// rateLimiter is a token bucket rate limiter per source IP.
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[netip.Addr]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[netip.Addr]*bucket),
+	}
+}
+
+// same reports whether the limiter has the given rate and burst.
+func (r *rateLimiter) same(rate float64, burst int) bool {
+	if burst < 1 {
+		burst = 1
+	}
+	return r.rate == rate && r.burst == float64(burst)
+}
+
+// allow reports whether a request from ip can be served at now. The table
+// of the sources is swept at most once per rateLimitSweep, and the new
+// sources are refused without a sweep while it is full, so that a flood of
+// spoofed sources costs no more than a lookup per packet.
+func (r *rateLimiter) allow(ip netip.Addr, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.lastSweep) > rateLimitSweep {
+		r.sweep(now)
+	}
+	b, ok := r.buckets[ip]
+	if !ok {
+		if len(r.buckets) >= maxRateLimitSources {
+			// Too many active sources, refuse the new ones until the
+			// next sweep.
+			return false
+		}
+		b = &bucket{r.burst, now}
+		r.buckets[ip] = b
+	}
+	return b.take(1, r.rate, r.burst, now)
+}
+
+// take refills the bucket at rate up to burst, and takes n tokens if there
+// are enough.
+func (b *bucket) take(n, rate, burst float64, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// sweep forgets the sources whose buckets have refilled, which are the same
+// as new ones.
+func (r *rateLimiter) sweep(now time.Time) {
+	r.lastSweep = now
+	for ip, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, ip)
+		}
+	}
+}
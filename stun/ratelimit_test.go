@@ -0,0 +1,82 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(1, 2)
+	ip := netip.MustParseAddr("192.0.2.1")
+	now := time.Now()
+	if !r.allow(ip, now) || !r.allow(ip, now) {
+		t.Errorf("allow error: burst refused")
+	}
+	if r.allow(ip, now) {
+		t.Errorf("allow error: over the limit")
+	}
+	if !r.allow(netip.MustParseAddr("192.0.2.2"), now) {
+		t.Errorf("allow error: other source refused")
+	}
+	if !r.allow(ip, now.Add(time.Second)) {
+		t.Errorf("allow error: not refilled")
+	}
+	r.sweep(now.Add(time.Hour))
+	if len(r.buckets) != 0 {
+		t.Errorf("sweep error: %d sources left", len(r.buckets))
+	}
+
+	// Once full, the new sources are refused until the next sweep.
+	for i := 0; len(r.buckets) < maxRateLimitSources; i++ {
+		r.buckets[netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})] = &bucket{r.burst, now}
+	}
+	if r.allow(ip, now.Add(time.Hour+time.Second)) || len(r.buckets) != maxRateLimitSources {
+		t.Errorf("allow error: new source accepted when full")
+	}
+	if !r.allow(ip, now.Add(time.Hour+rateLimitSweep+time.Second)) || len(r.buckets) != 1 {
+		t.Errorf("allow error: new source refused after the sweep, %d sources", len(r.buckets))
+	}
+}
+
+func TestServerPolicies(t *testing.T) {
+	s := NewServer()
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5678}
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	s.SetMaxAmplification(3)
+	b, _, _ := s.handle(req.bytes(), addr, &listener{}, time.Now())
+	if b == nil || len(b) > 60 {
+		t.Errorf("handle error: response of %d bytes", len(b))
+	}
+	s.SetMaxAmplification(1)
+	if b, _, _ = s.handle(req.bytes(), addr, &listener{}, time.Now()); b != nil {
+		t.Errorf("handle error: amplified response sent")
+	}
+	s.SetMaxAmplification(0)
+	req.types = typeAllocate
+	if b, _, _ = s.handle(req.bytes(), addr, &listener{}, time.Now()); b == nil {
+		t.Errorf("handle error: no error response")
+	}
+	s.SetDropPolicy(DropMalformed)
+	if b, _, _ = s.handle(req.bytes(), addr, &listener{}, time.Now()); b != nil {
+		t.Errorf("handle error: error response not dropped")
+	}
+}
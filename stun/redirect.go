@@ -0,0 +1,97 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// Redirector chooses the server to redirect a request to with the 300 Try
+// Alternate error and the ALTERNATE-SERVER attribute (RFC 5389 section
+// 11), e.g. to shed load or steer the clients by region.
+type Redirector interface {
+	// Redirect returns the alternate server of the request, and false if
+	// the request shall be served.
+	Redirect(r *Request) (*Host, bool)
+}
+
+// RedirectorFunc is an adapter to use an ordinary function as a Redirector.
+type RedirectorFunc func(r *Request) (*Host, bool)
+
+// Redirect calls f(r).
+func (f RedirectorFunc) Redirect(r *Request) (*Host, bool) {
+	return f(r)
+}
+
+// RealmRedirector redirects the requests by their REALM attribute, mapping
+// realms to alternate servers.
+type RealmRedirector map[string]*Host
+
+// Redirect returns the server of the realm of the request.
+func (m RealmRedirector) Redirect(r *Request) (*Host, bool) {
+	v, ok := r.Attribute(attributeRealm)
+	if !ok {
+		return nil, false
+	}
+	host, ok := m[string(v)]
+	return host, ok && host != nil
+}
+
+// loadRedirector redirects the requests over a rate to alternate servers in
+// turn.
+type loadRedirector struct {
+	limiter    *rateLimiter
+	alternates []*Host
+	next       atomic.Uint32
+}
+
+// NewLoadRedirector returns a redirector serving up to rate requests per
+// second, with bursts of up to burst requests, and redirecting the others to
+// the alternates in turn.
+func NewLoadRedirector(rate float64, burst int, alternates ...*Host) Redirector {
+	return &loadRedirector{
+		limiter:    newRateLimiter(rate, burst),
+		alternates: alternates,
+	}
+}
+
+func (l *loadRedirector) Redirect(r *Request) (*Host, bool) {
+	// All the requests share the bucket of the zero address.
+	if len(l.alternates) == 0 || l.limiter.allow(netip.Addr{}, time.Now()) {
+		return nil, false
+	}
+	i := l.next.Add(1) % uint32(len(l.alternates))
+	return l.alternates[i], true
+}
+
+// redirectMiddleware returns the handler answering the requests redirected
+// by rd with 300 Try Alternate, and passing the others to next.
+func redirectMiddleware(rd Redirector, next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		// RFC 3489 clients do not know ALTERNATE-SERVER.
+		if !r.w.req.isLegacy() {
+			if host, ok := rd.Redirect(r); ok {
+				w.Error(errorTryAlternate, "")
+				r.w.resp.addAttribute(*newAddrAttribute(attributeAlternateServer, host))
+				return
+			}
+		}
+		next.ServeSTUN(w, r)
+	})
+}
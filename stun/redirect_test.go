@@ -0,0 +1,53 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestServerRedirect(t *testing.T) {
+	s := NewServer()
+	alternate := NewHost(netip.MustParseAddrPort("192.0.2.10:3478"))
+	s.SetRedirector(NewLoadRedirector(1, 1, alternate))
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5678}
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	for i, code := range []int{0, errorTryAlternate} {
+		b, _, _ := s.handle(req.bytes(), addr, &listener{}, time.Now())
+		resp, err := newPacketFromBytes(b)
+		if err != nil || resp.getErrorCode() != code {
+			t.Fatalf("handle error: request %d, response %v %v", i, resp, err)
+		}
+		if code == 0 {
+			continue
+		}
+		a := resp.getAttribute(attributeAlternateServer)
+		if a == nil || a.rawAddr().String() != "192.0.2.10:3478" {
+			t.Errorf("handle error: alternate server %v", a)
+		}
+	}
+	s.SetRedirector(RealmRedirector{"eu.example.org": alternate})
+	req.addAttribute(*newAttribute(attributeRealm, []byte("eu.example.org")))
+	b, _, _ := s.handle(req.bytes(), addr, &listener{}, time.Now())
+	if resp, err := newPacketFromBytes(b); err != nil || resp.getErrorCode() != errorTryAlternate {
+		t.Errorf("handle error: realm not redirected")
+	}
+}
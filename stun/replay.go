@@ -0,0 +1,231 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// replayResponse is a response recorded in reply to a request.
+type replayResponse struct {
+	from netip.AddrPort
+	pkt  *packet
+}
+
+// replayTransaction is a transaction recorded, of the first request of its
+// transaction ID and the responses to it.
+type replayTransaction struct {
+	dst        netip.AddrPort
+	changeIP   bool
+	changePort bool
+	responses  []replayResponse
+	used       bool
+}
+
+// ReplayConn is a net.PacketConn replaying the STUN transactions of a pcap
+// file, e.g. of a discovery of go-stun discover -capture, to reproduce the
+// classification of a network without access to it. Each request written
+// is answered with the responses recorded to the next request unanswered of
+// the same destination and CHANGE-REQUEST, rewritten to its transaction ID,
+// or of the same CHANGE-REQUEST only if none; the reads time out at once if
+// no response is left, as of the responses lost. The ICMP errors are not
+// recorded, and a discovery failing of one is replayed as of no response.
+//
+// Its local address is the address of the client recorded. If it is the
+// unspecified one, of a socket bound to all the interfaces, the mapped
+// addresses are compared to the addresses of the interfaces of the host of
+// the replay to tell a NAT, so a discovery without a NAT is replayed as such
+// on the host of the capture only.
+type ReplayConn struct {
+	mu      sync.Mutex
+	local   netip.AddrPort
+	txs     []*replayTransaction
+	bound   map[string]bool // the transaction IDs of the requests replayed
+	queue   []replayResponse
+	closed  bool
+	servers []netip.AddrPort
+}
+
+// NewReplayConn reads the pcap file of r and returns the connection
+// replaying it, or an error if it records no STUN request.
+func NewReplayConn(r io.Reader) (*ReplayConn, error) {
+	pr, err := NewPcapReader(r)
+	if err != nil {
+		return nil, err
+	}
+	c := &ReplayConn{bound: make(map[string]bool)}
+	byID := make(map[string]*replayTransaction)
+	for {
+		p, err := pr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		pkt, err := newPacketFromBytes(p.Payload)
+		if err != nil {
+			continue
+		}
+		id := string(pkt.transID)
+		src, dst := unmapAddrPort(p.Src), unmapAddrPort(p.Dst)
+		if pkt.types&classMask == classRequest {
+			if _, ok := byID[id]; ok {
+				continue // retransmitted
+			}
+			tx := &replayTransaction{dst: dst}
+			tx.changeIP, tx.changePort, _ = pkt.getChangeRequest()
+			byID[id] = tx
+			c.txs = append(c.txs, tx)
+			if !c.local.IsValid() {
+				c.local = src
+			}
+			if len(c.servers) == 0 || c.servers[len(c.servers)-1] != dst {
+				c.servers = append(c.servers, dst)
+			}
+			continue
+		}
+		if tx, ok := byID[id]; ok {
+			tx.responses = append(tx.responses, replayResponse{src, pkt})
+		}
+	}
+	if len(c.txs) == 0 {
+		return nil, errors.New("No STUN request in the capture.")
+	}
+	return c, nil
+}
+
+// ServerAddr returns the address of the STUN server of the first request
+// recorded, to replay the discovery of.
+func (c *ReplayConn) ServerAddr() string {
+	return c.servers[0].String()
+}
+
+// WriteTo replays the request b to addr.
+func (c *ReplayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	pkt, err := newPacketFromBytes(b)
+	if err != nil || pkt.types&classMask != classRequest {
+		return len(b), nil
+	}
+	id := string(pkt.transID)
+	if c.bound[id] {
+		return len(b), nil
+	}
+	c.bound[id] = true
+	changeIP, changePort, _ := pkt.getChangeRequest()
+	dst := pcapAddr(addr)
+	var match *replayTransaction
+	for _, tx := range c.txs {
+		if tx.used || tx.changeIP != changeIP || tx.changePort != changePort {
+			continue
+		}
+		if tx.dst == dst {
+			match = tx
+			break
+		}
+		if match == nil {
+			match = tx
+		}
+	}
+	if match == nil {
+		return len(b), nil
+	}
+	match.used = true
+	for _, r := range match.responses {
+		c.queue = append(c.queue, replayResponse{r.from, retransact(r.pkt, pkt.transID)})
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads the next response queued, or fails of a timeout at once if
+// none.
+func (c *ReplayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, nil, net.ErrClosed
+	}
+	if len(c.queue) == 0 {
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+	r := c.queue[0]
+	c.queue = c.queue[1:]
+	n := copy(b, r.pkt.bytes())
+	return n, net.UDPAddrFromAddrPort(r.from), nil
+}
+
+// Close closes the connection.
+func (c *ReplayConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// LocalAddr returns the address of the client recorded.
+func (c *ReplayConn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.local)
+}
+
+// SetDeadline has no effect, the reads failing at once if no response is
+// left.
+func (c *ReplayConn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline has no effect.
+func (c *ReplayConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline has no effect.
+func (c *ReplayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// retransact returns the response p of the transaction ID transID, of the
+// XOR addresses re-encoded and the FINGERPRINT computed again. The
+// MESSAGE-INTEGRITY, if any, is not valid anymore.
+func retransact(p *packet, transID []byte) *packet {
+	q := newResponsePacket(&packet{transID: transID}, p.types)
+	for _, a := range p.attributes {
+		switch a.types {
+		case attributeXorMappedAddress, attributeXorMappedAddressExp,
+			attributeXorPeerAddress, attributeXorRelayedAddress:
+			if a.length >= 8 {
+				h := a.xorAddr(p.transID)
+				q.addAttribute(*newXorAddrAttribute(a.types, h, transID))
+				continue
+			}
+		case attributeFingerprint:
+			q.addAttribute(*newFingerprintAttribute(q))
+			continue
+		}
+		q.addAttribute(a)
+	}
+	return q
+}
+
+// unmapAddrPort returns addr of the IPv4 address mapped to IPv6 unmapped.
+func unmapAddrPort(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
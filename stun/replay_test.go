@@ -0,0 +1,120 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestReplayConn(t *testing.T) {
+	conns, err := listenAlternate("127.0.0.1:0", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("listenAlternate: %v", err)
+	}
+	s := NewServer()
+	go s.ServeAlternate(conns)
+	defer s.Close()
+	var capture bytes.Buffer
+	p, err := NewPcapWriter(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient()
+	c.SetServerAddr(conns[0][0].LocalAddr().String())
+	c.SetCapture(p)
+	nat, host, err := c.Discover()
+	if err != nil {
+		t.Fatalf("Discover error: %v", err)
+	}
+	s.Close()
+
+	rc, err := NewReplayConn(bytes.NewReader(capture.Bytes()))
+	if err != nil {
+		t.Fatalf("NewReplayConn error: %v", err)
+	}
+	if rc.ServerAddr() != conns[0][0].LocalAddr().String() {
+		t.Errorf("ServerAddr error: %v", rc.ServerAddr())
+	}
+	rc2 := NewClientWithConnection(rc)
+	rc2.SetServerAddr(rc.ServerAddr())
+	replayed, replayedHost, err := rc2.Discover()
+	if err != nil {
+		t.Fatalf("Discover error of the replay: %v", err)
+	}
+	if replayed != nat || replayedHost.String() != host.String() {
+		t.Errorf("Discover error of the replay: %v %v, expected %v %v", replayed, replayedHost, nat, host)
+	}
+}
+
+func TestReplayBlocked(t *testing.T) {
+	client := netip.MustParseAddrPort("192.0.2.1:5000")
+	server := netip.MustParseAddrPort("198.51.100.1:3478")
+	tls := netip.MustParseAddrPort("198.51.100.1:5349")
+	for _, reached := range []bool{false, true} {
+		var capture bytes.Buffer
+		p, err := NewPcapWriter(&capture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := newPacket()
+		req.types = typeBindingRequest
+		p.WriteMessage(time.Now(), client, server, req.bytes())
+		if reached {
+			req, _ = newPacket()
+			req.types = typeBindingRequest
+			resp := newResponsePacket(req, typeBindingResponse)
+			resp.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, newHost(client), resp.transID))
+			p.WriteMessage(time.Now(), client, tls, req.bytes())
+			p.WriteMessage(time.Now(), tls, client, resp.bytes())
+		}
+		rc, err := NewReplayConn(&capture)
+		if err != nil {
+			t.Fatalf("NewReplayConn error: %v", err)
+		}
+		c := NewClientWithConnection(rc)
+		c.SetServerAddr(rc.ServerAddr())
+		want := NATUnreachable
+		if reached {
+			want = NATBlocked
+		}
+		if nat, _, err := c.Discover(); err != nil || nat != want {
+			t.Errorf("Discover error: %v %v, expected %v", nat, err, want)
+		}
+	}
+}
+
+func TestRetransact(t *testing.T) {
+	req, _ := newPacket()
+	resp := newResponsePacket(req, typeBindingResponse)
+	mapped := newHost(netip.MustParseAddrPort("[2001:db8::1]:5000"))
+	resp.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, mapped, resp.transID))
+	resp.addAttribute(*newFingerprintAttribute(resp))
+	other, _ := newPacket()
+	q := retransact(resp, other.transID)
+	if !bytes.Equal(q.transID, other.transID) {
+		t.Fatalf("retransact error: transaction ID %x", q.transID)
+	}
+	if got := q.getXorMappedAddr(); got.String() != mapped.String() {
+		t.Errorf("retransact error: mapped %v, expected %v", got, mapped)
+	}
+	if b := q.bytes(); !checkFingerprint(b) {
+		t.Errorf("retransact error: fingerprint of %x", b)
+	}
+}
@@ -47,18 +47,8 @@ func newResponse(pkt *packet, conn net.PacketConn) *response {
 		mappedAddrStr := mappedAddr.String()
 		resp.identical = isLocalAddress(localAddrStr, mappedAddrStr)
 	}
-	// compute changedAddr
-	changedAddr := pkt.getChangedAddr()
-	if changedAddr != nil {
-		changedAddrHost := newHostFromStr(changedAddr.String())
-		resp.changedAddr = changedAddrHost
-	}
-	// compute otherAddr
-	otherAddr := pkt.getOtherAddr()
-	if otherAddr != nil {
-		otherAddrHost := newHostFromStr(otherAddr.String())
-		resp.otherAddr = otherAddrHost
-	}
+	resp.changedAddr = pkt.getChangedAddr()
+	resp.otherAddr = pkt.getOtherAddr()
 
 	return resp
 }
@@ -0,0 +1,66 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RESTCredentials returns the time-limited TURN credentials of the user,
+// valid for ttl, which are shared with the TURN server through secret as in
+// the TURN REST API of WebRTC deployments and coturn's use-auth-secret: the
+// username is the expiry time and the user ID separated by a colon, and the
+// password is the base64 HMAC-SHA1 of the username keyed by the secret. An
+// application server typically hands them out to its clients.
+func RESTCredentials(secret, userID string, ttl time.Duration) (username, password string) {
+	username = strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	if userID != "" {
+		username += ":" + userID
+	}
+	return username, restPassword(secret, username)
+}
+
+func restPassword(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// RESTCredentialStore is a CredentialStore of the credentials given by
+// RESTCredentials with the shared secret. The expired usernames are
+// rejected.
+type RESTCredentialStore string
+
+// Key returns the key of the user in the realm if the username has not
+// expired.
+func (secret RESTCredentialStore) Key(username, realm string) ([]byte, bool) {
+	ts, _, _ := strings.Cut(username, ":")
+	expiry, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Now().Unix() >= expiry {
+		return nil, false
+	}
+	password := restPassword(string(secret), username)
+	if realm == "" {
+		return ShortTermKey(password), true
+	}
+	return LongTermKey(username, realm, password), true
+}
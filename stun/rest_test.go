@@ -0,0 +1,42 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRESTCredentials(t *testing.T) {
+	store := RESTCredentialStore("secret")
+	username, password := RESTCredentials("secret", "alice", time.Hour)
+	key, ok := store.Key(username, "example.org")
+	if !ok || !bytes.Equal(key, LongTermKey(username, "example.org", password)) {
+		t.Errorf("Key error: valid credentials refused")
+	}
+	if key, _ = RESTCredentialStore("other").Key(username, "example.org"); bytes.Equal(key, LongTermKey(username, "example.org", password)) {
+		t.Errorf("Key error: key independent of the secret")
+	}
+	username, _ = RESTCredentials("secret", "alice", -time.Second)
+	if _, ok := store.Key(username, "example.org"); ok {
+		t.Errorf("Key error: expired credentials accepted")
+	}
+	if _, ok := store.Key("alice", "example.org"); ok {
+		t.Errorf("Key error: invalid username accepted")
+	}
+}
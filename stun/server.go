@@ -0,0 +1,993 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after the server
+// is closed.
+var ErrServerClosed = errors.New("Server closed.")
+
+// Server is a STUN server answering binding requests, which can be embedded
+// in other programs. RFC 5389 clients get the XOR-MAPPED-ADDRESS, while RFC
+// 3489 clients, which do not send the magic cookie, get the MAPPED-ADDRESS.
+// Handle and Use add custom methods and processing of the requests.
+type Server struct {
+	logger   *Logger
+	stats    *serverStats
+	traffic  *trafficStats
+	observer ServerObserver
+	capture  *PcapWriter
+	mux      serveMux
+	workers  int
+	relay    *TURNServer
+
+	cfgMu sync.Mutex // serializes the updates of cfg
+	cfg   atomic.Pointer[settings]
+
+	mu         sync.Mutex
+	conns      map[net.PacketConn]struct{}
+	listeners  map[net.Listener]struct{}
+	wg         sync.WaitGroup
+	inflight   sync.WaitGroup
+	closed     bool
+	onShutdown []func()
+}
+
+// settings are the settings of a server which can be changed while serving.
+// They are replaced as a whole, so that each request sees consistent ones.
+type settings struct {
+	softwareName string
+	auth         *serverAuth
+	requireFP    bool
+	limiter      *rateLimiter
+	amplify      float64
+	dropPolicy   DropPolicy
+	acl          *ACL
+	redirector   Redirector
+	clock        Clock
+	rand         io.Reader
+	middlewares  []Middleware
+	handler      Handler // chain of the middlewares and the handlers
+}
+
+// NewServer returns a server without network connection. Call Serve or
+// ListenAndServe to start serving.
+func NewServer() *Server {
+	s := new(Server)
+	s.logger = NewLogger()
+	s.conns = make(map[net.PacketConn]struct{})
+	s.listeners = make(map[net.Listener]struct{})
+	s.stats = newServerStats()
+	s.traffic = newTrafficStats()
+	s.mux = serveMux{typeBindingRequest: HandlerFunc(s.serveBinding)}
+	s.update(func(c *settings) {
+		c.softwareName = DefaultSoftwareName
+	})
+	return s
+}
+
+// update changes the settings with f.
+func (s *Server) update(f func(c *settings)) {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+	var c settings
+	if old := s.cfg.Load(); old != nil {
+		c = *old
+	}
+	f(&c)
+	c.handler = s.chain(&c)
+	s.cfg.Store(&c)
+}
+
+// SetVerbose sets the server to be in the verbose mode, which prints the
+// requests served.
+func (s *Server) SetVerbose(v bool) {
+	s.logger.SetDebug(v)
+}
+
+// SetVVerbose sets the server to be in the double verbose mode, which also
+// prints the requests decoded. SetCapture writes the messages to a pcap
+// file instead.
+func (s *Server) SetVVerbose(v bool) {
+	s.logger.SetInfo(v)
+}
+
+// SetSoftwareName sets the SOFTWARE attribute of the responses. An empty
+// name omits the attribute.
+func (s *Server) SetSoftwareName(name string) {
+	s.update(func(c *settings) {
+		c.softwareName = name
+	})
+}
+
+// SetAuth requires the clients to authenticate with the long-term
+// credentials of store in realm (RFC 5389 section 10.2). Requests without
+// valid credentials are rejected with 401 Unauthorized or, if the nonce is
+// stale, 438 Stale Nonce. If realm is empty, the short-term credentials are
+// required instead (RFC 5389 section 10.1), as in closed deployments where
+// they are provisioned beforehand, and requests without MESSAGE-INTEGRITY
+// are rejected with 400 Bad Request. The responses to authenticated requests
+// carry MESSAGE-INTEGRITY, and the authenticated requests replayed from
+// another source or after the retransmission time are dropped. A nil store
+// disables the authentication.
+func (s *Server) SetAuth(realm string, store CredentialStore) {
+	s.update(func(c *settings) {
+		c.auth = nil
+		if store != nil {
+			c.auth = newServerAuth(realm, store)
+			c.auth.rand = c.rand
+		}
+	})
+}
+
+// SetNonceLifetime sets the time the nonces of the long-term credentials
+// are valid, which is 10 minutes by default. The secret the nonces are made
+// with is rotated at the same period. It shall be called after SetAuth.
+func (s *Server) SetNonceLifetime(d time.Duration) {
+	s.update(func(c *settings) {
+		if c.auth != nil {
+			c.auth = c.auth.clone()
+			c.auth.setLifetime(d)
+		}
+	})
+}
+
+// SetRequireFingerprint makes the server drop the requests without the
+// FINGERPRINT attribute, and add it to all the responses. Requests with an
+// invalid FINGERPRINT are always dropped.
+func (s *Server) SetRequireFingerprint(v bool) {
+	s.update(func(c *settings) {
+		c.requireFP = v
+	})
+}
+
+// SetRateLimit limits the requests served per source IP to rate per second,
+// with bursts of up to burst requests. Requests over the limit are dropped
+// silently. A non-positive rate disables the limit.
+func (s *Server) SetRateLimit(rate float64, burst int) {
+	s.update(func(c *settings) {
+		c.limiter = nil
+		if rate > 0 {
+			c.limiter = newRateLimiter(rate, burst)
+		}
+	})
+}
+
+// SetMaxAmplification limits the size of the responses to factor times the
+// size of the requests, so that the server cannot amplify reflection attacks.
+// The SOFTWARE attribute is omitted from the responses over the limit, and
+// the responses still over it are dropped. A non-positive factor disables
+// the limit.
+func (s *Server) SetMaxAmplification(factor float64) {
+	s.update(func(c *settings) {
+		c.amplify = factor
+	})
+}
+
+// SetDropPolicy sets the requests to drop silently instead of answering with
+// an error response.
+func (s *Server) SetDropPolicy(p DropPolicy) {
+	s.update(func(c *settings) {
+		c.dropPolicy = p
+	})
+}
+
+// Handle registers the handler of the requests of the given message type,
+// e.g. of a custom method. The binding requests are answered by default, and
+// the requests of the types not registered are rejected with 400 Bad
+// Request. A nil handler removes the registration. It shall be called
+// before serving.
+func (s *Server) Handle(types uint16, h Handler) {
+	if h == nil {
+		delete(s.mux, types)
+		return
+	}
+	s.mux[types] = h
+}
+
+// Use appends middlewares to the chain the requests go through before their
+// handler. The first one is the outermost: it sees the requests first and
+// the responses last. The middlewares run after the drop checks and before
+// the authentication of SetAuth, so that they see the requests rejected by
+// it too.
+func (s *Server) Use(m ...Middleware) {
+	s.update(func(c *settings) {
+		c.middlewares = append(c.middlewares[:len(c.middlewares):len(c.middlewares)], m...)
+	})
+}
+
+// chain builds the handler of the requests from the middlewares of c.
+func (s *Server) chain(c *settings) Handler {
+	var h Handler = s.mux
+	if c.redirector != nil {
+		h = redirectMiddleware(c.redirector, h)
+	}
+	if c.auth != nil {
+		h = c.auth.middleware(h)
+	}
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		h = c.middlewares[i](h)
+	}
+	return h
+}
+
+// SetACL sets the access control list of the server. It can be called while
+// serving, e.g. to apply a new list at runtime. A nil list allows all.
+func (s *Server) SetACL(acl *ACL) {
+	if acl != nil {
+		acl = acl.clone()
+	}
+	s.update(func(c *settings) {
+		c.acl = acl
+	})
+}
+
+// SetRedirector makes the server redirect the requests chosen by rd to
+// alternate servers. The requests are redirected after the authentication,
+// so that the redirection of authenticated clients is protected by
+// MESSAGE-INTEGRITY. A nil redirector disables the redirection.
+func (s *Server) SetRedirector(rd Redirector) {
+	s.update(func(c *settings) {
+		c.redirector = rd
+	})
+}
+
+// SetWorkers sets the number of goroutines reading and answering the
+// requests of each listener, which bounds the resources used under load. The
+// default is GOMAXPROCS.
+func (s *Server) SetWorkers(n int) {
+	s.workers = n
+}
+
+// SetObserver sets the observer receiving the events of the server, in
+// addition to the counters returned by Stats.
+func (s *Server) SetObserver(o ServerObserver) {
+	s.observer = o
+}
+
+// SetCapture sets the server to write the STUN messages it receives and
+// sends to the pcap writer, or none if nil. It is to be called before
+// serving.
+func (s *Server) SetCapture(p *PcapWriter) {
+	s.capture = p
+}
+
+// Stats returns a snapshot of the counters of the server.
+func (s *Server) Stats() ServerStats {
+	return s.stats.snapshot()
+}
+
+// TrafficReport returns the methods and attributes the clients send, and
+// the n sources sending the most packets, or all the sources tracked if n is
+// negative. The packets dropped by the ACL or the rate limiter are not
+// counted.
+func (s *Server) TrafficReport(n int) TrafficReport {
+	return s.traffic.report(n)
+}
+
+// ListenAndServe listens on the UDP address addr and serves the requests.
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// ListenerConfig is the configuration of a listener of a server, which is
+// added to the settings of the server.
+type ListenerConfig struct {
+	// Network is "udp" for a dual-stack socket, or "udp4" or "udp6" for an
+	// IPv4 or IPv6 one, e.g. to serve the IPv4 and IPv6 addresses of the
+	// same port with different listeners. The default is "udp".
+	Network string
+	// Addr is the UDP address to listen on.
+	Addr string
+	// SoftwareName overrides the SOFTWARE attribute of the server if not
+	// empty.
+	SoftwareName string
+	// RequireFingerprint requires the FINGERPRINT attribute on this
+	// listener, see SetRequireFingerprint.
+	RequireFingerprint bool
+	// DropPolicy is added to the drop policy of the server.
+	DropPolicy DropPolicy
+	// Middlewares run before the middlewares of the server, see Use.
+	Middlewares []Middleware
+}
+
+// ListenAndServeAll listens on the addresses of all the configurations, e.g.
+// on several IPv4 and IPv6 addresses, and serves the requests of each with
+// its configuration. It returns when the server is closed or any of the
+// sockets fails, and closes all of them.
+func (s *Server) ListenAndServeAll(cfgs ...ListenerConfig) error {
+	conns := make([]net.PacketConn, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		network := cfg.Network
+		if network == "" {
+			network = "udp"
+		}
+		conn, err := net.ListenPacket(network, cfg.Addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return err
+		}
+		conns = append(conns, conn)
+	}
+	return s.serveAll(conns, cfgs)
+}
+
+// serveAll serves conns with their configurations until any of them fails,
+// and closes all of them.
+func (s *Server) serveAll(conns []net.PacketConn, cfgs []ListenerConfig) error {
+	errs := make(chan error, len(conns))
+	for i := range conns {
+		go func(i int) {
+			errs <- s.ServeConfig(conns[i], cfgs[i])
+		}(i)
+	}
+	err := <-errs
+	for _, conn := range conns {
+		conn.Close()
+	}
+	for i := 1; i < len(conns); i++ {
+		<-errs
+	}
+	return err
+}
+
+// ListenAndServeAlternate listens on two IPs by two ports and serves the
+// requests as a RFC 5780 server, which tells the clients its other address
+// and answers the CHANGE-REQUEST from the socket asked for. The IPs and ports
+// of addr are the primary ones and those of alternateAddr the other ones. If
+// the port of addr or alternateAddr is 0, an ephemeral port is chosen.
+func (s *Server) ListenAndServeAlternate(addr, alternateAddr string) error {
+	conns, err := listenAlternate(addr, alternateAddr)
+	if err != nil {
+		return err
+	}
+	return s.ServeAlternate(conns)
+}
+
+// listenAlternate binds the sockets for ListenAndServeAlternate, with the
+// same port on both IPs.
+func listenAlternate(addr, alternateAddr string) ([2][2]net.PacketConn, error) {
+	var conns [2][2]net.PacketConn
+	var addrs [2]*net.UDPAddr
+	for i, a := range []string{addr, alternateAddr} {
+		udpAddr, err := net.ResolveUDPAddr("udp", a)
+		if err != nil {
+			return conns, err
+		}
+		addrs[i] = udpAddr
+	}
+	if addrs[0].IP.Equal(addrs[1].IP) {
+		return conns, errors.New("Alternate IP must differ from the primary one.")
+	}
+	for port := 0; port < 2; port++ {
+		p := addrs[port].Port
+		for ip := 0; ip < 2; ip++ {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: addrs[ip].IP, Port: p, Zone: addrs[ip].Zone})
+			if err != nil {
+				closeAll(conns)
+				return conns, err
+			}
+			conns[ip][port] = conn
+			// Use the ephemeral port of the first IP on the second.
+			p = conn.LocalAddr().(*net.UDPAddr).Port
+		}
+	}
+	if conns[0][0].LocalAddr().(*net.UDPAddr).Port == conns[0][1].LocalAddr().(*net.UDPAddr).Port {
+		closeAll(conns)
+		return conns, errors.New("Alternate port must differ from the primary one.")
+	}
+	return conns, nil
+}
+
+func closeAll(conns [2][2]net.PacketConn) {
+	for _, row := range conns {
+		for _, conn := range row {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+}
+
+// Serve serves the requests received on conn until the server is closed,
+// and closes conn before returning. It can be called for several
+// connections at the same time.
+func (s *Server) Serve(conn net.PacketConn) error {
+	return s.serve(newListener(conn, ListenerConfig{}))
+}
+
+// ServeConfig is like Serve, with the configuration cfg of the listener. The
+// network and address of cfg are ignored.
+func (s *Server) ServeConfig(conn net.PacketConn, cfg ListenerConfig) error {
+	return s.serve(newListener(conn, cfg))
+}
+
+// ServeAlternate serves the requests as a RFC 5780 server on the four
+// sockets indexed by [IP][port], where index 0 is the primary IP or port and
+// 1 the alternate one. It returns when the server is closed or any of the
+// sockets fails, and closes all of them.
+func (s *Server) ServeAlternate(conns [2][2]net.PacketConn) error {
+	group := new([2][2]*listener)
+	for ip := range conns {
+		for port := range conns[ip] {
+			l := newListener(conns[ip][port], ListenerConfig{})
+			l.group, l.ip, l.port = group, ip, port
+			group[ip][port] = l
+		}
+	}
+	errs := make(chan error, 4)
+	for _, row := range group {
+		for _, l := range row {
+			go func(l *listener) {
+				errs <- s.serve(l)
+			}(l)
+		}
+	}
+	err := <-errs
+	closeAll(conns)
+	for i := 0; i < 3; i++ {
+		<-errs
+	}
+	return err
+}
+
+// ListenAndServeTCP listens on the TCP address addr and serves the requests
+// received on the connections accepted (RFC 5389 section 7.2.2).
+func (s *Server) ListenAndServeTCP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeListener(ln)
+}
+
+// ServeListener serves the requests received on the stream connections
+// accepted on ln, e.g. a TCP or TLS listener, until the server is closed,
+// and closes ln before returning. The requests of a connection are answered
+// one at a time.
+func (s *Server) ServeListener(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return err
+		}
+		l := newListener(newStreamConn(conn), ListenerConfig{Network: "tcp"})
+		l.handler = s.handler(l.cfg)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[l.conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveStream(l)
+	}
+}
+
+// serveStream answers the requests received on the stream connection of l
+// one at a time, until the connection fails or the server is closed.
+func (s *Server) serveStream(l *listener) {
+	defer s.wg.Done()
+	conn := l.conn.(*streamConn)
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		if l.takeover == nil {
+			conn.Close()
+		}
+	}()
+	for {
+		// The ChannelData messages of the TURN clients take the same
+		// path as the Send indications.
+		b, err := conn.decoder.readFrame()
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			s.logger.Errorln("Read from", conn.RemoteAddr(), "failed:", err)
+			return
+		}
+		if !s.begin() {
+			return
+		}
+		s.capture.capture(b, conn.RemoteAddr(), conn.LocalAddr(), s.logger)
+		resp, _, _ := s.handle(b, conn.RemoteAddr(), l, s.cfg.Load().now())
+		if resp != nil {
+			if _, err := conn.Write(resp); err != nil {
+				s.logger.Errorln("Send to", conn.RemoteAddr(), "failed:", err)
+			}
+			s.capture.capture(resp, conn.LocalAddr(), conn.RemoteAddr(), s.logger)
+		}
+		s.inflight.Done()
+		if l.takeover != nil {
+			go l.takeover(conn)
+			return
+		}
+	}
+}
+
+// handler returns the handler of the server wrapped by the middlewares of
+// the listener configuration cfg.
+func (s *Server) handler(cfg ListenerConfig) Handler {
+	// The handler of the server is looked up for each request, as it
+	// changes with the settings.
+	var h Handler = HandlerFunc(func(w ResponseWriter, r *Request) {
+		r.cfg.handler.ServeSTUN(w, r)
+	})
+	for i := len(cfg.Middlewares) - 1; i >= 0; i-- {
+		h = cfg.Middlewares[i](h)
+	}
+	return h
+}
+
+func (s *Server) serve(l *listener) error {
+	conn := l.conn
+	l.handler = s.handler(l.cfg)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	workers := s.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			errs <- s.work(l)
+		}()
+	}
+	err := <-errs
+	// Stop the other workers.
+	conn.Close()
+	for i := 1; i < workers; i++ {
+		<-errs
+	}
+	return err
+}
+
+// work is a worker of the listener l, which reads and answers the requests
+// one at a time with its own buffer.
+func (s *Server) work(l *listener) error {
+	buf := make([]byte, maxMessageSize)
+	conn, _ := l.conn.(*net.UDPConn)
+	for {
+		var n int
+		var addr net.Addr
+		var err error
+		if conn != nil && s.relay != nil {
+			// The ChannelData messages skip the request processing.
+			var ap netip.AddrPort
+			if n, ap, err = conn.ReadFromUDPAddrPort(buf); err == nil {
+				if s.relay.relayChannelData(buf[:n], ap, l) {
+					continue
+				}
+				addr = net.UDPAddrFromAddrPort(ap)
+			}
+		} else {
+			n, addr, err = l.conn.ReadFrom(buf)
+		}
+		if err != nil {
+			if s.isClosed() {
+				// Let the other listeners send their responses.
+				s.inflight.Wait()
+				return ErrServerClosed
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return err
+		}
+		if !s.begin() {
+			continue
+		}
+		s.capture.capture(buf[:n], addr, l.conn.LocalAddr(), s.logger)
+		resp, out, to := s.handle(buf[:n], addr, l, s.cfg.Load().now())
+		if resp != nil {
+			if _, err := out.conn.WriteTo(resp, to); err != nil {
+				s.logger.Errorln("Send to", to, "failed:", err)
+			}
+			s.capture.capture(resp, out.conn.LocalAddr(), to, s.logger)
+		}
+		s.inflight.Done()
+	}
+}
+
+// begin starts a transaction, unless the server is shutting down.
+func (s *Server) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
+}
+
+// RegisterOnShutdown registers a function to call when Shutdown is called,
+// e.g. to notify the clients of long-lived state. The functions are called
+// in their own goroutines.
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.mu.Lock()
+	s.onShutdown = append(s.onShutdown, f)
+	s.mu.Unlock()
+}
+
+// Shutdown shuts down the server gracefully: it stops accepting requests,
+// waits for the responses in progress to be sent, and closes the
+// connections. If ctx expires first, the connections are closed anyway and
+// the error of ctx is returned, without waiting for the handlers still
+// running.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for conn := range s.conns {
+		// Wake up the blocked reads.
+		conn.SetReadDeadline(time.Unix(1, 0))
+	}
+	for _, f := range s.onShutdown {
+		go f()
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.closeRelay()
+		return nil
+	case <-ctx.Done():
+		// The handlers still running are not waited for.
+		s.closeConns()
+		go func() {
+			<-done
+			s.closeRelay()
+		}()
+		return ctx.Err()
+	}
+}
+
+// Close closes the connections and waits until the calls of Serve and
+// ServeListener return.
+func (s *Server) Close() error {
+	err := s.closeConns()
+	s.wg.Wait()
+	s.closeRelay()
+	return err
+}
+
+// closeConns closes the listeners and the connections.
+func (s *Server) closeConns() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for conn := range s.conns {
+		if cerr := conn.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeRelay releases the allocations of the TURN server, if any.
+func (s *Server) closeRelay() {
+	if s.relay != nil {
+		s.relay.Close()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// handle returns the response to the packet b received from addr on l at
+// received, the listener to send it from, and the address to send it to.
+// The response is nil if the packet shall not be answered.
+func (s *Server) handle(b []byte, addr net.Addr, l *listener, received time.Time) ([]byte, *listener, net.Addr) {
+	c := s.cfg.Load()
+	host := hostFromAddr(addr)
+	if c.acl != nil && !c.acl.allowAddr(host.Addr()) {
+		s.logger.Debugln("Drop packet from", addr, ": denied")
+		s.dropped(DroppedACL)
+		return nil, nil, nil
+	}
+	if c.limiter != nil && !c.limiter.allow(host.Addr(), received) {
+		s.logger.Debugln("Drop packet from", addr, ": rate limited")
+		s.dropped(DroppedRateLimit)
+		return nil, nil, nil
+	}
+	// The packets denied are not counted, so that a flood dropped by the
+	// ACL or the rate limiter does not contend on the traffic report.
+	s.traffic.packet(host.Addr())
+	if s.relay != nil && s.relay.relay(b, host, l) {
+		return nil, nil, nil
+	}
+	req, err := newPacketFromBytes(b)
+	if err != nil {
+		s.logger.Debugln("Drop packet from", addr, ":", err)
+		s.dropped(DroppedMalformed)
+		return nil, nil, nil
+	}
+	// Indications and responses are never answered.
+	if req.types&classMask != classRequest {
+		s.dropped(DroppedNotRequest)
+		return nil, nil, nil
+	}
+	s.traffic.request(req)
+	if c.acl != nil && !c.acl.allowRequest(req) {
+		s.logger.Debugln("Drop packet from", addr, ": user or realm denied")
+		s.dropped(DroppedACL)
+		return nil, nil, nil
+	}
+	if req.hasAttribute(attributeFingerprint) {
+		if !checkFingerprint(b) {
+			s.logger.Debugln("Drop packet from", addr, ": wrong fingerprint")
+			s.dropped(DroppedFingerprint)
+			return nil, nil, nil
+		}
+	} else if c.requireFP || l.cfg.RequireFingerprint {
+		s.logger.Debugln("Drop packet from", addr, ": no fingerprint")
+		s.dropped(DroppedFingerprint)
+		return nil, nil, nil
+	}
+	policy := c.dropPolicy | l.cfg.DropPolicy
+	if req.isLegacy() && policy&DropLegacy != 0 {
+		s.logger.Debugln("Drop packet from", addr, ": RFC 3489 request")
+		s.dropped(DroppedPolicy)
+		return nil, nil, nil
+	}
+	s.logger.dumpln("Received from", addr, "\n"+(&Message{req, b}).String())
+	s.stats.Request(req.types)
+	if s.observer != nil {
+		s.observer.Request(req.types)
+	}
+	w := newResponder(req, l)
+	r := &Request{&Message{req, b}, host, l.origin, l, w, c}
+	if l.handler != nil {
+		l.handler.ServeSTUN(w, r)
+	} else {
+		c.handler.ServeSTUN(w, r)
+	}
+	if w.dropped {
+		s.logger.Debugln("Drop packet from", addr, ": dropped by handler:", w.reason)
+		s.dropped(w.reason)
+		return nil, nil, nil
+	}
+	resp, out, key := w.resp, w.out, w.key
+	to := addr
+	if w.port != 0 {
+		to = net.UDPAddrFromAddrPort(netip.AddrPortFrom(host.Addr(), uint16(w.port)))
+	}
+	if drop(req, resp, policy) {
+		s.logger.Debugln("Drop packet from", addr, ": error", resp.getErrorCode())
+		s.dropped(DroppedPolicy)
+		return nil, nil, nil
+	}
+	software := c.softwareName
+	if l.cfg.SoftwareName != "" {
+		software = l.cfg.SoftwareName
+	}
+	fp := c.requireFP || l.cfg.RequireFingerprint || req.hasAttribute(attributeFingerprint)
+	respBytes := finish(req, resp, key, software, fp)
+	if limit := int(c.amplify * float64(len(b))); limit > 0 && len(respBytes) > limit {
+		respBytes = finish(req, resp, key, "", fp)
+		if len(respBytes) > limit {
+			s.logger.Debugln("Drop packet from", addr, ": response too large")
+			s.dropped(DroppedAmplification)
+			return nil, nil, nil
+		}
+	}
+	s.logger.Debugln("Response to", addr, "type:", resp.types)
+	code, latency := resp.getErrorCode(), c.now().Sub(received)
+	s.stats.Response(resp.types, code, latency)
+	if s.observer != nil {
+		s.observer.Response(resp.types, code, latency)
+	}
+	return respBytes, out, to
+}
+
+func (s *Server) dropped(reason DropReason) {
+	s.stats.Drop(reason)
+	if s.observer != nil {
+		s.observer.Drop(reason)
+	}
+}
+
+// drop reports whether the error response resp to req shall be dropped by
+// the drop policy.
+func drop(req *packet, resp *packet, policy DropPolicy) bool {
+	if resp.types&classMask != classError {
+		return false
+	}
+	switch resp.getErrorCode() {
+	case errorBadRequest, errorUnknownAttribute:
+		return policy&DropMalformed != 0
+	case errorUnauthorized:
+		return policy&DropUnauthorized != 0 && req.hasAttribute(attributeMessageIntegrity)
+	}
+	return false
+}
+
+// serveBinding answers the binding requests.
+func (s *Server) serveBinding(w ResponseWriter, r *Request) {
+	rw, l := r.w, r.l
+	changeIP, changePort, ok := rw.req.getChangeRequest()
+	if ok && (changeIP || changePort) {
+		if l.group == nil {
+			// CHANGE-REQUEST is comprehension-required.
+			rw.Error(errorUnknownAttribute, "")
+			rw.resp.addAttribute(*newUnknownAttributesAttribute([]uint16{attributeChangeRequest}))
+			return
+		}
+		rw.out = l.other(changeIP, changePort)
+	}
+	if v, ok := r.Attribute(attributeResponsePort); ok && !rw.req.isLegacy() {
+		// RFC 5780 section 7.5: the response goes to the port while
+		// XOR-MAPPED-ADDRESS still gives the source of the request.
+		if len(v) < 2 || binary.BigEndian.Uint16(v) == 0 {
+			rw.Error(errorBadRequest, "")
+			return
+		}
+		rw.port = int(binary.BigEndian.Uint16(v))
+	}
+	resp, out := rw.resp, rw.out
+	if rw.req.isLegacy() {
+		resp.addAttribute(*newAddrAttribute(attributeMappedAddress, r.Source))
+		if out.origin != nil {
+			resp.addAttribute(*newAddrAttribute(attributeSourceAddress, out.origin))
+		}
+		if l.group != nil {
+			resp.addAttribute(*newAddrAttribute(attributeChangedAddress, l.other(true, true).origin))
+		}
+		return
+	}
+	resp.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, r.Source, resp.transID))
+	if out.origin != nil {
+		resp.addAttribute(*newAddrAttribute(attributeResponseOrigin, out.origin))
+	}
+	if l.group != nil {
+		resp.addAttribute(*newAddrAttribute(attributeOtherAddress, l.other(true, true).origin))
+	}
+}
+
+// finish returns the response with the trailing attributes: SOFTWARE if
+// software is not empty, MESSAGE-INTEGRITY if the request is authenticated
+// with key, and FINGERPRINT if fp is true.
+func finish(req *packet, resp *packet, key []byte, software string, fp bool) []byte {
+	if req.isLegacy() {
+		return resp.bytes()
+	}
+	p := *resp
+	if software != "" {
+		// The attributes of resp are copied by the append.
+		n := len(resp.attributes)
+		p.attributes = resp.attributes[:n:n]
+		p.addAttribute(*newSoftwareAttribute(software))
+	}
+	return p.appendEncode(make([]byte, 0, p.size()+trailerSize), key, fp)
+}
+
+// newErrorResponse returns the error response to req with the given code.
+func newErrorResponse(req *packet, code int) *packet {
+	resp := newResponsePacket(req, req.types|classError)
+	resp.addAttribute(*newErrorCodeAttribute(code, errorStr[code]))
+	return resp
+}
+
+// listener is a socket the server reads requests from. A RFC 5780 server
+// listens on a group of four sockets, two IPs by two ports, so that requests
+// can be answered from another address.
+type listener struct {
+	conn     net.PacketConn
+	origin   *Host // nil if bound to the unspecified address
+	group    *[2][2]*listener
+	ip, port int
+	cfg      ListenerConfig
+	handler  Handler // handler of the server wrapped by cfg.Middlewares
+	// takeover, if set by a handler of a stream connection, takes the
+	// connection over once the response is sent.
+	takeover func(conn *streamConn)
+}
+
+func newListener(conn net.PacketConn, cfg ListenerConfig) *listener {
+	l := &listener{conn: conn, cfg: cfg}
+	if host := hostFromAddr(conn.LocalAddr()); host != nil && !host.Addr().IsUnspecified() {
+		l.origin = host
+	}
+	return l
+}
+
+// other returns the listener of the group with the IP and/or port changed.
+func (l *listener) other(changeIP, changePort bool) *listener {
+	ip, port := l.ip, l.port
+	if changeIP {
+		ip = 1 - ip
+	}
+	if changePort {
+		port = 1 - port
+	}
+	return l.group[ip][port]
+}
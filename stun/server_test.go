@@ -0,0 +1,378 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a server on an ephemeral loopback port.
+func newTestServer(t *testing.T) (*Server, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	go s.Serve(conn)
+	t.Cleanup(func() { s.Close() })
+	return s, conn.LocalAddr().String()
+}
+
+// newRespondingServer returns the address of a test server answering the
+// requests by respond in place of the built-in handlers, e.g. to map the
+// clients to other addresses or to drop some requests.
+func newRespondingServer(t *testing.T, respond HandlerFunc) string {
+	s, addr := newTestServer(t)
+	s.Use(func(Handler) Handler { return respond })
+	return addr
+}
+
+// addXorMapped adds XOR-MAPPED-ADDRESS of the host to the response to r.
+func addXorMapped(w ResponseWriter, r *Request, host *Host) {
+	w.AddAttribute(attributeXorMappedAddress, newXorAddrAttribute(attributeXorMappedAddress, host, r.pkt.transID).value)
+}
+
+func TestServerBinding(t *testing.T) {
+	_, addr := newTestServer(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(addr)
+	host, err := c.Keepalive()
+	if err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	if host.String() != conn.LocalAddr().String() {
+		t.Errorf("Keepalive error: mapped %v, expected %v", host, conn.LocalAddr())
+	}
+	mtu, err := c.DiscoverPathMTU(1500)
+	if err != nil || mtu != 1500 {
+		t.Errorf("DiscoverPathMTU error: %d %v", mtu, err)
+	}
+}
+
+func TestServerLegacyBinding(t *testing.T) {
+	s := NewServer()
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	req.transID[0] = 0
+	req.addAttribute(*newFingerprintAttribute(req))
+	addr := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678}
+	b, _, _ := s.handle(req.bytes(), addr, &listener{}, time.Now())
+	resp, err := newPacketFromBytes(b)
+	if err != nil {
+		t.Fatalf("handle error: %v", err)
+	}
+	if resp.getXorMappedAddr() != nil || resp.hasAttribute(attributeFingerprint) {
+		t.Errorf("handle error: RFC 5389 attributes sent to RFC 3489 client")
+	}
+	if mapped := resp.getMappedAddr(); mapped == nil || mapped.String() != "1.2.3.4:5678" {
+		t.Errorf("handle error: mapped address %v", mapped)
+	}
+}
+
+func TestServerAlternate(t *testing.T) {
+	conns, err := listenAlternate("127.0.0.1:0", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("listenAlternate: %v", err)
+	}
+	s := NewServer()
+	go s.ServeAlternate(conns)
+	defer s.Close()
+	c := NewClient()
+	c.SetServerAddr(conns[0][0].LocalAddr().String())
+	nat, host, err := c.Discover()
+	if err != nil {
+		t.Fatalf("Discover error: %v", err)
+	}
+	if nat != NATNone || host == nil {
+		t.Errorf("Discover error: %v %v", nat, host)
+	}
+	// Test1 to the other address, and test3 from the other port.
+	conn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer conn.Close()
+	other := conns[1][1].LocalAddr()
+	resp, err := c.test1(conn, other)
+	if err != nil || resp == nil || resp.serverAddr.String() != other.String() {
+		t.Fatalf("test1 error: %v %v", resp, err)
+	}
+	if resp.otherAddr.String() != conns[0][0].LocalAddr().String() {
+		t.Errorf("test1 error: other address %v", resp.otherAddr)
+	}
+	resp, err = c.test3(conn, other)
+	if err != nil || resp == nil || resp.serverAddr.String() != conns[1][0].LocalAddr().String() {
+		t.Errorf("test3 error: %v %v", resp, err)
+	}
+}
+
+func TestServerMiddleware(t *testing.T) {
+	s := NewServer()
+	var seen []uint16
+	s.Use(func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			seen = append(seen, r.Type())
+			if _, ok := r.Attribute(attributeUsername); ok {
+				w.Error(errorForbidden, "")
+				return
+			}
+			next.ServeSTUN(w, r)
+			w.AddAttribute(0x8030, []byte("tag"))
+		})
+	})
+	s.Handle(0x0002, HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Drop()
+	}))
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5678}
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	b, _, _ := s.handle(req.bytes(), addr, &listener{}, time.Now())
+	resp, err := newPacketFromBytes(b)
+	if err != nil || resp.getXorMappedAddr() == nil || resp.getString(0x8030) != "tag" {
+		t.Errorf("handle error: response %v %v", resp, err)
+	}
+	req.types = 0x0002
+	if b, _, _ = s.handle(req.bytes(), addr, &listener{}, time.Now()); b != nil {
+		t.Errorf("handle error: dropped request answered")
+	}
+	req.types = typeBindingRequest
+	req.addAttribute(*newAttribute(attributeUsername, []byte("user")))
+	b, _, _ = s.handle(req.bytes(), addr, &listener{}, time.Now())
+	if resp, err = newPacketFromBytes(b); err != nil || resp.getErrorCode() != errorForbidden {
+		t.Errorf("handle error: request not rejected")
+	}
+	if len(seen) != 3 {
+		t.Errorf("middleware error: %d requests seen", len(seen))
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	notified := make(chan struct{})
+	s.RegisterOnShutdown(func() { close(notified) })
+	errs := make(chan error, 1)
+	go func() { errs <- s.Serve(conn) }()
+	cconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cconn.Close()
+	c := NewClientWithConnection(cconn)
+	c.SetServerAddr(conn.LocalAddr().String())
+	if _, err := c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown error: %v", err)
+	}
+	if err := <-errs; err != ErrServerClosed {
+		t.Errorf("Serve error: %v", err)
+	}
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Errorf("Shutdown error: not notified")
+	}
+}
+
+// newBlockingServer returns a test server whose handler blocks until
+// release is closed, with a channel receiving on entering it.
+func newBlockingServer(t *testing.T, release chan struct{}) (*Server, string, <-chan struct{}) {
+	s, addr := newTestServer(t)
+	entered := make(chan struct{}, 1)
+	s.Use(func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			notify(entered)
+			<-release
+			next.ServeSTUN(w, r)
+		})
+	})
+	return s, addr, entered
+}
+
+func TestServerShutdownInFlight(t *testing.T) {
+	release := make(chan struct{})
+	s, addr, entered := newBlockingServer(t, release)
+	c := NewClient()
+	c.SetServerAddr(addr)
+	pings := make(chan error, 1)
+	go func() {
+		_, err := c.PingWithOptions(context.Background(), addr, &PingOptions{Samples: 1})
+		pings <- err
+	}()
+	<-entered
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown error: %v before the response was sent", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown error: %v", err)
+	}
+	if err := <-pings; err != nil {
+		t.Errorf("Ping error: %v, expected the response in flight", err)
+	}
+
+	// The handler blocks beyond the expiry of ctx.
+	block := make(chan struct{})
+	defer close(block)
+	s, addr, entered = newBlockingServer(t, block)
+	go c.PingWithOptions(context.Background(), addr, &PingOptions{Samples: 1})
+	<-entered
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown error: %v, expected context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Shutdown error: returned after %v", d)
+	}
+}
+
+func TestServerResponsePort(t *testing.T) {
+	s := NewServer()
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	req.addAttribute(*newAttribute(attributeResponsePort, []byte{0x12, 0x34, 0, 0}))
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5678}
+	b, _, to := s.handle(req.bytes(), addr, &listener{}, time.Now())
+	resp, err := newPacketFromBytes(b)
+	if err != nil {
+		t.Fatalf("handle error: %v", err)
+	}
+	if to.String() != "192.0.2.1:4660" {
+		t.Errorf("handle error: response sent to %v", to)
+	}
+	if mapped := resp.getXorMappedAddr(); mapped == nil || mapped.String() != "192.0.2.1:5678" {
+		t.Errorf("handle error: mapped address %v", mapped)
+	}
+}
+
+func TestServerDualStack(t *testing.T) {
+	s := NewServer()
+	t.Cleanup(func() { s.Close() })
+	for _, network := range []string{"udp4", "udp6"} {
+		addr := "127.0.0.1:0"
+		if network == "udp6" {
+			addr = "[::1]:0"
+		}
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			t.Skipf("%s not available: %v", network, err)
+		}
+		go s.ServeConfig(conn, ListenerConfig{SoftwareName: network})
+		cconn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cconn.Close()
+		c := NewClientWithConnection(cconn)
+		c.SetServerAddr(conn.LocalAddr().String())
+		host, err := c.Keepalive()
+		if err != nil {
+			t.Fatalf("Keepalive error: %v", err)
+		}
+		if host.String() != cconn.LocalAddr().String() {
+			t.Errorf("Keepalive error: mapped %v, expected %v", host, cconn.LocalAddr())
+		}
+	}
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	addr := &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 5678}
+	b, _, _ := s.handle(req.bytes(), addr, &listener{cfg: ListenerConfig{SoftwareName: "test"}}, time.Now())
+	resp, err := newPacketFromBytes(b)
+	if err != nil {
+		t.Fatalf("handle error: %v", err)
+	}
+	if mapped := resp.getXorMappedAddr(); mapped == nil || mapped.Family() != attributeFamilyIPv4 {
+		t.Errorf("handle error: mapped address %v", mapped)
+	}
+	if software := resp.getString(attributeSoftware); software != "test" {
+		t.Errorf("handle error: software %q", software)
+	}
+}
+
+func TestServerWorkers(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	s.SetWorkers(4)
+	go s.Serve(conn)
+	defer s.Close()
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			cconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer cconn.Close()
+			c := NewClientWithConnection(cconn)
+			c.SetServerAddr(conn.LocalAddr().String())
+			_, err = c.Keepalive()
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Keepalive error: %v", err)
+		}
+	}
+}
+
+func TestServerTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	errs := make(chan error, 1)
+	go func() { errs <- s.ServeListener(ln) }()
+	c := NewClient()
+	c.SetServerAddr(ln.Addr().String())
+	for i := 0; i < 2; i++ {
+		host, err := c.Bind(TransportTCP)
+		if err != nil {
+			t.Fatalf("Bind error: %v", err)
+		}
+		if host.IP() != "127.0.0.1" {
+			t.Errorf("Bind error: mapped %v", host)
+		}
+	}
+	s.Close()
+	if err := <-errs; err != ErrServerClosed {
+		t.Errorf("ServeListener error: %v", err)
+	}
+}
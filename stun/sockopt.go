@@ -0,0 +1,113 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errSockoptUnsupported = errors.New("Socket option not supported on this platform.")
+
+// controlConn runs f on the file descriptor underlying conn. It fails if the
+// connection does not expose its descriptor, e.g. a user supplied wrapper.
+func controlConn(conn net.PacketConn, f func(fd uintptr) error) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("Connection does not support socket options.")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = f(fd)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// isIPv6Conn reports whether conn is bound to an IPv6 (or dual-stack)
+// socket, so that IPv6 level socket options apply.
+func isIPv6Conn(conn net.PacketConn) bool {
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	return addr.IP == nil || addr.IP.To4() == nil
+}
+
+// setTTL sets the IPv4 TTL and, for IPv6 sockets, the unicast hop limit of
+// the packets sent through conn.
+func setTTL(conn net.PacketConn, ttl int) error {
+	ipv6 := isIPv6Conn(conn)
+	return controlConn(conn, func(fd uintptr) error {
+		return setsockoptTTL(fd, ipv6, ttl)
+	})
+}
+
+// getTTL returns the TTL, or the unicast hop limit for IPv6 sockets, of the
+// packets sent through conn.
+func getTTL(conn net.PacketConn) (int, error) {
+	ipv6 := isIPv6Conn(conn)
+	var ttl int
+	err := controlConn(conn, func(fd uintptr) (err error) {
+		ttl, err = getsockoptTTL(fd, ipv6)
+		return err
+	})
+	return ttl, err
+}
+
+// setDontFragment sets or clears the DF bit (or its IPv6 equivalent, which
+// disables fragmentation at the source) on the packets sent through conn.
+func setDontFragment(conn net.PacketConn, on bool) error {
+	ipv6 := isIPv6Conn(conn)
+	return controlConn(conn, func(fd uintptr) error {
+		return setsockoptDontFragment(fd, ipv6, on)
+	})
+}
+
+// listenUDP creates a UDP connection on an ephemeral port. If iface is not
+// empty, the socket is bound to the network interface of that name, so that
+// its traffic always leaves through that interface.
+func listenUDP(iface string) (net.PacketConn, error) {
+	return listenUDPNetwork("udp", iface)
+}
+
+// listenUDPNetwork is listenUDP of the network, "udp", "udp4" or "udp6".
+func listenUDPNetwork(network, iface string) (net.PacketConn, error) {
+	lc := net.ListenConfig{}
+	if iface != "" {
+		lc.Control = func(network, address string, rc syscall.RawConn) error {
+			ipv6 := network != "udp4"
+			var serr error
+			err := rc.Control(func(fd uintptr) {
+				serr = setsockoptBindToDevice(fd, ipv6, iface)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	return lc.ListenPacket(context.Background(), network, ":0")
+}
@@ -0,0 +1,51 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"syscall"
+)
+
+// Missing from package syscall, see netinet/in.h and netinet6/in6.h.
+const (
+	ipDontFrag   = 28
+	ipv6DontFrag = 62
+	ipv6BoundIf  = 125
+)
+
+func setsockoptDontFragment(fd uintptr, ipv6 bool, on bool) error {
+	v := 0
+	if on {
+		v = 1
+	}
+	if !ipv6 {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipDontFrag, v)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6DontFrag, v)
+}
+
+func setsockoptBindToDevice(fd uintptr, ipv6 bool, name string) error {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	if !ipv6 {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, ifi.Index)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6BoundIf, ifi.Index)
+}
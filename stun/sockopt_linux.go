@@ -0,0 +1,41 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"syscall"
+)
+
+func setsockoptDontFragment(fd uintptr, ipv6 bool, on bool) error {
+	v := syscall.IP_PMTUDISC_DONT
+	if on {
+		v = syscall.IP_PMTUDISC_DO
+	}
+	err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, v)
+	if !ipv6 {
+		return err
+	}
+	v = syscall.IPV6_PMTUDISC_DONT
+	if on {
+		v = syscall.IPV6_PMTUDISC_DO
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, v)
+}
+
+func setsockoptBindToDevice(fd uintptr, ipv6 bool, name string) error {
+	return syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+}
@@ -0,0 +1,100 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestListenUDPInterface(t *testing.T) {
+	conn, err := listenUDP("")
+	if err != nil {
+		t.Fatalf("listenUDP error: %v", err)
+	}
+	conn.Close()
+	// The interface does not exist, or binding to it is not supported.
+	for _, network := range []string{"udp", "udp4", "udp6"} {
+		if conn, err := listenUDPNetwork(network, "nonexistent0"); err == nil {
+			conn.Close()
+			t.Errorf("listenUDPNetwork error: %s bound to an unknown interface", network)
+		}
+	}
+	_, addr := newTestServer(t)
+	c := NewClient()
+	c.SetInterface("nonexistent0")
+	opts := &PingOptions{Samples: 1}
+	if _, err := c.PingWithOptions(context.Background(), addr, opts); err == nil {
+		t.Errorf("Ping error: expected error of an unknown interface")
+	}
+	c.SetInterface("")
+	if _, err := c.PingWithOptions(context.Background(), addr, opts); err != nil {
+		t.Errorf("Ping error: %v", err)
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := setTTL(conn, 7); err == errSockoptUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatalf("setTTL error: %v", err)
+	}
+	if ttl, err := getTTL(conn); err != nil || ttl != 7 {
+		t.Fatalf("getTTL error: %d, %v, expected 7", ttl, err)
+	}
+	if conn6, err := net.ListenPacket("udp6", "[::1]:0"); err == nil {
+		defer conn6.Close()
+		if err := setTTL(conn6, 9); err != nil {
+			t.Errorf("setTTL error: %v", err)
+		}
+		if ttl, err := getTTL(conn6); err != nil || ttl != 9 {
+			t.Errorf("getTTL error: %d, %v, expected 9 of IPv6", ttl, err)
+		}
+	}
+
+	// The TTL is of the client during the transaction, then restored.
+	s, addr := newTestServer(t)
+	during := make(chan int, 1)
+	s.Use(func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			ttl, _ := getTTL(conn)
+			select {
+			case during <- ttl:
+			default:
+			}
+			next.ServeSTUN(w, r)
+		})
+	})
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(addr)
+	c.SetTTL(3)
+	if _, err := c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	if ttl := <-during; ttl != 3 {
+		t.Errorf("SetTTL error: TTL %d during the transaction, expected 3", ttl)
+	}
+	if ttl, err := getTTL(conn); err != nil || ttl != 7 {
+		t.Errorf("SetTTL error: TTL %d after the transaction, %v, expected 7", ttl, err)
+	}
+}
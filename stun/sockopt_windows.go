@@ -0,0 +1,66 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func setsockoptTTL(fd uintptr, ipv6 bool, ttl int) error {
+	if !ipv6 {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+	}
+	err := syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+	if err != nil {
+		return err
+	}
+	syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+	return nil
+}
+
+func getsockoptTTL(fd uintptr, ipv6 bool) (int, error) {
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TTL
+	if ipv6 {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS
+	}
+	var v int32
+	l := int32(unsafe.Sizeof(v))
+	err := syscall.Getsockopt(syscall.Handle(fd), int32(level), int32(opt), (*byte)(unsafe.Pointer(&v)), &l)
+	return int(v), err
+}
+
+// Missing from package syscall, see ws2ipdef.h.
+const (
+	ipDontFragment = 14
+	ipv6DontFrag   = 14
+)
+
+func setsockoptDontFragment(fd uintptr, ipv6 bool, on bool) error {
+	v := 0
+	if on {
+		v = 1
+	}
+	if !ipv6 {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, ipDontFragment, v)
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, ipv6DontFrag, v)
+}
+
+func setsockoptBindToDevice(fd uintptr, ipv6 bool, name string) error {
+	return errSockoptUnsupported
+}
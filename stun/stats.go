@@ -0,0 +1,188 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"sync"
+	"time"
+)
+
+// DropReason tells why the server dropped a packet without response.
+type DropReason int
+
+// Drop reasons.
+const (
+	DroppedMalformed DropReason = iota
+	DroppedFingerprint
+	DroppedNotRequest
+	DroppedRateLimit
+	DroppedPolicy
+	DroppedAmplification
+	DroppedACL
+	DroppedReplay
+)
+
+var dropStr = map[DropReason]string{
+	DroppedMalformed:     "malformed",
+	DroppedFingerprint:   "fingerprint",
+	DroppedNotRequest:    "not request",
+	DroppedRateLimit:     "rate limit",
+	DroppedPolicy:        "policy",
+	DroppedAmplification: "amplification",
+	DroppedACL:           "acl",
+	DroppedReplay:        "replay",
+}
+
+func (r DropReason) String() string {
+	if s, ok := dropStr[r]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler, so that the reason
+// marshals to its name, e.g. as the keys of ServerStats.Drops.
+func (r DropReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// ServerObserver receives the events of the server as they happen, e.g. to
+// feed a metrics system. The methods are called from the goroutines serving
+// the requests, so they must be safe for concurrent use and return quickly.
+type ServerObserver interface {
+	// Request is called for each request received, with its message type,
+	// which encodes the method and the class.
+	Request(types uint16)
+	// Response is called for each response, with its message type, the
+	// error code or 0 for success responses, and the time spent since the
+	// request was received.
+	Response(types uint16, code int, latency time.Duration)
+	// Drop is called for each packet dropped without response.
+	Drop(reason DropReason)
+}
+
+// Histogram is a snapshot of a latency histogram. Counts[i] is the number of
+// samples not larger than Bounds[i], and the last count is the number of the
+// larger ones.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// ServerStats is a snapshot of the counters of a server.
+type ServerStats struct {
+	Requests map[uint16]uint64     // requests by message type
+	Errors   map[int]uint64        // error responses by code
+	Drops    map[DropReason]uint64 // packets dropped by reason
+	Latency  Histogram             // response latency
+}
+
+var latencyBounds = []time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+// serverStats aggregates the events of a server for Server.Stats.
+type serverStats struct {
+	mu       sync.Mutex
+	requests map[uint16]uint64
+	errors   map[int]uint64
+	drops    map[DropReason]uint64
+	latency  []uint64
+	count    uint64
+	sum      time.Duration
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{
+		requests: make(map[uint16]uint64),
+		errors:   make(map[int]uint64),
+		drops:    make(map[DropReason]uint64),
+		latency:  make([]uint64, len(latencyBounds)+1),
+	}
+}
+
+func (s *serverStats) Request(types uint16) {
+	countExpvar(&expvars.serverRequests, 1)
+	s.mu.Lock()
+	s.requests[types]++
+	s.mu.Unlock()
+}
+
+func (s *serverStats) Response(types uint16, code int, latency time.Duration) {
+	countExpvar(&expvars.serverResponses, 1)
+	if code != 0 {
+		countExpvar(&expvars.serverErrors, 1)
+	}
+	i := 0
+	for i < len(latencyBounds) && latency > latencyBounds[i] {
+		i++
+	}
+	s.mu.Lock()
+	if code != 0 {
+		s.errors[code]++
+	}
+	s.latency[i]++
+	s.count++
+	s.sum += latency
+	s.mu.Unlock()
+}
+
+func (s *serverStats) Drop(reason DropReason) {
+	countExpvar(&expvars.serverDrops, 1)
+	if reason == DroppedMalformed {
+		countExpvar(&expvars.serverMalformed, 1)
+	}
+	s.mu.Lock()
+	s.drops[reason]++
+	s.mu.Unlock()
+}
+
+func (s *serverStats) snapshot() ServerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := ServerStats{
+		Requests: make(map[uint16]uint64, len(s.requests)),
+		Errors:   make(map[int]uint64, len(s.errors)),
+		Drops:    make(map[DropReason]uint64, len(s.drops)),
+		Latency: Histogram{
+			Bounds: append([]time.Duration(nil), latencyBounds...),
+			Counts: append([]uint64(nil), s.latency...),
+			Count:  s.count,
+			Sum:    s.sum,
+		},
+	}
+	for k, v := range s.requests {
+		st.Requests[k] = v
+	}
+	for k, v := range s.errors {
+		st.Errors[k] = v
+	}
+	for k, v := range s.drops {
+		st.Drops[k] = v
+	}
+	return st
+}
@@ -0,0 +1,60 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type testObserver struct {
+	requests, responses, drops int
+}
+
+func (o *testObserver) Request(types uint16)                             { o.requests++ }
+func (o *testObserver) Response(types uint16, code int, d time.Duration) { o.responses++ }
+func (o *testObserver) Drop(reason DropReason)                           { o.drops++ }
+
+func TestServerStats(t *testing.T) {
+	s := NewServer()
+	o := &testObserver{}
+	s.SetObserver(o)
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5678}
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	s.handle(req.bytes(), addr, &listener{}, time.Now())
+	req.types = 0x0002 // unknown method
+	s.handle(req.bytes(), addr, &listener{}, time.Now())
+	s.handle([]byte("not a stun packet"), addr, &listener{}, time.Now())
+	st := s.Stats()
+	if st.Requests[typeBindingRequest] != 1 || st.Requests[0x0002] != 1 {
+		t.Errorf("stats error: requests %v", st.Requests)
+	}
+	if st.Errors[errorBadRequest] != 1 {
+		t.Errorf("stats error: errors %v", st.Errors)
+	}
+	if st.Drops[DroppedMalformed] != 1 {
+		t.Errorf("stats error: drops %v", st.Drops)
+	}
+	if st.Latency.Count != 2 || len(st.Latency.Counts) != len(st.Latency.Bounds)+1 {
+		t.Errorf("stats error: latency %+v", st.Latency)
+	}
+	if o.requests != 2 || o.responses != 2 || o.drops != 1 {
+		t.Errorf("observer error: %+v", o)
+	}
+}
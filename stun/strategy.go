@@ -0,0 +1,121 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+// Strategy is the way for two peers to connect, as recommended by
+// ConnectStrategy.
+type Strategy int
+
+// Connection strategies.
+const (
+	// StrategyRelay relays the traffic through a TURN server.
+	StrategyRelay Strategy = iota
+	// StrategyLAN connects the local addresses directly on the LAN.
+	StrategyLAN
+	// StrategyHairpin connects the mapped addresses through the NAT
+	// shared by the peers, which loops the packets back.
+	StrategyHairpin
+	// StrategyPunch punches a hole through the NATs between the mapped
+	// addresses, e.g. by Punch.
+	StrategyPunch
+)
+
+var strategyStr = map[Strategy]string{
+	StrategyRelay:   "relay",
+	StrategyLAN:     "direct LAN",
+	StrategyHairpin: "hairpin",
+	StrategyPunch:   "hole punching",
+}
+
+func (s Strategy) String() string {
+	if str, ok := strategyStr[s]; ok {
+		return str
+	}
+	return "unknown"
+}
+
+var strategyName = map[Strategy]string{
+	StrategyRelay:   "relay",
+	StrategyLAN:     "lan",
+	StrategyHairpin: "hairpin",
+	StrategyPunch:   "punch",
+}
+
+// MarshalText implements encoding.TextMarshaler, so that the strategy
+// marshals to its name, e.g. "punch".
+func (s Strategy) MarshalText() ([]byte, error) {
+	if str, ok := strategyName[s]; ok {
+		return []byte(str), nil
+	}
+	return []byte("unknown"), nil
+}
+
+// PeerInfo is the result of the discovery of a peer, as signaled to the
+// other one.
+type PeerInfo struct {
+	// Local is the address of the socket of the peer, and Mapped the one
+	// mapped by its NAT.
+	Local  *Host
+	Mapped *Host
+	NAT    NATType
+	// Hairpinning is whether the NAT of the peer loops back the packets
+	// to its mapped addresses, e.g. as in NATProfile.
+	Hairpinning bool
+}
+
+// ConnectStrategy recommends how the peers connect. Peers of the same
+// public IP address are behind the same NAT, connecting on the LAN if the
+// local addresses are of the same private network, through the NAT if it
+// hairpins otherwise, e.g. of the hosts behind nested NATs or a CGNAT, or
+// by relay. Peers behind distinct NATs punch a hole unless a NAT of a
+// mapping per destination defeats it, i.e. a symmetric NAT on either side
+// while the other filters by port, or the NATs are not discovered.
+func ConnectStrategy(a, b PeerInfo) Strategy {
+	if a.Mapped == nil || b.Mapped == nil {
+		return StrategyRelay
+	}
+	if a.Mapped.Addr() == b.Mapped.Addr() {
+		if a.Local != nil && b.Local != nil {
+			na, oka := privateNetwork(a.Local.Addr())
+			nb, okb := privateNetwork(b.Local.Addr())
+			if oka && okb && na == nb {
+				return StrategyLAN
+			}
+		}
+		if a.Hairpinning || b.Hairpinning {
+			return StrategyHairpin
+		}
+		return StrategyRelay
+	}
+	if punchable(a.NAT, b.NAT) && punchable(b.NAT, a.NAT) {
+		return StrategyPunch
+	}
+	return StrategyRelay
+}
+
+// punchable reports whether a hole is punched from behind a NAT through
+// another one.
+func punchable(nat, other NATType) bool {
+	switch nat {
+	case NATNone, NATFull, NATRestricted, NATPortRestricted, NATSymetricUDPFirewall:
+		return other != NATError && other != NATUnknown && other != NATBlocked && other != NATUnreachable
+	case NATSymetric:
+		// The peer is heard from another port than the mapped one.
+		return other == NATNone || other == NATFull || other == NATRestricted
+	}
+	return false
+}
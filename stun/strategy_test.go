@@ -0,0 +1,49 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import "testing"
+
+func TestConnectStrategy(t *testing.T) {
+	peer := func(local, mapped string, nat NATType, hairpinning bool) PeerInfo {
+		return PeerInfo{Local: newHostFromStr(local), Mapped: newHostFromStr(mapped), NAT: nat, Hairpinning: hairpinning}
+	}
+	tests := []struct {
+		a, b PeerInfo
+		s    Strategy
+	}{
+		// The same NAT.
+		{peer("192.168.1.2:5000", "203.0.113.1:6000", NATPortRestricted, false), peer("192.168.1.3:5000", "203.0.113.1:6001", NATPortRestricted, false), StrategyLAN},
+		{peer("192.168.1.2:5000", "203.0.113.1:6000", NATSymetric, true), peer("100.64.0.3:5000", "203.0.113.1:6001", NATSymetric, true), StrategyHairpin},
+		{peer("192.168.1.2:5000", "203.0.113.1:6000", NATSymetric, false), peer("192.168.2.3:5000", "203.0.113.1:6001", NATSymetric, false), StrategyRelay},
+		// Distinct NATs.
+		{peer("192.168.1.2:5000", "203.0.113.1:6000", NATPortRestricted, false), peer("192.168.1.3:5000", "198.51.100.1:6000", NATFull, false), StrategyPunch},
+		{peer("192.168.1.2:5000", "203.0.113.1:6000", NATSymetric, false), peer("10.0.0.3:5000", "198.51.100.1:6000", NATRestricted, false), StrategyPunch},
+		{peer("192.168.1.2:5000", "203.0.113.1:6000", NATSymetric, false), peer("10.0.0.3:5000", "198.51.100.1:6000", NATPortRestricted, false), StrategyRelay},
+		{peer("192.168.1.2:5000", "203.0.113.1:6000", NATSymetric, false), peer("10.0.0.3:5000", "198.51.100.1:6000", NATSymetric, false), StrategyRelay},
+		{peer("192.168.1.2:5000", "203.0.113.1:6000", NATFull, false), peer("10.0.0.3:5000", "198.51.100.1:6000", NATBlocked, false), StrategyRelay},
+		{peer("192.168.1.2:5000", "203.0.113.1:6000", NATFull, false), PeerInfo{NAT: NATUnreachable}, StrategyRelay},
+	}
+	for i, tt := range tests {
+		if s := ConnectStrategy(tt.a, tt.b); s != tt.s {
+			t.Errorf("ConnectStrategy error of test %d: %v, expected %v", i, s, tt.s)
+		}
+		if s := ConnectStrategy(tt.b, tt.a); s != tt.s {
+			t.Errorf("ConnectStrategy error of test %d reversed: %v, expected %v", i, s, tt.s)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// Transports of STUN messages.
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+	TransportTLS = "tls"
+)
+
+// RFC 5389: Reliable transports only need a single transaction timeout,
+// which is 39.5 seconds.
+const streamTimeout = 39500
+
+// streamConn adapts a TCP or TLS connection to net.PacketConn, so that the
+// transactions over it share the code of UDP. Messages, STUN or ChannelData,
+// are framed by the length in their header, and written as whole to the
+// peer regardless of the address passed to WriteTo.
+type streamConn struct {
+	net.Conn
+	decoder *Decoder
+	timeout int // of the connection and the transactions, in ms
+}
+
+func newStreamConn(conn net.Conn) *streamConn {
+	return &streamConn{conn, NewDecoder(conn), streamTimeout}
+}
+
+// dialStream connects to addr over TCP or TLS.
+func dialStream(transport string, addr string, opts *TLSOptions) (*streamConn, error) {
+	return dialStreamTimeout(transport, addr, opts, streamTimeout)
+}
+
+// dialStreamTimeout connects to addr over TCP or TLS, of the timeout in ms
+// instead of the one of RFC 5389.
+func dialStreamTimeout(transport string, addr string, opts *TLSOptions, timeout int) (*streamConn, error) {
+	dialer := &net.Dialer{Timeout: time.Duration(timeout) * time.Millisecond}
+	switch transport {
+	case TransportTCP:
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return &streamConn{conn, NewDecoder(conn), timeout}, nil
+	case TransportTLS:
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, opts.config(host))
+		if err != nil {
+			return nil, err
+		}
+		return &streamConn{conn, NewDecoder(conn), timeout}, nil
+	}
+	return nil, errors.New("Unknown transport: " + transport)
+}
+
+func (c *streamConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	m, err := c.decoder.readFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	n := copy(b, m)
+	return n, c.RemoteAddr(), nil
+}
+
+func (c *streamConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
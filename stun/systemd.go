@@ -0,0 +1,84 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// First file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// SystemdPacketConns returns the datagram sockets passed by systemd with
+// socket activation (see sd_listen_fds(3)), in the order of the socket unit,
+// and unsets the environment variables so that they are not passed to the
+// child processes. It returns no socket if the process is not activated.
+// The names of the sockets given by FileDescriptorName are returned too.
+func SystemdPacketConns() ([]net.PacketConn, []string, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, nil, errors.New("Invalid LISTEN_FDS.")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	conns := make([]net.PacketConn, 0, n)
+	connNames := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		// FilePacketConn duplicates the descriptor, which is close-on-exec.
+		conn, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, nil, err
+		}
+		conns = append(conns, conn)
+		connNames = append(connNames, name)
+	}
+	return conns, connNames, nil
+}
+
+// ServeSystemd serves the requests on the sockets passed by systemd, see
+// SystemdPacketConns, so that the server can be socket-activated and
+// restarted without closing the port. It returns when the server is closed
+// or any of the sockets fails, and closes all of them.
+func (s *Server) ServeSystemd() error {
+	conns, _, err := SystemdPacketConns()
+	if err != nil {
+		return err
+	}
+	if len(conns) == 0 {
+		return errors.New("No socket passed by systemd.")
+	}
+	return s.serveAll(conns, make([]ListenerConfig, len(conns)))
+}
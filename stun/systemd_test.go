@@ -0,0 +1,35 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestSystemdPacketConns(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	conns, _, err := SystemdPacketConns()
+	if err != nil || len(conns) != 0 {
+		t.Errorf("SystemdPacketConns error: %d sockets for another process, %v", len(conns), err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("SystemdPacketConns error: environment not unset")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+// ALPN protocol identifiers of the TLS transports (RFC 7443).
+const (
+	ALPNTURN         = "stun.turn"
+	ALPNNATDiscovery = "stun.nat-discovery"
+)
+
+// TLSOptions configures the TLS transport of STUN (stuns:) and TURN (turns:)
+// servers.
+type TLSOptions struct {
+	// ServerName is used to verify the certificate of the server. It
+	// defaults to the host of the server address.
+	ServerName string
+	// RootCAs is the set of certificate authorities trusted to sign server
+	// certificates. If nil, the root set of the host is used. Self-signed
+	// server certificates can be trusted by adding them here.
+	RootCAs *x509.CertPool
+	// Pins are SHA-256 digests of the DER-encoded SubjectPublicKeyInfo of
+	// the trusted keys, see SPKIPin. If not empty, at least one certificate
+	// of the verified chain must carry one of the keys.
+	Pins [][]byte
+	// MinVersion is the minimum TLS version accepted, tls.VersionTLS12 by
+	// default.
+	MinVersion uint16
+	// ALPN is the list of application protocols to offer, e.g.
+	// ALPNNATDiscovery for STUN and ALPNTURN for TURN.
+	ALPN []string
+}
+
+// SPKIPin returns the pin of the public key of cert, for TLSOptions.Pins.
+func SPKIPin(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// config returns the tls.Config for a connection to host.
+func (o *TLSOptions) config(host string) *tls.Config {
+	if o == nil {
+		o = &TLSOptions{}
+	}
+	conf := &tls.Config{
+		ServerName: o.ServerName,
+		RootCAs:    o.RootCAs,
+		MinVersion: o.MinVersion,
+		NextProtos: o.ALPN,
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = host
+	}
+	if conf.MinVersion == 0 {
+		conf.MinVersion = tls.VersionTLS12
+	}
+	if len(o.Pins) > 0 {
+		pins := o.Pins
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+	return conf
+}
+
+// verifyPins checks that the verified chains of the connection contain one of
+// the pinned keys.
+func verifyPins(cs tls.ConnectionState, pins [][]byte) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			pin := SPKIPin(cert)
+			for _, p := range pins {
+				if bytes.Equal(pin, p) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("Server certificate does not match the pinned keys.")
+}
@@ -0,0 +1,74 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newTestCert(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestVerifyPins(t *testing.T) {
+	cert, other := newTestCert(t), newTestCert(t)
+	cs := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	if err := verifyPins(cs, [][]byte{SPKIPin(other), SPKIPin(cert)}); err != nil {
+		t.Errorf("verifyPins error: %v", err)
+	}
+	if err := verifyPins(cs, [][]byte{SPKIPin(other)}); err == nil {
+		t.Errorf("verifyPins error: mismatched pin accepted")
+	}
+}
+
+func TestTLSOptionsConfig(t *testing.T) {
+	var opts *TLSOptions
+	conf := opts.config("stun.example.com")
+	if conf.ServerName != "stun.example.com" || conf.MinVersion != tls.VersionTLS12 {
+		t.Errorf("config error: default options")
+	}
+	opts = &TLSOptions{ServerName: "a", MinVersion: tls.VersionTLS13, ALPN: []string{ALPNNATDiscovery}}
+	conf = opts.config("b")
+	if conf.ServerName != "a" || conf.MinVersion != tls.VersionTLS13 ||
+		len(conf.NextProtos) != 1 || conf.VerifyConnection != nil {
+		t.Errorf("config error: custom options")
+	}
+}
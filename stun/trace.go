@@ -0,0 +1,129 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+)
+
+// Tracer starts the spans of the STUN and TURN transactions, e.g. of
+// OpenTelemetry, with an adapter of its tracer:
+//
+//	type otelTracer struct{ trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, stun.Span) {
+//		ctx, span := t.Tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+//		return ctx, otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ trace.Span }
+//
+//	func (s otelSpan) SetAttribute(key string, value interface{}) {
+//		switch v := value.(type) {
+//		case string:
+//			s.SetAttributes(attribute.String(key, v))
+//		case int:
+//			s.SetAttributes(attribute.Int(key, v))
+//		case bool:
+//			s.SetAttributes(attribute.Bool(key, v))
+//		case time.Duration:
+//			s.SetAttributes(attribute.Float64(key, v.Seconds()))
+//		}
+//	}
+//
+//	func (s otelSpan) End(err error) {
+//		if err != nil {
+//			s.RecordError(err)
+//			s.SetStatus(codes.Error, err.Error())
+//		}
+//		s.Span.End()
+//	}
+//
+// The spans of the operations taking a context, e.g. Ping, are started of
+// it, and the others of context.Background(), which a tracer made for a
+// connection setup may parent to the span of the setup instead.
+type Tracer interface {
+	// Start starts the span of the name, e.g. "STUN Binding", as a child
+	// of the span of ctx if any, and returns the context of the span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute sets the attribute of the key, e.g. "stun.server", to
+	// the value, a string, an int, a bool or a time.Duration.
+	SetAttribute(key string, value interface{})
+	// End ends the span, failed of err if not nil.
+	End(err error)
+}
+
+// noopSpan is the span of no tracer.
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) End(err error)                              {}
+
+// startSpan starts the span of the name with the tracer t, or returns a
+// no-op span if t is nil.
+func startSpan(ctx context.Context, t Tracer, name string) (context.Context, Span) {
+	if t == nil {
+		return ctx, noopSpan{}
+	}
+	return t.Start(ctx, name)
+}
+
+// spanName returns the name of the span of a transaction of the protocol,
+// e.g. "STUN Binding", of the method of the message type.
+func spanName(protocol string, types uint16) string {
+	if method, ok := methodStr[types&^classMask]; ok {
+		return protocol + " " + method
+	}
+	return protocol + " transaction"
+}
+
+// SetTracer sets the tracer of the transactions of the client, a span
+// each, with the address of the server, the attempts and the outcome.
+func (c *Client) SetTracer(t Tracer) {
+	c.tracer = t
+}
+
+// trace sets the attributes of the transaction to the span.
+func (tx *Transaction) trace(span Span) {
+	span.SetAttribute("stun.server", tx.Server)
+	span.SetAttribute("stun.attempts", tx.Attempts)
+	span.SetAttribute("stun.timeouts", tx.Timeouts)
+	if tx.Stray > 0 {
+		span.SetAttribute("stun.stray", tx.Stray)
+	}
+	switch {
+	case tx.Responded:
+		span.SetAttribute("stun.outcome", "responded")
+		span.SetAttribute("stun.rtt", tx.RTT)
+	case tx.Err != nil:
+		span.SetAttribute("stun.outcome", "failed")
+	default:
+		span.SetAttribute("stun.outcome", "lost")
+	}
+}
+
+// traceErrorCode sets the error code of the response pkt to the span of
+// its transaction, if an error response.
+func traceErrorCode(span Span, pkt *packet) {
+	if pkt != nil && pkt.types&classMask == classError {
+		span.SetAttribute("stun.error_code", pkt.getErrorCode())
+	}
+}
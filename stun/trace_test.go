@@ -0,0 +1,108 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+// testSpan is a span recorded by testTracer.
+type testSpan struct {
+	name  string
+	attrs map[string]interface{}
+	err   error
+	ended bool
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *testSpan) End(err error)                              { s.err, s.ended = err, true }
+
+// testTracer records the spans started.
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	s := &testSpan{name: name, attrs: make(map[string]interface{})}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return ctx, s
+}
+
+func TestClientTracer(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	tracer := &testTracer{}
+	c.SetTracer(tracer)
+	_, addr := newTestServer(t)
+	c.SetServerAddr(addr)
+	if _, err := c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	pkt, err := c.newBindingReq(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.transmit(pkt, conn, silent.LocalAddr(), 2)
+	if len(tracer.spans) != 2 {
+		t.Fatalf("Tracer error: %d spans", len(tracer.spans))
+	}
+	s := tracer.spans[0]
+	if s.name != "STUN Binding" || !s.ended || s.attrs["stun.server"] != addr ||
+		s.attrs["stun.attempts"] != 1 || s.attrs["stun.outcome"] != "responded" || s.attrs["stun.rtt"] == nil {
+		t.Errorf("Tracer error: %+v", s)
+	}
+	s = tracer.spans[1]
+	if s.attrs["stun.attempts"] != 2 || s.attrs["stun.timeouts"] != 2 || s.attrs["stun.outcome"] != "lost" {
+		t.Errorf("Tracer error: %+v", s)
+	}
+}
+
+func TestTURNClientTracer(t *testing.T) {
+	_, c := newTestTURNClient(t, TURNConfig{})
+	tracer := &testTracer{}
+	c.SetTracer(tracer)
+	c.SetCredentials("alice", "secret")
+	if _, err := c.Allocate(); err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	// The request challenged and the one with the credentials.
+	if len(tracer.spans) != 2 {
+		t.Fatalf("Tracer error: %d spans", len(tracer.spans))
+	}
+	s := tracer.spans[0]
+	if s.name != "TURN Allocate" || s.attrs["stun.outcome"] != "responded" || s.attrs["stun.error_code"] != errorUnauthorized {
+		t.Errorf("Tracer error: %+v", s)
+	}
+	if s = tracer.spans[1]; s.attrs["stun.error_code"] != nil || s.err != nil || !s.ended {
+		t.Errorf("Tracer error: %+v", s)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"container/heap"
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+const (
+	// Maximum number of distinct methods and attribute types counted, so
+	// that crafted requests cannot grow the counters without bound.
+	maxTrafficTypes = 256
+	// Number of sources tracked for the top talkers.
+	maxTalkers = 128
+)
+
+// TrafficReport describes the composition of the traffic of a server.
+type TrafficReport struct {
+	// Methods counts the requests by method, i.e. message type without
+	// the class bits.
+	Methods map[uint16]uint64
+	// Attributes counts the attributes of the requests by type.
+	Attributes map[uint16]uint64
+	// Other counts the requests and attributes of the types not counted
+	// after the limit of distinct types is reached.
+	Other uint64
+	// TopTalkers lists the sources sending the most packets, in
+	// descending order.
+	TopTalkers []Talker
+}
+
+// Talker is a source of packets of a server. The counts are estimated with
+// the space-saving algorithm: Packets may be over the actual count by up to
+// Error.
+type Talker struct {
+	Addr    netip.Addr
+	Packets uint64
+	Error   uint64
+}
+
+// trafficStats aggregates the traffic of a server with bounded memory.
+type trafficStats struct {
+	mu         sync.Mutex
+	methods    map[uint16]uint64
+	attributes map[uint16]uint64
+	other      uint64
+	talkers    map[netip.Addr]*talker
+	smallest   talkerHeap // of the talkers, by packets
+}
+
+// talker is a tracked source, at index in the heap of the talkers.
+type talker struct {
+	Talker
+	index int
+}
+
+// talkerHeap is a min-heap of the talkers by packets, whose root is the one
+// replaced by a new source.
+type talkerHeap []*talker
+
+func (h talkerHeap) Len() int           { return len(h) }
+func (h talkerHeap) Less(i, j int) bool { return h[i].Packets < h[j].Packets }
+
+func (h talkerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *talkerHeap) Push(x interface{}) {
+	tk := x.(*talker)
+	tk.index = len(*h)
+	*h = append(*h, tk)
+}
+
+func (h *talkerHeap) Pop() interface{} {
+	old := *h
+	tk := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return tk
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{
+		methods:    make(map[uint16]uint64),
+		attributes: make(map[uint16]uint64),
+		talkers:    make(map[netip.Addr]*talker),
+	}
+}
+
+// packet counts a packet from ip, in O(log maxTalkers).
+func (t *trafficStats) packet(ip netip.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tk, ok := t.talkers[ip]; ok {
+		tk.Packets++
+		heap.Fix(&t.smallest, tk.index)
+		return
+	}
+	if len(t.talkers) < maxTalkers {
+		tk := &talker{Talker: Talker{Addr: ip, Packets: 1}}
+		t.talkers[ip] = tk
+		heap.Push(&t.smallest, tk)
+		return
+	}
+	// Replace the smallest talker, whose count the new one inherits.
+	tk := t.smallest[0]
+	delete(t.talkers, tk.Addr)
+	tk.Talker = Talker{Addr: ip, Packets: tk.Packets + 1, Error: tk.Packets}
+	t.talkers[ip] = tk
+	heap.Fix(&t.smallest, 0)
+}
+
+// request counts the method and the attributes of req.
+func (t *trafficStats) request(req *packet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count(t.methods, req.types&^classMask)
+	for _, a := range req.attributes {
+		t.count(t.attributes, a.types)
+	}
+}
+
+func (t *trafficStats) count(m map[uint16]uint64, types uint16) {
+	if _, ok := m[types]; ok || len(m) < maxTrafficTypes {
+		m[types]++
+		return
+	}
+	t.other++
+}
+
+// report returns the counters and the n top talkers.
+func (t *trafficStats) report(n int) TrafficReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := TrafficReport{
+		Methods:    make(map[uint16]uint64, len(t.methods)),
+		Attributes: make(map[uint16]uint64, len(t.attributes)),
+		Other:      t.other,
+		TopTalkers: make([]Talker, 0, len(t.talkers)),
+	}
+	for k, v := range t.methods {
+		r.Methods[k] = v
+	}
+	for k, v := range t.attributes {
+		r.Attributes[k] = v
+	}
+	for _, tk := range t.talkers {
+		r.TopTalkers = append(r.TopTalkers, tk.Talker)
+	}
+	sort.Slice(r.TopTalkers, func(i, j int) bool {
+		return r.TopTalkers[i].Packets > r.TopTalkers[j].Packets
+	})
+	if n >= 0 && n < len(r.TopTalkers) {
+		r.TopTalkers = r.TopTalkers[:n]
+	}
+	return r
+}
@@ -0,0 +1,77 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestTrafficStats(t *testing.T) {
+	ts := newTrafficStats()
+	heavy := netip.MustParseAddr("192.0.2.1")
+	for i := 0; i < 1000; i++ {
+		ts.packet(heavy)
+		ts.packet(netip.AddrFrom4([4]byte{198, 51, byte(i >> 8), byte(i)}))
+	}
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	req.addAttribute(*newSoftwareAttribute("test"))
+	for i := 0; i < maxTrafficTypes+10; i++ {
+		// Spread i over the method bits, skipping the class ones.
+		req.types = uint16(i)&0x000f | uint16(i)&0x0070<<1 | uint16(i)&0x0f80<<2
+		ts.request(req)
+	}
+	r := ts.report(1)
+	if len(r.TopTalkers) != 1 || r.TopTalkers[0].Addr != heavy || r.TopTalkers[0].Packets < 1000 {
+		t.Errorf("report error: top talkers %v", r.TopTalkers)
+	}
+	if len(ts.talkers) > maxTalkers || len(r.Methods) > maxTrafficTypes || r.Other == 0 {
+		t.Errorf("report error: %d talkers, %d methods, %d other", len(ts.talkers), len(r.Methods), r.Other)
+	}
+	if r.Attributes[attributeSoftware] != maxTrafficTypes+10 {
+		t.Errorf("report error: attributes %v", r.Attributes)
+	}
+
+	// A new source replaces the smallest talker.
+	ts = newTrafficStats()
+	for i := 0; i < maxTalkers; i++ {
+		ip := netip.AddrFrom4([4]byte{198, 51, 100, byte(i)})
+		for j := 0; j < maxTalkers-i; j++ {
+			ts.packet(ip)
+		}
+	}
+	ts.packet(heavy)
+	tk := ts.talkers[heavy]
+	if _, ok := ts.talkers[netip.AddrFrom4([4]byte{198, 51, 100, maxTalkers - 1})]; ok || tk == nil || tk.Packets != 2 || tk.Error != 1 {
+		t.Errorf("packet error: smallest talker not replaced, %+v", tk)
+	}
+}
+
+func TestServerTrafficACL(t *testing.T) {
+	s := NewServer()
+	s.SetACL(&ACL{Deny: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}})
+	req, _ := newPacket()
+	req.types = typeBindingRequest
+	s.handle(req.bytes(), &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5678}, &listener{}, time.Now())
+	s.handle(req.bytes(), &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5678}, &listener{}, time.Now())
+	if r := s.TrafficReport(-1); len(r.TopTalkers) != 1 || r.TopTalkers[0].Addr != netip.MustParseAddr("198.51.100.1") {
+		t.Errorf("TrafficReport error: top talkers %v", r.TopTalkers)
+	}
+}
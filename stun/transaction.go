@@ -0,0 +1,200 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Transaction is the outcome of a request transaction of the client.
+type Transaction struct {
+	Server string
+	// Attempts is the number of the requests sent, the first one and the
+	// retransmissions, of which Timeouts timed out without response.
+	Attempts int
+	Timeouts int
+	// Stray is the number of the packets read of other transactions, e.g.
+	// the late responses to earlier ones.
+	Stray int
+	// Responded is whether a response was matched, RTT after the last
+	// attempt and Elapsed after the first one.
+	Responded bool
+	RTT       time.Duration
+	Elapsed   time.Duration
+	// Err is the error failing the transaction, e.g. an ICMP error.
+	Err error
+}
+
+// TransactionStats is a snapshot of the counters of the transactions of a
+// client.
+type TransactionStats struct {
+	// Transactions is the number of the transactions, either Responded,
+	// Lost without a response to any attempt, or Failed of an error.
+	Transactions uint64
+	Responded    uint64
+	Lost         uint64
+	Failed       uint64
+	// Sent and Timeouts are the requests sent and timed out.
+	Sent     uint64
+	Timeouts uint64
+	// Attempts[i] is the number of the transactions responded to after
+	// i+1 attempts.
+	Attempts []uint64
+	Stray    uint64
+	// RTT is the round-trip time of the transactions responded to.
+	RTT Histogram
+}
+
+// PacketLoss estimates the fraction of the requests or responses lost by
+// the network, of the retransmissions of the transactions eventually
+// responded to. A slow or lossy network shows as packet loss, while a NAT
+// or firewall filtering the responses shows as transactions lost instead.
+func (s *TransactionStats) PacketLoss() float64 {
+	var sent, lost uint64
+	for i, n := range s.Attempts {
+		sent += uint64(i+1) * n
+		lost += uint64(i) * n
+	}
+	if sent == 0 {
+		return 0
+	}
+	return float64(lost) / float64(sent)
+}
+
+// TransactionLoss is the fraction of the transactions lost, of the ones
+// not failed.
+func (s *TransactionStats) TransactionLoss() float64 {
+	if s.Responded+s.Lost == 0 {
+		return 0
+	}
+	return float64(s.Lost) / float64(s.Responded+s.Lost)
+}
+
+var rttBounds = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+}
+
+// clientStats aggregates the transactions of a client for Client.Stats.
+type clientStats struct {
+	mu  sync.Mutex
+	st  TransactionStats
+	rtt []uint64
+}
+
+func newClientStats() *clientStats {
+	return &clientStats{rtt: make([]uint64, len(rttBounds)+1)}
+}
+
+func (s *clientStats) record(tx *Transaction) {
+	countExpvar(&expvars.requestsSent, tx.Attempts)
+	countExpvar(&expvars.timeouts, tx.Timeouts)
+	if tx.Responded {
+		countExpvar(&expvars.responsesReceived, 1)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &s.st
+	st.Transactions++
+	st.Sent += uint64(tx.Attempts)
+	st.Timeouts += uint64(tx.Timeouts)
+	st.Stray += uint64(tx.Stray)
+	switch {
+	case tx.Responded:
+		st.Responded++
+		for len(st.Attempts) < tx.Attempts {
+			st.Attempts = append(st.Attempts, 0)
+		}
+		st.Attempts[tx.Attempts-1]++
+		i := 0
+		for i < len(rttBounds) && tx.RTT > rttBounds[i] {
+			i++
+		}
+		s.rtt[i]++
+		st.RTT.Count++
+		st.RTT.Sum += tx.RTT
+	case tx.Err != nil:
+		st.Failed++
+	default:
+		st.Lost++
+	}
+}
+
+func (s *clientStats) snapshot() TransactionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.st
+	st.Attempts = append([]uint64(nil), s.st.Attempts...)
+	st.RTT.Bounds = append([]time.Duration(nil), rttBounds...)
+	st.RTT.Counts = append([]uint64(nil), s.rtt...)
+	return st
+}
+
+// SetTransactionObserver sets the function called with each transaction of
+// the client, in addition to the counters returned by Stats. It is called
+// from the goroutine of the transaction, so it must be safe for concurrent
+// use and return quickly.
+func (c *Client) SetTransactionObserver(f func(tx *Transaction)) {
+	c.txObserver = f
+}
+
+// Stats returns a snapshot of the counters of the transactions of the
+// client.
+func (c *Client) Stats() TransactionStats {
+	return c.stats.snapshot()
+}
+
+// recordTransaction records the transaction in the statistics and reports
+// it to the observer.
+func (c *Client) recordTransaction(tx *Transaction) {
+	c.stats.record(tx)
+	if c.txObserver != nil {
+		c.txObserver(tx)
+	}
+}
+
+// logTransaction logs the transaction: its result, or its failure or
+// loss.
+func (c *Client) logTransaction(tx *Transaction) {
+	switch {
+	case tx.Responded:
+		c.logger.logAttrs(levelInfo, "STUN transaction", "server", tx.Server, "attempts", tx.Attempts, "rtt", tx.RTT)
+	case tx.Err != nil:
+		c.logger.Errorln("Transaction to", tx.Server, "failed:", tx.Err)
+	default:
+		c.logger.Warnln("No response from", tx.Server, "after", tx.Attempts, "attempts")
+	}
+}
+
+// MarshalJSON implements json.Marshaler, of Err as its message.
+func (tx Transaction) MarshalJSON() ([]byte, error) {
+	type transaction Transaction
+	return json.Marshal(struct {
+		transaction
+		Err string `json:",omitempty"`
+	}{transaction(tx), errorText(tx.Err)})
+}
@@ -0,0 +1,95 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// newLossyServer returns the address of a server dropping the first
+// request of each transaction, as a lossy network.
+func newLossyServer(t *testing.T) string {
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	return newRespondingServer(t, func(w ResponseWriter, r *Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !seen[string(r.pkt.transID)] {
+			seen[string(r.pkt.transID)] = true
+			w.Drop()
+			return
+		}
+		addXorMapped(w, r, r.Source)
+	})
+}
+
+func TestTransactionStats(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewClientWithConnection(conn)
+	var txs []Transaction
+	c.SetTransactionObserver(func(tx *Transaction) { txs = append(txs, *tx) })
+	_, addr := newTestServer(t)
+	c.SetServerAddr(addr)
+	if _, err := c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	c.SetServerAddr(newLossyServer(t))
+	if _, err := c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	// A server not responding.
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	pkt, err := c.newBindingReq(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := c.transmit(pkt, conn, silent.LocalAddr(), 2); resp != nil || err != nil {
+		t.Fatalf("transmit error: %v, %v", resp, err)
+	}
+	st := c.Stats()
+	if st.Transactions != 3 || st.Responded != 2 || st.Lost != 1 || st.Failed != 0 {
+		t.Errorf("Stats error: %+v", st)
+	}
+	if st.Sent != 5 || st.Timeouts != 3 {
+		t.Errorf("Stats error: %d sent, %d timeouts", st.Sent, st.Timeouts)
+	}
+	if len(st.Attempts) != 2 || st.Attempts[0] != 1 || st.Attempts[1] != 1 {
+		t.Errorf("Stats error: attempts %v", st.Attempts)
+	}
+	if st.RTT.Count != 2 {
+		t.Errorf("Stats error: %d RTTs", st.RTT.Count)
+	}
+	if l := st.PacketLoss(); l != 1.0/3 {
+		t.Errorf("PacketLoss error: %v", l)
+	}
+	if l := st.TransactionLoss(); l != 1.0/3 {
+		t.Errorf("TransactionLoss error: %v", l)
+	}
+	if len(txs) != 3 || txs[1].Attempts != 2 || !txs[1].Responded || txs[2].Responded {
+		t.Errorf("observer error: %+v", txs)
+	}
+}
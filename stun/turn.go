@@ -0,0 +1,143 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// TURN (RFC 5766) parameters.
+const (
+	defaultAllocationLifetime = 10 * time.Minute
+	maxAllocationLifetime     = time.Hour
+	permissionLifetime        = 5 * time.Minute
+	channelLifetime           = 10 * time.Minute
+	minChannelNumber          = 0x4000
+	maxChannelNumber          = 0x7fff
+	channelDataHeaderSize     = 4
+	protocolUDP               = 17
+	typeSendIndication        = typeSend | classIndication
+	typeDataIndication        = typeData | classIndication
+	// reservationLifetime is the time the port reserved by an Allocate
+	// with EVEN-PORT is held for its RESERVATION-TOKEN.
+	reservationLifetime = 30 * time.Second
+	// evenPortAttempts bounds the listens for an even relayed port.
+	evenPortAttempts = 32
+)
+
+// wheelSlots is the number of the one second slots of the expiry wheel of
+// the TURN server. Longer deadlines take several turns.
+const wheelSlots = 1024
+
+// maxRelayPayload is the largest datagram of a peer relayed to the client,
+// the payload of a 1500 bytes Ethernet frame and more, so that the relay
+// buffers of an allocation stay small. The larger datagrams are dropped, as
+// they would be fragmented on the way to the client anyway.
+const maxRelayPayload = 1500
+
+// TURN TCP allocations (RFC 6062) parameters.
+const (
+	// connectionTimeout bounds the connection with a peer, and the wait
+	// for the ConnectionBind request of a connection.
+	connectionTimeout               = 30 * time.Second
+	protocolTCP                     = 6
+	typeConnectionAttemptIndication = typeConnectionAttempt | classIndication
+)
+
+// newLifetimeAttribute returns the LIFETIME attribute of d.
+func newLifetimeAttribute(d time.Duration) *attribute {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(d/time.Second))
+	return newAttribute(attributeLifetime, b)
+}
+
+// getLifetime returns the duration of the LIFETIME attribute, and whether
+// the attribute is present.
+func (v *packet) getLifetime() (time.Duration, bool) {
+	a := v.getAttribute(attributeLifetime)
+	if a == nil || a.length < 4 {
+		return 0, false
+	}
+	return time.Duration(binary.BigEndian.Uint32(a.value)) * time.Second, true
+}
+
+// newConnectionIDAttribute returns the CONNECTION-ID attribute of id.
+func newConnectionIDAttribute(id uint32) *attribute {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, id)
+	return newAttribute(attributeConnectionID, b)
+}
+
+// getConnectionID returns the value of the CONNECTION-ID attribute, and
+// whether the attribute is present.
+func (v *packet) getConnectionID() (uint32, bool) {
+	a := v.getAttribute(attributeConnectionID)
+	if a == nil || a.length < 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(a.value), true
+}
+
+// newChannelNumberAttribute returns the CHANNEL-NUMBER attribute of number.
+func newChannelNumberAttribute(number uint16) *attribute {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, number)
+	return newAttribute(attributeChannelNumber, b)
+}
+
+// getPeerAddrs returns the XOR-PEER-ADDRESS attributes of the packet.
+func (v *packet) getPeerAddrs() []*Host {
+	var hosts []*Host
+	for i := range v.attributes {
+		a := &v.attributes[i]
+		if a.types == attributeXorPeerAddress && a.length >= 8 {
+			hosts = append(hosts, a.xorAddr(v.transID))
+		}
+	}
+	return hosts
+}
+
+// newChannelData returns the ChannelData message of the channel carrying
+// data (RFC 5766 section 11.4). It is not padded, as over UDP.
+func newChannelData(number uint16, data []byte) []byte {
+	b := make([]byte, channelDataHeaderSize+len(data))
+	binary.BigEndian.PutUint16(b[0:2], number)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(data)))
+	copy(b[channelDataHeaderSize:], data)
+	return b
+}
+
+// padChannelData pads the ChannelData message b to a multiple of four
+// bytes, as over stream transports (RFC 5766 section 11.5).
+func padChannelData(b []byte) []byte {
+	return append(b, make([]byte, int(align(uint16(len(b))))-len(b))...)
+}
+
+// parseChannelData returns the channel number and the data of the
+// ChannelData message b, and false if b is not one.
+func parseChannelData(b []byte) (uint16, []byte, bool) {
+	if len(b) < channelDataHeaderSize {
+		return 0, nil, false
+	}
+	number := binary.BigEndian.Uint16(b[0:2])
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if number < minChannelNumber || number > maxChannelNumber || channelDataHeaderSize+length > len(b) {
+		return 0, nil, false
+	}
+	return number, b[channelDataHeaderSize : channelDataHeaderSize+length], true
+}
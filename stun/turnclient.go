@@ -0,0 +1,1388 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrClientClosed is returned by the requests of a TURN client after it is
+// closed.
+var ErrClientClosed = errors.New("TURN client closed.")
+
+// ErrAllocationClosed is returned by the methods of a TURN allocation after
+// it is closed.
+var ErrAllocationClosed = errors.New("TURN allocation closed.")
+
+// TURNError is an error response of a TURN server.
+type TURNError struct {
+	Code   int
+	Reason string
+}
+
+func (e *TURNError) Error() string {
+	return "TURN error " + strconv.Itoa(e.Code) + ": " + e.Reason
+}
+
+// TURNClient is a client of a TURN server (RFC 5766), which allocates a
+// relayed transport address on the server with Allocate. It reads the
+// connection to the server in the background until closed.
+type TURNClient struct {
+	server net.Addr
+	logger *Logger
+	auth   *turnAuth // shared by the clients of Share
+
+	mu           sync.Mutex
+	conn         net.PacketConn // replaced by Migrate
+	mobility     bool
+	softwareName string
+	tracer       Tracer
+	pending      map[string]chan *Message // by transaction ID
+	allocation   *TURNAllocation
+	shared       []*TURNClient // by Share, closed by Close
+	closed       bool
+	err          error         // of the connection, once failed
+	done         chan struct{} // closed once the connection failed
+}
+
+// turnAuth is the long-term credentials of TURN clients, with the realm and
+// the nonce last challenged with.
+type turnAuth struct {
+	mu       sync.Mutex
+	username string
+	password string
+	realm    string
+	nonce    string
+	key      []byte
+}
+
+// dataQueueSize is the number of the Data indications queued for ReadFrom
+// by a TURN allocation, beyond which the data is dropped.
+const dataQueueSize = 64
+
+// The intervals the permissions and the channels of a TURN client are
+// refreshed at, ahead of their expiry, and the delay before retrying a
+// failed Refresh of an allocation.
+const (
+	permissionRefresh = permissionLifetime - time.Minute
+	channelRefresh    = channelLifetime - time.Minute
+	refreshRetry      = 10 * time.Second
+)
+
+// A peer is promoted from Send indications to a channel once sent
+// promoteCount indications within promoteWindow, saving their 32 bytes
+// (RFC 5766 section 2.5).
+const (
+	promoteCount  = 8
+	promoteWindow = time.Second
+)
+
+// reallocationEventBuffer is the number of the ReallocationEvents buffered
+// for a subscriber.
+const reallocationEventBuffer = 4
+
+// ReallocationEvent reports an allocation of a TURN client made again by the
+// client, after lost by the server, e.g. as restarted. The new relayed
+// address is to be signaled to the peers again.
+type ReallocationEvent struct {
+	Relayed *Host
+	Mapped  *Host
+	Err     error // of the allocation, which is then retried
+}
+
+// TURNAllocation is an allocation of a TURN client. It is a net.PacketConn
+// of the relayed transport address, e.g. to be used as a relay candidate.
+// If lost by the server, it is allocated again with its permissions and
+// channels, as reported to Subscribe.
+type TURNAllocation struct {
+	c    *TURNClient
+	opts AllocateOptions // to allocate again, without ReservationToken
+	df   bool            // allocated with DONT-FRAGMENT
+
+	data chan datagram // received from the peers
+	done chan struct{} // closed by Close
+
+	mu            sync.Mutex
+	relayed       *Host
+	additional    *Host // IPv6 relayed address of a dual-stack allocation
+	mapped        *Host
+	token         []byte // RESERVATION-TOKEN of the next port, if reserved
+	lost          bool   // by the server, to allocate again
+	subs          []chan ReallocationEvent
+	lifetime      time.Duration
+	ticket        string // MOBILITY-TICKET, if any
+	dontFragment  bool
+	closed        bool
+	expiry        *time.Timer // refreshing the allocation
+	readDeadline  time.Time
+	writeDeadline time.Time
+	wake          chan struct{} // closed when the read deadline is changed
+	permissions   map[netip.Addr]struct{}
+	repermit      *time.Timer // of the permissions, once installed
+	channels      map[netip.AddrPort]uint16
+	peers         map[uint16]netip.AddrPort // by channel number
+	nextChannel   uint16
+	rebind        *time.Timer // of the channels, once bound
+	sends         map[netip.AddrPort]*sendCount
+
+	sent          turnTraffic
+	received      turnTraffic
+	drops         atomic.Uint64
+	refreshes     atomic.Uint64
+	reallocations atomic.Uint64
+}
+
+// sendCount counts the Send indications to a peer within promoteWindow.
+type sendCount struct {
+	n         int
+	start     time.Time
+	promoting bool
+}
+
+// TURNTraffic counts the data relayed in one direction of a TURN
+// allocation, in ChannelData messages and in Send or Data indications.
+type TURNTraffic struct {
+	ChannelPackets    uint64
+	ChannelBytes      uint64
+	IndicationPackets uint64
+	IndicationBytes   uint64
+}
+
+// Packets returns the number of the packets relayed.
+func (t TURNTraffic) Packets() uint64 {
+	return t.ChannelPackets + t.IndicationPackets
+}
+
+// Bytes returns the number of the bytes of data relayed, without the
+// framing of the messages.
+func (t TURNTraffic) Bytes() uint64 {
+	return t.ChannelBytes + t.IndicationBytes
+}
+
+// TURNAllocationStats is a snapshot of the counters of a TURN allocation.
+type TURNAllocationStats struct {
+	Sent          TURNTraffic   // to the peers
+	Received      TURNTraffic   // from the peers, including Drops
+	Drops         uint64        // packets received and dropped as the queue is full
+	Refreshes     uint64        // of the allocation, succeeded
+	Reallocations uint64        // after lost by the server
+	Lifetime      time.Duration // of the allocation, as last granted
+}
+
+// turnTraffic aggregates the data relayed in one direction for
+// TURNAllocation.Stats.
+type turnTraffic struct {
+	channelPackets    atomic.Uint64
+	channelBytes      atomic.Uint64
+	indicationPackets atomic.Uint64
+	indicationBytes   atomic.Uint64
+}
+
+func (t *turnTraffic) add(n int, channel bool) {
+	if channel {
+		t.channelPackets.Add(1)
+		t.channelBytes.Add(uint64(n))
+	} else {
+		t.indicationPackets.Add(1)
+		t.indicationBytes.Add(uint64(n))
+	}
+}
+
+func (t *turnTraffic) snapshot() TURNTraffic {
+	return TURNTraffic{
+		ChannelPackets:    t.channelPackets.Load(),
+		ChannelBytes:      t.channelBytes.Load(),
+		IndicationPackets: t.indicationPackets.Load(),
+		IndicationBytes:   t.indicationBytes.Load(),
+	}
+}
+
+// NewTURNClient returns a client of the TURN server at server over conn,
+// which it takes over: conn is closed by Close.
+func NewTURNClient(conn net.PacketConn, server net.Addr) *TURNClient {
+	return newTURNClient(conn, server, NewLogger(), &turnAuth{})
+}
+
+func newTURNClient(conn net.PacketConn, server net.Addr, logger *Logger, auth *turnAuth) *TURNClient {
+	c := &TURNClient{
+		conn:         conn,
+		server:       server,
+		logger:       logger,
+		auth:         auth,
+		softwareName: DefaultSoftwareName,
+		pending:      make(map[string]chan *Message),
+		done:         make(chan struct{}),
+	}
+	go c.read(conn)
+	return c
+}
+
+// DialTURN returns a client of the TURN server at addr over the transport,
+// TransportUDP, TransportTCP or TransportTLS (turns:) where UDP to the
+// server is blocked. opts configures TLS, and offers ALPNTURN if nil.
+func DialTURN(transport, addr string, opts *TLSOptions) (*TURNClient, error) {
+	if transport != TransportUDP {
+		if transport == TransportTLS && opts == nil {
+			opts = &TLSOptions{ALPN: []string{ALPNTURN}}
+		}
+		conn, err := dialStream(transport, addr, opts)
+		if err != nil {
+			return nil, err
+		}
+		return NewTURNClient(conn, conn.RemoteAddr()), nil
+	}
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenUDP("")
+	if err != nil {
+		return nil, err
+	}
+	return NewTURNClient(conn, server), nil
+}
+
+// SetVerbose sets the client to be in the verbose mode.
+func (c *TURNClient) SetVerbose(v bool) {
+	c.logger.SetDebug(v)
+}
+
+// SetSoftwareName sets the SOFTWARE attribute of the requests.
+func (c *TURNClient) SetSoftwareName(name string) {
+	c.mu.Lock()
+	c.softwareName = name
+	c.mu.Unlock()
+}
+
+// SetTracer sets the tracer of the transactions of the client, a span
+// each, e.g. "TURN Allocate", with the attempts and the outcome.
+func (c *TURNClient) SetTracer(t Tracer) {
+	c.mu.Lock()
+	c.tracer = t
+	c.mu.Unlock()
+}
+
+// SetCredentials sets the long-term credentials of the requests, which are
+// sent once challenged by the server.
+func (c *TURNClient) SetCredentials(username, password string) {
+	a := c.auth
+	a.mu.Lock()
+	a.username, a.password = username, password
+	if a.realm != "" {
+		a.key = LongTermKey(username, a.realm, password)
+	}
+	a.mu.Unlock()
+}
+
+// SetMobility makes the client ask for a MOBILITY-TICKET in Allocate (RFC
+// 8016), with which the allocation can be moved by Migrate.
+func (c *TURNClient) SetMobility(v bool) {
+	c.mu.Lock()
+	c.mobility = v
+	c.mu.Unlock()
+}
+
+// Share returns a client of the same server over conn, which it takes
+// over, sharing the credentials of c with the realm and the nonce, so that
+// its requests are not challenged again. A server tells the allocations
+// apart by the 5-tuples of their clients (RFC 5766 section 2.2): each of
+// several allocations, e.g. of each component of a media stream, is made by
+// its own client. An allocation of both IPv4 and IPv6 needs no other client,
+// see AllocateOptions.DualStack. The clients shared are closed by Close of
+// c.
+func (c *TURNClient) Share(conn net.PacketConn) *TURNClient {
+	sc := newTURNClient(conn, c.server, c.logger, c.auth)
+	c.mu.Lock()
+	sc.mobility, sc.softwareName, sc.tracer = c.mobility, c.softwareName, c.tracer
+	closed := c.closed
+	if !closed {
+		c.shared = append(c.shared, sc)
+	}
+	c.mu.Unlock()
+	if closed {
+		sc.Close()
+	}
+	return sc
+}
+
+// Close closes the connection to the server, and the clients shared by
+// Share.
+func (c *TURNClient) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	conn, shared := c.conn, c.shared
+	c.shared = nil
+	c.mu.Unlock()
+	for _, sc := range shared {
+		sc.Close()
+	}
+	return conn.Close()
+}
+
+// Migrate moves the client to conn, e.g. on the new network after a
+// handover, and moves its allocation there with a Refresh carrying its
+// MOBILITY-TICKET (RFC 8016). The previous connection is closed. With a nil
+// conn, the allocation is moved to the new source address of the current
+// connection.
+func (c *TURNClient) Migrate(conn net.PacketConn) error {
+	c.mu.Lock()
+	a, err := c.allocation, c.err
+	if c.closed {
+		err = ErrClientClosed
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		return errors.New("No TURN allocation to migrate.")
+	}
+	a.mu.Lock()
+	ticket := a.ticket
+	a.mu.Unlock()
+	if ticket == "" {
+		return errors.New("TURN allocation without mobility ticket.")
+	}
+	if conn != nil {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			conn.Close()
+			return ErrClientClosed
+		}
+		old := c.conn
+		c.conn = conn
+		c.mu.Unlock()
+		go c.read(conn)
+		old.Close()
+	}
+	return a.refresh()
+}
+
+// packetConn returns the connection to the server.
+func (c *TURNClient) packetConn() net.PacketConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// AllocateOptions are the options of an allocation of a TURN client.
+type AllocateOptions struct {
+	// EvenPort asks for an even relayed port, and ReservePort for the
+	// next port to be reserved as well, e.g. for the RTP and the RTCP of
+	// a media stream. The ReservationToken of the allocation is then
+	// allocated by another client.
+	EvenPort    bool
+	ReservePort bool
+	// ReservationToken allocates the port reserved by another allocation.
+	ReservationToken []byte
+	// DontFragment asks for the DF bit on all the data relayed to the
+	// peers.
+	DontFragment bool
+	// IPv6 asks for an IPv6 relayed transport address (RFC 6156).
+	IPv6 bool
+	// DualStack asks for an IPv6 relayed transport address in addition
+	// to the IPv4 one, in one allocation of the connection (RFC 8656
+	// section 7.2), through which the peers of both families are reached.
+	// The server may grant the IPv4 one only, see RelayedAddrs. It cannot
+	// be combined with IPv6.
+	DualStack bool
+}
+
+// Allocate allocates a relayed transport address for UDP on the server.
+func (c *TURNClient) Allocate() (*TURNAllocation, error) {
+	return c.AllocateWithOptions(nil)
+}
+
+// AllocateWithOptions allocates a relayed transport address for UDP on the
+// server with the options.
+func (c *TURNClient) AllocateWithOptions(opts *AllocateOptions) (*TURNAllocation, error) {
+	if opts == nil {
+		opts = &AllocateOptions{}
+	}
+	resp, err := c.allocate(opts)
+	if err != nil {
+		return nil, err
+	}
+	a := &TURNAllocation{
+		c:           c,
+		opts:        *opts,
+		df:          opts.DontFragment,
+		data:        make(chan datagram, dataQueueSize),
+		done:        make(chan struct{}),
+		wake:        make(chan struct{}),
+		permissions: make(map[netip.Addr]struct{}),
+		channels:    make(map[netip.AddrPort]uint16),
+		peers:       make(map[uint16]netip.AddrPort),
+		nextChannel: minChannelNumber,
+		sends:       make(map[netip.AddrPort]*sendCount),
+	}
+	a.opts.ReservationToken = nil
+	if err := a.update(resp); err != nil {
+		return nil, err
+	}
+	a.expiry = time.AfterFunc(refreshDelay(a.lifetime), a.refreshAllocation)
+	c.mu.Lock()
+	c.allocation = a
+	c.mu.Unlock()
+	return a, nil
+}
+
+// allocate sends the Allocate request of the options.
+func (c *TURNClient) allocate(opts *AllocateOptions) (*packet, error) {
+	c.mu.Lock()
+	mobility := c.mobility
+	c.mu.Unlock()
+	return c.request(typeAllocate, func(pkt *packet) {
+		pkt.addAttribute(*newAttribute(attributeRequestedTransport, []byte{protocolUDP, 0, 0, 0}))
+		if opts.EvenPort || opts.ReservePort {
+			var flags byte
+			if opts.ReservePort {
+				flags = 0x80
+			}
+			pkt.addAttribute(*newAttribute(attributeEvenPort, []byte{flags}))
+		}
+		if opts.ReservationToken != nil {
+			pkt.addAttribute(*newAttribute(attributeReservationToken, opts.ReservationToken))
+		}
+		if opts.DontFragment {
+			pkt.addAttribute(*newAttribute(attributeDontFragment, nil))
+		}
+		if opts.IPv6 {
+			pkt.addAttribute(*newAttribute(attributeRequestedAddressFamily, []byte{attributeFamilyIPV6, 0, 0, 0}))
+		}
+		if opts.DualStack {
+			pkt.addAttribute(*newAttribute(attributeAdditionalAddressFamily, []byte{attributeFamilyIPV6, 0, 0, 0}))
+		}
+		if mobility {
+			pkt.addAttribute(*newAttribute(attributeMobilityTicket, nil))
+		}
+	})
+}
+
+// update takes the addresses, the lifetime and the tickets of the Allocate
+// response resp.
+func (a *TURNAllocation) update(resp *packet) error {
+	relayed := resp.getXorAddr(attributeXorRelayedAddress)
+	if relayed == nil {
+		return errors.New("Allocate response without XOR-RELAYED-ADDRESS.")
+	}
+	lifetime, ok := resp.getLifetime()
+	if !ok {
+		lifetime = defaultAllocationLifetime
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.relayed, a.mapped, a.lifetime = relayed, resp.getXorMappedAddr(), lifetime
+	// The relayed address of the additional family follows the first one.
+	a.additional = nil
+	for i := range resp.attributes {
+		if at := &resp.attributes[i]; at.types == attributeXorRelayedAddress {
+			if h := at.xorAddr(resp.transID); h != nil && h.Family() != relayed.Family() {
+				a.additional = h
+				break
+			}
+		}
+	}
+	a.ticket = resp.getString(attributeMobilityTicket)
+	a.token = nil
+	if token := resp.getAttribute(attributeReservationToken); token != nil {
+		a.token = token.value[:token.length]
+	}
+	return nil
+}
+
+// refreshDelay returns the delay before refreshing an allocation of the
+// lifetime: a fifth of it ahead of the expiry, less up to a tenth at random
+// so that the clients started together do not refresh together.
+func refreshDelay(lifetime time.Duration) time.Duration {
+	d := lifetime - lifetime/5
+	if j := int64(lifetime / 10); j > 0 {
+		d -= time.Duration(rand.Int63n(j))
+	}
+	return d
+}
+
+// RelayedAddr returns the relayed transport address of the allocation.
+func (a *TURNAllocation) RelayedAddr() *Host {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.relayed
+}
+
+// RelayedAddrs returns the relayed transport addresses of the allocation:
+// the one of RelayedAddr and, if the server granted it to DualStack, the
+// IPv6 one.
+func (a *TURNAllocation) RelayedAddrs() []*Host {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.additional == nil {
+		return []*Host{a.relayed}
+	}
+	return []*Host{a.relayed, a.additional}
+}
+
+// MappedAddr returns the address of the client as seen by the server, or
+// nil if the server did not tell.
+func (a *TURNAllocation) MappedAddr() *Host {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.mapped
+}
+
+// SetDontFragment makes the data sent by WriteTo carry DONT-FRAGMENT, for
+// the server to relay it with the DF bit. As ChannelData cannot carry it,
+// the data is then sent in Send indications, unless allocated with
+// AllocateOptions.DontFragment.
+func (a *TURNAllocation) SetDontFragment(v bool) {
+	a.mu.Lock()
+	a.dontFragment = v
+	a.mu.Unlock()
+}
+
+// ReservationToken returns the RESERVATION-TOKEN of the port reserved with
+// AllocateOptions.ReservePort, or nil.
+func (a *TURNAllocation) ReservationToken() []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.token
+}
+
+// Subscribe returns a channel receiving the ReallocationEvents of the
+// allocation, closed by Close. Events are dropped if the subscriber does
+// not keep up.
+func (a *TURNAllocation) Subscribe() <-chan ReallocationEvent {
+	ch := make(chan ReallocationEvent, reallocationEventBuffer)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		close(ch)
+	} else {
+		a.subs = append(a.subs, ch)
+	}
+	return ch
+}
+
+// publish sends ev to the subscribers.
+func (a *TURNAllocation) publish(ev ReallocationEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, ch := range a.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Stats returns a snapshot of the counters of the allocation.
+func (a *TURNAllocation) Stats() TURNAllocationStats {
+	return TURNAllocationStats{
+		Sent:          a.sent.snapshot(),
+		Received:      a.received.snapshot(),
+		Drops:         a.drops.Load(),
+		Refreshes:     a.refreshes.Load(),
+		Reallocations: a.reallocations.Load(),
+		Lifetime:      a.Lifetime(),
+	}
+}
+
+// Lifetime returns the lifetime of the allocation granted by the server,
+// by the last Refresh.
+func (a *TURNAllocation) Lifetime() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lifetime
+}
+
+// Close deallocates the allocation with a Refresh of lifetime zero, and
+// stops refreshing its permissions and channels.
+func (a *TURNAllocation) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	for _, timer := range []*time.Timer{a.expiry, a.repermit, a.rebind} {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	for _, ch := range a.subs {
+		close(ch)
+	}
+	a.subs = nil
+	a.mu.Unlock()
+	close(a.done)
+	c := a.c
+	c.mu.Lock()
+	if c.allocation == a {
+		c.allocation = nil
+	}
+	c.mu.Unlock()
+	_, err := c.request(typeRefresh, func(pkt *packet) {
+		pkt.addAttribute(*newLifetimeAttribute(0))
+	})
+	// The allocation is gone already on a mismatch.
+	if isAllocationMismatch(err) {
+		return nil
+	}
+	return err
+}
+
+// isAllocationMismatch reports whether err is the 437 error response of a
+// server which has not the allocation.
+func isAllocationMismatch(err error) bool {
+	terr, ok := err.(*TURNError)
+	return ok && terr.Code == errorAllocationMismatch
+}
+
+// refreshAllocation refreshes the allocation ahead of its expiry, until
+// closed, and allocates it again once lost by the server. A stale nonce is
+// taken by request.
+func (a *TURNAllocation) refreshAllocation() {
+	a.mu.Lock()
+	lost := a.lost
+	a.mu.Unlock()
+	var err error
+	if lost {
+		err = a.reallocate()
+	} else {
+		err = a.refresh()
+	}
+	if err == ErrClientClosed {
+		return
+	}
+	delay := refreshRetry
+	if err == nil {
+		if !lost {
+			a.refreshes.Add(1)
+		}
+		delay = refreshDelay(a.Lifetime())
+	} else if !lost && isAllocationMismatch(err) {
+		a.c.logger.Warnln("TURN allocation lost:", err)
+		a.lose()
+		return
+	} else {
+		a.c.logger.Errorln("Refresh TURN allocation:", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.closed {
+		a.expiry.Reset(delay)
+	}
+}
+
+// lose marks the allocation lost by the server, to be allocated again right
+// away.
+func (a *TURNAllocation) lose() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lost = true
+	if !a.closed {
+		a.expiry.Reset(0)
+	}
+}
+
+// reallocate allocates the allocation again, installs its permissions and
+// channels again, and reports it to the subscribers.
+func (a *TURNAllocation) reallocate() error {
+	resp, err := a.c.allocate(&a.opts)
+	if err == nil {
+		err = a.update(resp)
+	}
+	if err == ErrClientClosed {
+		return err
+	}
+	if err != nil {
+		a.publish(ReallocationEvent{Err: err})
+		return err
+	}
+	a.mu.Lock()
+	a.lost = false
+	a.mu.Unlock()
+	a.reallocations.Add(1)
+	if peers := a.Permissions(); len(peers) > 0 {
+		if err := a.c.createPermission(peers); err != nil {
+			a.c.logger.Errorln("Install TURN permissions again:", err)
+		}
+	}
+	for peer, number := range a.Channels() {
+		if err := a.c.bindChannel(number, newHost(peer)); err != nil {
+			a.c.logger.Errorln("Bind TURN channel", number, "again:", err)
+		}
+	}
+	a.publish(ReallocationEvent{Relayed: a.RelayedAddr(), Mapped: a.MappedAddr()})
+	return nil
+}
+
+// refresh sends the Refresh request of the allocation keeping its lifetime,
+// with its MOBILITY-TICKET if any, which is replaced by the server.
+func (a *TURNAllocation) refresh() error {
+	a.mu.Lock()
+	lifetime, ticket := a.lifetime, a.ticket
+	a.mu.Unlock()
+	resp, err := a.c.request(typeRefresh, func(pkt *packet) {
+		pkt.addAttribute(*newLifetimeAttribute(lifetime))
+		if ticket != "" {
+			pkt.addAttribute(*newAttribute(attributeMobilityTicket, []byte(ticket)))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	if d, ok := resp.getLifetime(); ok {
+		a.lifetime = d
+	}
+	if t := resp.getString(attributeMobilityTicket); t != "" {
+		a.ticket = t
+	}
+	a.mu.Unlock()
+	return nil
+}
+
+// CreatePermission installs the permissions of the peers on the server, so
+// that the data they send to the relayed address is relayed to the client.
+// The installed permissions are refreshed until the client is closed.
+func (a *TURNAllocation) CreatePermission(peers ...netip.Addr) error {
+	if len(peers) == 0 {
+		return errors.New("No peer to create permission for.")
+	}
+	if a.isClosed() {
+		return ErrAllocationClosed
+	}
+	unmapped := make([]netip.Addr, len(peers))
+	for i, ip := range peers {
+		unmapped[i] = ip.Unmap()
+	}
+	peers = unmapped
+	if err := a.c.createPermission(peers); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	for _, ip := range peers {
+		a.permissions[ip] = struct{}{}
+	}
+	if a.repermit == nil {
+		a.repermit = time.AfterFunc(permissionRefresh, a.refreshPermissions)
+	}
+	a.mu.Unlock()
+	return nil
+}
+
+// WriteTo sends b to the peer addr through the relay, in ChannelData once a
+// channel is bound to the peer and in a Send indication otherwise. The
+// permission of the peer is created first if not installed yet, since the
+// server drops the data to the peers without one. The peers sent to often
+// are bound a channel in the background.
+func (a *TURNAllocation) WriteTo(b []byte, addr net.Addr) (int, error) {
+	peer := hostFromAddr(addr)
+	if peer == nil {
+		return 0, errors.New("Invalid peer address.")
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return 0, ErrAllocationClosed
+	}
+	if !a.writeDeadline.IsZero() && !time.Now().Before(a.writeDeadline) {
+		a.mu.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+	number, bound := a.channels[peer.AddrPort()]
+	// The ChannelData messages carry no DONT-FRAGMENT.
+	df := a.dontFragment && !a.df
+	bound = bound && !df
+	_, permitted := a.permissions[peer.Addr()]
+	promote := !bound && !df && a.promote(peer.AddrPort(), time.Now())
+	a.mu.Unlock()
+	if bound {
+		msg := newChannelData(number, b)
+		if a.c.stream() {
+			msg = padChannelData(msg)
+		}
+		if _, err := a.c.packetConn().WriteTo(msg, a.c.server); err != nil {
+			return 0, err
+		}
+		a.sent.add(len(b), true)
+		return len(b), nil
+	}
+	if !permitted {
+		if err := a.CreatePermission(peer.Addr()); err != nil {
+			return 0, err
+		}
+	}
+	if promote {
+		go a.promoteChannel(peer)
+	}
+	pkt, err := newPacket()
+	if err != nil {
+		return 0, err
+	}
+	pkt.types = typeSendIndication
+	pkt.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, peer, pkt.transID))
+	pkt.addAttribute(*newAttribute(attributeData, b))
+	if df {
+		pkt.addAttribute(*newAttribute(attributeDontFragment, nil))
+	}
+	if _, err := a.c.packetConn().WriteTo(pkt.bytes(), a.c.server); err != nil {
+		return 0, err
+	}
+	a.sent.add(len(b), false)
+	return len(b), nil
+}
+
+// promote counts a Send indication to the peer at now, and reports whether
+// the peer is to be bound a channel. It is called with a.mu held.
+func (a *TURNAllocation) promote(peer netip.AddrPort, now time.Time) bool {
+	sc := a.sends[peer]
+	if sc == nil {
+		sc = &sendCount{start: now}
+		a.sends[peer] = sc
+	}
+	if sc.promoting {
+		return false
+	}
+	if now.Sub(sc.start) > promoteWindow {
+		sc.n, sc.start = 0, now
+	}
+	sc.n++
+	if sc.n < promoteCount {
+		return false
+	}
+	sc.promoting = true
+	return true
+}
+
+// promoteChannel binds a channel to the peer sent to often.
+func (a *TURNAllocation) promoteChannel(peer *Host) {
+	if _, err := a.BindChannel(peer); err != nil && err != ErrClientClosed {
+		a.c.logger.Errorln("Bind TURN channel to", peer, "error:", err)
+	}
+	a.mu.Lock()
+	delete(a.sends, peer.AddrPort())
+	a.mu.Unlock()
+}
+
+// BindChannel binds a channel to the peer, and returns its number. The data
+// to and from the peer is then relayed in ChannelData, and the channel is
+// refreshed until the client is closed. Binding a channel also installs
+// the permission of the peer.
+func (a *TURNAllocation) BindChannel(peer *Host) (uint16, error) {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return 0, ErrAllocationClosed
+	}
+	number, ok := a.channels[peer.AddrPort()]
+	if !ok {
+		if a.nextChannel > maxChannelNumber || a.nextChannel < minChannelNumber {
+			a.mu.Unlock()
+			return 0, errors.New("No TURN channel number left.")
+		}
+		number = a.nextChannel
+		a.nextChannel++
+	}
+	a.mu.Unlock()
+	if err := a.c.bindChannel(number, peer); err != nil {
+		return 0, err
+	}
+	a.mu.Lock()
+	a.channels[peer.AddrPort()] = number
+	a.peers[number] = peer.AddrPort()
+	a.permissions[peer.Addr()] = struct{}{}
+	if a.repermit == nil {
+		a.repermit = time.AfterFunc(permissionRefresh, a.refreshPermissions)
+	}
+	if a.rebind == nil {
+		a.rebind = time.AfterFunc(channelRefresh, a.refreshChannels)
+	}
+	a.mu.Unlock()
+	return number, nil
+}
+
+// Channels returns the numbers of the channels bound by the peers.
+func (a *TURNAllocation) Channels() map[netip.AddrPort]uint16 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	channels := make(map[netip.AddrPort]uint16, len(a.channels))
+	for peer, number := range a.channels {
+		channels[peer] = number
+	}
+	return channels
+}
+
+// refreshChannels binds the channels again, every channelRefresh until the
+// client is closed.
+func (a *TURNAllocation) refreshChannels() {
+	if a.isClosed() {
+		return
+	}
+	for peer, number := range a.Channels() {
+		err := a.c.bindChannel(number, newHost(peer))
+		if err == ErrClientClosed {
+			return
+		}
+		if isAllocationMismatch(err) {
+			a.lose()
+			break
+		}
+		if err != nil {
+			a.c.logger.Errorln("Refresh TURN channel", number, "error:", err)
+		}
+	}
+	a.mu.Lock()
+	if !a.closed {
+		a.rebind.Reset(channelRefresh)
+	}
+	a.mu.Unlock()
+}
+
+// ReadFrom reads the data relayed from a peer into b, and returns the
+// number of bytes read and the peer which sent it.
+func (a *TURNAllocation) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		a.mu.Lock()
+		deadline, wake := a.readDeadline, a.wake
+		a.mu.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			expired = timer.C
+		}
+		select {
+		case d := <-a.data:
+			if timer != nil {
+				timer.Stop()
+			}
+			return copy(b, d.buf), net.UDPAddrFromAddrPort(d.addr), nil
+		case <-a.c.done:
+			// The data queued before the failure is still read.
+			select {
+			case d := <-a.data:
+				return copy(b, d.buf), net.UDPAddrFromAddrPort(d.addr), nil
+			default:
+				return 0, nil, a.c.failure()
+			}
+		case <-a.done:
+			return 0, nil, ErrAllocationClosed
+		case <-expired:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-wake:
+			// The deadline is changed.
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// LocalAddr returns the relayed transport address of the allocation, which
+// the peers send to.
+func (a *TURNAllocation) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(a.RelayedAddr().AddrPort())
+}
+
+// SetDeadline sets the read and write deadlines of the allocation.
+func (a *TURNAllocation) SetDeadline(t time.Time) error {
+	a.SetReadDeadline(t)
+	return a.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of ReadFrom, including the calls
+// blocked already. A zero t means no deadline.
+func (a *TURNAllocation) SetReadDeadline(t time.Time) error {
+	a.mu.Lock()
+	a.readDeadline = t
+	close(a.wake)
+	a.wake = make(chan struct{})
+	a.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of WriteTo. A zero t means no
+// deadline.
+func (a *TURNAllocation) SetWriteDeadline(t time.Time) error {
+	a.mu.Lock()
+	a.writeDeadline = t
+	a.mu.Unlock()
+	return nil
+}
+
+// isClosed reports whether the allocation is closed.
+func (a *TURNAllocation) isClosed() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closed
+}
+
+// deliver queues the data from the peer, of a ChannelData message if
+// channel and of a Data indication otherwise, for ReadFrom, and drops it if
+// the queue is full.
+func (a *TURNAllocation) deliver(peer *Host, data []byte, channel bool) {
+	a.received.add(len(data), channel)
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	select {
+	case a.data <- datagram{buf: buf, n: len(buf), addr: peer.AddrPort()}:
+	default:
+		a.drops.Add(1)
+		a.c.logger.Debugln("Drop data from", peer, "as the queue is full")
+	}
+}
+
+// Permissions returns the peers installed by CreatePermission.
+func (a *TURNAllocation) Permissions() []netip.Addr {
+	a.mu.Lock()
+	peers := make([]netip.Addr, 0, len(a.permissions))
+	for ip := range a.permissions {
+		peers = append(peers, ip)
+	}
+	a.mu.Unlock()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Less(peers[j]) })
+	return peers
+}
+
+// refreshPermissions refreshes the installed permissions, every
+// permissionRefresh until the client is closed. As the interval is shorter
+// than their lifetime, the permissions installed since the last refresh
+// are refreshed in time as well.
+func (a *TURNAllocation) refreshPermissions() {
+	if a.isClosed() {
+		return
+	}
+	err := a.c.createPermission(a.Permissions())
+	if err == ErrClientClosed {
+		return
+	}
+	if isAllocationMismatch(err) {
+		// The permissions are installed again with the allocation.
+		a.lose()
+	} else if err != nil {
+		a.c.logger.Errorln("Refresh TURN permissions:", err)
+	}
+	a.mu.Lock()
+	if !a.closed {
+		a.repermit.Reset(permissionRefresh)
+	}
+	a.mu.Unlock()
+}
+
+// createPermission sends the CreatePermission request of the peers.
+func (c *TURNClient) createPermission(peers []netip.Addr) error {
+	_, err := c.request(typeCreatePermisiion, func(pkt *packet) {
+		for _, ip := range peers {
+			pkt.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, newHost(netip.AddrPortFrom(ip, 0)), pkt.transID))
+		}
+	})
+	return err
+}
+
+// bindChannel sends the ChannelBind request of the channel number to the
+// peer.
+func (c *TURNClient) bindChannel(number uint16, peer *Host) error {
+	_, err := c.request(typeChannelBinding, func(pkt *packet) {
+		pkt.addAttribute(*newChannelNumberAttribute(number))
+		pkt.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, peer, pkt.transID))
+	})
+	return err
+}
+
+// stream reports whether the client is connected to the server over a
+// stream transport.
+func (c *TURNClient) stream() bool {
+	_, ok := c.packetConn().(*streamConn)
+	return ok
+}
+
+// request sends the request of the type with the attributes added by add,
+// with the long-term credentials once challenged, and returns the success
+// response.
+// The request is sent again with the realm and the nonce of a 401 or 438
+// error response, as would be a stale nonce.
+func (c *TURNClient) request(types uint16, add func(pkt *packet)) (*packet, error) {
+	for retries := 0; ; retries++ {
+		pkt, key, err := c.newRequest(types, add)
+		if err != nil {
+			return nil, err
+		}
+		m, err := c.transact(pkt)
+		if err != nil {
+			return nil, err
+		}
+		resp := m.pkt
+		if resp.types&classMask == classSuccess {
+			if key != nil && !checkMessageIntegrity(m.raw, key) {
+				return nil, errors.New("Response integrity check failed.")
+			}
+			return resp, nil
+		}
+		code := resp.getErrorCode()
+		if (code == errorUnauthorized || code == errorStaleNonce) && retries < 2 && c.challenged(resp) {
+			continue
+		}
+		return nil, &TURNError{code, resp.getErrorReason()}
+	}
+}
+
+// newRequest returns the request of the type with the attributes added by
+// add, and the key it is signed with, if any.
+func (c *TURNClient) newRequest(types uint16, add func(pkt *packet)) (*packet, []byte, error) {
+	pkt, err := newPacket()
+	if err != nil {
+		return nil, nil, err
+	}
+	pkt.types = types
+	if add != nil {
+		add(pkt)
+	}
+	c.mu.Lock()
+	software := c.softwareName
+	c.mu.Unlock()
+	if software != "" {
+		pkt.addAttribute(*newSoftwareAttribute(software))
+	}
+	a := c.auth
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.key == nil {
+		return pkt, nil, nil
+	}
+	pkt.addAttribute(*newAttribute(attributeUsername, []byte(a.username)))
+	pkt.addAttribute(*newAttribute(attributeRealm, []byte(a.realm)))
+	pkt.addAttribute(*newAttribute(attributeNonce, []byte(a.nonce)))
+	pkt.addAttribute(*newMessageIntegrityAttribute(pkt, a.key))
+	return pkt, a.key, nil
+}
+
+// challenged takes the realm and the nonce of the error response resp, and
+// reports whether the request can be sent again with them.
+func (c *TURNClient) challenged(resp *packet) bool {
+	realm, nonce := resp.getString(attributeRealm), resp.getString(attributeNonce)
+	a := c.auth
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if nonce == "" || a.username == "" {
+		return false
+	}
+	if realm != "" && realm != a.realm {
+		a.realm = realm
+		a.key = LongTermKey(a.username, realm, a.password)
+	}
+	a.nonce = nonce
+	return a.key != nil
+}
+
+// transact sends the request pkt, again while unanswered over UDP, and
+// returns the response.
+func (c *TURNClient) transact(pkt *packet) (m *Message, err error) {
+	id := string(pkt.transID[4:])
+	ch := make(chan *Message, 1)
+	c.mu.Lock()
+	tracer := c.tracer
+	c.mu.Unlock()
+	tx := &Transaction{Server: c.server.String()}
+	_, span := startSpan(context.Background(), tracer, spanName("TURN", pkt.types))
+	defer func() {
+		tx.Responded, tx.Err = m != nil, err
+		tx.trace(span)
+		if m != nil {
+			traceErrorCode(span, m.pkt)
+		}
+		span.End(err)
+	}()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+	attempts, timeout := numRetransmit, defaultTimeout
+	if c.stream() {
+		attempts, timeout = 1, streamTimeout
+	}
+	b := pkt.bytes()
+	for i := 0; i < attempts; i++ {
+		if _, err := c.packetConn().WriteTo(b, c.server); err != nil {
+			return nil, err
+		}
+		sent := time.Now()
+		tx.Attempts++
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		select {
+		case resp := <-ch:
+			timer.Stop()
+			if resp == nil {
+				return nil, c.failure()
+			}
+			tx.RTT = time.Since(sent)
+			return resp, nil
+		case <-timer.C:
+			tx.Timeouts++
+		}
+		if timeout < maxTimeout {
+			timeout *= 2
+		}
+	}
+	return nil, errors.New("No response from the TURN server.")
+}
+
+// failure returns the error which stopped the client.
+func (c *TURNClient) failure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+	return c.err
+}
+
+// read dispatches the messages received from the server on conn until the
+// connection fails, and then fails the transactions in progress unless the
+// client migrated from conn. Over UDP, the datagrams from other sources are
+// dropped, so that they can neither answer the requests nor inject data as
+// if from the peers.
+func (c *TURNClient) read(conn net.PacketConn) {
+	var server *Host
+	if _, stream := conn.(*streamConn); !stream {
+		server = hostFromAddr(c.server)
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			c.mu.Lock()
+			if c.conn != conn {
+				c.mu.Unlock()
+				return
+			}
+			c.err = err
+			for id, ch := range c.pending {
+				ch <- nil
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+			close(c.done)
+			return
+		}
+		if server != nil {
+			if h := hostFromAddr(from); h == nil || h.addr != server.addr {
+				c.logger.Debugln("Drop message from", from, "not the TURN server")
+				continue
+			}
+		}
+		c.handle(buf[:n])
+	}
+}
+
+// handle dispatches the message b received from the server.
+func (c *TURNClient) handle(b []byte) {
+	if number, data, ok := parseChannelData(b); ok {
+		c.handleChannelData(number, data)
+		return
+	}
+	pkt, err := newPacketFromBytes(b)
+	if err != nil {
+		c.logger.Debugln("Drop message from the TURN server:", err)
+		return
+	}
+	if pkt.types == typeDataIndication {
+		c.handleData(pkt)
+		return
+	}
+	if class := pkt.types & classMask; class != classSuccess && class != classError {
+		return
+	}
+	raw := make([]byte, len(b))
+	copy(raw, b)
+	c.mu.Lock()
+	ch := c.pending[string(pkt.transID[4:])]
+	delete(c.pending, string(pkt.transID[4:]))
+	c.mu.Unlock()
+	if ch != nil {
+		ch <- &Message{pkt, raw}
+	}
+}
+
+// handleData delivers the data of the Data indication pkt to the
+// allocation.
+func (c *TURNClient) handleData(pkt *packet) {
+	peer := pkt.getXorAddr(attributeXorPeerAddress)
+	data := pkt.getAttribute(attributeData)
+	c.mu.Lock()
+	a := c.allocation
+	c.mu.Unlock()
+	if a == nil || peer == nil || data == nil {
+		c.logger.Debugln("Drop invalid Data indication")
+		return
+	}
+	a.deliver(peer, data.value[:data.length], false)
+}
+
+// handleChannelData delivers the data of a ChannelData message of the
+// channel number to the allocation.
+func (c *TURNClient) handleChannelData(number uint16, data []byte) {
+	c.mu.Lock()
+	a := c.allocation
+	c.mu.Unlock()
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	peer, ok := a.peers[number]
+	a.mu.Unlock()
+	if !ok {
+		c.logger.Debugln("Drop ChannelData of unbound channel", number)
+		return
+	}
+	a.deliver(newHost(peer), data, true)
+}
@@ -0,0 +1,801 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestTURNClient starts a TURN server of cfg relaying on the loopback
+// address with the credentials of alice, and returns a client of it.
+func newTestTURNClient(t testing.TB, cfg TURNConfig) (*TURNServer, *TURNClient) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	s.SetAuth("example.org", StaticCredentials{"alice": "secret"})
+	cfg.RelayIP = netip.MustParseAddr("127.0.0.1")
+	cfg.AllowPeers = testLoopbackPeers
+	ts, err := NewTURNServer(s, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(conn)
+	t.Cleanup(func() { s.Close() })
+	cconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewTURNClient(cconn, conn.LocalAddr())
+	t.Cleanup(func() { c.Close() })
+	return ts, c
+}
+
+func TestTURNClientAllocate(t *testing.T) {
+	ts, c := newTestTURNClient(t, TURNConfig{})
+	var terr *TURNError
+	if _, err := c.Allocate(); !errors.As(err, &terr) || terr.Code != errorUnauthorized {
+		t.Fatalf("Allocate error: expected 401 without credentials, get %v", err)
+	}
+	c.SetCredentials("alice", "wrong")
+	if _, err := c.Allocate(); !errors.As(err, &terr) || terr.Code != errorUnauthorized {
+		t.Fatalf("Allocate error: expected 401 with a wrong password, get %v", err)
+	}
+	c.SetCredentials("alice", "secret")
+	a, err := c.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	if a.RelayedAddr().IP() != "127.0.0.1" || a.MappedAddr().String() != c.packetConn().LocalAddr().String() {
+		t.Errorf("Allocate error: relayed %v, mapped %v", a.RelayedAddr(), a.MappedAddr())
+	}
+	if a.Lifetime() != defaultAllocationLifetime || ts.Allocations() != 1 {
+		t.Errorf("Allocate error: lifetime %v, %d allocations", a.Lifetime(), ts.Allocations())
+	}
+	if _, err := c.Allocate(); !errors.As(err, &terr) || terr.Code != errorAllocationMismatch {
+		t.Errorf("Allocate error: expected 437 when allocated, get %v", err)
+	}
+	c.Close()
+	if _, err := c.Allocate(); err != ErrClientClosed {
+		t.Errorf("Allocate error: expected ErrClientClosed, get %v", err)
+	}
+}
+
+// serverAllocation returns the only allocation of the TURN server.
+func serverAllocation(t testing.TB, ts *TURNServer) *allocation {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	for _, a := range ts.allocations {
+		return a
+	}
+	t.Fatal("no allocation")
+	return nil
+}
+
+func TestTURNClientPermission(t *testing.T) {
+	ts, c := newTestTURNClient(t, TURNConfig{})
+	c.SetCredentials("alice", "secret")
+	a, err := c.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	peers := []netip.Addr{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("::ffff:127.0.0.1")}
+	if err := a.CreatePermission(peers...); err != nil {
+		t.Fatalf("CreatePermission error: %v", err)
+	}
+	if p := a.Permissions(); len(p) != 2 || p[0].String() != "127.0.0.1" || p[1].String() != "127.0.0.2" {
+		t.Errorf("Permissions error: %v", p)
+	}
+	sa := serverAllocation(t, ts)
+	expires := sa.table.Load().permissions[netip.MustParseAddr("127.0.0.1")]
+	if !sa.permitted(netip.MustParseAddr("127.0.0.2"), time.Now()) || expires.IsZero() {
+		t.Fatalf("CreatePermission error: permissions not installed")
+	}
+	time.Sleep(10 * time.Millisecond)
+	a.refreshPermissions()
+	if !sa.table.Load().permissions[netip.MustParseAddr("127.0.0.1")].After(expires) {
+		t.Errorf("refreshPermissions error: permission not refreshed")
+	}
+	if err := a.CreatePermission(); err == nil {
+		t.Errorf("CreatePermission error: expected error without peer")
+	}
+}
+
+func TestTURNClientData(t *testing.T) {
+	_, c := newTestTURNClient(t, TURNConfig{})
+	c.SetCredentials("alice", "secret")
+	a, err := c.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := a.WriteTo([]byte("ping"), peer.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo error: %v", err)
+	}
+	if len(a.Permissions()) != 1 {
+		t.Errorf("WriteTo error: permission not created")
+	}
+	buf := make([]byte, 64)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := peer.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" || from.String() != a.RelayedAddr().String() {
+		t.Fatalf("WriteTo error: peer read %q from %v, %v", buf[:n], from, err)
+	}
+	// The data indications of others than the server are dropped.
+	spoofed := newTURNRequest(typeDataIndication)
+	spoofed.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, hostFromAddr(peer.LocalAddr()), spoofed.transID))
+	spoofed.addAttribute(*newAttribute(attributeData, []byte("spoofed")))
+	if _, err := peer.WriteTo(spoofed.bytes(), c.packetConn().LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	n, from, err = a.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "pong" || from.String() != peer.LocalAddr().String() {
+		t.Fatalf("ReadFrom error: read %q from %v, %v", buf[:n], from, err)
+	}
+	c.Close()
+	if _, _, err := a.ReadFrom(buf); err != ErrClientClosed {
+		t.Errorf("ReadFrom error: expected ErrClientClosed, get %v", err)
+	}
+}
+
+func TestTURNClientChannel(t *testing.T) {
+	ts, c := newTestTURNClient(t, TURNConfig{})
+	c.SetCredentials("alice", "secret")
+	a, err := c.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	number, err := a.BindChannel(hostFromAddr(peer.LocalAddr()))
+	if err != nil || number != minChannelNumber {
+		t.Fatalf("BindChannel error: channel %#x, %v", number, err)
+	}
+	if ch := serverAllocation(t, ts).table.Load().channels[number]; ch == nil || ch.peer != hostFromAddr(peer.LocalAddr()).AddrPort() {
+		t.Fatalf("BindChannel error: channel not bound on the server")
+	}
+	if _, err := a.WriteTo([]byte("ping"), peer.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo error: %v", err)
+	}
+	buf := make([]byte, 64)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := peer.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("WriteTo error: peer read %q, %v", buf[:n], err)
+	}
+	if _, err := peer.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err = a.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("ReadFrom error: read %q, %v", buf[:n], err)
+	}
+	a.refreshChannels()
+	if len(a.Channels()) != 1 {
+		t.Errorf("refreshChannels error: %v", a.Channels())
+	}
+
+	// A peer sent to often is promoted to a channel.
+	other, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	for i := 0; i < promoteCount; i++ {
+		if _, err := a.WriteTo([]byte("data"), other.LocalAddr()); err != nil {
+			t.Fatalf("WriteTo error: %v", err)
+		}
+	}
+	key := hostFromAddr(other.LocalAddr()).AddrPort()
+	for i := 0; i < 100; i++ {
+		if _, ok := a.Channels()[key]; ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("WriteTo error: peer not promoted to a channel")
+}
+
+func TestPadChannelData(t *testing.T) {
+	for n, size := range map[int]int{0: 4, 1: 8, 4: 8, 5: 12} {
+		b := padChannelData(newChannelData(minChannelNumber, make([]byte, n)))
+		if len(b) != size {
+			t.Errorf("padChannelData error: %d bytes of data padded to %d", n, len(b))
+		}
+		if _, data, ok := parseChannelData(b); !ok || len(data) != n {
+			t.Errorf("parseChannelData error: padded %d bytes of data", n)
+		}
+	}
+}
+
+func TestTURNClientRefresh(t *testing.T) {
+	ts, c := newTestTURNClient(t, TURNConfig{})
+	c.SetCredentials("alice", "secret")
+	a, err := c.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	sa := serverAllocation(t, ts)
+	sa.mu.Lock()
+	expires := sa.expires
+	sa.mu.Unlock()
+
+	// The refresh takes the new nonce of the 438 response.
+	c.auth.mu.Lock()
+	c.auth.nonce = "0-0000000000000000"
+	c.auth.mu.Unlock()
+	a.refreshAllocation()
+	sa.mu.Lock()
+	refreshed := sa.expires.After(expires)
+	sa.mu.Unlock()
+	if !refreshed || a.Lifetime() != defaultAllocationLifetime {
+		t.Errorf("refreshAllocation error: allocation not refreshed")
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if ts.Allocations() != 0 {
+		t.Errorf("Close error: allocation not released")
+	}
+	if _, err := a.WriteTo([]byte("data"), net.UDPAddrFromAddrPort(a.RelayedAddr().AddrPort())); err != ErrAllocationClosed {
+		t.Errorf("WriteTo error: expected ErrAllocationClosed, get %v", err)
+	}
+	if _, _, err := a.ReadFrom(make([]byte, 4)); err != ErrAllocationClosed {
+		t.Errorf("ReadFrom error: expected ErrAllocationClosed, get %v", err)
+	}
+	if _, err := c.Allocate(); err != nil {
+		t.Errorf("Allocate error after Close: %v", err)
+	}
+}
+
+func TestRefreshDelay(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := refreshDelay(defaultAllocationLifetime)
+		if d <= 7*time.Minute || d > 8*time.Minute {
+			t.Fatalf("refreshDelay error: %v", d)
+		}
+	}
+}
+
+func TestTURNClientReallocate(t *testing.T) {
+	ts, c := newTestTURNClient(t, TURNConfig{})
+	c.SetCredentials("alice", "secret")
+	a, err := c.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	events := a.Subscribe()
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	number, err := a.BindChannel(hostFromAddr(peer.LocalAddr()))
+	if err != nil {
+		t.Fatalf("BindChannel error: %v", err)
+	}
+
+	// The allocation lost by the server is allocated again on the 437
+	// response of the refresh.
+	ts.remove(serverAllocation(t, ts))
+	a.refreshAllocation()
+	var ev ReallocationEvent
+	select {
+	case ev = <-events:
+	case <-time.After(time.Second):
+		t.Fatalf("refreshAllocation error: allocation not made again")
+	}
+	if ev.Err != nil || ev.Relayed == nil || ev.Relayed.String() != a.RelayedAddr().String() {
+		t.Fatalf("ReallocationEvent error: relayed %v, %v", ev.Relayed, ev.Err)
+	}
+	sa := serverAllocation(t, ts)
+	if ch := sa.table.Load().channels[number]; ch == nil || ch.peer != hostFromAddr(peer.LocalAddr()).AddrPort() {
+		t.Fatalf("reallocate error: channel not bound again")
+	}
+	if !sa.permitted(netip.MustParseAddr("127.0.0.1"), time.Now()) {
+		t.Fatalf("reallocate error: permission not installed again")
+	}
+	if _, err := a.WriteTo([]byte("ping"), peer.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo error: %v", err)
+	}
+	buf := make([]byte, 64)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := peer.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" || from.String() != ev.Relayed.String() {
+		t.Fatalf("WriteTo error: peer read %q from %v, %v", buf[:n], from, err)
+	}
+
+	a.Close()
+	if _, ok := <-events; ok {
+		t.Errorf("Close error: subscription not closed")
+	}
+}
+
+func TestTURNClientStats(t *testing.T) {
+	_, c := newTestTURNClient(t, TURNConfig{})
+	c.SetCredentials("alice", "secret")
+	a, err := c.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	buf := make([]byte, 64)
+	exchange := func() {
+		if _, err := a.WriteTo([]byte("ping"), peer.LocalAddr()); err != nil {
+			t.Fatalf("WriteTo error: %v", err)
+		}
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		_, from, err := peer.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := peer.WriteTo([]byte("pong!"), from); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := a.ReadFrom(buf); err != nil {
+			t.Fatalf("ReadFrom error: %v", err)
+		}
+	}
+	exchange()
+	if _, err := a.BindChannel(hostFromAddr(peer.LocalAddr())); err != nil {
+		t.Fatalf("BindChannel error: %v", err)
+	}
+	exchange()
+	exchange()
+	a.refreshAllocation()
+	st := a.Stats()
+	want := TURNAllocationStats{
+		Sent:      TURNTraffic{ChannelPackets: 2, ChannelBytes: 8, IndicationPackets: 1, IndicationBytes: 4},
+		Received:  TURNTraffic{ChannelPackets: 2, ChannelBytes: 10, IndicationPackets: 1, IndicationBytes: 5},
+		Refreshes: 1,
+		Lifetime:  defaultAllocationLifetime,
+	}
+	if st != want {
+		t.Errorf("Stats error: %+v", st)
+	}
+	if st.Sent.Packets() != 3 || st.Received.Bytes() != 15 {
+		t.Errorf("TURNTraffic error: %d packets sent, %d bytes received", st.Sent.Packets(), st.Received.Bytes())
+	}
+}
+
+func TestTURNClientPacketConn(t *testing.T) {
+	_, c := newTestTURNClient(t, TURNConfig{})
+	c.SetCredentials("alice", "secret")
+	a, err := c.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	var conn net.PacketConn = a
+	if conn.LocalAddr().String() != a.RelayedAddr().String() {
+		t.Errorf("LocalAddr error: %v", conn.LocalAddr())
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, _, err := conn.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadFrom error: expected timeout, get %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn.SetReadDeadline(time.Now())
+	}()
+	if _, _, err := conn.ReadFrom(buf); err == nil || !err.(net.Error).Timeout() {
+		t.Errorf("ReadFrom error: expected timeout of a blocked read, get %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(-time.Second))
+	if _, err := conn.WriteTo(buf, a.LocalAddr()); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("WriteTo error: expected timeout, get %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := conn.WriteTo([]byte("ping"), peer.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo error: %v", err)
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := peer.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" || from.String() != conn.LocalAddr().String() {
+		t.Fatalf("WriteTo error: peer read %q from %v, %v", buf[:n], from, err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close error: %v", err)
+	}
+}
+
+// newTestTLSConfig returns the configuration of a TLS server at 127.0.0.1,
+// and the pool trusting its certificate.
+func newTestTLSConfig(t *testing.T) (*tls.Config, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, pool
+}
+
+func TestTURNClientStream(t *testing.T) {
+	for _, transport := range []string{TransportTCP, TransportTLS} {
+		s := NewServer()
+		s.SetAuth("example.org", StaticCredentials{"alice": "secret"})
+		if _, err := NewTURNServer(s, TURNConfig{RelayIP: netip.MustParseAddr("127.0.0.1"), AllowPeers: testLoopbackPeers}); err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var opts *TLSOptions
+		if transport == TransportTLS {
+			conf, pool := newTestTLSConfig(t)
+			ln = tls.NewListener(ln, conf)
+			opts = &TLSOptions{RootCAs: pool}
+		}
+		go s.ServeListener(ln)
+		c, err := DialTURN(transport, ln.Addr().String(), opts)
+		if err != nil {
+			t.Fatalf("DialTURN error over %s: %v", transport, err)
+		}
+		c.SetCredentials("alice", "secret")
+		a, err := c.Allocate()
+		if err != nil {
+			t.Fatalf("Allocate error over %s: %v", transport, err)
+		}
+		peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The data of 5 bytes is padded in the ChannelData over streams,
+		// after the Send and Data indications.
+		for _, bind := range []bool{false, true} {
+			if bind {
+				if _, err := a.BindChannel(hostFromAddr(peer.LocalAddr())); err != nil {
+					t.Fatalf("BindChannel error over %s: %v", transport, err)
+				}
+			}
+			if _, err := a.WriteTo([]byte("hello"), peer.LocalAddr()); err != nil {
+				t.Fatalf("WriteTo error over %s: %v", transport, err)
+			}
+			buf := make([]byte, 64)
+			peer.SetReadDeadline(time.Now().Add(time.Second))
+			n, from, err := peer.ReadFrom(buf)
+			if err != nil || string(buf[:n]) != "hello" {
+				t.Fatalf("WriteTo error over %s: peer read %q, %v", transport, buf[:n], err)
+			}
+			for i := 0; i < 2; i++ {
+				if _, err := peer.WriteTo([]byte("world"), from); err != nil {
+					t.Fatal(err)
+				}
+			}
+			a.SetReadDeadline(time.Now().Add(time.Second))
+			for i := 0; i < 2; i++ {
+				n, _, err = a.ReadFrom(buf)
+				if err != nil || string(buf[:n]) != "world" {
+					t.Fatalf("ReadFrom error over %s: read %q, %v", transport, buf[:n], err)
+				}
+			}
+		}
+		if err := a.Close(); err != nil {
+			t.Errorf("Close error over %s: %v", transport, err)
+		}
+		peer.Close()
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestTURNClientMigrate(t *testing.T) {
+	ts, c := newTestTURNClient(t, TURNConfig{Mobility: true})
+	c.SetCredentials("alice", "secret")
+	c.SetMobility(true)
+	a, err := c.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	ticket := a.ticket
+	if ticket == "" {
+		t.Fatalf("Allocate error: no MOBILITY-TICKET")
+	}
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := a.BindChannel(hostFromAddr(peer.LocalAddr())); err != nil {
+		t.Fatalf("BindChannel error: %v", err)
+	}
+
+	// The client moves to another address, with its channel.
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Migrate(conn); err != nil {
+		t.Fatalf("Migrate error: %v", err)
+	}
+	if a.ticket == ticket || ts.Allocations() != 1 {
+		t.Errorf("Migrate error: ticket not replaced, %d allocations", ts.Allocations())
+	}
+	if client := serverAllocation(t, ts).table.Load().client; client != hostFromAddr(conn.LocalAddr()).AddrPort() {
+		t.Errorf("Migrate error: allocation of %v", client)
+	}
+	if _, err := peer.WriteTo([]byte("data"), a.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	a.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := a.ReadFrom(buf); err != nil || string(buf[:n]) != "data" {
+		t.Fatalf("ReadFrom error after Migrate: read %q, %v", buf[:n], err)
+	}
+
+	// The tickets are not reused.
+	ts.mu.RLock()
+	stale := ts.tickets[ticket]
+	ts.mu.RUnlock()
+	if stale != nil {
+		t.Errorf("Migrate error: ticket still valid once replaced")
+	}
+
+	// The allocations closed are not moved back.
+	ts.Close()
+	other, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	var terr *TURNError
+	if err := c.Migrate(other); !errors.As(err, &terr) || terr.Code != errorInsufficientCapacity {
+		t.Errorf("Migrate error: %v after Close, expected %d", err, errorInsufficientCapacity)
+	}
+	if ts.Allocations() != 0 || len(ts.tickets) != 0 {
+		t.Errorf("Migrate error: %d allocations, %d tickets after Close", ts.Allocations(), len(ts.tickets))
+	}
+}
+
+func TestTURNClientMigrateForbidden(t *testing.T) {
+	_, c := newTestTURNClient(t, TURNConfig{})
+	c.SetCredentials("alice", "secret")
+	c.SetMobility(true)
+	a, err := c.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	if a.ticket != "" || c.Migrate(nil) == nil {
+		t.Errorf("Migrate error: mobility without a server supporting it")
+	}
+}
+
+func TestTURNClientEvenPort(t *testing.T) {
+	ts, c := newTestTURNClient(t, TURNConfig{})
+	c.SetCredentials("alice", "secret")
+	a, err := c.AllocateWithOptions(&AllocateOptions{ReservePort: true})
+	if err != nil {
+		t.Fatalf("AllocateWithOptions error: %v", err)
+	}
+	port := a.RelayedAddr().Port()
+	if port%2 != 0 || len(a.ReservationToken()) != 8 {
+		t.Fatalf("AllocateWithOptions error: port %d, token %x", port, a.ReservationToken())
+	}
+
+	// Another client takes the reserved port, once.
+	for i, code := range []int{0, errorInsufficientCapacity} {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := NewTURNClient(conn, c.server)
+		defer other.Close()
+		other.SetCredentials("alice", "secret")
+		b, err := other.AllocateWithOptions(&AllocateOptions{ReservationToken: a.ReservationToken()})
+		var terr *TURNError
+		switch {
+		case code == 0 && (err != nil || b.RelayedAddr().Port() != port+1):
+			t.Errorf("AllocateWithOptions error %d: reserved port, %v", i, err)
+		case code != 0 && (!errors.As(err, &terr) || terr.Code != code):
+			t.Errorf("AllocateWithOptions error %d: expected %d, get %v", i, code, err)
+		}
+	}
+	if ts.Allocations() != 2 {
+		t.Errorf("AllocateWithOptions error: %d allocations", ts.Allocations())
+	}
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := NewTURNClient(conn, c.server)
+	defer other.Close()
+	other.SetCredentials("alice", "secret")
+	var terr *TURNError
+	if _, err := other.AllocateWithOptions(&AllocateOptions{EvenPort: true, ReservationToken: []byte("12345678")}); !errors.As(err, &terr) || terr.Code != errorBadRequest {
+		t.Errorf("AllocateWithOptions error: expected 400 for EVEN-PORT with RESERVATION-TOKEN, get %v", err)
+	}
+}
+
+func TestTURNClientDontFragment(t *testing.T) {
+	ts, c := newTestTURNClient(t, TURNConfig{})
+	c.SetCredentials("alice", "secret")
+	a, err := c.AllocateWithOptions(&AllocateOptions{DontFragment: true})
+	if err != nil {
+		t.Fatalf("AllocateWithOptions error: %v", err)
+	}
+	if !serverAllocation(t, ts).relays[0].df.Load() {
+		t.Errorf("AllocateWithOptions error: relay without the DF bit")
+	}
+	a.Close()
+
+	// The DF bit is set by the first Send indication asking for it.
+	a, err = c.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := a.BindChannel(hostFromAddr(peer.LocalAddr())); err != nil {
+		t.Fatalf("BindChannel error: %v", err)
+	}
+	rl := serverAllocation(t, ts).relays[0]
+	buf := make([]byte, 64)
+	for _, df := range []bool{false, true} {
+		a.SetDontFragment(df)
+		if _, err := a.WriteTo([]byte("data"), peer.LocalAddr()); err != nil {
+			t.Fatalf("WriteTo error: %v", err)
+		}
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		if n, _, err := peer.ReadFrom(buf); err != nil || string(buf[:n]) != "data" {
+			t.Fatalf("WriteTo error: peer read %q, %v", buf[:n], err)
+		}
+		if rl.df.Load() != df {
+			t.Errorf("WriteTo error: DF bit %v with DONT-FRAGMENT %v", rl.df.Load(), df)
+		}
+	}
+}
+
+func TestTURNClientShare(t *testing.T) {
+	if c, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 not available:", err)
+	} else {
+		c.Close()
+	}
+	ts, c := newTestTURNClient(t, TURNConfig{RelayIPv6: netip.MustParseAddr("::1")})
+	c.SetCredentials("alice", "secret")
+	a, err := c.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := c.Share(conn)
+
+	// The shared client is authenticated with the nonce of c, unchallenged.
+	c.auth.mu.Lock()
+	nonce := c.auth.nonce
+	c.auth.mu.Unlock()
+	a6, err := sc.AllocateWithOptions(&AllocateOptions{IPv6: true})
+	if err != nil {
+		t.Fatalf("Allocate error: shared client, %v", err)
+	}
+	c.auth.mu.Lock()
+	challenged := c.auth.nonce != nonce
+	c.auth.mu.Unlock()
+	if challenged {
+		t.Errorf("Share error: shared client challenged again")
+	}
+	if a.RelayedAddr().IP() != "127.0.0.1" || a6.RelayedAddr().IP() != "::1" || ts.Allocations() != 2 {
+		t.Errorf("Allocate error: relayed %v and %v, %d allocations", a.RelayedAddr(), a6.RelayedAddr(), ts.Allocations())
+	}
+
+	c.Close()
+	if _, err := sc.Allocate(); err != ErrClientClosed {
+		t.Errorf("Close error: expected ErrClientClosed of the shared client, get %v", err)
+	}
+}
+
+func TestTURNClientDualStack(t *testing.T) {
+	if c, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 not available:", err)
+	} else {
+		c.Close()
+	}
+	ts, c := newTestTURNClient(t, TURNConfig{RelayIPv6: netip.MustParseAddr("::1")})
+	c.SetCredentials("alice", "secret")
+	a, err := c.AllocateWithOptions(&AllocateOptions{DualStack: true})
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	relayed := a.RelayedAddrs()
+	if len(relayed) != 2 || relayed[0].IP() != "127.0.0.1" || relayed[1].IP() != "::1" || ts.Allocations() != 1 {
+		t.Fatalf("Allocate error: relayed %v, %d allocations", relayed, ts.Allocations())
+	}
+	// The peers of both families are reached over the one allocation.
+	for i, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		peer, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		if _, err := a.WriteTo([]byte("ping"), peer.LocalAddr()); err != nil {
+			t.Fatalf("WriteTo error: %v", err)
+		}
+		buf := make([]byte, 64)
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := peer.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != "ping" || hostFromAddr(from).String() != relayed[i].String() {
+			t.Errorf("WriteTo error: peer %v read %q from %v, %v", peer.LocalAddr(), buf[:n], from, err)
+		}
+	}
+
+	// Without IPv6 relaying, the allocation is of IPv4 only.
+	_, c4 := newTestTURNClient(t, TURNConfig{})
+	c4.SetCredentials("alice", "secret")
+	a4, err := c4.AllocateWithOptions(&AllocateOptions{DualStack: true})
+	if err != nil {
+		t.Fatalf("Allocate error: %v", err)
+	}
+	if relayed := a4.RelayedAddrs(); len(relayed) != 1 || relayed[0].IP() != "127.0.0.1" {
+		t.Errorf("Allocate error: relayed %v without IPv6", relayed)
+	}
+}
@@ -0,0 +1,1333 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TURNConfig is the configuration of the relay of a TURN server.
+type TURNConfig struct {
+	// RelayIP is the IPv4 address the relayed transport addresses are
+	// allocated on, or all the addresses if unset.
+	RelayIP netip.Addr
+	// ExternalIP is the address of the relayed transport addresses given
+	// to the clients, if other than RelayIP, e.g. behind a 1:1 NAT.
+	ExternalIP netip.Addr
+	// RelayIPv6 and ExternalIPv6 are the same for the IPv6 allocations
+	// (RFC 6156), which are not supported if both are unset.
+	RelayIPv6    netip.Addr
+	ExternalIPv6 netip.Addr
+	// MaxLifetime caps the lifetime of the allocations, one hour by
+	// default.
+	MaxLifetime time.Duration
+	// MaxAllocations limits the number of allocations of the server, over
+	// which Allocate gets 508 Insufficient Capacity. 0 means no limit.
+	MaxAllocations int
+	// MaxUserAllocations limits the number of allocations of each user,
+	// over which Allocate gets 486 Allocation Quota Reached.
+	MaxUserAllocations int
+	// MaxBandwidth limits the bytes per second relayed by each allocation
+	// in both directions. The packets over the limit are dropped.
+	MaxBandwidth int
+	// MaxUserBandwidth limits the bytes per second relayed by all the
+	// allocations of each user.
+	MaxUserBandwidth int
+	// Mobility issues MOBILITY-TICKET to the UDP allocations asking for
+	// it (RFC 8016), with which a Refresh from another address of the
+	// client moves the allocation there.
+	Mobility bool
+	// AllowPeers lists the peer networks relayed to even if denied by
+	// default, e.g. the private networks of a closed deployment.
+	AllowPeers []netip.Prefix
+	// DenyPeers lists the peer networks never relayed to, even if allowed,
+	// in addition to the loopback, private, link-local, multicast and
+	// unspecified addresses denied by default. The permissions and the
+	// connections to denied peers get 403 Forbidden.
+	DenyPeers []netip.Prefix
+}
+
+// TURNServer relays the traffic of the clients of a server to their peers
+// (RFC 5766), for the clients which cannot connect to each other directly.
+// It handles the Allocate, Refresh, CreatePermission and ChannelBind
+// requests, and relays the Send and Data indications and the ChannelData
+// messages. The TCP allocations (RFC 6062), asked for on the connections of
+// ServeListener, relay the connections with the peers instead, set up with
+// the Connect and ConnectionBind requests.
+//
+// The ChannelData messages received on UDP take a fast path, which skips
+// the rate limit and the traffic report of the server: the bandwidth quotas
+// apply instead. The clients shall be authenticated with the long-term
+// credentials of SetAuth.
+type TURNServer struct {
+	s   *Server
+	cfg TURNConfig
+
+	mu          sync.RWMutex
+	allocations map[fiveTuple]*allocation
+	tickets     map[string]*allocation // by MOBILITY-TICKET
+	users       map[string]*turnUser
+	connections map[uint32]*peerConn    // by CONNECTION-ID
+	ports       map[string]*relayedAddr // reserved, by RESERVATION-TOKEN
+	reserved    int                     // allocations being created
+	closed      bool
+	done        chan struct{}
+	wheel       *timerWheel // of the expiry of the allocations, permissions and channels
+
+	sent     turnTraffic // to the peers, over UDP
+	received turnTraffic // from the peers, over UDP
+}
+
+// TURNServerStats is a snapshot of the counters of a TURN server.
+type TURNServerStats struct {
+	Allocations int
+	Sent        TURNTraffic // to the peers, over UDP
+	Received    TURNTraffic // from the peers, over UDP, relayed to the clients
+}
+
+// turnUser is the usage of the quotas of a user.
+type turnUser struct {
+	allocations int // guarded by TURNServer.mu
+
+	mu sync.Mutex
+	bw bucket
+}
+
+// fiveTuple identifies an allocation by the transport address of the client
+// and the listener of the server it uses.
+type fiveTuple struct {
+	client netip.AddrPort
+	l      *listener
+}
+
+// allocation is a relayed transport address of a client.
+type allocation struct {
+	t        *TURNServer
+	key      fiveTuple
+	username string
+	user     *turnUser
+	transID  [12]byte // of the Allocate request, to answer retransmissions
+	relays   []*relayedAddr
+	errors   []attribute // ADDRESS-ERROR-CODE of the families not allocated
+	token    []byte      // RESERVATION-TOKEN of the next port, if reserved
+	tcp      bool
+	ticket   string // MOBILITY-TICKET, guarded by t.mu
+
+	table atomic.Pointer[relayTable]
+
+	mu        sync.Mutex // also serializes the updates of table
+	expires   time.Time
+	scheduled time.Time // deadline of the last expiry timer
+	released  bool
+	bw        bucket
+}
+
+// relayTable is the permissions and the channels of an allocation, and the
+// address of its client, which changes with mobility. It is replaced as a
+// whole on change, so that the relay reads it without locking.
+type relayTable struct {
+	client      netip.AddrPort
+	permissions map[netip.Addr]time.Time
+	channels    map[uint16]*channel
+	peers       map[netip.AddrPort]*channel
+}
+
+// clone returns a copy of tb to change.
+func (tb *relayTable) clone() *relayTable {
+	c := &relayTable{
+		client:      tb.client,
+		permissions: make(map[netip.Addr]time.Time, len(tb.permissions)),
+		channels:    make(map[uint16]*channel, len(tb.channels)),
+		peers:       make(map[netip.AddrPort]*channel, len(tb.peers)),
+	}
+	for ip, expires := range tb.permissions {
+		c.permissions[ip] = expires
+	}
+	for number, ch := range tb.channels {
+		c.channels[number] = ch
+	}
+	for peer, ch := range tb.peers {
+		c.peers[peer] = ch
+	}
+	return c
+}
+
+// relayedAddr is a relayed transport address of an allocation. A dual
+// allocation has one by address family.
+type relayedAddr struct {
+	conn *net.UDPConn     // of an UDP allocation
+	ln   *net.TCPListener // of a TCP allocation
+	host *Host
+	// df is whether conn sets the DF bit, as asked for by the Allocate
+	// request, or by the first Send indication with DONT-FRAGMENT since
+	// the bit cannot be set per packet portably.
+	df   atomic.Bool
+	dfMu sync.Mutex // serializes the setting of df
+}
+
+// peerConn is a connection with a peer of a TCP allocation. It is closed
+// unless the client binds it with ConnectionBind in connectionTimeout.
+type peerConn struct {
+	a     *allocation
+	id    uint32
+	peer  netip.AddrPort
+	conn  net.Conn
+	timer *time.Timer
+	bound bool // guarded by TURNServer.mu
+}
+
+// channel is a channel binding of an allocation. It is not changed once in
+// a relayTable.
+type channel struct {
+	number  uint16
+	peer    netip.AddrPort
+	expires time.Time
+}
+
+// NewTURNServer makes s a TURN server relaying with the configuration cfg.
+// It shall be called before serving. The allocations are released when s is
+// closed. The TURN requests get 401 Unauthorized unless the long-term
+// credentials are required with SetAuth, e.g. of a RESTCredentialStore, so
+// that the server is never an open relay.
+func NewTURNServer(s *Server, cfg TURNConfig) (*TURNServer, error) {
+	if !cfg.ExternalIP.IsValid() {
+		cfg.ExternalIP = cfg.RelayIP
+	}
+	if !cfg.ExternalIPv6.IsValid() {
+		cfg.ExternalIPv6 = cfg.RelayIPv6
+	}
+	if !cfg.ExternalIP.Is4() && !cfg.ExternalIPv6.Is6() || cfg.ExternalIP.IsUnspecified() || cfg.ExternalIPv6.IsUnspecified() {
+		return nil, errors.New("No relay address.")
+	}
+	if cfg.MaxLifetime <= 0 {
+		cfg.MaxLifetime = maxAllocationLifetime
+	}
+	t := &TURNServer{
+		s:           s,
+		cfg:         cfg,
+		allocations: make(map[fiveTuple]*allocation),
+		tickets:     make(map[string]*allocation),
+		ports:       make(map[string]*relayedAddr),
+		users:       make(map[string]*turnUser),
+		connections: make(map[uint32]*peerConn),
+		done:        make(chan struct{}),
+		wheel:       newTimerWheel(time.Second, wheelSlots, time.Now()),
+	}
+	s.Handle(typeAllocate, authenticated(t.serveAllocate))
+	s.Handle(typeRefresh, authenticated(t.serveRefresh))
+	s.Handle(typeCreatePermisiion, authenticated(t.serveCreatePermission))
+	s.Handle(typeChannelBinding, authenticated(t.serveChannelBind))
+	s.Handle(typeConnect, authenticated(t.serveConnect))
+	s.Handle(typeConnectionBind, authenticated(t.serveConnectionBind))
+	s.relay = t
+	go t.wheel.run(t.done)
+	return t, nil
+}
+
+// Close releases all the allocations.
+func (t *TURNServer) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.done)
+	allocations, ports := t.allocations, t.ports
+	t.allocations = make(map[fiveTuple]*allocation)
+	t.ports = make(map[string]*relayedAddr)
+	t.users = make(map[string]*turnUser)
+	t.tickets = make(map[string]*allocation)
+	t.reserved = 0
+	t.mu.Unlock()
+	for _, a := range allocations {
+		a.close()
+	}
+	for _, rl := range ports {
+		rl.conn.Close()
+	}
+	return nil
+}
+
+// Allocations returns the number of allocations.
+func (t *TURNServer) Allocations() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.allocations)
+}
+
+// Stats returns a snapshot of the counters of the server.
+func (t *TURNServer) Stats() TURNServerStats {
+	return TURNServerStats{
+		Allocations: t.Allocations(),
+		Sent:        t.sent.snapshot(),
+		Received:    t.received.snapshot(),
+	}
+}
+
+func (t *TURNServer) allocation(key fiveTuple) *allocation {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.allocations[key]
+}
+
+func (t *TURNServer) remove(a *allocation) {
+	t.mu.Lock()
+	if t.allocations[a.key] == a {
+		delete(t.allocations, a.key)
+		delete(t.tickets, a.ticket)
+		t.release(a.username)
+	}
+	t.mu.Unlock()
+	a.close()
+}
+
+// issueTicket replaces the MOBILITY-TICKET of the allocation with a new one,
+// and returns it. It is called with t.mu held.
+func (t *TURNServer) issueTicket(a *allocation) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	delete(t.tickets, a.ticket)
+	a.ticket = string(b)
+	t.tickets[a.ticket] = a
+	return a.ticket
+}
+
+// move moves the allocation of the MOBILITY-TICKET of the Refresh request r
+// to the 5-tuple of r (RFC 8016 section 3.3), or answers the error.
+func (t *TURNServer) move(w ResponseWriter, r *Request, ticket string) *allocation {
+	if !t.cfg.Mobility {
+		w.Error(errorMobilityForbidden, "")
+		return nil
+	}
+	key := fiveTuple{r.Source.AddrPort(), r.l}
+	t.mu.Lock()
+	a := t.tickets[ticket]
+	code := 0
+	switch {
+	case t.closed:
+		code = errorInsufficientCapacity
+	case a == nil:
+		code = errorBadRequest
+	case a.username != r.w.req.getString(attributeUsername):
+		code = errorWrongCredentials
+	case a.key.l != r.l:
+		// The allocation is moved within the listener.
+		code = errorMobilityForbidden
+	case t.allocations[key] != nil:
+		code = errorAllocationMismatch
+	}
+	if code != 0 {
+		t.mu.Unlock()
+		w.Error(code, "")
+		return nil
+	}
+	delete(t.allocations, a.key)
+	a.key.client = key.client
+	t.allocations[key] = a
+	t.mu.Unlock()
+	a.mu.Lock()
+	tb := a.table.Load().clone()
+	tb.client = key.client
+	a.table.Store(tb)
+	a.mu.Unlock()
+	return a
+}
+
+// reserve counts a new allocation of the user against the quotas, or
+// returns the error code if one is reached. It is called with t.mu held.
+func (t *TURNServer) reserve(username string) (*turnUser, int) {
+	if t.closed || t.cfg.MaxAllocations > 0 && len(t.allocations)+t.reserved >= t.cfg.MaxAllocations {
+		return nil, errorInsufficientCapacity
+	}
+	u := t.users[username]
+	if u == nil {
+		u = &turnUser{bw: bucket{float64(t.cfg.MaxUserBandwidth), time.Now()}}
+		t.users[username] = u
+	}
+	if t.cfg.MaxUserAllocations > 0 && u.allocations >= t.cfg.MaxUserAllocations {
+		return nil, errorAllocationQuotaReached
+	}
+	u.allocations++
+	t.reserved++
+	return u, 0
+}
+
+// unreserve cancels the reservation of an allocation of the user.
+func (t *TURNServer) unreserve(username string) {
+	t.mu.Lock()
+	t.reserved--
+	t.release(username)
+	t.mu.Unlock()
+}
+
+// release uncounts an allocation of the user. It is called with t.mu held.
+func (t *TURNServer) release(username string) {
+	if u := t.users[username]; u != nil {
+		if u.allocations--; u.allocations <= 0 {
+			delete(t.users, username)
+		}
+	}
+}
+
+// supports reports whether the relayed transport addresses of the family
+// can be allocated.
+func (t *TURNServer) supports(family uint16) bool {
+	if family == attributeFamilyIPv4 {
+		return t.cfg.ExternalIP.Is4()
+	}
+	return t.cfg.ExternalIPv6.Is6()
+}
+
+// listen returns a new relayed transport address of the family at port, or
+// any port if 0, listening for the connections of the peers if tcp.
+func (t *TURNServer) listen(family uint16, tcp bool, port int) (*relayedAddr, error) {
+	version, ip, external := "4", t.cfg.RelayIP, t.cfg.ExternalIP
+	if family == attributeFamilyIPV6 {
+		version, ip, external = "6", t.cfg.RelayIPv6, t.cfg.ExternalIPv6
+	}
+	var laddr []byte
+	if ip.IsValid() {
+		laddr = ip.AsSlice()
+	}
+	rl := new(relayedAddr)
+	if tcp {
+		ln, err := net.ListenTCP("tcp"+version, &net.TCPAddr{IP: laddr, Port: port})
+		if err != nil {
+			return nil, err
+		}
+		rl.ln, port = ln, ln.Addr().(*net.TCPAddr).Port
+	} else {
+		conn, err := net.ListenUDP("udp"+version, &net.UDPAddr{IP: laddr, Port: port})
+		if err != nil {
+			return nil, err
+		}
+		rl.conn, port = conn, conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	rl.host = newHost(netip.AddrPortFrom(external, uint16(port)))
+	return rl, nil
+}
+
+// listenEven returns a new UDP relayed transport address of the family at
+// an even port, and the next port reserved as well if reserve (RFC 5766
+// section 6.2), e.g. for the RTCP of RTP.
+func (t *TURNServer) listenEven(family uint16, reserve bool) (*relayedAddr, *relayedAddr, error) {
+	for i := 0; i < evenPortAttempts; i++ {
+		rl, err := t.listen(family, false, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		port := int(rl.host.Port())
+		if port%2 != 0 {
+			rl.conn.Close()
+			continue
+		}
+		if !reserve {
+			return rl, nil, nil
+		}
+		if next, err := t.listen(family, false, port+1); err == nil {
+			return rl, next, nil
+		}
+		rl.conn.Close()
+	}
+	return nil, nil, errors.New("No even port pair available.")
+}
+
+// holdPort holds the reserved relayed transport address rl for
+// reservationLifetime, and returns its RESERVATION-TOKEN.
+func (t *TURNServer) holdPort(rl *relayedAddr) []byte {
+	token := make([]byte, 8)
+	rand.Read(token)
+	t.mu.Lock()
+	t.ports[string(token)] = rl
+	t.mu.Unlock()
+	t.wheel.schedule(time.Now().Add(reservationLifetime), func(time.Time) {
+		if rl := t.takePort(token); rl != nil {
+			rl.conn.Close()
+		}
+	})
+	return token
+}
+
+// takePort returns the relayed transport address reserved for the token,
+// or nil if unknown or expired.
+func (t *TURNServer) takePort(token []byte) *relayedAddr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rl := t.ports[string(token)]
+	delete(t.ports, string(token))
+	return rl
+}
+
+// families returns the address families of the relayed transport addresses
+// asked for by the Allocate request req (RFC 6156 and RFC 8656 section
+// 7.2), or the error code if req is invalid: the first one is required and
+// the second one, for a dual allocation, is optional.
+func families(req *packet) ([]uint16, int) {
+	requested := req.getAttribute(attributeRequestedAddressFamily)
+	additional := req.getAttribute(attributeAdditionalAddressFamily)
+	switch {
+	case requested != nil && additional != nil:
+		return nil, errorBadRequest
+	case requested != nil:
+		if requested.length < 4 || requested.value[0] != attributeFamilyIPv4 && requested.value[0] != attributeFamilyIPV6 {
+			return nil, errorAddressFamilyNotSupported
+		}
+		return []uint16{uint16(requested.value[0])}, 0
+	case additional != nil:
+		if additional.length < 4 || additional.value[0] != attributeFamilyIPV6 {
+			return nil, errorBadRequest
+		}
+		return []uint16{attributeFamilyIPv4, attributeFamilyIPV6}, 0
+	}
+	return []uint16{attributeFamilyIPv4}, 0
+}
+
+// lifetime returns the lifetime of the allocation asked for by req.
+func (t *TURNServer) lifetime(req *packet) time.Duration {
+	d, ok := req.getLifetime()
+	if !ok || d < defaultAllocationLifetime {
+		d = defaultAllocationLifetime
+	}
+	if d > t.cfg.MaxLifetime {
+		d = t.cfg.MaxLifetime
+	}
+	return d
+}
+
+// authenticated answers 401 Unauthorized to the requests of h unless the
+// server requires the long-term credentials, which have been checked before
+// h by the middleware of SetAuth.
+func authenticated(h HandlerFunc) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		if a := r.cfg.auth; a == nil || a.realm == "" {
+			w.Error(errorUnauthorized, "")
+			return
+		}
+		h(w, r)
+	})
+}
+
+// allowPeer reports whether the traffic to the peer ip is relayed.
+func (t *TURNServer) allowPeer(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range t.cfg.DenyPeers {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	for _, p := range t.cfg.AllowPeers {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsMulticast() &&
+		!ip.IsUnspecified() && !(ip.Is4() && (ip.As4()[0] == 0 || ip == netip.AddrFrom4([4]byte{255, 255, 255, 255})))
+}
+
+// lookup returns the allocation of the request, or answers the request with
+// an error and returns nil.
+func (t *TURNServer) lookup(w ResponseWriter, r *Request) *allocation {
+	a := t.allocation(fiveTuple{r.Source.AddrPort(), r.l})
+	if a == nil {
+		w.Error(errorAllocationMismatch, "")
+		return nil
+	}
+	if a.username != r.w.req.getString(attributeUsername) {
+		w.Error(errorWrongCredentials, "")
+		return nil
+	}
+	return a
+}
+
+func (t *TURNServer) serveAllocate(w ResponseWriter, r *Request) {
+	req := r.w.req
+	key := fiveTuple{r.Source.AddrPort(), r.l}
+	if a := t.allocation(key); a != nil {
+		// Answer the retransmissions of the request again.
+		if string(a.transID[:]) != string(r.TransactionID()) {
+			w.Error(errorAllocationMismatch, "")
+			return
+		}
+		a.respond(r, t.lifetime(req))
+		return
+	}
+	transport := req.getAttribute(attributeRequestedTransport)
+	if transport == nil || transport.length < 4 {
+		w.Error(errorBadRequest, "")
+		return
+	}
+	tcp := transport.value[0] == protocolTCP
+	if transport.value[0] != protocolUDP && !tcp {
+		w.Error(errorUnsupportedTransportProtocol, "")
+		return
+	}
+	if _, ok := r.l.conn.(*streamConn); tcp && (!ok || req.hasAttribute(attributeDontFragment)) {
+		// The connections with the peers are controlled over a
+		// connection with the client.
+		w.Error(errorBadRequest, "")
+		return
+	}
+	evenPort := req.getAttribute(attributeEvenPort)
+	token := req.getAttribute(attributeReservationToken)
+	if (evenPort != nil || token != nil) && tcp || evenPort != nil && token != nil ||
+		token != nil && (token.length < 8 || req.hasAttribute(attributeRequestedAddressFamily) || req.hasAttribute(attributeAdditionalAddressFamily)) {
+		w.Error(errorBadRequest, "")
+		return
+	}
+	fams, code := families(req)
+	var reserved *relayedAddr
+	if code == 0 && token != nil {
+		// The reserved address is taken as the relayed address, of the
+		// family it was reserved in.
+		if reserved = t.takePort(token.value[:8]); reserved == nil {
+			code = errorInsufficientCapacity
+		} else {
+			fams = []uint16{reserved.host.Family()}
+		}
+	}
+	if code == 0 && !t.supports(fams[0]) {
+		code = errorAddressFamilyNotSupported
+	}
+	if code != 0 {
+		w.Error(code, "")
+		return
+	}
+	username := req.getString(attributeUsername)
+	t.mu.Lock()
+	user, code := t.reserve(username)
+	t.mu.Unlock()
+	if code != 0 {
+		if reserved != nil {
+			reserved.conn.Close()
+		}
+		w.Error(code, "")
+		return
+	}
+	a := &allocation{
+		t:        t,
+		key:      key,
+		username: username,
+		user:     user,
+		tcp:      tcp,
+	}
+	a.table.Store(&relayTable{
+		client:      key.client,
+		permissions: make(map[netip.Addr]time.Time),
+		channels:    make(map[uint16]*channel),
+		peers:       make(map[netip.AddrPort]*channel),
+	})
+	var next *relayedAddr
+	for i, family := range fams {
+		code := errorAddressFamilyNotSupported
+		if t.supports(family) {
+			var rl *relayedAddr
+			var err error
+			switch {
+			case i == 0 && reserved != nil:
+				rl = reserved
+			case i == 0 && evenPort != nil:
+				rl, next, err = t.listenEven(family, evenPort.length > 0 && evenPort.value[0]&0x80 != 0)
+			default:
+				rl, err = t.listen(family, tcp, 0)
+			}
+			if err == nil && req.hasAttribute(attributeDontFragment) {
+				if err = rl.setDontFragment(); err != nil {
+					rl.conn.Close()
+					if next != nil {
+						next.conn.Close()
+					}
+					a.close()
+					t.unreserve(username)
+					w.Error(errorUnknownAttribute, "")
+					r.w.resp.addAttribute(*newUnknownAttributesAttribute([]uint16{attributeDontFragment}))
+					return
+				}
+			}
+			if err == nil {
+				a.relays = append(a.relays, rl)
+				continue
+			}
+			t.s.logger.Debugln("Allocate failed:", err)
+			code = errorInsufficientCapacity
+		}
+		if i == 0 {
+			t.unreserve(username)
+			w.Error(code, "")
+			return
+		}
+		// The additional family is optional.
+		a.errors = append(a.errors, *newAddressErrorCodeAttribute(family, code))
+	}
+	copy(a.transID[:], r.TransactionID())
+	lifetime := t.lifetime(req)
+	now := time.Now()
+	a.expires = now.Add(lifetime)
+	a.bw = bucket{float64(t.cfg.MaxBandwidth), now}
+	if next != nil {
+		a.token = t.holdPort(next)
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		a.close()
+		if rl := t.takePort(a.token); rl != nil {
+			rl.conn.Close()
+		}
+		w.Error(errorInsufficientCapacity, "")
+		return
+	}
+	// The allocation replaces its reservation.
+	t.reserved--
+	t.allocations[key] = a
+	if t.cfg.Mobility && !tcp && req.hasAttribute(attributeMobilityTicket) {
+		t.issueTicket(a)
+	}
+	t.mu.Unlock()
+	a.mu.Lock()
+	a.scheduleExpiry(a.expires)
+	a.mu.Unlock()
+	for _, rl := range a.relays {
+		if tcp {
+			go a.accept(rl)
+		} else {
+			go a.serve(rl)
+		}
+	}
+	a.respond(r, lifetime)
+}
+
+func (t *TURNServer) serveRefresh(w ResponseWriter, r *Request) {
+	var a *allocation
+	ticket := r.w.req.getAttribute(attributeMobilityTicket)
+	if ticket != nil && ticket.length > 0 && t.allocation(fiveTuple{r.Source.AddrPort(), r.l}) == nil {
+		a = t.move(w, r, string(ticket.value[:ticket.length]))
+	} else {
+		a = t.lookup(w, r)
+	}
+	if a == nil {
+		return
+	}
+	lifetime := t.lifetime(r.w.req)
+	if d, ok := r.w.req.getLifetime(); ok && d == 0 {
+		t.remove(a)
+		lifetime = 0
+	} else {
+		if ticket != nil {
+			// A new ticket is issued by each refresh.
+			t.mu.Lock()
+			if a.ticket != "" {
+				r.w.resp.addAttribute(*newAttribute(attributeMobilityTicket, []byte(t.issueTicket(a))))
+			}
+			t.mu.Unlock()
+		}
+		a.mu.Lock()
+		a.expires = time.Now().Add(lifetime)
+		if a.expires.Before(a.scheduled) {
+			a.scheduleExpiry(a.expires)
+		}
+		a.mu.Unlock()
+	}
+	r.w.resp.addAttribute(*newLifetimeAttribute(lifetime))
+}
+
+func (t *TURNServer) serveCreatePermission(w ResponseWriter, r *Request) {
+	a := t.lookup(w, r)
+	if a == nil {
+		return
+	}
+	peers := r.w.req.getPeerAddrs()
+	if len(peers) == 0 {
+		w.Error(errorBadRequest, "")
+		return
+	}
+	for _, peer := range peers {
+		if a.relayFor(peer.Family()) == nil {
+			w.Error(errorPeerAddressFamilyMismatch, "")
+			return
+		}
+		if !t.allowPeer(peer.Addr()) {
+			w.Error(errorForbidden, "")
+			return
+		}
+	}
+	expires := time.Now().Add(permissionLifetime)
+	a.mu.Lock()
+	tb := a.table.Load().clone()
+	for _, peer := range peers {
+		a.permit(tb, peer.Addr(), expires)
+	}
+	a.table.Store(tb)
+	a.mu.Unlock()
+}
+
+func (t *TURNServer) serveChannelBind(w ResponseWriter, r *Request) {
+	a := t.lookup(w, r)
+	if a == nil {
+		return
+	}
+	req := r.w.req
+	peers := req.getPeerAddrs()
+	num := req.getAttribute(attributeChannelNumber)
+	if a.tcp || len(peers) != 1 || num == nil || num.length < 4 {
+		w.Error(errorBadRequest, "")
+		return
+	}
+	number := binary.BigEndian.Uint16(num.value)
+	peer := peers[0].AddrPort()
+	if number < minChannelNumber || number > maxChannelNumber {
+		w.Error(errorBadRequest, "")
+		return
+	}
+	if a.relayFor(peers[0].Family()) == nil {
+		w.Error(errorPeerAddressFamilyMismatch, "")
+		return
+	}
+	if !t.allowPeer(peer.Addr()) {
+		w.Error(errorForbidden, "")
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	tb := a.table.Load()
+	// A channel is bound to one peer, and a peer to one channel.
+	if ch := tb.channels[number]; ch != nil && ch.peer != peer || tb.peers[peer] != nil && tb.peers[peer].number != number {
+		w.Error(errorBadRequest, "")
+		return
+	}
+	ch := &channel{number: number, peer: peer, expires: now.Add(channelLifetime)}
+	if tb.channels[number] == nil {
+		a.t.wheel.schedule(ch.expires, func(now time.Time) {
+			a.expireChannel(number, now)
+		})
+	}
+	tb = tb.clone()
+	tb.channels[number] = ch
+	tb.peers[peer] = ch
+	a.permit(tb, peer.Addr(), now.Add(permissionLifetime))
+	a.table.Store(tb)
+}
+
+func (t *TURNServer) serveConnect(w ResponseWriter, r *Request) {
+	a := t.lookup(w, r)
+	if a == nil {
+		return
+	}
+	peers := r.w.req.getPeerAddrs()
+	if !a.tcp || len(peers) != 1 {
+		w.Error(errorBadRequest, "")
+		return
+	}
+	rl := a.relayFor(peers[0].Family())
+	if rl == nil {
+		w.Error(errorPeerAddressFamilyMismatch, "")
+		return
+	}
+	peer := peers[0].AddrPort()
+	if !t.allowPeer(peer.Addr()) || !a.permitted(peer.Addr(), time.Now()) {
+		w.Error(errorForbidden, "")
+		return
+	}
+	if t.connected(a, peer) {
+		w.Error(errorConnectionAlreadyExists, "")
+		return
+	}
+	// The connection is made from the relayed IP address, but not its
+	// port, which is listening.
+	dialer := &net.Dialer{
+		Timeout:   connectionTimeout,
+		LocalAddr: &net.TCPAddr{IP: rl.ln.Addr().(*net.TCPAddr).IP},
+	}
+	conn, err := dialer.Dial("tcp", peer.String())
+	if err != nil {
+		t.s.logger.Debugln("Connect to", peer, "failed:", err)
+		w.Error(errorConnectionTimeoutOrFailure, "")
+		return
+	}
+	pc := t.addConn(a, peer, conn)
+	if pc == nil {
+		w.Error(errorConnectionTimeoutOrFailure, "")
+		return
+	}
+	r.w.resp.addAttribute(*newConnectionIDAttribute(pc.id))
+}
+
+func (t *TURNServer) serveConnectionBind(w ResponseWriter, r *Request) {
+	id, ok := r.w.req.getConnectionID()
+	if _, stream := r.l.conn.(*streamConn); !ok || !stream {
+		w.Error(errorBadRequest, "")
+		return
+	}
+	t.mu.Lock()
+	pc := t.connections[id]
+	if pc == nil || pc.bound {
+		t.mu.Unlock()
+		w.Error(errorBadRequest, "")
+		return
+	}
+	if pc.a.username != r.w.req.getString(attributeUsername) {
+		t.mu.Unlock()
+		w.Error(errorWrongCredentials, "")
+		return
+	}
+	pc.bound = true
+	t.mu.Unlock()
+	pc.timer.Stop()
+	r.l.takeover = func(conn *streamConn) {
+		t.pipe(pc, conn)
+	}
+}
+
+// connected reports whether the TCP allocation a has a connection with the
+// peer.
+func (t *TURNServer) connected(a *allocation, peer netip.AddrPort) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, pc := range t.connections {
+		if pc.a == a && pc.peer == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// addConn registers the connection conn of the TCP allocation a with the
+// peer under a new CONNECTION-ID, or closes conn and returns nil if the
+// server is closed.
+func (t *TURNServer) addConn(a *allocation, peer netip.AddrPort, conn net.Conn) *peerConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		conn.Close()
+		return nil
+	}
+	pc := &peerConn{a: a, peer: peer, conn: conn}
+	for pc.id == 0 || t.connections[pc.id] != nil {
+		var b [4]byte
+		rand.Read(b[:])
+		pc.id = binary.BigEndian.Uint32(b[:])
+	}
+	t.connections[pc.id] = pc
+	pc.timer = time.AfterFunc(connectionTimeout, func() {
+		t.mu.Lock()
+		expired := !pc.bound && t.connections[pc.id] == pc
+		if expired {
+			delete(t.connections, pc.id)
+		}
+		t.mu.Unlock()
+		if expired {
+			conn.Close()
+		}
+	})
+	return pc
+}
+
+// pipe relays the data between the connection of the client conn bound to
+// pc and the connection of the peer, until either is closed.
+func (t *TURNServer) pipe(pc *peerConn, conn *streamConn) {
+	done := make(chan struct{})
+	go func() {
+		// What the decoder buffered after the ConnectionBind request is
+		// data for the peer already.
+		io.Copy(pc.conn, conn.decoder.r)
+		pc.conn.Close()
+		conn.Close()
+		close(done)
+	}()
+	io.Copy(conn, pc.conn)
+	pc.conn.Close()
+	conn.Close()
+	<-done
+	t.mu.Lock()
+	if t.connections[pc.id] == pc {
+		delete(t.connections, pc.id)
+	}
+	t.mu.Unlock()
+}
+
+// relayChannelData relays the ChannelData message b received from the
+// client on the UDP listener l, on the fast path of the relay, and reports
+// whether b is one.
+func (t *TURNServer) relayChannelData(b []byte, client netip.AddrPort, l *listener) bool {
+	if len(b) == 0 || b[0]&0xc0 != 0x40 {
+		return false
+	}
+	client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+	if c := t.s.cfg.Load(); c.acl != nil && !c.acl.allowAddr(client.Addr()) {
+		t.s.dropped(DroppedACL)
+		return true
+	}
+	if a := t.allocation(fiveTuple{client, l}); a != nil {
+		a.relayChannelData(b)
+	}
+	return true
+}
+
+// relay handles the Send indications and ChannelData messages b received
+// from host on l, and reports whether b is one of them.
+func (t *TURNServer) relay(b []byte, host *Host, l *listener) bool {
+	if len(b) > 0 && b[0]&0xc0 == 0x40 {
+		if a := t.allocation(fiveTuple{host.AddrPort(), l}); a != nil {
+			a.relayChannelData(b)
+		}
+		return true
+	}
+	if len(b) < messageHeaderSize || binary.BigEndian.Uint16(b[0:2]) != typeSendIndication {
+		return false
+	}
+	pkt, err := newPacketFromBytes(b)
+	if err != nil {
+		return true
+	}
+	a := t.allocation(fiveTuple{host.AddrPort(), l})
+	peers := pkt.getPeerAddrs()
+	data := pkt.getAttribute(attributeData)
+	if a == nil || a.tcp || len(peers) == 0 || data == nil {
+		return true
+	}
+	peer := peers[0].AddrPort()
+	if now := time.Now(); a.permitted(peer.Addr(), now) && a.allow(int(data.length), now) {
+		a.send(data.value[:data.length], peer, pkt.hasAttribute(attributeDontFragment), false)
+	}
+	return true
+}
+
+// respond adds the attributes of the success response to the Allocate
+// request r.
+func (a *allocation) respond(r *Request, lifetime time.Duration) {
+	resp := r.w.resp
+	for _, rl := range a.relays {
+		resp.addAttribute(*newXorAddrAttribute(attributeXorRelayedAddress, rl.host, resp.transID))
+	}
+	for _, e := range a.errors {
+		resp.addAttribute(e)
+	}
+	if a.token != nil {
+		resp.addAttribute(*newAttribute(attributeReservationToken, a.token))
+	}
+	resp.addAttribute(*newLifetimeAttribute(lifetime))
+	resp.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, r.Source, resp.transID))
+	a.t.mu.RLock()
+	ticket := a.ticket
+	a.t.mu.RUnlock()
+	if ticket != "" {
+		resp.addAttribute(*newAttribute(attributeMobilityTicket, []byte(ticket)))
+	}
+}
+
+// relayChannelData relays the ChannelData message b of the client to the
+// peer bound to its channel.
+func (a *allocation) relayChannelData(b []byte) {
+	number, data, ok := parseChannelData(b)
+	if !ok {
+		return
+	}
+	if ch := a.table.Load().channels[number]; ch != nil && a.allow(len(data), time.Now()) {
+		a.send(data, ch.peer, false, true)
+	}
+}
+
+// relayFor returns the relayed transport address of the family, or nil.
+func (a *allocation) relayFor(family uint16) *relayedAddr {
+	for _, rl := range a.relays {
+		if rl.host.Family() == family {
+			return rl
+		}
+	}
+	return nil
+}
+
+// send relays data to the peer from the relayed transport address of its
+// family, with the DF bit if df, of a ChannelData message if channel.
+func (a *allocation) send(data []byte, peer netip.AddrPort, df, channel bool) {
+	rl := a.relayFor(newHost(peer).Family())
+	if rl == nil {
+		return
+	}
+	// The data which cannot be sent with the DF bit is discarded (RFC
+	// 5766 section 10.2).
+	if df && !rl.df.Load() && rl.setDontFragment() != nil {
+		return
+	}
+	if _, err := rl.conn.WriteToUDPAddrPort(data, peer); err == nil {
+		a.t.sent.add(len(data), channel)
+	}
+}
+
+// setDontFragment sets the DF bit of the packets relayed by rl.
+func (rl *relayedAddr) setDontFragment() error {
+	rl.dfMu.Lock()
+	defer rl.dfMu.Unlock()
+	if rl.df.Load() {
+		return nil
+	}
+	if err := setDontFragment(rl.conn, true); err != nil {
+		return err
+	}
+	rl.df.Store(true)
+	return nil
+}
+
+// close releases the relayed transport addresses and the connections with
+// the peers.
+func (a *allocation) close() {
+	a.mu.Lock()
+	a.released = true
+	a.mu.Unlock()
+	for _, rl := range a.relays {
+		if rl.conn != nil {
+			rl.conn.Close()
+		} else {
+			rl.ln.Close()
+		}
+	}
+	t := a.t
+	var conns []*peerConn
+	t.mu.Lock()
+	for id, pc := range t.connections {
+		if pc.a == a {
+			delete(t.connections, id)
+			conns = append(conns, pc)
+		}
+	}
+	t.mu.Unlock()
+	for _, pc := range conns {
+		pc.timer.Stop()
+		pc.conn.Close()
+	}
+}
+
+// permitted reports whether the peer at ip has a permission at now.
+func (a *allocation) permitted(ip netip.Addr, now time.Time) bool {
+	return now.Before(a.table.Load().permissions[ip])
+}
+
+// allow reports whether n bytes can be relayed at now within the bandwidth
+// quotas of the allocation and its user.
+func (a *allocation) allow(n int, now time.Time) bool {
+	cfg := &a.t.cfg
+	if cfg.MaxBandwidth > 0 {
+		a.mu.Lock()
+		ok := a.bw.take(float64(n), float64(cfg.MaxBandwidth), float64(cfg.MaxBandwidth), now)
+		a.mu.Unlock()
+		if !ok {
+			return false
+		}
+	}
+	if cfg.MaxUserBandwidth > 0 {
+		a.user.mu.Lock()
+		defer a.user.mu.Unlock()
+		return a.user.bw.take(float64(n), float64(cfg.MaxUserBandwidth), float64(cfg.MaxUserBandwidth), now)
+	}
+	return true
+}
+
+// scheduleExpiry schedules the release of the allocation at expires. It is
+// called with a.mu held.
+func (a *allocation) scheduleExpiry(expires time.Time) {
+	a.scheduled = expires
+	a.t.wheel.schedule(expires, func(now time.Time) {
+		a.expireAllocation(expires, now)
+	})
+}
+
+// expireAllocation releases the allocation if it is expired at now, or
+// schedules its expiry again if it was refreshed. The timers at other
+// deadlines than the last one scheduled are stale.
+func (a *allocation) expireAllocation(at, now time.Time) {
+	a.mu.Lock()
+	if a.released || !at.Equal(a.scheduled) {
+		a.mu.Unlock()
+		return
+	}
+	if now.Before(a.expires) {
+		a.scheduleExpiry(a.expires)
+		a.mu.Unlock()
+		return
+	}
+	a.mu.Unlock()
+	a.t.remove(a)
+}
+
+// permit installs or refreshes the permission of ip in tb until expires,
+// scheduling its expiry if new. It is called with a.mu held.
+func (a *allocation) permit(tb *relayTable, ip netip.Addr, expires time.Time) {
+	if _, ok := tb.permissions[ip]; !ok {
+		a.t.wheel.schedule(expires, func(now time.Time) {
+			a.expirePermission(ip, now)
+		})
+	}
+	tb.permissions[ip] = expires
+}
+
+// expirePermission forgets the permission of ip if it is expired at now, or
+// schedules its expiry again if it was refreshed.
+func (a *allocation) expirePermission(ip netip.Addr, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	expires, ok := a.table.Load().permissions[ip]
+	if !ok || a.released {
+		return
+	}
+	if now.Before(expires) {
+		a.t.wheel.schedule(expires, func(now time.Time) {
+			a.expirePermission(ip, now)
+		})
+		return
+	}
+	tb := a.table.Load().clone()
+	delete(tb.permissions, ip)
+	a.table.Store(tb)
+}
+
+// expireChannel unbinds the channel if it is expired at now, or schedules
+// its expiry again if it was refreshed.
+func (a *allocation) expireChannel(number uint16, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ch := a.table.Load().channels[number]
+	if ch == nil || a.released {
+		return
+	}
+	if now.Before(ch.expires) {
+		a.t.wheel.schedule(ch.expires, func(now time.Time) {
+			a.expireChannel(number, now)
+		})
+		return
+	}
+	tb := a.table.Load().clone()
+	delete(tb.channels, number)
+	delete(tb.peers, ch.peer)
+	a.table.Store(tb)
+}
+
+// serve relays the packets of the peers received on rl to the client until
+// the allocation is released. The packets are read and sent in batches,
+// and the ChannelData messages are made in place in the buffers. The
+// buffers hold one byte more than maxRelayPayload, so that the larger
+// datagrams, truncated by the read, are detected and dropped.
+func (a *allocation) serve(rl *relayedAddr) {
+	in := newBatchConn(rl.conn, relayBatchSize)
+	var out *batchConn
+	if conn, ok := a.key.l.conn.(*net.UDPConn); ok {
+		out = newBatchConn(conn, relayBatchSize)
+	}
+	_, stream := a.key.l.conn.(*streamConn)
+	bufs := make([][]byte, relayBatchSize)
+	for i := range bufs {
+		// The ChannelData messages are padded over streams.
+		bufs[i] = make([]byte, channelDataHeaderSize+maxRelayPayload+1+3)
+	}
+	msgs := make([]datagram, relayBatchSize)
+	sends := make([]datagram, 0, relayBatchSize)
+	for {
+		for i := range msgs {
+			msgs[i].buf = bufs[i][channelDataHeaderSize : channelDataHeaderSize+maxRelayPayload+1]
+		}
+		n, err := in.read(msgs)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return
+		}
+		now := time.Now()
+		tb := a.table.Load()
+		sends = sends[:0]
+		for i, m := range msgs[:n] {
+			peer := netip.AddrPortFrom(m.addr.Addr().Unmap(), m.addr.Port())
+			if m.n > maxRelayPayload || !now.Before(tb.permissions[peer.Addr()]) || !a.allow(m.n, now) {
+				continue
+			}
+			var msg []byte
+			ch := tb.peers[peer]
+			if ch != nil {
+				msg = bufs[i][:channelDataHeaderSize+m.n]
+				binary.BigEndian.PutUint16(msg[0:2], ch.number)
+				binary.BigEndian.PutUint16(msg[2:4], uint16(m.n))
+				if stream {
+					msg = bufs[i][:channelDataHeaderSize+(m.n+3)&^3]
+					for j := channelDataHeaderSize + m.n; j < len(msg); j++ {
+						msg[j] = 0
+					}
+				}
+			} else {
+				msg = newDataIndication(newHost(peer), m.buf[:m.n])
+			}
+			a.t.received.add(m.n, ch != nil)
+			sends = append(sends, datagram{buf: msg, n: len(msg), addr: tb.client})
+		}
+		if out != nil {
+			if err := out.write(sends); err != nil {
+				a.t.s.logger.Debugln("Relay to", tb.client, "failed:", err)
+			}
+			continue
+		}
+		client := net.UDPAddrFromAddrPort(tb.client)
+		for _, m := range sends {
+			a.key.l.conn.WriteTo(m.buf[:m.n], client)
+		}
+	}
+}
+
+// accept announces the connections of the peers accepted on rl to the
+// client with ConnectionAttempt indications, until the allocation is
+// released. The connections of the peers without permission are closed.
+func (a *allocation) accept(rl *relayedAddr) {
+	client := net.UDPAddrFromAddrPort(a.key.client)
+	for {
+		conn, err := rl.ln.AcceptTCP()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return
+		}
+		peer := newHost(conn.RemoteAddr().(*net.TCPAddr).AddrPort()).AddrPort()
+		if !a.permitted(peer.Addr(), time.Now()) {
+			conn.Close()
+			continue
+		}
+		pc := a.t.addConn(a, peer, conn)
+		if pc == nil {
+			return
+		}
+		ind, _ := newPacket()
+		ind.types = typeConnectionAttemptIndication
+		ind.addAttribute(*newConnectionIDAttribute(pc.id))
+		ind.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, newHost(peer), ind.transID))
+		a.key.l.conn.WriteTo(ind.bytes(), client)
+	}
+}
+
+// newDataIndication returns the Data indication carrying data from peer.
+func newDataIndication(peer *Host, data []byte) []byte {
+	pkt, _ := newPacket()
+	pkt.types = typeDataIndication
+	pkt.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, peer, pkt.transID))
+	pkt.addAttribute(*newAttribute(attributeData, data))
+	return pkt.bytes()
+}
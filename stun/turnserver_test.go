@@ -0,0 +1,641 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// testTURNUsers are the users of the TURN servers of the tests.
+var testTURNUsers = StaticCredentials{"alice": "secret", "bob": "secret", "carol": "secret"}
+
+// testLoopbackPeers allows the TURN servers of the tests to relay to the
+// peers on the loopback addresses, which are denied by default.
+var testLoopbackPeers = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+
+// newTestTURN makes s a TURN server of the test users with the
+// configuration cfg, relaying to the loopback peers.
+func newTestTURN(t testing.TB, s *Server, cfg TURNConfig) *TURNServer {
+	s.SetAuth("example.org", testTURNUsers)
+	cfg.AllowPeers = append(cfg.AllowPeers, testLoopbackPeers...)
+	ts, err := NewTURNServer(s, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+// signTURN authenticates req as the user of its USERNAME, alice if none,
+// with a nonce of s for the client ip, and returns it encoded.
+func signTURN(s *Server, req *packet, ip string) []byte {
+	username := "alice"
+	if req.hasAttribute(attributeUsername) {
+		username = req.getString(attributeUsername)
+	} else {
+		req.addAttribute(*newAttribute(attributeUsername, []byte(username)))
+	}
+	a := s.cfg.Load().auth
+	req.addAttribute(*newAttribute(attributeRealm, []byte(a.realm)))
+	req.addAttribute(*newAttribute(attributeNonce, []byte(a.nonce(netip.MustParseAddr(ip), time.Now()))))
+	req.addAttribute(*newMessageIntegrityAttribute(req, LongTermKey(username, a.realm, testTURNUsers[username])))
+	return req.bytes()
+}
+
+// newTestTURNServer starts a TURN server relaying on the loopback address.
+func newTestTURNServer(t testing.TB) (*Server, *TURNServer, net.Addr) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	ts := newTestTURN(t, s, TURNConfig{RelayIP: netip.MustParseAddr("127.0.0.1")})
+	go s.Serve(conn)
+	t.Cleanup(func() { s.Close() })
+	return s, ts, conn.LocalAddr()
+}
+
+// roundTrip sends b to addr on conn and returns the next message received.
+func roundTrip(t testing.TB, conn net.PacketConn, addr net.Addr, b []byte) []byte {
+	if b != nil {
+		if _, err := conn.WriteTo(b, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func newTURNRequest(types uint16, attrs ...*attribute) *packet {
+	req, _ := newPacket()
+	req.types = types
+	for _, a := range attrs {
+		req.addAttribute(*a)
+	}
+	return req
+}
+
+func TestTURNServer(t *testing.T) {
+	s, ts, addr := newTestTURNServer(t)
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peerHost := hostFromAddr(peer.LocalAddr())
+
+	req := newTURNRequest(typeAllocate)
+	resp, _ := newPacketFromBytes(roundTrip(t, client, addr, signTURN(s, req, "127.0.0.1")))
+	if resp.getErrorCode() != errorBadRequest {
+		t.Errorf("Allocate error: expected 400 without REQUESTED-TRANSPORT, get %d", resp.getErrorCode())
+	}
+	req = newTURNRequest(typeAllocate, newAttribute(attributeRequestedTransport, []byte{protocolUDP, 0, 0, 0}))
+	allocate := signTURN(s, req, "127.0.0.1")
+	resp, _ = newPacketFromBytes(roundTrip(t, client, addr, allocate))
+	relayed := resp.getXorAddr(attributeXorRelayedAddress)
+	if resp.types != typeAllocateResponse || relayed == nil {
+		t.Fatalf("Allocate error: %d", resp.getErrorCode())
+	}
+	if d, _ := resp.getLifetime(); d != defaultAllocationLifetime {
+		t.Errorf("Allocate error: lifetime %v", d)
+	}
+	// A retransmission gets the same allocation, a new request does not.
+	resp, _ = newPacketFromBytes(roundTrip(t, client, addr, allocate))
+	if a := resp.getXorAddr(attributeXorRelayedAddress); a == nil || a.String() != relayed.String() {
+		t.Errorf("Allocate error: retransmission got %v", a)
+	}
+	req = newTURNRequest(typeAllocate, newAttribute(attributeRequestedTransport, []byte{protocolUDP, 0, 0, 0}))
+	resp, _ = newPacketFromBytes(roundTrip(t, client, addr, signTURN(s, req, "127.0.0.1")))
+	if resp.getErrorCode() != errorAllocationMismatch {
+		t.Errorf("Allocate error: expected 437, get %d", resp.getErrorCode())
+	}
+
+	relayedAddr := net.UDPAddrFromAddrPort(relayed.AddrPort())
+	req = newTURNRequest(typeCreatePermisiion)
+	req.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, peerHost, req.transID))
+	resp, _ = newPacketFromBytes(roundTrip(t, client, addr, signTURN(s, req, "127.0.0.1")))
+	if resp.types != typeCreatePermisiionResponse {
+		t.Fatalf("CreatePermission error: %d", resp.getErrorCode())
+	}
+	ind := newTURNRequest(typeSendIndication)
+	ind.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, peerHost, ind.transID))
+	ind.addAttribute(*newAttribute(attributeData, []byte("hello")))
+	client.WriteTo(ind.bytes(), addr)
+	if b := roundTrip(t, peer, nil, nil); string(b) != "hello" {
+		t.Errorf("Send error: peer got %q", b)
+	}
+	peer.WriteTo([]byte("world"), relayedAddr)
+	data, _ := newPacketFromBytes(roundTrip(t, client, nil, nil))
+	if data.types != typeDataIndication || data.getString(attributeData) != "world" {
+		t.Errorf("Data error: %v", data)
+	}
+
+	req = newTURNRequest(typeChannelBinding, newAttribute(attributeChannelNumber, []byte{0x40, 0x01, 0, 0}))
+	req.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, peerHost, req.transID))
+	resp, _ = newPacketFromBytes(roundTrip(t, client, addr, signTURN(s, req, "127.0.0.1")))
+	if resp.types != typeChannelBindingResponse {
+		t.Fatalf("ChannelBind error: %d", resp.getErrorCode())
+	}
+	client.WriteTo(newChannelData(0x4001, []byte("ping")), addr)
+	if b := roundTrip(t, peer, nil, nil); string(b) != "ping" {
+		t.Errorf("ChannelData error: peer got %q", b)
+	}
+	peer.WriteTo([]byte("pong"), relayedAddr)
+	b := roundTrip(t, client, nil, nil)
+	if number, payload, ok := parseChannelData(b); !ok || number != 0x4001 || !bytes.Equal(payload, []byte("pong")) {
+		t.Errorf("ChannelData error: client got %x", b)
+	}
+	expected := TURNTraffic{ChannelPackets: 1, ChannelBytes: 4, IndicationPackets: 1, IndicationBytes: 5}
+	if st := ts.Stats(); st.Allocations != 1 || st.Sent != expected || st.Received != expected {
+		t.Errorf("Stats error: %+v", st)
+	}
+	// The datagrams larger than the relay buffers are dropped.
+	peer.WriteTo(make([]byte, maxRelayPayload+1), relayedAddr)
+	peer.WriteTo(make([]byte, maxRelayPayload), relayedAddr)
+	if b := roundTrip(t, client, nil, nil); len(b) != channelDataHeaderSize+maxRelayPayload {
+		t.Errorf("ChannelData error: client got %d bytes", len(b))
+	}
+
+	lifetime := make([]byte, 4)
+	binary.BigEndian.PutUint32(lifetime, 0)
+	req = newTURNRequest(typeRefresh, newAttribute(attributeLifetime, lifetime))
+	resp, _ = newPacketFromBytes(roundTrip(t, client, addr, signTURN(s, req, "127.0.0.1")))
+	if resp.types != typeRefreshResponse || ts.Allocations() != 0 {
+		t.Errorf("Refresh error: %d, %d allocations", resp.getErrorCode(), ts.Allocations())
+	}
+}
+
+func TestTURNQuotas(t *testing.T) {
+	s := NewServer()
+	ts := newTestTURN(t, s, TURNConfig{
+		RelayIP:            netip.MustParseAddr("127.0.0.1"),
+		MaxAllocations:     2,
+		MaxUserAllocations: 1,
+		MaxBandwidth:       1000,
+	})
+	defer s.Close()
+	l := &listener{}
+	allocate := func(port int, username string) *packet {
+		req := newTURNRequest(typeAllocate, newAttribute(attributeRequestedTransport, []byte{protocolUDP, 0, 0, 0}))
+		req.addAttribute(*newAttribute(attributeUsername, []byte(username)))
+		addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: port}
+		b, _, _ := s.handle(signTURN(s, req, "192.0.2.1"), addr, l, time.Now())
+		resp, err := newPacketFromBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for i, c := range []struct {
+		username string
+		code     int
+	}{
+		{"alice", 0},
+		{"alice", errorAllocationQuotaReached},
+		{"bob", 0},
+		{"carol", errorInsufficientCapacity},
+	} {
+		if code := allocate(1000+i, c.username).getErrorCode(); code != c.code {
+			t.Errorf("Allocate error: %s expected %d, get %d", c.username, c.code, code)
+		}
+	}
+	if ts.Allocations() != 2 {
+		t.Errorf("Allocate error: %d allocations", ts.Allocations())
+	}
+	a := ts.allocation(fiveTuple{netip.MustParseAddrPort("192.0.2.1:1000"), l})
+	now := time.Now()
+	if !a.allow(800, now) || a.allow(800, now) || !a.allow(800, now.Add(time.Second)) {
+		t.Errorf("allow error: bandwidth not limited")
+	}
+}
+
+func TestTURNIPv6(t *testing.T) {
+	if c, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 not available:", err)
+	} else {
+		c.Close()
+	}
+	s := NewServer()
+	newTestTURN(t, s, TURNConfig{
+		RelayIP:   netip.MustParseAddr("127.0.0.1"),
+		RelayIPv6: netip.MustParseAddr("::1"),
+	})
+	defer s.Close()
+	l := &listener{}
+	port := 1000
+	allocate := func(attrs ...*attribute) *packet {
+		req := newTURNRequest(typeAllocate, append([]*attribute{newAttribute(attributeRequestedTransport, []byte{protocolUDP, 0, 0, 0})}, attrs...)...)
+		port++
+		b, _, _ := s.handle(signTURN(s, req, "192.0.2.1"), &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: port}, l, time.Now())
+		resp, err := newPacketFromBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	families := func(resp *packet) []uint16 {
+		var fams []uint16
+		for _, a := range resp.attributes {
+			if a.types == attributeXorRelayedAddress {
+				fams = append(fams, a.xorAddr(resp.transID).Family())
+			}
+		}
+		return fams
+	}
+	ipv4 := []byte{attributeFamilyIPv4, 0, 0, 0}
+	ipv6 := []byte{attributeFamilyIPV6, 0, 0, 0}
+
+	resp := allocate(newAttribute(attributeRequestedAddressFamily, ipv6))
+	if fams := families(resp); len(fams) != 1 || fams[0] != attributeFamilyIPV6 {
+		t.Errorf("Allocate error: IPv6 got %v, %d", fams, resp.getErrorCode())
+	}
+	relayed := resp.getXorAddr(attributeXorRelayedAddress)
+	if relayed == nil || relayed.IP() != "::1" {
+		t.Errorf("Allocate error: IPv6 relayed %v", relayed)
+	}
+	resp = allocate(newAttribute(attributeAdditionalAddressFamily, ipv6))
+	if fams := families(resp); len(fams) != 2 || fams[0] != attributeFamilyIPv4 || fams[1] != attributeFamilyIPV6 {
+		t.Errorf("Allocate error: dual got %v, %d", fams, resp.getErrorCode())
+	}
+	for _, c := range []struct {
+		attrs []*attribute
+		code  int
+	}{
+		{[]*attribute{newAttribute(attributeRequestedAddressFamily, []byte{3, 0, 0, 0})}, errorAddressFamilyNotSupported},
+		{[]*attribute{newAttribute(attributeAdditionalAddressFamily, ipv4)}, errorBadRequest},
+		{[]*attribute{newAttribute(attributeRequestedAddressFamily, ipv4), newAttribute(attributeAdditionalAddressFamily, ipv6)}, errorBadRequest},
+	} {
+		if code := allocate(c.attrs...).getErrorCode(); code != c.code {
+			t.Errorf("Allocate error: expected %d, get %d", c.code, code)
+		}
+	}
+
+	// Without IPv6 relaying, a dual allocation gets IPv4 only.
+	s4 := NewServer()
+	newTestTURN(t, s4, TURNConfig{RelayIP: netip.MustParseAddr("127.0.0.1")})
+	defer s4.Close()
+	s = s4
+	resp = allocate(newAttribute(attributeAdditionalAddressFamily, ipv6))
+	e := resp.getAttribute(attributeAddressErrorCode)
+	if fams := families(resp); len(fams) != 1 || e == nil || e.value[0] != attributeFamilyIPV6 || int(e.value[2])*100+int(e.value[3]) != errorAddressFamilyNotSupported {
+		t.Errorf("Allocate error: dual without IPv6 got %v, %v", fams, e)
+	}
+	if code := allocate(newAttribute(attributeRequestedAddressFamily, ipv6)).getErrorCode(); code != errorAddressFamilyNotSupported {
+		t.Errorf("Allocate error: IPv6 without IPv6 relaying expected 440, get %d", code)
+	}
+}
+
+func TestTURNTCP(t *testing.T) {
+	s := NewServer()
+	ts := newTestTURN(t, s, TURNConfig{RelayIP: netip.MustParseAddr("127.0.0.1")})
+	defer s.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(ln)
+	peerLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerLn.Close()
+	peerHost := hostFromAddr(peerLn.Addr())
+	dial := func() *streamConn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return newStreamConn(conn)
+	}
+	tcpTransport := newAttribute(attributeRequestedTransport, []byte{protocolTCP, 0, 0, 0})
+
+	// The control connection is a stream.
+	b, _, _ := s.handle(signTURN(s, newTURNRequest(typeAllocate, tcpTransport), "192.0.2.1"), &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}, &listener{}, time.Now())
+	if resp, _ := newPacketFromBytes(b); resp.getErrorCode() != errorBadRequest {
+		t.Errorf("Allocate error: expected 400 over UDP, get %d", resp.getErrorCode())
+	}
+	control := dial()
+	resp, _ := newPacketFromBytes(roundTrip(t, control, nil, signTURN(s, newTURNRequest(typeAllocate, tcpTransport), "127.0.0.1")))
+	relayed := resp.getXorAddr(attributeXorRelayedAddress)
+	if resp.types != typeAllocateResponse || relayed == nil {
+		t.Fatalf("Allocate error: %d", resp.getErrorCode())
+	}
+	connect := newTURNRequest(typeConnect)
+	connect.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, peerHost, connect.transID))
+	resp, _ = newPacketFromBytes(roundTrip(t, control, nil, signTURN(s, connect, "127.0.0.1")))
+	if resp.getErrorCode() != errorForbidden {
+		t.Errorf("Connect error: expected 403 without permission, get %d", resp.getErrorCode())
+	}
+	req := newTURNRequest(typeCreatePermisiion)
+	req.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, peerHost, req.transID))
+	if resp, _ = newPacketFromBytes(roundTrip(t, control, nil, signTURN(s, req, "127.0.0.1"))); resp.types != typeCreatePermisiionResponse {
+		t.Fatalf("CreatePermission error: %d", resp.getErrorCode())
+	}
+
+	// bind binds the connection id on a new data connection, and checks
+	// that it relays both ways with the peer connection.
+	bind := func(id uint32, peer net.Conn) {
+		data := dial()
+		resp, _ := newPacketFromBytes(roundTrip(t, data, nil, signTURN(s, newTURNRequest(typeConnectionBind, newConnectionIDAttribute(id)), "127.0.0.1")))
+		if resp.types != typeConnectionBindResponse {
+			t.Fatalf("ConnectionBind error: %d", resp.getErrorCode())
+		}
+		buf := make([]byte, 5)
+		data.Write([]byte("hello"))
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("ConnectionBind error: peer got %q, %v", buf, err)
+		}
+		peer.Write([]byte("world"))
+		data.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(data, buf); err != nil || string(buf) != "world" {
+			t.Errorf("ConnectionBind error: client got %q, %v", buf, err)
+		}
+	}
+
+	connect = newTURNRequest(typeConnect)
+	connect.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, peerHost, connect.transID))
+	b = signTURN(s, connect, "127.0.0.1")
+	resp, _ = newPacketFromBytes(roundTrip(t, control, nil, b))
+	id, ok := resp.getConnectionID()
+	if resp.types != typeConnectResponse || !ok {
+		t.Fatalf("Connect error: %d", resp.getErrorCode())
+	}
+	peer, err := peerLn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	resp, _ = newPacketFromBytes(roundTrip(t, control, nil, b))
+	if resp.getErrorCode() != errorConnectionAlreadyExists {
+		t.Errorf("Connect error: expected 446, get %d", resp.getErrorCode())
+	}
+	bind(id, peer)
+	resp, _ = newPacketFromBytes(roundTrip(t, dial(), nil, signTURN(s, newTURNRequest(typeConnectionBind, newConnectionIDAttribute(id)), "127.0.0.1")))
+	if resp.getErrorCode() != errorBadRequest {
+		t.Errorf("ConnectionBind error: expected 400 when bound, get %d", resp.getErrorCode())
+	}
+
+	// The connections of the peers are announced.
+	peer, err = net.Dial("tcp", relayed.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	ind, _ := newPacketFromBytes(roundTrip(t, control, nil, nil))
+	id, ok = ind.getConnectionID()
+	if ind.types != typeConnectionAttemptIndication || !ok {
+		t.Fatalf("ConnectionAttempt error: %v", ind)
+	}
+	if a := ind.getXorAddr(attributeXorPeerAddress); a == nil || a.String() != hostFromAddr(peer.LocalAddr()).String() {
+		t.Errorf("ConnectionAttempt error: peer %v", a)
+	}
+	bind(id, peer)
+
+	if ts.Close(); len(ts.connections) != 0 {
+		t.Errorf("Close error: %d connections", len(ts.connections))
+	}
+}
+
+func TestTURNExpiry(t *testing.T) {
+	s := NewServer()
+	ts := newTestTURN(t, s, TURNConfig{RelayIP: netip.MustParseAddr("127.0.0.1")})
+	defer s.Close()
+	l := &listener{}
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	peer := newHost(netip.MustParseAddrPort("192.0.2.2:2000"))
+	send := func(req *packet) *packet {
+		b, _, _ := s.handle(signTURN(s, req, "192.0.2.1"), addr, l, time.Now())
+		resp, err := newPacketFromBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	send(newTURNRequest(typeAllocate, newAttribute(attributeRequestedTransport, []byte{protocolUDP, 0, 0, 0})))
+	req := newTURNRequest(typeChannelBinding, newAttribute(attributeChannelNumber, []byte{0x40, 0x00, 0, 0}))
+	req.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, peer, req.transID))
+	if resp := send(req); resp.types != typeChannelBindingResponse {
+		t.Fatalf("ChannelBind error: %d", resp.getErrorCode())
+	}
+	a := ts.allocation(fiveTuple{netip.MustParseAddrPort("192.0.2.1:1000"), l})
+	now := time.Now()
+
+	// The permission lasts less than the channel, which the allocation
+	// outlives once refreshed.
+	lifetime := newLifetimeAttribute(time.Hour)
+	if resp := send(newTURNRequest(typeRefresh, lifetime)); resp.types != typeRefreshResponse {
+		t.Fatalf("Refresh error: %d", resp.getErrorCode())
+	}
+	ts.wheel.advance(now.Add(permissionLifetime + time.Second))
+	if tb := a.table.Load(); len(tb.permissions) != 0 || len(tb.channels) != 1 {
+		t.Errorf("expiry error: %d permissions, %d channels", len(tb.permissions), len(tb.channels))
+	}
+	ts.wheel.advance(now.Add(channelLifetime + time.Second))
+	if tb := a.table.Load(); len(tb.channels) != 0 || len(tb.peers) != 0 || ts.Allocations() != 1 {
+		t.Errorf("expiry error: %d channels, %d allocations", len(tb.channels), ts.Allocations())
+	}
+	// A shorter refresh brings the expiry forward.
+	if resp := send(newTURNRequest(typeRefresh, newLifetimeAttribute(defaultAllocationLifetime))); resp.types != typeRefreshResponse {
+		t.Fatalf("Refresh error: %d", resp.getErrorCode())
+	}
+	ts.wheel.advance(now.Add(defaultAllocationLifetime + channelLifetime + 2*time.Second))
+	if ts.Allocations() != 0 {
+		t.Errorf("expiry error: %d allocations", ts.Allocations())
+	}
+}
+
+// newTestChannel allocates on the TURN server s at addr for client, and
+// binds the channel 0x4000 to peer.
+func newTestChannel(tb testing.TB, s *Server, client net.PacketConn, addr net.Addr, peer *Host) *Host {
+	req := newTURNRequest(typeAllocate, newAttribute(attributeRequestedTransport, []byte{protocolUDP, 0, 0, 0}))
+	resp, _ := newPacketFromBytes(roundTrip(tb, client, addr, signTURN(s, req, "127.0.0.1")))
+	relayed := resp.getXorAddr(attributeXorRelayedAddress)
+	if relayed == nil {
+		tb.Fatalf("Allocate error: %d", resp.getErrorCode())
+	}
+	req = newTURNRequest(typeChannelBinding, newAttribute(attributeChannelNumber, []byte{0x40, 0x00, 0, 0}))
+	req.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, peer, req.transID))
+	if resp, _ = newPacketFromBytes(roundTrip(tb, client, addr, signTURN(s, req, "127.0.0.1"))); resp.types != typeChannelBindingResponse {
+		tb.Fatalf("ChannelBind error: %d", resp.getErrorCode())
+	}
+	return relayed
+}
+
+// benchmarkRelay measures the relay of 1 KiB payloads written with send,
+// waiting for each one on recv so that none is dropped.
+func benchmarkRelay(b *testing.B, send func() error, recv net.PacketConn) {
+	b.SetBytes(1024)
+	b.ReportAllocs()
+	buf := make([]byte, 1500)
+	recv.SetReadDeadline(time.Now().Add(time.Minute))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := send(); err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := recv.ReadFrom(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTURNChannelData(b *testing.B) {
+	s, _, addr := newTestTURNServer(b)
+	s.SetWorkers(1)
+	client, _ := net.ListenPacket("udp4", "127.0.0.1:0")
+	defer client.Close()
+	peer, _ := net.ListenPacket("udp4", "127.0.0.1:0")
+	defer peer.Close()
+	newTestChannel(b, s, client, addr, hostFromAddr(peer.LocalAddr()))
+	msg := newChannelData(0x4000, make([]byte, 1024))
+	benchmarkRelay(b, func() error {
+		_, err := client.WriteTo(msg, addr)
+		return err
+	}, peer)
+}
+
+func BenchmarkTURNPeerData(b *testing.B) {
+	s, _, addr := newTestTURNServer(b)
+	client, _ := net.ListenPacket("udp4", "127.0.0.1:0")
+	defer client.Close()
+	peer, _ := net.ListenPacket("udp4", "127.0.0.1:0")
+	defer peer.Close()
+	relayed := net.UDPAddrFromAddrPort(newTestChannel(b, s, client, addr, hostFromAddr(peer.LocalAddr())).AddrPort())
+	payload := make([]byte, 1024)
+	benchmarkRelay(b, func() error {
+		_, err := peer.WriteTo(payload, relayed)
+		return err
+	}, client)
+}
+
+func TestTURNServerAuth(t *testing.T) {
+	s := NewServer()
+	if _, err := NewTURNServer(s, TURNConfig{RelayIP: netip.MustParseAddr("127.0.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	allocate := func(key []byte) int {
+		req := newTURNRequest(typeAllocate, newAttribute(attributeRequestedTransport, []byte{protocolUDP, 0, 0, 0}))
+		if key != nil {
+			req.addAttribute(*newAttribute(attributeUsername, []byte("alice")))
+			req.addAttribute(*newMessageIntegrityAttribute(req, key))
+		}
+		b, _, _ := s.handle(req.bytes(), addr, &listener{}, time.Now())
+		resp, err := newPacketFromBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.getErrorCode()
+	}
+	// The relay is never open, even with the short-term credentials.
+	if code := allocate(nil); code != errorUnauthorized {
+		t.Errorf("Allocate error: expected 401 without auth, get %d", code)
+	}
+	s.SetAuth("", testTURNUsers)
+	if code := allocate(ShortTermKey("secret")); code != errorUnauthorized {
+		t.Errorf("Allocate error: expected 401 with short-term auth, get %d", code)
+	}
+}
+
+func TestTURNPeers(t *testing.T) {
+	s := NewServer()
+	ts, err := NewTURNServer(s, TURNConfig{
+		RelayIP:    netip.MustParseAddr("127.0.0.1"),
+		AllowPeers: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+		DenyPeers:  []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24"), netip.MustParsePrefix("10.1.2.0/24")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetAuth("example.org", testTURNUsers)
+	for _, c := range []struct {
+		peer string
+		ok   bool
+	}{
+		{"192.0.2.2", true},
+		{"2001:db8::1", true},
+		{"10.1.0.1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"198.51.100.1", false},
+		{"10.1.2.3", false},
+	} {
+		if ok := ts.allowPeer(netip.MustParseAddr(c.peer)); ok != c.ok {
+			t.Errorf("allowPeer error: %s expected %v", c.peer, c.ok)
+		}
+	}
+
+	l := &listener{}
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	send := func(req *packet) int {
+		b, _, _ := s.handle(signTURN(s, req, "192.0.2.1"), addr, l, time.Now())
+		resp, err := newPacketFromBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.getErrorCode()
+	}
+	if code := send(newTURNRequest(typeAllocate, newAttribute(attributeRequestedTransport, []byte{protocolUDP, 0, 0, 0}))); code != 0 {
+		t.Fatalf("Allocate error: %d", code)
+	}
+	metadata := newHost(netip.MustParseAddrPort("169.254.169.254:80"))
+	req := newTURNRequest(typeCreatePermisiion)
+	req.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, newHost(netip.MustParseAddrPort("192.0.2.2:2000")), req.transID))
+	req.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, metadata, req.transID))
+	if code := send(req); code != errorForbidden {
+		t.Errorf("CreatePermission error: expected 403, get %d", code)
+	}
+	req = newTURNRequest(typeChannelBinding, newAttribute(attributeChannelNumber, []byte{0x40, 0x00, 0, 0}))
+	req.addAttribute(*newXorAddrAttribute(attributeXorPeerAddress, metadata, req.transID))
+	if code := send(req); code != errorForbidden {
+		t.Errorf("ChannelBind error: expected 403, get %d", code)
+	}
+	if tb := ts.allocation(fiveTuple{netip.MustParseAddrPort("192.0.2.1:1000"), l}).table.Load(); len(tb.permissions) != 0 || len(tb.channels) != 0 {
+		t.Errorf("permission error: %d permissions, %d channels", len(tb.permissions), len(tb.channels))
+	}
+}
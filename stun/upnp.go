@@ -0,0 +1,377 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ssdpAddr is the multicast address of SSDP, replaced in tests.
+var ssdpAddr = "239.255.255.250:1900"
+
+// upnpServices are the types of the services of the IGD mapping ports, in
+// order of preference.
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// upnpOnlyPermanentLeases is the error code of an IGD of the mappings of
+// no lifetime only (UPnP IGD WANIPConnection section 2.4.16).
+const upnpOnlyPermanentLeases = 725
+
+// UPnPMapper is a Mapper of the AddPortMapping action of a UPnP Internet
+// Gateway Device.
+type UPnPMapper struct {
+	// Location is the URL of the description of the IGD, or empty to
+	// discover the IGD by SSDP.
+	Location string
+	// Description is the description of the mappings, "go-stun" if empty.
+	Description string
+
+	mu      sync.Mutex
+	control string // the URL of the control of the service, once found
+	service string // the type of the service
+}
+
+// upnpError is the UPnP error of a failed action.
+type upnpError struct {
+	Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+	Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+// Mechanism returns MechanismUPnP.
+func (p *UPnPMapper) Mechanism() string {
+	return MechanismUPnP
+}
+
+// AddMapping maps the internal port on the IGD to the same external port,
+// of the external address of the IGD. An IGD of the permanent mappings
+// only is requested one of no lifetime.
+func (p *UPnPMapper) AddMapping(ctx context.Context, protocol string, internalPort int, lifetime time.Duration) (*ExternalMapping, error) {
+	if protocol != "udp" && protocol != "tcp" {
+		return nil, errors.New("Unsupported protocol.")
+	}
+	control, service, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(control)
+	if err != nil {
+		return nil, err
+	}
+	gateway, err := net.ResolveUDPAddr("udp", hostPort(u))
+	if err != nil {
+		return nil, err
+	}
+	local, err := localAddrTo(gateway)
+	if err != nil {
+		return nil, err
+	}
+	desc := p.Description
+	if desc == "" {
+		desc = "go-stun"
+	}
+	port := strconv.Itoa(internalPort)
+	args := func(lifetime time.Duration) [][2]string {
+		return [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", port},
+			{"NewProtocol", strings.ToUpper(protocol)},
+			{"NewInternalPort", port},
+			{"NewInternalClient", local.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", desc},
+			{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+		}
+	}
+	_, err = upnpAction(ctx, control, service, "AddPortMapping", args(lifetime))
+	var uerr *upnpError
+	if errors.As(err, &uerr) && uerr.Code == upnpOnlyPermanentLeases && lifetime != 0 {
+		lifetime = 0
+		_, err = upnpAction(ctx, control, service, "AddPortMapping", args(lifetime))
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp, err := upnpAction(ctx, control, service, "GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(resp["NewExternalIPAddress"]))
+	if err != nil || addr.IsUnspecified() {
+		return nil, errors.New("No external address of the gateway.")
+	}
+	return &ExternalMapping{
+		Mechanism:    MechanismUPnP,
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		External:     newHost(netip.AddrPortFrom(addr, uint16(internalPort))),
+		Lifetime:     lifetime,
+		Mapper:       p,
+	}, nil
+}
+
+// DeleteMapping deletes the mapping by the DeletePortMapping action.
+func (p *UPnPMapper) DeleteMapping(ctx context.Context, m *ExternalMapping) error {
+	control, service, err := p.discover(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = upnpAction(ctx, control, service, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(m.External.Port()))},
+		{"NewProtocol", strings.ToUpper(m.Protocol)},
+	})
+	return err
+}
+
+// discover returns the URL of the control and the type of the service
+// mapping ports, of the description at Location or of the IGD discovered
+// by SSDP, once found.
+func (p *UPnPMapper) discover(ctx context.Context) (string, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.control != "" {
+		return p.control, p.service, nil
+	}
+	location := p.Location
+	if location == "" {
+		var err error
+		if location, err = ssdpSearch(ctx); err != nil {
+			return "", "", err
+		}
+	}
+	control, service, err := upnpDescribe(ctx, location)
+	if err != nil {
+		return "", "", err
+	}
+	p.control, p.service = control, service
+	return control, service, nil
+}
+
+// ssdpSearch searches for an IGD by SSDP and returns the location of the
+// description of the first one responding.
+func ssdpSearch(ctx context.Context) (string, error) {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	buf := make([]byte, maxPacketSize)
+	interval := gatewayInterval
+	for i := 0; i < gatewayAttempts; i++ {
+		if _, err := conn.WriteTo([]byte(req), addr); err != nil {
+			return "", err
+		}
+		end := time.Now().Add(interval)
+		for time.Now().Before(end) {
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+			deadline := end
+			if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+				deadline = d
+			}
+			conn.SetReadDeadline(deadline)
+			n, _, err := conn.ReadFrom(buf)
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				continue
+			}
+			if location := resp.Header.Get("Location"); location != "" {
+				return location, nil
+			}
+		}
+		interval *= 2
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("No UPnP gateway found.")
+}
+
+// upnpDevice is a device of a UPnP description, of its services and of
+// its embedded devices.
+type upnpDevice struct {
+	Services []struct {
+		Type       string `xml:"serviceType"`
+		ControlURL string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// find returns the control URL of the service of the type, of the device
+// or of its embedded devices.
+func (d *upnpDevice) find(service string) string {
+	for _, s := range d.Services {
+		if strings.TrimSpace(s.Type) == service {
+			return strings.TrimSpace(s.ControlURL)
+		}
+	}
+	for i := range d.Devices {
+		if control := d.Devices[i].find(service); control != "" {
+			return control
+		}
+	}
+	return ""
+}
+
+// upnpDescribe fetches the description at the location and returns the
+// URL of the control and the type of the service mapping ports.
+func upnpDescribe(ctx context.Context, location string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", errors.New("Failed to fetch the UPnP description: " + resp.Status)
+	}
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return "", "", err
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	if root.URLBase != "" {
+		if u, err := url.Parse(strings.TrimSpace(root.URLBase)); err == nil {
+			base = u
+		}
+	}
+	for _, service := range upnpServices {
+		if control := root.Device.find(service); control != "" {
+			u, err := base.Parse(control)
+			if err != nil {
+				return "", "", err
+			}
+			return u.String(), service, nil
+		}
+	}
+	return "", "", errors.New("No UPnP service of port mappings.")
+}
+
+// upnpAction invokes the SOAP action of the service with the arguments in
+// order, and returns the arguments of the response by name, or the UPnP
+// error of a fault.
+func upnpAction(ctx context.Context, control, service, action string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + service + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, control, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+service+"#"+action+`"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		uerr := &upnpError{}
+		if xml.Unmarshal(data, uerr) == nil && uerr.Code != 0 {
+			return nil, uerr
+		}
+		return nil, errors.New("Failed to invoke " + action + ": " + resp.Status)
+	}
+	var envelope struct {
+		Body struct {
+			Response struct {
+				Args []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	if err := xml.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	out := make(map[string]string)
+	for _, arg := range envelope.Body.Response.Args {
+		out[arg.XMLName.Local] = arg.Value
+	}
+	return out, nil
+}
+
+// hostPort returns the host and the port of the URL, of the default port
+// of the scheme if missing.
+func hostPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
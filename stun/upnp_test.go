@@ -0,0 +1,201 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testUPnPDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL>
+</service></serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>`
+
+// testIGD is a UPnP IGD of the external address 203.0.113.1, of the
+// permanent mappings only if permanent.
+type testIGD struct {
+	permanent bool
+
+	mu       sync.Mutex
+	mappings map[string]string // the internal clients by protocol and port
+	actions  []string
+}
+
+func newTestIGD(t *testing.T, permanent bool) (*testIGD, string) {
+	g := &testIGD{permanent: permanent, mappings: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testUPnPDescription)
+	})
+	mux.HandleFunc("/ctl/IPConn", g.control)
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return g, s.URL + "/rootDesc.xml"
+}
+
+func (g *testIGD) control(w http.ResponseWriter, r *http.Request) {
+	action := r.Header.Get("SOAPAction")
+	action = strings.Trim(action[strings.Index(action, "#")+1:], `"`)
+	// The arguments are the elements of text.
+	args := make(map[string]string)
+	d := xml.NewDecoder(r.Body)
+	var name string
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			name = tok.Name.Local
+		case xml.CharData:
+			args[name] = string(tok)
+		case xml.EndElement:
+			name = ""
+		}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.actions = append(g.actions, action)
+	switch action {
+	case "AddPortMapping":
+		if g.permanent && args["NewLeaseDuration"] != "0" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+				`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+				`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode>`+
+				`<errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError>`+
+				`</detail></s:Fault></s:Body></s:Envelope>`, upnpOnlyPermanentLeases)
+			return
+		}
+		g.mappings[args["NewProtocol"]+" "+args["NewExternalPort"]] = args["NewInternalClient"]
+		io.WriteString(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:AddPortMappingResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/></s:Body></s:Envelope>`)
+	case "DeletePortMapping":
+		delete(g.mappings, args["NewProtocol"]+" "+args["NewExternalPort"])
+		io.WriteString(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:DeletePortMappingResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/></s:Body></s:Envelope>`)
+	case "GetExternalIPAddress":
+		io.WriteString(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">`+
+			`<NewExternalIPAddress>203.0.113.1</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func TestUPnPMapper(t *testing.T) {
+	g, location := newTestIGD(t, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p := &UPnPMapper{Location: location}
+	m, err := p.AddMapping(ctx, "udp", 4242, time.Hour)
+	if err != nil {
+		t.Fatalf("AddMapping error: %v", err)
+	}
+	if m.Mechanism != MechanismUPnP || m.External.String() != "203.0.113.1:4242" || m.Lifetime != time.Hour {
+		t.Errorf("AddMapping error: %v", m)
+	}
+	g.mu.Lock()
+	if client := g.mappings["UDP 4242"]; client != "127.0.0.1" {
+		t.Errorf("AddMapping error: internal client %q", client)
+	}
+	g.mu.Unlock()
+	if err := p.DeleteMapping(ctx, m); err != nil {
+		t.Fatalf("DeleteMapping error: %v", err)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.mappings) != 0 {
+		t.Errorf("DeleteMapping error: %v", g.mappings)
+	}
+}
+
+func TestUPnPMapperPermanent(t *testing.T) {
+	g, location := newTestIGD(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := (&UPnPMapper{Location: location}).AddMapping(ctx, "tcp", 4242, time.Hour)
+	if err != nil {
+		t.Fatalf("AddMapping error: %v", err)
+	}
+	if m.Lifetime != 0 {
+		t.Errorf("AddMapping error: lifetime %v, expected permanent", m.Lifetime)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.actions) != 3 || g.mappings["TCP 4242"] == "" {
+		t.Errorf("AddMapping error: actions %v, mappings %v", g.actions, g.mappings)
+	}
+}
+
+func TestUPnPMapperSSDP(t *testing.T) {
+	_, location := newTestIGD(t, false)
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+				continue
+			}
+			conn.WriteTo([]byte("HTTP/1.1 200 OK\r\n"+
+				"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n"+
+				"LOCATION: "+location+"\r\n\r\n"), addr)
+		}
+	}()
+	defer func(addr string) { ssdpAddr = addr }(ssdpAddr)
+	ssdpAddr = conn.LocalAddr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := MapPort(ctx, "udp", 4242, time.Hour, &UPnPMapper{})
+	if err != nil {
+		t.Fatalf("MapPort error: %v", err)
+	}
+	if m.Mechanism != MechanismUPnP {
+		t.Errorf("MapPort error: %v", m)
+	}
+}
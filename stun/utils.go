@@ -61,3 +61,12 @@ func isLocalAddress(local, localRemote string) bool {
 	}
 	return false
 }
+
+// errorText returns the message of err, or "" if nil, for the JSON encoding
+// of the results carrying an error.
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,110 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"sync"
+	"time"
+)
+
+// timerWheel calls functions at their deadlines, with the resolution of a
+// tick, without a timer or a goroutine by function: the functions are
+// hashed by deadline into a ring of slots which advance visits one tick at
+// a time (a hashed timing wheel). Scheduling is O(1), and a tick only looks
+// at the functions of its slot, so that many deadlines are cheap.
+type timerWheel struct {
+	tick time.Duration
+
+	mu    sync.Mutex
+	slots [][]wheelTimer
+	next  int64 // the tick to visit next
+}
+
+// wheelTimer is a function of a slot and the tick of its deadline.
+type wheelTimer struct {
+	at int64
+	f  func(now time.Time)
+}
+
+// newTimerWheel returns a wheel of n slots of one tick each, starting at
+// now.
+func newTimerWheel(tick time.Duration, n int, now time.Time) *timerWheel {
+	return &timerWheel{
+		tick:  tick,
+		slots: make([][]wheelTimer, n),
+		next:  now.UnixNano() / int64(tick),
+	}
+}
+
+// schedule calls f at the first tick after at, or the next tick if at is
+// past. f is called by advance, without the lock of the wheel: it can
+// schedule again.
+func (w *timerWheel) schedule(at time.Time, f func(now time.Time)) {
+	tick := (at.UnixNano() + int64(w.tick) - 1) / int64(w.tick)
+	w.mu.Lock()
+	if tick < w.next {
+		tick = w.next
+	}
+	slot := &w.slots[tick%int64(len(w.slots))]
+	*slot = append(*slot, wheelTimer{tick, f})
+	w.mu.Unlock()
+}
+
+// advance visits the ticks up to now, and calls the functions due.
+func (w *timerWheel) advance(now time.Time) {
+	tick := now.UnixNano() / int64(w.tick)
+	var due []wheelTimer
+	w.mu.Lock()
+	// After a pause of more than a turn, each slot is visited once.
+	if n := int64(len(w.slots)); tick-w.next >= n {
+		w.next = tick - n + 1
+	}
+	for ; w.next <= tick; w.next++ {
+		slot := &w.slots[w.next%int64(len(w.slots))]
+		kept := (*slot)[:0]
+		for _, t := range *slot {
+			if t.at <= tick {
+				due = append(due, t)
+			} else {
+				kept = append(kept, t)
+			}
+		}
+		for i := len(kept); i < len(*slot); i++ {
+			// Release the functions called.
+			(*slot)[i] = wheelTimer{}
+		}
+		*slot = kept
+	}
+	w.mu.Unlock()
+	for _, t := range due {
+		t.f(now)
+	}
+}
+
+// run advances the wheel every tick until done is closed.
+func (w *timerWheel) run(done <-chan struct{}) {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			w.advance(now)
+		}
+	}
+}
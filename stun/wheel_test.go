@@ -0,0 +1,61 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stun
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	start := time.Unix(1000, 0)
+	w := newTimerWheel(time.Second, 8, start)
+	var fired []int
+	at := func(i int, d time.Duration) {
+		w.schedule(start.Add(d), func(now time.Time) {
+			if now.Before(start.Add(d)) {
+				t.Errorf("timer %d fired early at %v", i, now.Sub(start))
+			}
+			fired = append(fired, i)
+		})
+	}
+	at(0, 1500*time.Millisecond)
+	at(1, 3*time.Second)
+	at(2, 20*time.Second) // after more than a turn
+	at(3, -time.Second)   // past
+	w.advance(start.Add(time.Second))
+	if len(fired) != 1 || fired[0] != 3 {
+		t.Errorf("advance error: %v fired", fired)
+	}
+	w.advance(start.Add(3 * time.Second))
+	if len(fired) != 3 || fired[1] != 0 || fired[2] != 1 {
+		t.Errorf("advance error: %v fired", fired)
+	}
+	w.advance(start.Add(19 * time.Second))
+	if len(fired) != 3 {
+		t.Errorf("advance error: %v fired", fired)
+	}
+	// A function can schedule again.
+	w.schedule(start.Add(20*time.Second), func(now time.Time) {
+		at(4, 21*time.Second)
+	})
+	w.advance(start.Add(20 * time.Second))
+	w.advance(start.Add(time.Minute))
+	if len(fired) != 5 || fired[3] != 2 || fired[4] != 4 {
+		t.Errorf("advance error: %v fired", fired)
+	}
+}
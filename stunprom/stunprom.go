@@ -0,0 +1,329 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+// Package stunprom exposes the metrics of the STUN clients and servers and
+// the TURN servers and allocations of package stun to Prometheus.
+//
+// The metrics are collected from their Stats on each scrape and written in
+// the Prometheus text exposition format, so that no client library is
+// needed:
+//
+//	c := stunprom.NewCollector("stun")
+//	c.AddServer("main", server)
+//	c.AddTURNServer("main", turnServer)
+//	c.AddClient("probe", client)
+//	http.Handle("/metrics", c)
+package stunprom
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// Collector collects the metrics of the clients, the servers, the TURN
+// servers and the TURN allocations added to it, each labeled by its name.
+// It is an http.Handler serving the metrics to the scrapes.
+type Collector struct {
+	namespace string
+
+	mu          sync.Mutex
+	clients     map[string]*stun.Client
+	servers     map[string]*stun.Server
+	turnServers map[string]*stun.TURNServer
+	allocations map[string]*stun.TURNAllocation
+}
+
+// NewCollector returns a collector of the metrics named after the
+// namespace, e.g. stun_server_requests_total of "stun", which is the default
+// if empty.
+func NewCollector(namespace string) *Collector {
+	if namespace == "" {
+		namespace = "stun"
+	}
+	return &Collector{
+		namespace:   namespace,
+		clients:     make(map[string]*stun.Client),
+		servers:     make(map[string]*stun.Server),
+		turnServers: make(map[string]*stun.TURNServer),
+		allocations: make(map[string]*stun.TURNAllocation),
+	}
+}
+
+// AddClient adds the client of the name, replacing the one of the same name
+// if any, or removes it if nil.
+func (c *Collector) AddClient(name string, client *stun.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client == nil {
+		delete(c.clients, name)
+		return
+	}
+	c.clients[name] = client
+}
+
+// AddServer adds the server of the name, replacing the one of the same name
+// if any, or removes it if nil.
+func (c *Collector) AddServer(name string, s *stun.Server) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s == nil {
+		delete(c.servers, name)
+		return
+	}
+	c.servers[name] = s
+}
+
+// AddTURNServer adds the TURN server of the name, replacing the one of the
+// same name if any, or removes it if nil.
+func (c *Collector) AddTURNServer(name string, t *stun.TURNServer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t == nil {
+		delete(c.turnServers, name)
+		return
+	}
+	c.turnServers[name] = t
+}
+
+// AddTURNAllocation adds the TURN allocation of the client of the name,
+// replacing the one of the same name if any, or removes it if nil.
+func (c *Collector) AddTURNAllocation(name string, a *stun.TURNAllocation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if a == nil {
+		delete(c.allocations, name)
+		return
+	}
+	c.allocations[name] = a
+}
+
+// ServeHTTP implements http.Handler, writing the metrics in the text
+// exposition format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w in the text exposition format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	m := &metrics{namespace: c.namespace}
+	for _, name := range sortedKeys(c.clients) {
+		m.client(name, c.clients[name].Stats())
+	}
+	for _, name := range sortedKeys(c.servers) {
+		m.server(name, c.servers[name].Stats())
+	}
+	for _, name := range sortedKeys(c.turnServers) {
+		m.turnServer(name, c.turnServers[name].Stats())
+	}
+	for _, name := range sortedKeys(c.allocations) {
+		m.allocation(name, c.allocations[name].Stats())
+	}
+	c.mu.Unlock()
+	return m.writeTo(w)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metrics is the metric families of a scrape, in the order they are
+// first added.
+type metrics struct {
+	namespace string
+	families  []*family
+	index     map[string]*family
+}
+
+type family struct {
+	name, help, kind string
+	samples          []sample
+}
+
+type sample struct {
+	suffix string   // of the histograms, e.g. _bucket
+	labels []string // names and values
+	value  float64
+}
+
+// add adds the sample of the metric, of the labels given as names and
+// values in turn.
+func (m *metrics) add(name, kind, help string, value float64, labels ...string) {
+	m.addSample(name, kind, help, sample{labels: labels, value: value})
+}
+
+func (m *metrics) addSample(name, kind, help string, s sample) {
+	name = m.namespace + "_" + name
+	f := m.index[name]
+	if f == nil {
+		if m.index == nil {
+			m.index = make(map[string]*family)
+		}
+		f = &family{name: name, help: help, kind: kind}
+		m.index[name] = f
+		m.families = append(m.families, f)
+	}
+	f.samples = append(f.samples, s)
+}
+
+// histogram adds the samples of h in seconds, of the cumulative buckets,
+// the sum and the count.
+func (m *metrics) histogram(name, help string, h stun.Histogram, labels ...string) {
+	var n uint64
+	for i, count := range h.Counts {
+		n += count
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = formatFloat(h.Bounds[i].Seconds())
+		}
+		l := append(append([]string(nil), labels...), "le", le)
+		m.addSample(name, "histogram", help, sample{"_bucket", l, float64(n)})
+	}
+	m.addSample(name, "histogram", help, sample{"_sum", labels, h.Sum.Seconds()})
+	m.addSample(name, "histogram", help, sample{"_count", labels, float64(h.Count)})
+}
+
+// traffic adds the packets and the bytes relayed in the direction.
+func (m *metrics) traffic(prefix string, t stun.TURNTraffic, labels ...string) {
+	const (
+		packets = "Packets relayed, by direction and framing."
+		bytes   = "Bytes of data relayed, by direction and framing."
+	)
+	channel := append(append([]string(nil), labels...), "framing", "channel")
+	indication := append(append([]string(nil), labels...), "framing", "indication")
+	m.add(prefix+"relayed_packets_total", "counter", packets, float64(t.ChannelPackets), channel...)
+	m.add(prefix+"relayed_packets_total", "counter", packets, float64(t.IndicationPackets), indication...)
+	m.add(prefix+"relayed_bytes_total", "counter", bytes, float64(t.ChannelBytes), channel...)
+	m.add(prefix+"relayed_bytes_total", "counter", bytes, float64(t.IndicationBytes), indication...)
+}
+
+func (m *metrics) client(name string, st stun.TransactionStats) {
+	const transactions = "Request transactions of the client, by result."
+	m.add("client_transactions_total", "counter", transactions, float64(st.Responded), "client", name, "result", "responded")
+	m.add("client_transactions_total", "counter", transactions, float64(st.Lost), "client", name, "result", "lost")
+	m.add("client_transactions_total", "counter", transactions, float64(st.Failed), "client", name, "result", "failed")
+	m.add("client_requests_total", "counter", "Requests sent by the client, the retransmissions included.", float64(st.Sent), "client", name)
+	var retransmissions uint64
+	if st.Sent > st.Transactions {
+		retransmissions = st.Sent - st.Transactions
+	}
+	m.add("client_retransmissions_total", "counter", "Requests retransmitted by the client.", float64(retransmissions), "client", name)
+	m.add("client_timeouts_total", "counter", "Requests of the client timed out without response.", float64(st.Timeouts), "client", name)
+	m.add("client_stray_packets_total", "counter", "Packets read by the client of no transaction in progress.", float64(st.Stray), "client", name)
+	m.histogram("client_rtt_seconds", "Round-trip time of the transactions of the client responded to.", st.RTT, "client", name)
+}
+
+func (m *metrics) server(name string, st stun.ServerStats) {
+	types := make([]int, 0, len(st.Requests))
+	for t := range st.Requests {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	for _, t := range types {
+		m.add("server_requests_total", "counter", "Requests received by the server, by message type.",
+			float64(st.Requests[uint16(t)]), "server", name, "type", stun.TypeName(uint16(t)))
+	}
+	codes := make([]int, 0, len(st.Errors))
+	for code := range st.Errors {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		m.add("server_errors_total", "counter", "Error responses of the server, by error code.",
+			float64(st.Errors[code]), "server", name, "code", strconv.Itoa(code))
+	}
+	reasons := make([]int, 0, len(st.Drops))
+	for r := range st.Drops {
+		reasons = append(reasons, int(r))
+	}
+	sort.Ints(reasons)
+	for _, r := range reasons {
+		m.add("server_drops_total", "counter", "Packets dropped by the server without response, by reason.",
+			float64(st.Drops[stun.DropReason(r)]), "server", name, "reason", stun.DropReason(r).String())
+	}
+	m.histogram("server_latency_seconds", "Time of the server to respond to the requests.", st.Latency, "server", name)
+}
+
+func (m *metrics) turnServer(name string, st stun.TURNServerStats) {
+	m.add("turn_allocations", "gauge", "Allocations of the TURN server.", float64(st.Allocations), "server", name)
+	m.traffic("turn_", st.Sent, "server", name, "direction", "sent")
+	m.traffic("turn_", st.Received, "server", name, "direction", "received")
+}
+
+func (m *metrics) allocation(name string, st stun.TURNAllocationStats) {
+	m.traffic("turn_client_", st.Sent, "allocation", name, "direction", "sent")
+	m.traffic("turn_client_", st.Received, "allocation", name, "direction", "received")
+	m.add("turn_client_drops_total", "counter", "Packets received by the allocation and dropped as the queue is full.", float64(st.Drops), "allocation", name)
+	m.add("turn_client_refreshes_total", "counter", "Refreshes of the allocation.", float64(st.Refreshes), "allocation", name)
+	m.add("turn_client_reallocations_total", "counter", "Reallocations after the allocation is lost by the server.", float64(st.Reallocations), "allocation", name)
+	m.add("turn_client_lifetime_seconds", "gauge", "Lifetime of the allocation as last granted.", st.Lifetime.Seconds(), "allocation", name)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metrics) writeTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	b := bufio.NewWriter(cw)
+	for _, f := range m.families {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, s := range f.samples {
+			b.WriteString(f.name + s.suffix)
+			for i := 0; i+1 < len(s.labels); i += 2 {
+				sep := ","
+				if i == 0 {
+					sep = "{"
+				}
+				fmt.Fprintf(b, `%s%s="%s"`, sep, s.labels[i], labelEscaper.Replace(s.labels[i+1]))
+			}
+			if len(s.labels) > 0 {
+				b.WriteByte('}')
+			}
+			b.WriteString(" " + formatFloat(s.value) + "\n")
+		}
+	}
+	err := b.Flush()
+	return cw.n, err
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// countWriter counts the bytes written for WriteTo.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,105 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stunprom
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+func TestCollector(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := stun.NewServer()
+	ts, err := stun.NewTURNServer(s, stun.TURNConfig{RelayIP: netip.MustParseAddr("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(conn)
+	defer s.Close()
+
+	cc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	client := stun.NewClientWithConnection(cc)
+	client.SetServerAddr(conn.LocalAddr().String())
+	for i := 0; i < 2; i++ {
+		if _, err := client.Keepalive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewCollector("")
+	c.AddClient("probe", client)
+	c.AddServer("main", s)
+	c.AddTURNServer("main", ts)
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("ServeHTTP error: content type %q", ct)
+	}
+	out := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE stun_client_transactions_total counter",
+		`stun_client_transactions_total{client="probe",result="responded"} 2`,
+		`stun_client_requests_total{client="probe"} 2`,
+		`stun_client_retransmissions_total{client="probe"} 0`,
+		"# TYPE stun_client_rtt_seconds histogram",
+		`stun_client_rtt_seconds_bucket{client="probe",le="+Inf"} 2`,
+		`stun_client_rtt_seconds_count{client="probe"} 2`,
+		`stun_server_requests_total{server="main",type="Binding request"} 2`,
+		`stun_server_latency_seconds_count{server="main"} 2`,
+		"# TYPE stun_turn_allocations gauge",
+		`stun_turn_allocations{server="main"} 0`,
+		`stun_turn_relayed_bytes_total{server="main",direction="sent",framing="channel"} 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("ServeHTTP error: %q not found in\n%s", line, out)
+		}
+	}
+	if strings.Count(out, "# TYPE stun_turn_relayed_bytes_total") != 1 {
+		t.Errorf("ServeHTTP error: metric family repeated\n%s", out)
+	}
+
+	c.AddServer("main", nil)
+	var b strings.Builder
+	if n, err := c.WriteTo(&b); err != nil || n != int64(b.Len()) {
+		t.Errorf("WriteTo error: %d, %v", n, err)
+	}
+	if strings.Contains(b.String(), "stun_server_") {
+		t.Errorf("AddServer error: server not removed\n%s", b.String())
+	}
+}
+
+func TestLabelEscape(t *testing.T) {
+	m := &metrics{namespace: "test"}
+	m.add("up", "gauge", "Up.", 1, "name", "a\"b\\c\nd")
+	var b strings.Builder
+	m.writeTo(&b)
+	if want := `test_up{name="a\"b\\c\nd"} 1`; !strings.Contains(b.String(), want) {
+		t.Errorf("writeTo error: %q, expected %q", b.String(), want)
+	}
+}
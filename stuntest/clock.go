@@ -0,0 +1,73 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stuntest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a fake clock, whose time only passes by Advance, or up to the
+// read deadlines of the connections of a Network of instant timeouts. It
+// implements stun.Clock.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	changed chan struct{} // closed when the time passes
+}
+
+// NewClock returns a clock of the time start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start, changed: make(chan struct{})}
+}
+
+// Now returns the time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance passes the time of the clock by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(c.now.Add(d))
+}
+
+// advanceTo passes the time of the clock up to t, unless already later.
+func (c *Clock) advanceTo(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.now) {
+		c.set(t)
+	}
+}
+
+// set sets the time and wakes the waiters, with the lock held.
+func (c *Clock) set(t time.Time) {
+	c.now = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// state returns the time and the channel closed when it passes.
+func (c *Clock) state() (time.Time, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now, c.changed
+}
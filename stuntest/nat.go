@@ -0,0 +1,174 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stuntest
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// privateAddr is the address of the hosts behind the NATs.
+var privateAddr = netip.MustParseAddr("10.0.0.1")
+
+// NAT is a NAT of the network, of the mapping and the filtering behaviors
+// of RFC 4787, without hairpinning. The mappings do not expire.
+type NAT struct {
+	net       *Network
+	public    netip.Addr
+	mapping   stun.Behavior
+	filtering stun.Behavior
+
+	mu       sync.Mutex
+	nextPort uint16
+	mappings map[mappingKey]*natMapping
+}
+
+// mappingKey is the key of a mapping, of the internal address and of the
+// destination as far as the mapping behavior depends on it.
+type mappingKey struct {
+	internal netip.AddrPort
+	dst      netip.AddrPort
+}
+
+// natMapping is a mapping of a NAT, to the internal connection, with the
+// destinations of the datagrams sent through it to filter the ones in.
+type natMapping struct {
+	nat      *NAT
+	conn     *conn
+	public   netip.AddrPort
+	sent     map[netip.AddrPort]bool
+	sentAddr map[netip.Addr]bool
+}
+
+// NewNAT returns a NAT of the public IP address, e.g. "203.0.113.1", and the
+// mapping and the filtering behaviors, as Behaviors returns of a NAT type.
+func (n *Network) NewNAT(public string, mapping, filtering stun.Behavior) (*NAT, error) {
+	ip, err := netip.ParseAddr(public)
+	if err != nil {
+		return nil, err
+	}
+	if mapping == stun.BehaviorUnknown || filtering == stun.BehaviorUnknown {
+		return nil, errors.New("Unknown NAT behavior.")
+	}
+	return &NAT{
+		net:       n,
+		public:    ip.Unmap(),
+		mapping:   mapping,
+		filtering: filtering,
+		nextPort:  firstPort,
+		mappings:  make(map[mappingKey]*natMapping),
+	}, nil
+}
+
+// Behaviors returns the mapping and the filtering behaviors of the NAT type
+// of RFC 3489, or false if it is not of a NAT, e.g. stun.NATNone.
+func Behaviors(t stun.NATType) (mapping, filtering stun.Behavior, ok bool) {
+	switch t {
+	case stun.NATFull:
+		return stun.BehaviorEndpointIndependent, stun.BehaviorEndpointIndependent, true
+	case stun.NATRestricted:
+		return stun.BehaviorEndpointIndependent, stun.BehaviorAddressDependent, true
+	case stun.NATPortRestricted:
+		return stun.BehaviorEndpointIndependent, stun.BehaviorAddressPortDependent, true
+	case stun.NATSymetric:
+		return stun.BehaviorAddressPortDependent, stun.BehaviorAddressPortDependent, true
+	}
+	return stun.BehaviorUnknown, stun.BehaviorUnknown, false
+}
+
+// ListenPacket returns a connection of a host behind the NAT, of a private
+// address, whose datagrams are sent through the mappings of the NAT.
+func (t *NAT) ListenPacket() (net.PacketConn, error) {
+	t.mu.Lock()
+	if t.nextPort == 0 {
+		t.mu.Unlock()
+		return nil, errors.New("No ephemeral port left.")
+	}
+	c := newConn(t.net, netip.AddrPortFrom(privateAddr, t.nextPort))
+	t.nextPort++
+	t.mu.Unlock()
+	c.send = func(dst netip.AddrPort, b []byte) {
+		t.send(c, dst, b)
+	}
+	c.onClose = func() {
+		t.release(c)
+	}
+	return c, nil
+}
+
+// send sends the datagram b of the connection to dst through its mapping,
+// created if none.
+func (t *NAT) send(c *conn, dst netip.AddrPort, b []byte) {
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	key := mappingKey{internal: c.addr}
+	switch t.mapping {
+	case stun.BehaviorAddressDependent:
+		key.dst = netip.AddrPortFrom(dst.Addr(), 0)
+	case stun.BehaviorAddressPortDependent:
+		key.dst = dst
+	}
+	t.mu.Lock()
+	m := t.mappings[key]
+	if m == nil {
+		m = &natMapping{nat: t, conn: c, sent: make(map[netip.AddrPort]bool), sentAddr: make(map[netip.Addr]bool)}
+		var err error
+		if m.public, err = t.net.bind(netip.AddrPortFrom(t.public, 0), m); err != nil {
+			t.mu.Unlock()
+			return
+		}
+		t.mappings[key] = m
+	}
+	m.sent[dst] = true
+	m.sentAddr[dst.Addr()] = true
+	t.mu.Unlock()
+	t.net.send(m.public, dst, b)
+}
+
+// release removes the mappings of the connection.
+func (t *NAT) release(c *conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, m := range t.mappings {
+		if m.conn == c {
+			t.net.unbind(m.public)
+			delete(t.mappings, key)
+		}
+	}
+}
+
+// deliver lets the datagram b from src in to the internal connection if the
+// filtering behavior of the NAT allows.
+func (m *natMapping) deliver(src netip.AddrPort, b []byte) {
+	m.nat.mu.Lock()
+	allowed := true
+	switch m.nat.filtering {
+	case stun.BehaviorAddressDependent:
+		allowed = m.sentAddr[src.Addr()]
+	case stun.BehaviorAddressPortDependent:
+		allowed = m.sent[src]
+	}
+	m.nat.mu.Unlock()
+	if !allowed {
+		m.nat.net.release()
+		return
+	}
+	m.conn.deliver(src, b)
+}
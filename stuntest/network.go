@@ -0,0 +1,394 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+// Package stuntest provides an in-memory network of STUN servers and NATs
+// for the deterministic tests of the users of package stun, without
+// sockets: the servers answer on scripted behaviors, e.g. dropping the n-th
+// request, mangling attributes or delaying the responses, and the clients
+// are put behind NATs of the types of RFC 3489, or of the behaviors of RFC
+// 4787. The clients are of stun.NewClientWithConnection, and the timeouts
+// of their retransmissions take no time with the instant timeouts.
+//
+//	n := stuntest.NewNetwork()
+//	n.SetInstantTimeouts(true)
+//	s, _ := stuntest.NewServer(n, "192.0.2.1:3478", "192.0.2.2:3479")
+//	defer s.Close()
+//	nat, _ := n.NewNAT("203.0.113.1", stun.BehaviorEndpointIndependent, stun.BehaviorAddressPortDependent)
+//	conn, _ := nat.ListenPacket()
+//	c := stun.NewClientWithConnection(conn)
+//	c.SetServerAddr(s.Addr())
+//	typ, host, err := c.Discover() // stun.NATPortRestricted
+package stuntest
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// queueSize is the number of the datagrams queued to a connection,
+	// after which they are dropped.
+	queueSize = 256
+	// firstPort is the first of the ephemeral ports.
+	firstPort = 49152
+)
+
+// endpoint receives the datagrams sent to an address of the network.
+type endpoint interface {
+	deliver(src netip.AddrPort, b []byte)
+}
+
+// Network is an in-memory network of UDP, which delivers the datagrams at
+// once and in order, unless the queue of the destination is full.
+type Network struct {
+	mu        sync.Mutex
+	endpoints map[netip.AddrPort]endpoint
+	nextPort  map[netip.Addr]uint16
+	instant   bool
+	inflight  int           // the datagrams queued or being answered
+	idle      chan struct{} // closed when none is in flight
+	clock     *Clock
+}
+
+// NewNetwork returns an empty network.
+func NewNetwork() *Network {
+	idle := make(chan struct{})
+	close(idle)
+	return &Network{
+		endpoints: make(map[netip.AddrPort]endpoint),
+		nextPort:  make(map[netip.Addr]uint16),
+		idle:      idle,
+	}
+}
+
+// SetInstantTimeouts sets the reads of a deadline to time out at once when
+// no datagram is in flight in the network, i.e. queued to a connection or
+// being answered by a Server, or a response delayed by its script, as if
+// the time up to the deadline passed. The retransmissions of the clients
+// then take no time. A datagram read by a connection of ListenPacket is
+// not in flight anymore, so the servers of the tests are to be of
+// NewServer.
+func (n *Network) SetInstantTimeouts(on bool) {
+	n.mu.Lock()
+	n.instant = on
+	n.mu.Unlock()
+}
+
+// SetClock sets the clock the read deadlines of the connections are of, the
+// system clock if nil. The clients and servers on the network are to be of
+// the same clock, by their SetClock. With the instant timeouts, a read
+// timing out passes the time of the clock up to its deadline, so the
+// retransmission timers of the clients see the time they wait for. The
+// delays of the scripts stay of the system clock.
+func (n *Network) SetClock(clock *Clock) {
+	n.mu.Lock()
+	n.clock = clock
+	n.mu.Unlock()
+}
+
+// clockOf returns the clock of the network, nil if the system clock.
+func (n *Network) clockOf() *Clock {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.clock
+}
+
+// hold counts a datagram in flight.
+func (n *Network) hold() {
+	n.mu.Lock()
+	if n.inflight == 0 {
+		n.idle = make(chan struct{})
+	}
+	n.inflight++
+	n.mu.Unlock()
+}
+
+// release counts a datagram in flight no more.
+func (n *Network) release() {
+	n.mu.Lock()
+	n.inflight--
+	if n.inflight == 0 {
+		close(n.idle)
+	}
+	n.mu.Unlock()
+}
+
+// idleChan returns the channel closed when no datagram is in flight, or nil
+// without the instant timeouts.
+func (n *Network) idleChan() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.instant {
+		return nil
+	}
+	return n.idle
+}
+
+// ListenPacket returns a connection of the address, e.g. "192.0.2.1:3478",
+// of an ephemeral port if 0, not behind any NAT.
+func (n *Network) ListenPacket(addr string) (net.PacketConn, error) {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := n.listen(ap)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// listen returns a connection of the address, of an ephemeral port if 0.
+func (n *Network) listen(ap netip.AddrPort) (*conn, error) {
+	c := newConn(n, ap)
+	var err error
+	if c.addr, err = n.bind(ap, c); err != nil {
+		return nil, err
+	}
+	c.send = func(dst netip.AddrPort, b []byte) {
+		n.send(c.addr, dst, b)
+	}
+	c.onClose = func() {
+		n.unbind(c.addr)
+	}
+	return c, nil
+}
+
+// bind binds the endpoint to the address, of an ephemeral port if 0, and
+// returns the address.
+func (n *Network) bind(addr netip.AddrPort, e endpoint) (netip.AddrPort, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	if addr.Port() == 0 {
+		for i := 0; ; i++ {
+			if i == 0x10000-firstPort {
+				return addr, errors.New("No ephemeral port left.")
+			}
+			port := n.nextPort[addr.Addr()]
+			if port < firstPort {
+				port = firstPort
+			}
+			n.nextPort[addr.Addr()] = port + 1
+			if _, ok := n.endpoints[netip.AddrPortFrom(addr.Addr(), port)]; !ok {
+				addr = netip.AddrPortFrom(addr.Addr(), port)
+				break
+			}
+		}
+	}
+	if _, ok := n.endpoints[addr]; ok {
+		return addr, errors.New("Address already in use.")
+	}
+	n.endpoints[addr] = e
+	return addr, nil
+}
+
+// unbind releases the address.
+func (n *Network) unbind(addr netip.AddrPort) {
+	n.mu.Lock()
+	delete(n.endpoints, addr)
+	n.mu.Unlock()
+}
+
+// send delivers a copy of the datagram b from src to dst, or drops it if
+// none is bound to dst. The datagram is in flight until dropped or read.
+func (n *Network) send(src, dst netip.AddrPort, b []byte) {
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	n.hold()
+	n.mu.Lock()
+	e := n.endpoints[dst]
+	n.mu.Unlock()
+	if e == nil {
+		n.release()
+		return
+	}
+	e.deliver(src, append([]byte(nil), b...))
+}
+
+// datagram is a datagram queued to a connection.
+type datagram struct {
+	src netip.AddrPort
+	b   []byte
+}
+
+// conn is a connection of the network, of the functions sending the
+// datagrams written and releasing the address once closed.
+type conn struct {
+	net     *Network
+	addr    netip.AddrPort
+	send    func(dst netip.AddrPort, b []byte)
+	onClose func()
+	queue   chan datagram
+	done    chan struct{}
+	once    sync.Once
+
+	mu       sync.Mutex
+	closed   bool
+	deadline time.Time
+	wake     chan struct{} // closed when the deadline changes
+}
+
+func newConn(n *Network, addr netip.AddrPort) *conn {
+	return &conn{
+		net:   n,
+		addr:  addr,
+		queue: make(chan datagram, queueSize),
+		done:  make(chan struct{}),
+		wake:  make(chan struct{}),
+	}
+}
+
+func (c *conn) deliver(src netip.AddrPort, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		c.net.release()
+		return
+	}
+	select {
+	case c.queue <- datagram{src, b}:
+	default:
+		c.net.release()
+	}
+}
+
+// ReadFrom reads the next datagram, until the deadline if any.
+func (c *conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.readFrom(b)
+	if err == nil {
+		c.net.release()
+	}
+	return n, addr, err
+}
+
+// readFrom is ReadFrom, of the datagram read still in flight.
+func (c *conn) readFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, wake := c.deadline, c.wake
+		c.mu.Unlock()
+		clock := c.net.clockOf()
+		var timer *time.Timer
+		var idle, passed <-chan struct{}
+		if !deadline.IsZero() {
+			var now time.Time
+			if clock != nil {
+				now, passed = clock.state()
+			} else {
+				now = time.Now()
+			}
+			d := deadline.Sub(now)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			if clock == nil {
+				timer = time.NewTimer(d)
+			}
+			idle = c.net.idleChan()
+		}
+		var expired <-chan time.Time
+		if timer != nil {
+			expired = timer.C
+		}
+		select {
+		case d := <-c.queue:
+			stopTimer(timer)
+			return copy(b, d.b), net.UDPAddrFromAddrPort(d.src), nil
+		default:
+		}
+		select {
+		case d := <-c.queue:
+			stopTimer(timer)
+			return copy(b, d.b), net.UDPAddrFromAddrPort(d.src), nil
+		case <-expired:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-idle:
+			stopTimer(timer)
+			if clock != nil {
+				clock.advanceTo(deadline)
+			}
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-passed:
+		case <-wake:
+			stopTimer(timer)
+		case <-c.done:
+			stopTimer(timer)
+			return 0, nil, net.ErrClosed
+		}
+	}
+}
+
+// stopTimer stops the timer unless nil.
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// WriteTo sends the datagram b to addr, a *net.UDPAddr.
+func (c *conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("Not a UDP address.")
+	}
+	c.send(ua.AddrPort(), b)
+	return len(b), nil
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.onClose()
+		c.mu.Lock()
+		c.closed = true
+		for len(c.queue) > 0 {
+			<-c.queue
+			c.net.release()
+		}
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.addr)
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
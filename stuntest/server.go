@@ -0,0 +1,323 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stuntest
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+const (
+	// classMask is the mask of the class bits of the message type.
+	classMask = 0x0110
+	// fingerprintXor is XORed with the CRC of the FINGERPRINT attribute.
+	fingerprintXor = 0x5354554e
+)
+
+// Script is the scripted behavior of a Server. The requests are numbered
+// from 1 in the order received, the retransmissions included, and the
+// functions unset do not change the behavior.
+type Script struct {
+	// Drop tells whether the n-th request is dropped, unanswered.
+	Drop func(n int, req *stun.Message) bool
+	// Delay returns the time the response to the n-th request is delayed.
+	Delay func(n int, req *stun.Message) time.Duration
+	// Mangle returns the response to the n-th request to send instead of
+	// resp, in the wire format, or nil to drop it.
+	Mangle func(n int, resp []byte) []byte
+}
+
+// Server is a STUN server of the network, answering on its script. The
+// server of package stun it runs is embedded, to be configured.
+type Server struct {
+	*stun.Server
+	addr string
+
+	mu       sync.Mutex
+	script   Script
+	requests int
+	pending  map[string]scripted // by transaction ID
+}
+
+// scripted is a request received, of its number and the delay of its
+// response, and the number of the requests of its transaction ID in flight
+// until answered.
+type scripted struct {
+	n     int
+	delay time.Duration
+	held  int
+}
+
+// NewServer returns a server of the address, e.g. "192.0.2.1:3478", of
+// RFC 5780 if the alternate address is not empty, of another IP and port.
+func NewServer(n *Network, addr, alternate string) (*Server, error) {
+	s := &Server{Server: stun.NewServer(), addr: addr, pending: make(map[string]scripted)}
+	if alternate == "" {
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := n.listen(ap)
+		if err != nil {
+			return nil, err
+		}
+		go s.Serve(&scriptConn{conn, s})
+		return s, nil
+	}
+	var addrs [2]netip.AddrPort
+	for i, a := range []string{addr, alternate} {
+		ap, err := netip.ParseAddrPort(a)
+		if err != nil {
+			return nil, err
+		}
+		addrs[i] = ap
+	}
+	if addrs[0].Addr() == addrs[1].Addr() || addrs[0].Port() == addrs[1].Port() {
+		return nil, errors.New("Alternate IP and port must differ from the primary ones.")
+	}
+	var conns [2][2]net.PacketConn
+	for ip := range conns {
+		for port := range conns[ip] {
+			conn, err := n.listen(netip.AddrPortFrom(addrs[ip].Addr(), addrs[port].Port()))
+			if err != nil {
+				closeConns(conns)
+				return nil, err
+			}
+			conns[ip][port] = &scriptConn{conn, s}
+		}
+	}
+	go s.ServeAlternate(conns)
+	return s, nil
+}
+
+// closeConns closes the connections opened.
+func closeConns(conns [2][2]net.PacketConn) {
+	for _, row := range conns {
+		for _, conn := range row {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+}
+
+// Addr returns the primary address of the server.
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// SetScript sets the script of the behavior of the server.
+func (s *Server) SetScript(script Script) {
+	s.mu.Lock()
+	s.script = script
+	s.mu.Unlock()
+}
+
+// Requests returns the number of the requests received, the dropped ones
+// included.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// receive numbers the request, and tells whether it is dropped. The request
+// kept is in flight until answered.
+func (s *Server) receive(req *stun.Message) bool {
+	s.mu.Lock()
+	s.requests++
+	n, script := s.requests, s.script
+	s.mu.Unlock()
+	if script.Drop != nil && script.Drop(n, req) {
+		return true
+	}
+	var delay time.Duration
+	if script.Delay != nil {
+		delay = script.Delay(n, req)
+	}
+	s.mu.Lock()
+	id := string(req.TransactionID())
+	s.pending[id] = scripted{n, delay, s.pending[id].held + 1}
+	s.mu.Unlock()
+	return false
+}
+
+// respond returns the response b as mangled by the script, its delay, and
+// whether it answers a request in flight.
+func (s *Server) respond(b []byte) ([]byte, time.Duration, bool) {
+	if len(b) < 20 {
+		return b, 0, false
+	}
+	id := string(b[8:20])
+	s.mu.Lock()
+	r, ok := s.pending[id]
+	if r.held > 1 {
+		s.pending[id] = scripted{r.n, r.delay, r.held - 1}
+	} else {
+		delete(s.pending, id)
+	}
+	mangle := s.script.Mangle
+	s.mu.Unlock()
+	if !ok {
+		return b, 0, false
+	}
+	if mangle != nil {
+		b = mangle(r.n, b)
+	}
+	return b, r.delay, true
+}
+
+// scriptConn is a connection of a server, which applies its script to the
+// requests read and the responses written.
+type scriptConn struct {
+	*conn
+	s *Server
+}
+
+func (c *scriptConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.conn.readFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		m, err := stun.ParseMessage(b[:n])
+		if err != nil || m.Type()&classMask != 0 {
+			c.net.release()
+			return n, addr, nil
+		}
+		if c.s.receive(m) {
+			c.net.release()
+			continue
+		}
+		return n, addr, nil
+	}
+}
+
+func (c *scriptConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n := len(b)
+	resp, delay, held := c.s.respond(append([]byte(nil), b...))
+	send := func() error {
+		var err error
+		if resp != nil {
+			_, err = c.conn.WriteTo(resp, addr)
+		}
+		if held {
+			c.net.release()
+		}
+		return err
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, func() { send() })
+		return n, nil
+	}
+	if err := send(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// DropRequests returns the Drop function of a Script dropping the requests
+// of the numbers.
+func DropRequests(ns ...int) func(int, *stun.Message) bool {
+	drop := make(map[int]bool)
+	for _, n := range ns {
+		drop[n] = true
+	}
+	return func(n int, req *stun.Message) bool {
+		return drop[n]
+	}
+}
+
+// DelayResponses returns the Delay function of a Script delaying all the
+// responses by d.
+func DelayResponses(d time.Duration) func(int, *stun.Message) time.Duration {
+	return func(int, *stun.Message) time.Duration {
+		return d
+	}
+}
+
+// RemoveAttribute returns the Mangle function of a Script removing the
+// attributes of the type from the responses.
+func RemoveAttribute(types uint16) func(int, []byte) []byte {
+	return func(n int, resp []byte) []byte {
+		return rewriteAttributes(resp, types, func([]byte) []byte { return nil })
+	}
+}
+
+// ReplaceAttribute returns the Mangle function of a Script replacing the
+// value of the attributes of the type of the responses with value.
+func ReplaceAttribute(types uint16, value []byte) func(int, []byte) []byte {
+	return func(n int, resp []byte) []byte {
+		return rewriteAttributes(resp, types, func([]byte) []byte { return value })
+	}
+}
+
+// rewriteAttributes returns the message b of the values of the attributes
+// of the type replaced by f, removed if nil, with the length and the
+// FINGERPRINT updated. The MESSAGE-INTEGRITY is not valid anymore.
+func rewriteAttributes(b []byte, types uint16, f func(value []byte) []byte) []byte {
+	if len(b) < 20 {
+		return b
+	}
+	out := append([]byte(nil), b[:20]...)
+	fingerprint := false
+	for pos := 20; pos+4 <= len(b); {
+		t := binary.BigEndian.Uint16(b[pos:])
+		l := int(binary.BigEndian.Uint16(b[pos+2:]))
+		if pos+4+l > len(b) {
+			break
+		}
+		v := b[pos+4 : pos+4+l]
+		pos += 4 + (l+3)&^3
+		switch {
+		case t == stun.AttributeFingerprint:
+			fingerprint = true
+			continue
+		case t == types:
+			if v = f(v); v == nil {
+				continue
+			}
+		}
+		out = appendAttribute(out, t, v)
+	}
+	if fingerprint {
+		binary.BigEndian.PutUint16(out[2:], uint16(len(out)-20+8))
+		crc := crc32.ChecksumIEEE(out) ^ fingerprintXor
+		out = appendAttribute(out, stun.AttributeFingerprint, binary.BigEndian.AppendUint32(nil, crc))
+	}
+	binary.BigEndian.PutUint16(out[2:], uint16(len(out)-20))
+	return out
+}
+
+// appendAttribute appends the attribute of the type and the value, padded
+// to 4 bytes.
+func appendAttribute(b []byte, types uint16, value []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, types)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
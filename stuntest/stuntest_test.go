@@ -0,0 +1,255 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package stuntest
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// newTestClient returns a client of a connection behind a NAT of the type,
+// or of none if stun.NATNone, to the server.
+func newTestClient(t *testing.T, n *Network, s *Server, typ stun.NATType) (*stun.Client, net.PacketConn) {
+	var conn net.PacketConn
+	var err error
+	if mapping, filtering, ok := Behaviors(typ); ok {
+		nat, err := n.NewNAT("203.0.113.1", mapping, filtering)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err = nat.ListenPacket()
+	} else {
+		conn, err = n.ListenPacket("198.51.100.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := stun.NewClientWithConnection(conn)
+	c.SetServerAddr(s.Addr())
+	return c, conn
+}
+
+func newTestServer(t *testing.T, n *Network) *Server {
+	n.SetInstantTimeouts(true)
+	s, err := NewServer(n, "192.0.2.1:3478", "192.0.2.2:3479")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestNATTypes(t *testing.T) {
+	for _, typ := range []stun.NATType{stun.NATNone, stun.NATFull, stun.NATRestricted, stun.NATPortRestricted, stun.NATSymetric} {
+		n := NewNetwork()
+		s := newTestServer(t, n)
+		c, _ := newTestClient(t, n, s, typ)
+		nat, host, err := c.Discover()
+		if err != nil {
+			t.Fatalf("Discover error of %v: %v", typ, err)
+		}
+		if nat != typ {
+			t.Errorf("Discover error: %v, expected %v", nat, typ)
+		}
+		want := "203.0.113.1"
+		if typ == stun.NATNone {
+			want = "198.51.100.1"
+		}
+		if host.IP() != want {
+			t.Errorf("Discover error of %v: mapped %v", typ, host)
+		}
+	}
+}
+
+func TestNATBehaviors(t *testing.T) {
+	n := NewNetwork()
+	n.SetInstantTimeouts(true)
+	var peers []net.PacketConn
+	for _, addr := range []string{"192.0.2.1:1000", "192.0.2.1:2000", "192.0.2.2:1000"} {
+		conn, err := n.ListenPacket(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		peers = append(peers, conn)
+	}
+	for _, c := range []struct {
+		mapping, filtering stun.Behavior
+		mapped             int // the number of the mappings to the peers
+		filtered           bool
+	}{
+		{stun.BehaviorEndpointIndependent, stun.BehaviorEndpointIndependent, 1, false},
+		{stun.BehaviorAddressDependent, stun.BehaviorAddressDependent, 2, false},
+		{stun.BehaviorAddressPortDependent, stun.BehaviorAddressPortDependent, 3, true},
+	} {
+		nat, err := n.NewNAT("203.0.113.1", c.mapping, c.filtering)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := nat.ListenPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapped := make(map[string]bool)
+		buf := make([]byte, 16)
+		for _, peer := range peers {
+			if _, err := conn.WriteTo([]byte("ping"), peer.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			_, from, err := peer.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("ReadFrom error: %v", err)
+			}
+			mapped[from.String()] = true
+		}
+		if len(mapped) != c.mapped {
+			t.Errorf("%v mapping error: %d mappings", c.mapping, len(mapped))
+		}
+		// A port of the same IP not sent to from the first mapping.
+		other, err := n.ListenPacket("192.0.2.1:3000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for from := range mapped {
+			addr, _ := net.ResolveUDPAddr("udp", from)
+			other.WriteTo([]byte("pong"), addr)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = conn.ReadFrom(buf)
+		if filtered := err != nil; filtered != c.filtered {
+			t.Errorf("%v filtering error: filtered %v", c.filtering, filtered)
+		}
+		other.Close()
+		conn.Close()
+	}
+}
+
+func TestScriptDrop(t *testing.T) {
+	n := NewNetwork()
+	s := newTestServer(t, n)
+	s.SetScript(Script{Drop: DropRequests(1)})
+	c, _ := newTestClient(t, n, s, stun.NATNone)
+	if _, err := c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	if s.Requests() != 2 {
+		t.Errorf("Keepalive error: %d requests, expected a retransmission", s.Requests())
+	}
+}
+
+func TestScriptDelay(t *testing.T) {
+	n := NewNetwork()
+	s := newTestServer(t, n)
+	s.SetScript(Script{Delay: DelayResponses(50 * time.Millisecond)})
+	c, _ := newTestClient(t, n, s, stun.NATNone)
+	start := time.Now()
+	if _, err := c.Keepalive(); err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("Keepalive error: responded in %v", d)
+	}
+}
+
+func TestScriptMangle(t *testing.T) {
+	n := NewNetwork()
+	s := newTestServer(t, n)
+	c, _ := newTestClient(t, n, s, stun.NATNone)
+	// 203.0.113.9:1234 XORed with the magic cookie.
+	xor := []byte{0, 1, 0x04 ^ 0x21, 0xd2 ^ 0x12, 203 ^ 0x21, 0 ^ 0x12, 113 ^ 0xa4, 9 ^ 0x42}
+	s.SetScript(Script{Mangle: ReplaceAttribute(stun.AttributeXorMappedAddress, xor)})
+	host, err := c.Keepalive()
+	if err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	if host == nil || host.String() != "203.0.113.9:1234" {
+		t.Errorf("Keepalive error: mapped %v", host)
+	}
+	s.SetScript(Script{Mangle: RemoveAttribute(stun.AttributeXorMappedAddress)})
+	if host, err := c.Keepalive(); err == nil && host != nil {
+		t.Errorf("Keepalive error: mapped %v of no address", host)
+	}
+	s.SetScript(Script{Mangle: func(n int, resp []byte) []byte {
+		resp = RemoveAttribute(stun.AttributeOtherAddress)(n, resp)
+		return RemoveAttribute(stun.AttributeChangedAddress)(n, resp)
+	}})
+	if _, _, err := c.Discover(); err == nil {
+		t.Error("Discover error: expected no changed address")
+	}
+}
+
+func TestRewriteAttributes(t *testing.T) {
+	m, err := stun.NewMessage(stun.TypeBindingResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.AddAttribute(stun.AttributeSoftware, []byte("server"))
+	m.AddAttribute(stun.AttributeUsername, []byte("alice"))
+	b := m.Encode(nil)
+	b = ReplaceAttribute(stun.AttributeSoftware, []byte("mangled"))(1, b)
+	b = RemoveAttribute(stun.AttributeUsername)(1, b)
+	got, err := stun.ParseMessage(b)
+	if err != nil {
+		t.Fatalf("ParseMessage error: %v", err)
+	}
+	if v, _ := got.Attribute(stun.AttributeSoftware); string(v) != "mangled" {
+		t.Errorf("ReplaceAttribute error: %q", v)
+	}
+	if _, ok := got.Attribute(stun.AttributeUsername); ok {
+		t.Error("RemoveAttribute error: username left")
+	}
+	fp, ok := got.Attribute(stun.AttributeFingerprint)
+	if !ok || binary.BigEndian.Uint32(fp) != crc32.ChecksumIEEE(b[:len(b)-8])^fingerprintXor {
+		t.Errorf("rewriteAttributes error: fingerprint of %x", b)
+	}
+}
+
+func TestClock(t *testing.T) {
+	n := NewNetwork()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewClock(start)
+	n.SetClock(clock)
+	s := newTestServer(t, n)
+	s.SetClock(clock)
+	var ids []string
+	s.SetScript(Script{Drop: func(n int, req *stun.Message) bool {
+		ids = append(ids, string(req.TransactionID()))
+		return n == 1
+	}})
+	for i := 0; i < 2; i++ {
+		c, _ := newTestClient(t, n, s, stun.NATNone)
+		c.SetClock(clock)
+		c.SetRand(rand.New(rand.NewSource(1)))
+		if _, err := c.Keepalive(); err != nil {
+			t.Fatalf("Keepalive error: %v", err)
+		}
+	}
+	// The first request timed out once, of the initial timeout of 100ms.
+	if d := clock.Now().Sub(start); d != 100*time.Millisecond {
+		t.Errorf("Clock error: passed %v, expected 100ms", d)
+	}
+	if len(ids) != 3 || ids[0] != ids[2] {
+		t.Errorf("SetRand error: transaction IDs not of the seed")
+	}
+}